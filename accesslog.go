@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+//AccessLogConfig enables one JSON line per request, written to Path or to
+//stdout when no path is set. The field names are ready for an index template.
+type AccessLogConfig struct {
+	Enabled bool   `json:"enabled"`
+	Path    string `json:"path"`
+}
+
+//accessEntry is one line of the access log.
+type accessEntry struct {
+	Timestamp  string  `json:"@timestamp"`
+	RequestID  string  `json:"request_id,omitempty"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Route      string  `json:"route"`
+	Status     int     `json:"status"`
+	Bytes      int     `json:"bytes"`
+	DurationMS float64 `json:"duration_ms"`
+	RemoteAddr string  `json:"remote_addr"`
+	Index      string  `json:"index,omitempty"`
+	ESCalls    int     `json:"es_calls"`
+	ESTookMS   int64   `json:"es_took_ms"`
+	QueryHash  string  `json:"query_hash,omitempty"`
+}
+
+var (
+	accessLogMu  sync.Mutex
+	accessLogOut io.Writer = os.Stdout
+)
+
+func setupAccessLog() error {
+	if len(config.AccessLog.Path) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(config.AccessLog.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	accessLogOut = f
+	return nil
+}
+
+//AccessLogMid writes an access log line once the request has been served.
+func AccessLogMid(app http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx, info := withUpstreamInfo(r.Context())
+		sw := &statusWriter{ResponseWriter: w}
+		app.ServeHTTP(sw, r.WithContext(ctx))
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		index, calls, took, hash := info.snapshot()
+		b, err := json.Marshal(accessEntry{
+			Timestamp:  start.UTC().Format(time.RFC3339Nano),
+			RequestID:  requestID(r.Context()),
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Route:      routeTemplate(r),
+			Status:     sw.status,
+			Bytes:      sw.bytes,
+			DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+			RemoteAddr: r.RemoteAddr,
+			Index:      index,
+			ESCalls:    calls,
+			ESTookMS:   took,
+			QueryHash:  hash,
+		})
+		if err != nil {
+			logger.ErrorContext(r.Context(), "error encoding access log entry", "error", err)
+			return
+		}
+		accessLogMu.Lock()
+		accessLogOut.Write(append(b, '\n'))
+		accessLogMu.Unlock()
+	})
+}
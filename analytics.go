@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+//AnalyticsConfig sends gateway events (experiment exposures and the like) to
+//an index of the default cluster. Without an index, events are only logged.
+type AnalyticsConfig struct {
+	Index string `json:"index"`
+}
+
+var analyticsEvents = make(chan map[string]interface{}, 1024)
+
+//recordEvent queues an analytics event without blocking the request. Events
+//are dropped when the queue is full rather than slowing searches down.
+func recordEvent(ctx context.Context, kind string, fields map[string]interface{}) {
+	event := map[string]interface{}{
+		"@timestamp": time.Now().UTC().Format(time.RFC3339Nano),
+		"event":      kind,
+		"request_id": requestID(ctx),
+	}
+	for k, v := range fields {
+		event[k] = v
+	}
+	if len(config.Analytics.Index) == 0 {
+		logger.InfoContext(ctx, "analytics event", "event", event)
+		return
+	}
+	select {
+	case analyticsEvents <- event:
+	default:
+		logger.WarnContext(ctx, "analytics queue full, dropping event", "event", kind)
+	}
+}
+
+//shipAnalytics indexes queued events one by one into the analytics index.
+func shipAnalytics() {
+	for event := range analyticsEvents {
+		es, err := defaultClient()
+		if err != nil {
+			logger.Error("unable to create es client object", "error", err)
+			continue
+		}
+		buf, err := encodeBody(event)
+		if err != nil {
+			logger.Error("error encoding analytics event", "error", err)
+			continue
+		}
+		res, err := es.Index(config.Analytics.Index, buf)
+		if err != nil {
+			logger.Error("error indexing analytics event", "error", err)
+			continue
+		}
+		if res.IsError() {
+			logger.Error("analytics event rejected by elastic search", "response", res.String())
+		}
+		res.Body.Close()
+	}
+}
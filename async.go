@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//asyncKeepAlive is how long elastic search keeps async searches by default.
+const asyncKeepAlive = 5 * 24 * time.Hour
+
+//asyncSearch is an async search submitted through the gateway, kept until
+//elastic search drops it.
+type asyncSearch struct {
+	index   []string
+	expires time.Time
+}
+
+var (
+	asyncMu       sync.Mutex
+	asyncSearches = map[string]asyncSearch{}
+	asyncParams   = []string{"wait_for_completion_timeout", "keep_alive", "keep_on_completion"}
+)
+
+//trackAsync remembers the indices of a submitted search, forgetting the
+//searches that expired.
+func trackAsync(id string, index []string, expires time.Time) {
+	asyncMu.Lock()
+	defer asyncMu.Unlock()
+	now := time.Now()
+	for key, s := range asyncSearches {
+		if now.After(s.expires) {
+			delete(asyncSearches, key)
+		}
+	}
+	asyncSearches[id] = asyncSearch{index: index, expires: expires}
+}
+
+//extendAsync follows a keep_alive given when the results are read, which
+//elastic search keeps them for from then on.
+func extendAsync(ctx context.Context, id, keepAlive string) {
+	if keepAlive == "" {
+		return
+	}
+	d, err := parseESDuration(keepAlive)
+	if err != nil {
+		logger.WarnContext(ctx, "unable to parse keep_alive", "keep_alive", keepAlive, "error", err)
+		return
+	}
+	asyncMu.Lock()
+	defer asyncMu.Unlock()
+	if s, ok := asyncSearches[id]; ok && s.expires.Before(time.Now().Add(d)) {
+		s.expires = time.Now().Add(d)
+		asyncSearches[id] = s
+	}
+}
+
+//asyncAccess checks access to a running async search with the indices it was
+//submitted on. Searches submitted through another gateway instance, or
+//expired, are only served to callers allowed on every index.
+func asyncAccess(w http.ResponseWriter, r *http.Request, id string) bool {
+	asyncMu.Lock()
+	s := asyncSearches[id]
+	asyncMu.Unlock()
+	if time.Now().After(s.expires) {
+		s.index = nil
+	}
+	return checkAccess(w, r, opSearch, s.index)
+}
+
+//submitAsyncHandler starts an async search with the query of the body and
+//answers with its id, plus the results when it completes within
+//wait_for_completion_timeout, partial ones otherwise.
+func submitAsyncHandler(w http.ResponseWriter, r *http.Request) {
+	index := strings.Split(mux.Vars(r)["index"], ",")
+	if !checkAccess(w, r, opSearch, index) {
+		return
+	}
+	var query interface{}
+	if err := json.NewDecoder(r.Body).Decode(&query); err != nil && err != io.EOF {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if config.SoftDelete.Enabled {
+		query = excludeSoftDeleted(query)
+	}
+	buf, err := encodeBody(query)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error encoding elastic search query", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u := &url.URL{Path: "/" + strings.Join(index, ",") + "/_async_search", RawQuery: forwardParams(r, asyncParams...).Encode()}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, u.String(), buf)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error creating elastic search request", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := es.Perform(req)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error submitting async search", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error reading async search response", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	var submitted struct {
+		ID      string `json:"id"`
+		Expires int64  `json:"expiration_time_in_millis"`
+	}
+	//searches completed without keep_on_completion have no id, nothing is stored
+	if json.Unmarshal(b, &submitted) == nil && len(submitted.ID) != 0 {
+		expires := time.Now().Add(asyncKeepAlive)
+		if submitted.Expires != 0 {
+			expires = time.UnixMilli(submitted.Expires)
+		}
+		trackAsync(submitted.ID, index, expires)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.StatusCode)
+	w.Write(b)
+}
+
+//asyncStatusHandler tells whether an async search is still running.
+func asyncStatusHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !asyncAccess(w, r, id) {
+		return
+	}
+	passthrough(w, r, http.MethodGet, "/_async_search/status/"+url.PathEscape(id), nil, nil)
+}
+
+//getAsyncHandler returns the results of an async search so far.
+func getAsyncHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !asyncAccess(w, r, id) {
+		return
+	}
+	extendAsync(r.Context(), id, r.URL.Query().Get("keep_alive"))
+	passthrough(w, r, http.MethodGet, "/_async_search/"+url.PathEscape(id), forwardParams(r, "wait_for_completion_timeout", "keep_alive"), nil)
+}
+
+//deleteAsyncHandler cancels an async search, or drops its stored results.
+func deleteAsyncHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !asyncAccess(w, r, id) {
+		return
+	}
+	passthrough(w, r, http.MethodDelete, "/_async_search/"+url.PathEscape(id), nil, nil)
+	asyncMu.Lock()
+	delete(asyncSearches, id)
+	asyncMu.Unlock()
+}
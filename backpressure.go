@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//BackpressureConfig makes ingestion endpoints answer 429 with a Retry-After
+//while MaxInFlight writes are already running or elastic search rejected
+//MaxRejections writes within Window. Past WarnRatio of either limit, responses
+//carry an X-Backpressure header so producers can slow down early.
+type BackpressureConfig struct {
+	Enabled       bool     `json:"enabled"`
+	MaxInFlight   int      `json:"max_in_flight"`
+	MaxRejections int      `json:"max_rejections"`
+	Window        Duration `json:"window"`
+	WarnRatio     float64  `json:"warn_ratio"`
+}
+
+//pressure tracks running writes and recent rejections by elastic search.
+type pressure struct {
+	mu         sync.Mutex
+	inFlight   int
+	rejections []time.Time
+}
+
+var ingestPressure = &pressure{}
+
+//prune drops rejections older than the window. The caller holds the lock.
+func (p *pressure) prune(now time.Time) {
+	cutoff := now.Add(-config.Backpressure.Window.Duration)
+	i := 0
+	for i < len(p.rejections) && p.rejections[i].Before(cutoff) {
+		i++
+	}
+	p.rejections = p.rejections[i:]
+}
+
+//admit reserves a write slot. When overloaded it returns the reason and how
+//long the producer should wait instead.
+func (p *pressure) admit(now time.Time) (ok bool, reason string, retryAfter time.Duration) {
+	c := config.Backpressure
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.prune(now)
+	if c.MaxRejections > 0 && len(p.rejections) >= c.MaxRejections {
+		//wait until enough rejections age out of the window to get below the limit
+		oldest := p.rejections[len(p.rejections)-c.MaxRejections]
+		return false, "rejections", oldest.Add(c.Window.Duration).Sub(now)
+	}
+	if c.MaxInFlight > 0 && p.inFlight >= c.MaxInFlight {
+		return false, "queue", time.Duration(float64(time.Second) * float64(p.inFlight) / float64(c.MaxInFlight))
+	}
+	p.inFlight++
+	return true, "", 0
+}
+
+//done releases a write slot, counting it as a rejection on a 429 from elastic search.
+func (p *pressure) done(status int, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inFlight--
+	if status == http.StatusTooManyRequests {
+		p.rejections = append(p.rejections, now)
+	}
+}
+
+//level is the highest load ratio among the limits, 1 meaning at the limit.
+func (p *pressure) level() float64 {
+	c := config.Backpressure
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var l float64
+	if c.MaxInFlight > 0 {
+		l = math.Max(l, float64(p.inFlight)/float64(c.MaxInFlight))
+	}
+	if c.MaxRejections > 0 {
+		l = math.Max(l, float64(len(p.rejections))/float64(c.MaxRejections))
+	}
+	return l
+}
+
+//retrySeconds rounds a retry delay up to whole seconds, at least one.
+func retrySeconds(d time.Duration) int {
+	seconds := int(math.Ceil(d.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+//BackpressureMid sheds ingestion load before it reaches an overloaded cluster.
+func BackpressureMid(app http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !config.Backpressure.Enabled {
+			app.ServeHTTP(w, r)
+			return
+		}
+		ok, reason, retryAfter := ingestPressure.admit(time.Now())
+		if !ok {
+			seconds := retrySeconds(retryAfter)
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			w.Header().Set("X-Backpressure", reason)
+			logger.WarnContext(r.Context(), "shedding ingestion load", "reason", reason, "retry_after", seconds)
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		if l := ingestPressure.level(); l >= config.Backpressure.WarnRatio {
+			w.Header().Set("X-Backpressure", fmt.Sprintf("%.2f", l))
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() { ingestPressure.done(sw.status, time.Now()) }()
+		app.ServeHTTP(sw, r)
+	})
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch"
+	"github.com/gorilla/mux"
+)
+
+//BoostConfig drives the full-text mode of searches sending a text: the text
+//is matched against the boosted fields of the queried indices. Boosts are
+//edited at runtime through the admin endpoints and stored, versioned, in
+//Index. Fields applies to indices that have no stored boosts yet.
+type BoostConfig struct {
+	Index   string             `json:"index"`
+	Fields  map[string]float64 `json:"fields"`
+	Refresh Duration           `json:"refresh"`
+}
+
+//BoostSet is one version of the field boosts of an index.
+type BoostSet struct {
+	Index     string             `json:"index"`
+	Version   int64              `json:"version"`
+	Fields    map[string]float64 `json:"fields"`
+	Actor     string             `json:"actor"`
+	Timestamp string             `json:"timestamp"`
+}
+
+type boostEntry struct {
+	at  time.Time
+	set BoostSet
+}
+
+var (
+	boostsMu    sync.Mutex
+	boostsCache = map[string]boostEntry{}
+)
+
+var boostMapping = map[string]interface{}{
+	"mappings": map[string]interface{}{
+		"properties": map[string]interface{}{
+			"index":     map[string]interface{}{"type": "keyword"},
+			"version":   map[string]interface{}{"type": "long"},
+			"fields":    map[string]interface{}{"type": "object", "enabled": false},
+			"actor":     map[string]interface{}{"type": "keyword"},
+			"timestamp": map[string]interface{}{"type": "date"},
+		},
+	},
+}
+
+func ensureBoostIndex(ctx context.Context, es *elasticsearch.Client) {
+	ensureOnce(ctx, config.Boosts.Index, func() {
+		buf, err := encodeBody(boostMapping)
+		if err != nil {
+			logger.ErrorContext(ctx, "error encoding boost mapping", "error", err)
+			return
+		}
+		res, err := es.Indices.Create(config.Boosts.Index,
+			es.Indices.Create.WithContext(ctx),
+			es.Indices.Create.WithBody(buf),
+		)
+		if err != nil {
+			logger.ErrorContext(ctx, "unable to create boost index", "error", err)
+			return
+		}
+		res.Body.Close()
+	})
+}
+
+//boostVersions lists the stored boost versions of an index, newest first.
+func boostVersions(ctx context.Context, es *elasticsearch.Client, index string) ([]BoostSet, error) {
+	query := map[string]interface{}{
+		"query": map[string]interface{}{"term": map[string]interface{}{"index": index}},
+		"sort":  []interface{}{map[string]interface{}{"version": "desc"}},
+		"size":  100,
+	}
+	var result struct {
+		Hits struct {
+			Hits []struct {
+				Source BoostSet `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	ensureBoostIndex(ctx, es)
+	if err := searchInto(ctx, es, []string{config.Boosts.Index}, query, &result); err != nil {
+		return nil, err
+	}
+	sets := make([]BoostSet, 0, len(result.Hits.Hits))
+	for _, h := range result.Hits.Hits {
+		sets = append(sets, h.Source)
+	}
+	return sets, nil
+}
+
+//currentBoosts returns the latest boosts of an index, or the configured
+//defaults as version 0. Lookups are cached for the refresh interval so that
+//every gateway instance picks up changes without asking on each search.
+func currentBoosts(ctx context.Context, es *elasticsearch.Client, index string) (BoostSet, error) {
+	key := tenantScope(ctx, index)
+	boostsMu.Lock()
+	e, ok := boostsCache[key]
+	boostsMu.Unlock()
+	if ok && time.Since(e.at) < config.Boosts.Refresh.Duration {
+		return e.set, nil
+	}
+	sets, err := boostVersions(ctx, es, index)
+	if err != nil {
+		return BoostSet{}, err
+	}
+	set := BoostSet{Index: index, Fields: config.Boosts.Fields}
+	if len(sets) != 0 {
+		set = sets[0]
+	}
+	boostsMu.Lock()
+	boostsCache[key] = boostEntry{at: time.Now(), set: set}
+	boostsMu.Unlock()
+	return set, nil
+}
+
+//saveBoosts stores fields as the next version of the boosts of an index. The
+//version is created, never overwritten, so of two concurrent edits one fails.
+func saveBoosts(ctx context.Context, es *elasticsearch.Client, index string, fields map[string]float64, by string) (BoostSet, error) {
+	sets, err := boostVersions(ctx, es, index)
+	if err != nil {
+		return BoostSet{}, err
+	}
+	set := BoostSet{
+		Index:     index,
+		Version:   1,
+		Fields:    fields,
+		Actor:     by,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	}
+	if len(sets) != 0 {
+		set.Version = sets[0].Version + 1
+	}
+	buf, err := encodeBody(set)
+	if err != nil {
+		return BoostSet{}, err
+	}
+	res, err := es.Index(config.Boosts.Index, buf,
+		es.Index.WithContext(ctx),
+		es.Index.WithDocumentID(fmt.Sprintf("%s:%d", index, set.Version)),
+		es.Index.WithOpType("create"),
+		es.Index.WithRefresh("wait_for"),
+	)
+	if err != nil {
+		return BoostSet{}, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return BoostSet{}, fmt.Errorf("boost write for %s: %s", index, res.Status())
+	}
+	boostsMu.Lock()
+	boostsCache[tenantScope(ctx, index)] = boostEntry{at: time.Now(), set: set}
+	boostsMu.Unlock()
+	return set, nil
+}
+
+//withText adds a multi_match of text over the boosted fields of the indices
+//to the query. A field boosted in several indices keeps its highest boost.
+//With normalize, the folded subfields or the folding analyzer are used.
+func withText(ctx context.Context, index []string, q interface{}, text string, normalize bool) (interface{}, error) {
+	body, ok := searchBody(q)
+	if !ok {
+		return q, nil
+	}
+	es, err := defaultClient()
+	if err != nil {
+		return q, err
+	}
+	boosts := map[string]float64{}
+	for _, i := range index {
+		set, err := currentBoosts(ctx, es, i)
+		if err != nil {
+			return q, err
+		}
+		for f, b := range set.Fields {
+			if b > boosts[f] {
+				boosts[f] = b
+			}
+		}
+	}
+	var subfield, analyzer string
+	if normalize {
+		subfield, analyzer = foldingFor(index)
+		if len(subfield) != 0 && len(boosts) == 0 {
+			subfield, analyzer = "", config.Folding.Analyzer
+		}
+	}
+	fields := make([]string, 0, len(boosts))
+	for f, b := range boosts {
+		if len(subfield) != 0 {
+			f += "." + subfield
+		}
+		fields = append(fields, f+"^"+strconv.FormatFloat(b, 'g', -1, 64))
+	}
+	sort.Strings(fields)
+	match := map[string]interface{}{"query": text}
+	if len(fields) != 0 {
+		match["fields"] = fields
+	}
+	if len(analyzer) != 0 {
+		match["analyzer"] = analyzer
+	}
+	clause := map[string]interface{}{"multi_match": match}
+	if _, ok := body["query"]; ok {
+		addClause(body, "must", clause)
+	} else {
+		body["query"] = clause
+	}
+	return body, nil
+}
+
+//boostsHandler returns the boosts currently in use for an index.
+func boostsHandler(w http.ResponseWriter, r *http.Request) {
+	index := mux.Vars(r)["index"]
+	if !checkAccess(w, r, opAdmin, []string{index}) {
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	set, err := currentBoosts(r.Context(), es, index)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to read field boosts", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, set)
+}
+
+//putBoostsHandler stores the field boosts of the body as a new version.
+func putBoostsHandler(w http.ResponseWriter, r *http.Request) {
+	index := mux.Vars(r)["index"]
+	if !checkAccess(w, r, opAdmin, []string{index}) {
+		return
+	}
+	var body struct {
+		Fields map[string]float64 `json:"fields"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for f, b := range body.Fields {
+		if b <= 0 {
+			http.Error(w, "boost of "+f+" must be positive", http.StatusBadRequest)
+			return
+		}
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	set, err := saveBoosts(r.Context(), es, index, body.Fields, actor(r))
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to save field boosts", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, set)
+}
+
+//boostVersionsHandler lists the stored boost versions of an index, newest first.
+func boostVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	index := mux.Vars(r)["index"]
+	if !checkAccess(w, r, opAdmin, []string{index}) {
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sets, err := boostVersions(r.Context(), es, index)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to read field boosts", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, sets)
+}
+
+//rollbackBoostsHandler makes an earlier version current again by storing its
+//fields as a new version, so the rollback itself shows up in the versions.
+func rollbackBoostsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !checkAccess(w, r, opAdmin, []string{vars["index"]}) {
+		return
+	}
+	version, err := strconv.ParseInt(vars["version"], 10, 64)
+	if err != nil {
+		http.Error(w, "version must be a number", http.StatusBadRequest)
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sets, err := boostVersions(r.Context(), es, vars["index"])
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to read field boosts", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	for _, s := range sets {
+		if s.Version != version {
+			continue
+		}
+		set, err := saveBoosts(r.Context(), es, vars["index"], s.Fields, actor(r))
+		if err != nil {
+			logger.ErrorContext(r.Context(), "unable to save field boosts", "error", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, http.StatusOK, set)
+		return
+	}
+	http.Error(w, "unknown boost version", http.StatusNotFound)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"time"
+
+	"github.com/elastic/go-elasticsearch"
+	"github.com/elastic/go-elasticsearch/esapi"
+)
+
+//LatencyConfig maps caller latency budgets to search parameters. The search
+//timeout is the budget minus Headroom (a fraction kept for the gateway and
+//the network); the first tier whose UpTo covers the budget adds its limits.
+type LatencyConfig struct {
+	Headroom float64       `json:"headroom"`
+	Tiers    []LatencyTier `json:"tiers"`
+}
+
+//LatencyTier trades completeness for speed for budgets up to UpTo. Zero
+//values leave the elastic search default in place.
+type LatencyTier struct {
+	UpTo               Duration `json:"up_to"`
+	TerminateAfter     int      `json:"terminate_after"`
+	PreFilterShardSize int      `json:"pre_filter_shard_size"`
+	BatchedReduceSize  int      `json:"batched_reduce_size"`
+}
+
+func defaultLatencyTiers() []LatencyTier {
+	return []LatencyTier{
+		{UpTo: Duration{100 * time.Millisecond}, TerminateAfter: 1000, PreFilterShardSize: 1, BatchedReduceSize: 64},
+		{UpTo: Duration{500 * time.Millisecond}, TerminateAfter: 10000, PreFilterShardSize: 1, BatchedReduceSize: 128},
+		{UpTo: Duration{2 * time.Second}, TerminateAfter: 100000, PreFilterShardSize: 16},
+	}
+}
+
+//budgetOptions returns the search options honouring the latency budget.
+func budgetOptions(es *elasticsearch.Client, budget time.Duration) []func(*esapi.SearchRequest) {
+	if budget <= 0 {
+		return nil
+	}
+	timeout := time.Duration(float64(budget) * (1 - config.Latency.Headroom))
+	opts := []func(*esapi.SearchRequest){es.Search.WithTimeout(timeout)}
+	for _, t := range config.Latency.Tiers {
+		if budget > t.UpTo.Duration {
+			continue
+		}
+		if t.TerminateAfter > 0 {
+			opts = append(opts, es.Search.WithTerminateAfter(t.TerminateAfter))
+		}
+		if t.PreFilterShardSize > 0 {
+			opts = append(opts, es.Search.WithPreFilterShardSize(t.PreFilterShardSize))
+		}
+		if t.BatchedReduceSize > 0 {
+			opts = append(opts, es.Search.WithBatchedReduceSize(t.BatchedReduceSize))
+		}
+		break
+	}
+	return opts
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch"
+	"github.com/elastic/go-elasticsearch/esapi"
+)
+
+//CacheConfig enables caching of search responses. Popular queries get longer
+//TTLs, up to MaxTTL, and hot entries are refreshed in the background shortly
+//before they expire so their callers never wait on the cluster. The least
+//recently used entries are evicted past MaxEntries or MaxBytes of responses.
+//The cache is kept in memory by each instance unless Backend is "redis",
+//which shares it between the instances of the gateway.
+type CacheConfig struct {
+	Enabled      bool        `json:"enabled"`
+	TTL          Duration    `json:"ttl"`
+	MaxTTL       Duration    `json:"max_ttl"`
+	MaxEntries   int         `json:"max_entries"`
+	MaxBytes     int64       `json:"max_bytes"`
+	HalfLife     Duration    `json:"half_life"`
+	HotScore     float64     `json:"hot_score"`
+	RefreshAhead float64     `json:"refresh_ahead"`
+	Backend      string      `json:"backend"`
+	Redis        RedisConfig `json:"redis"`
+}
+
+//searchCacher is a cache of search responses, in memory or in Redis.
+type searchCacher interface {
+	//get serves the search from the cache, running fetch on a miss. Only
+	//successful responses are cached. hit reports whether the cluster was
+	//skipped.
+	get(ctx context.Context, key string, fetch searchFunc, cc cacheControl) (result searchResult, hit bool, err error)
+	snapshot() CacheStats
+	purge(ctx context.Context) error
+}
+
+//searchResult is a raw elastic search response, with the time it was received.
+type searchResult struct {
+	StatusCode int
+	Body       []byte
+	At         time.Time
+	//Stale is set on expired responses served while elastic search fails
+	Stale bool
+}
+
+func (r searchResult) IsError() bool {
+	return r.StatusCode > 299
+}
+
+type searchFunc func(ctx context.Context) (searchResult, error)
+
+//doSearch returns a search that can be run again later, as cache refreshes do.
+func doSearch(es *elasticsearch.Client, body []byte, opts []func(*esapi.SearchRequest)) searchFunc {
+	return func(ctx context.Context) (searchResult, error) {
+		all := append(opts[:len(opts):len(opts)],
+			es.Search.WithContext(ctx),
+			es.Search.WithBody(bytes.NewReader(body)),
+		)
+		res, err := es.Search(all...)
+		if err != nil {
+			return searchResult{}, err
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		return searchResult{StatusCode: res.StatusCode, Body: b, At: time.Now()}, err
+	}
+}
+
+type cacheEntry struct {
+	//elem is the place of the entry in the recency list, size what it counts
+	//against MaxBytes
+	elem      *list.Element
+	size      int64
+	result    searchResult
+	fetch     searchFunc
+	storedAt  time.Time
+	expiresAt time.Time
+	popularity
+	refreshing bool
+}
+
+//popularity is the hit count of an entry, decaying with HalfLife.
+type popularity struct {
+	Score  float64   `json:"score"`
+	SeenAt time.Time `json:"seen_at"`
+}
+
+//touch decays the popularity score of the entry and counts one more hit.
+func (p *popularity) touch(now time.Time) {
+	halfLife := config.Cache.HalfLife.Seconds()
+	p.Score = p.Score*math.Exp2(-now.Sub(p.SeenAt).Seconds()/halfLife) + 1
+	p.SeenAt = now
+}
+
+//ttl grows logarithmically with popularity.
+func (p popularity) ttl() time.Duration {
+	ttl := time.Duration(float64(config.Cache.TTL.Duration) * (1 + math.Log2(1+p.Score)))
+	if ttl > config.Cache.MaxTTL.Duration {
+		ttl = config.Cache.MaxTTL.Duration
+	}
+	return ttl
+}
+
+type responseCache struct {
+	mu       sync.Mutex
+	entries  map[string]*cacheEntry
+	recency  *list.List
+	bytes    int64
+	inflight map[string]*flight
+	stats    CacheStats
+}
+
+//CacheStats counts the lookups of the cache since the start.
+type CacheStats struct {
+	Hits      int64   `json:"hits"`
+	Misses    int64   `json:"misses"`
+	Refreshes int64   `json:"refreshes"`
+	Evictions int64   `json:"evictions"`
+	Entries   int     `json:"entries"`
+	Bytes     int64   `json:"bytes"`
+	HitRatio  float64 `json:"hit_ratio"`
+}
+
+//cacheControl holds the Cache-Control directives of a request: no-store
+//skips the cache, no-cache fetches a fresh response that is then cached,
+//max-age bounds the age of a cached response and only-if-cached answers from
+//the cache or not at all.
+type cacheControl struct {
+	noStore      bool
+	noCache      bool
+	onlyIfCached bool
+	maxAge       time.Duration
+	//stale serves expired responses, set by the degradation policy
+	stale bool
+}
+
+//errNotCached answers only-if-cached requests that miss.
+var errNotCached = errors.New("response not in cache")
+
+func requestCacheControl(r *http.Request) cacheControl {
+	cc := cacheControl{maxAge: -1}
+	for _, d := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+		switch strings.ToLower(name) {
+		case "no-store":
+			cc.noStore = true
+		case "no-cache":
+			cc.noCache = true
+		case "only-if-cached":
+			cc.onlyIfCached = true
+		case "max-age":
+			if n, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil && n >= 0 {
+				cc.maxAge = time.Duration(n) * time.Second
+			}
+		}
+	}
+	return cc
+}
+
+//fresh tells whether a cached response may be served to the request.
+func (cc cacheControl) fresh(result searchResult, now time.Time) bool {
+	if cc.noCache {
+		return false
+	}
+	return cc.maxAge < 0 || now.Sub(result.At) <= cc.maxAge
+}
+
+//flight is a search being fetched that identical concurrent searches wait on.
+type flight struct {
+	done   chan struct{}
+	result searchResult
+	err    error
+}
+
+//searchCache is the response cache, replaced by a Redis cache at startup when
+//configured.
+var searchCache searchCacher = newResponseCache()
+
+func newResponseCache() *responseCache {
+	return &responseCache{entries: map[string]*cacheEntry{}, recency: list.New(), inflight: map[string]*flight{}}
+}
+
+//cacheKey combines the query hash with what else decides the response: the
+//cluster and credentials used, the latency budget and source filtering.
+func cacheKey(parts ...interface{}) string {
+	h := sha256.New()
+	json.NewEncoder(h).Encode(parts)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *responseCache) get(ctx context.Context, key string, fetch searchFunc, cc cacheControl) (result searchResult, hit bool, err error) {
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && (now.Before(e.expiresAt) || cc.stale) && cc.fresh(e.result, now) {
+		e.touch(now)
+		c.recency.MoveToFront(e.elem)
+		c.stats.Hits++
+		result = e.result
+		result.Stale = !now.Before(e.expiresAt)
+		ttl := e.expiresAt.Sub(e.storedAt)
+		if !e.refreshing && e.Score >= config.Cache.HotScore && e.expiresAt.Sub(now) < time.Duration(float64(ttl)*config.Cache.RefreshAhead) {
+			e.refreshing = true
+			go c.refresh(detachedContext(ctx), key, e)
+		}
+		c.mu.Unlock()
+		return result, true, nil
+	}
+	if cc.onlyIfCached {
+		c.stats.Misses++
+		c.mu.Unlock()
+		return searchResult{}, false, errNotCached
+	}
+	if f, ok := c.inflight[key]; ok && !cc.noCache {
+		c.stats.Hits++
+		c.mu.Unlock()
+		select {
+		case <-f.done:
+			return f.result, true, f.err
+		case <-ctx.Done():
+			return searchResult{}, false, ctx.Err()
+		}
+	}
+	c.stats.Misses++
+	f := &flight{done: make(chan struct{})}
+	c.inflight[key] = f
+	c.mu.Unlock()
+
+	result, err = fetch(ctx)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f.result, f.err = result, err
+	if c.inflight[key] == f {
+		delete(c.inflight, key)
+	}
+	close(f.done)
+	if err != nil || result.IsError() {
+		return result, false, err
+	}
+	if !ok {
+		e = &cacheEntry{popularity: popularity{SeenAt: now}}
+	}
+	e.touch(now)
+	c.store(key, e, result, fetch, now)
+	return result, false, nil
+}
+
+//detachedContext carries the request id, identity and tenant of ctx but not
+//its cancellation, for work outliving the request. Cache refreshes need the
+//tenant to reach its cluster and indices, the entry being keyed by tenant.
+func detachedContext(ctx context.Context) context.Context {
+	detached := context.Background()
+	for _, key := range []contextKey{requestIDKey, identityKey, tenantKey} {
+		if v := ctx.Value(key); v != nil {
+			detached = context.WithValue(detached, key, v)
+		}
+	}
+	return detached
+}
+
+//scopedContext carries the tenant and identity kept from a request, for the
+//calls made on their behalf once the request is over, such as closing the
+//points in time it left open.
+func scopedContext(t *Tenant, id *Identity) context.Context {
+	ctx := context.Background()
+	if t != nil {
+		ctx = context.WithValue(ctx, tenantKey, t)
+	}
+	if id != nil {
+		ctx = context.WithValue(ctx, identityKey, id)
+	}
+	return ctx
+}
+
+//refresh runs the query of a hot entry again ahead of its expiry, in the
+//context of the request that found it hot.
+func (c *responseCache) refresh(ctx context.Context, key string, e *cacheEntry) {
+	result, err := e.fetch(ctx)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.refreshing = false
+	if err != nil || result.IsError() {
+		logger.Warn("cache refresh failed", "key", key, "error", err)
+		return
+	}
+	//the entry may have been evicted meanwhile
+	if c.entries[key] != e {
+		return
+	}
+	c.stats.Refreshes++
+	c.store(key, e, result, e.fetch, time.Now())
+}
+
+func (c *responseCache) store(key string, e *cacheEntry, result searchResult, fetch searchFunc, now time.Time) {
+	size := int64(len(key) + len(result.Body))
+	if config.Cache.MaxBytes > 0 && size > config.Cache.MaxBytes {
+		c.remove(key)
+		return
+	}
+	if c.entries[key] != e {
+		c.remove(key)
+		e.elem = c.recency.PushFront(key)
+		c.entries[key] = e
+	} else {
+		c.recency.MoveToFront(e.elem)
+		c.bytes -= e.size
+	}
+	e.size = size
+	c.bytes += size
+	e.result = result
+	e.fetch = fetch
+	e.storedAt = now
+	e.expiresAt = now.Add(e.ttl())
+	for len(c.entries) > 1 && (len(c.entries) > config.Cache.MaxEntries || (config.Cache.MaxBytes > 0 && c.bytes > config.Cache.MaxBytes)) {
+		c.remove(c.recency.Back().Value.(string))
+		c.stats.Evictions++
+	}
+}
+
+//remove drops the entry of the key, if any. The caller holds the lock.
+func (c *responseCache) remove(key string) {
+	e, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	c.recency.Remove(e.elem)
+	c.bytes -= e.size
+	delete(c.entries, key)
+}
+
+//snapshot returns the statistics of the cache.
+func (c *responseCache) snapshot() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Entries, s.Bytes = len(c.entries), c.bytes
+	if total := s.Hits + s.Misses; total != 0 {
+		s.HitRatio = float64(s.Hits) / float64(total)
+	}
+	return s
+}
+
+//purge empties the cache, keeping the statistics.
+func (c *responseCache) purge(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]*cacheEntry{}
+	c.recency.Init()
+	c.bytes = 0
+	return nil
+}
+
+//setCacheHeader tells the caller whether the response came from the cache,
+//and how old it is.
+func setCacheHeader(w http.ResponseWriter, hit bool, result searchResult) {
+	if hit {
+		w.Header().Set("X-Cache", "HIT")
+		if !result.At.IsZero() {
+			w.Header().Set("Age", strconv.Itoa(int(time.Since(result.At).Seconds())))
+		}
+		return
+	}
+	w.Header().Set("X-Cache", "MISS")
+}
+
+//cacheStatsHandler reports the hits, misses and size of the response cache.
+func cacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	writeJSON(w, http.StatusOK, searchCache.snapshot())
+}
+
+//purgeCacheHandler empties the response cache.
+func purgeCacheHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	if err := searchCache.purge(r.Context()); err != nil {
+		logger.ErrorContext(r.Context(), "unable to purge the response cache", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	logger.InfoContext(r.Context(), "response cache purged", "actor", actor(r))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+//defaultSize is the number of hits elastic search returns when size is not set.
+const defaultSize = 10
+
+//canonicalSearch is the normalized form of a search: everything that decides
+//which documents come back, and nothing about who asked or how.
+type canonicalSearch struct {
+	Index []string    `json:"index"`
+	Sort  []string    `json:"sort"`
+	From  int         `json:"from"`
+	Size  int         `json:"size"`
+	Query interface{} `json:"query"`
+}
+
+//queryHash returns the stable hash of a search. Index lists are sorted, sort
+//fields trimmed, size defaulted and object keys sorted by encoding/json;
+//query strings are hashed as sent. Caching, deduplication, analytics
+//and the logs all identify a search by this hash.
+func queryHash(index, sortFields []string, from, size int, query interface{}) string {
+	c := canonicalSearch{
+		Index: append([]string{}, index...),
+		From:  from,
+		Size:  size,
+		Query: normalizeJSON(query),
+	}
+	sort.Strings(c.Index)
+	for _, s := range sortFields {
+		c.Sort = append(c.Sort, strings.TrimSpace(s))
+	}
+	if c.Size == 0 {
+		c.Size = defaultSize
+	}
+	b, _ := json.Marshal(c)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+//normalizeJSON returns v as plain JSON values, whose object keys
+//encoding/json sorts. Strings are kept as they are: whitespace matters in
+//phrases, regular expressions and keyword terms.
+func normalizeJSON(v interface{}) interface{} {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var out interface{}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return v
+	}
+	return out
+}
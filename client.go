@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/elastic/go-elasticsearch"
+	"github.com/elastic/go-elasticsearch/esapi"
+)
+
+//newClient creates every elastic search client of the gateway, so that they
+//all share the same transport instrumentation.
+func newClient(cfg elasticsearch.Config) (*elasticsearch.Client, error) {
+	base := cfg.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if config.Degradation.Enabled {
+		base = degradationTransport{base: base}
+	}
+	base = requestIDTransport{base: retryTransport{base: base}}
+	if config.AccessLog.Enabled {
+		base = upstreamTransport{base: base}
+	}
+	if config.RequestTracking.Enabled {
+		base = trackingTransport{base: base}
+	}
+	if config.Tracing.Enabled {
+		base = tracingTransport{base: base}
+	}
+	if config.Tenancy.enabled() {
+		base = tenantTransport{base: base}
+	}
+	cfg.Transport = base
+	return elasticsearch.NewClient(cfg)
+}
+
+//defaultClient returns a client for the configured default cluster. Without
+//one, the ELASTICSEARCH_URL environment handling of the client library applies.
+func defaultClient() (*elasticsearch.Client, error) {
+	return clusterClient(config.Cluster)
+}
+
+//clusterClient returns a client for a configured cluster.
+func clusterClient(c ClusterConfig) (*elasticsearch.Client, error) {
+	return newClient(elasticsearch.Config{
+		Addresses: c.Addresses,
+		Username:  c.Username,
+		Password:  c.Password,
+	})
+}
+
+//writeResponse copies an elastic search response to the caller as is,
+//keeping its status code.
+func writeResponse(w http.ResponseWriter, res *esapi.Response) {
+	defer res.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.StatusCode)
+	io.Copy(w, res.Body)
+}
+
+//writeJSON marshals v as the response body with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		logger.Error("error in json marshaling", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+//actor names the caller on whose behalf a write is made. The authenticated
+//identity wins; the X-Actor header is only trusted when auth is disabled.
+func actor(r *http.Request) string {
+	if id := identityFrom(r.Context()); id != nil {
+		return id.Name
+	}
+	if config.Auth.enabled() {
+		return ""
+	}
+	return r.Header.Get("X-Actor")
+}
+
+//encodeBody encodes v as the JSON body of an elastic search call.
+func encodeBody(v interface{}) (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+//searchInto runs a search built by the gateway itself and decodes the response into v.
+func searchInto(ctx context.Context, es *elasticsearch.Client, index []string, query interface{}, v interface{}) error {
+	buf, err := encodeBody(query)
+	if err != nil {
+		return err
+	}
+	res, err := es.Search(
+		es.Search.WithContext(ctx),
+		es.Search.WithIndex(index...),
+		es.Search.WithBody(buf),
+	)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("search %v: %s", index, res.String())
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"path"
+
+	"github.com/elastic/go-elasticsearch"
+)
+
+//ClusterSettingsConfig lists the patterns ("cluster.routing.allocation.disk.*")
+//of the cluster settings admins may change through the gateway. Every change
+//is logged with the previous value and who made it.
+type ClusterSettingsConfig struct {
+	Allowed []string `json:"allowed"`
+}
+
+//clusterSettingScopes are the sections of a cluster settings update.
+var clusterSettingScopes = []string{"persistent", "transient"}
+
+func settingAllowed(key string) bool {
+	for _, pattern := range config.ClusterSettings.Allowed {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//flattenSettings turns nested settings into dotted keys, the way
+//flat_settings=true returns them.
+func flattenSettings(prefix string, settings map[string]interface{}, flat map[string]interface{}) {
+	for key, value := range settings {
+		if nested, ok := value.(map[string]interface{}); ok {
+			flattenSettings(prefix+key+".", nested, flat)
+			continue
+		}
+		flat[prefix+key] = value
+	}
+}
+
+//currentClusterSettings returns the persistent and transient settings of the
+//cluster, flat.
+func currentClusterSettings(ctx context.Context, es *elasticsearch.Client) (map[string]map[string]interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/_cluster/settings?flat_settings=true", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := es.Perform(req)
+	if err != nil {
+		return nil, err
+	}
+	settings := map[string]map[string]interface{}{}
+	if err := decodeAdminResponse(res.StatusCode >= http.StatusMultipleChoices, res.Status, res.Body, &settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+//clusterSettingsHandler returns the persistent and transient cluster
+//settings, with the defaults when include_defaults=true.
+func clusterSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	passthrough(w, r, http.MethodGet, "/_cluster/settings", forwardParams(r, "flat_settings", "include_defaults", "master_timeout"), nil)
+}
+
+//putClusterSettingsHandler updates the persistent and transient cluster
+//settings of the body, refusing the whole update when a key is not allowed.
+//A null value resets the setting to its default.
+func putClusterSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	var body map[string]map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	update := map[string]interface{}{}
+	for _, scope := range clusterSettingScopes {
+		flat := map[string]interface{}{}
+		flattenSettings("", body[scope], flat)
+		for _, key := range sortedKeys(flat) {
+			if !settingAllowed(key) {
+				writeValidationError(w, &ValidationError{Path: "/" + scope + "/" + escapePointer(key), Message: "is not a cluster setting changed through the gateway"})
+				return
+			}
+		}
+		if len(flat) != 0 {
+			update[scope] = flat
+		}
+		delete(body, scope)
+	}
+	for key := range body {
+		writeValidationError(w, &ValidationError{Path: "/" + escapePointer(key), Message: "must be persistent or transient"})
+		return
+	}
+	if len(update) == 0 {
+		writeValidationError(w, &ValidationError{Path: "", Message: "no setting to change"})
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	previous, err := currentClusterSettings(r.Context(), es)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to read cluster settings", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	b, err := json.Marshal(update)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error encoding cluster settings", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPut, "/_cluster/settings?flat_settings=true", bytes.NewReader(b))
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error creating elastic search request", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := es.Perform(req)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error getting response from elastic search cluster", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	var result map[string]interface{}
+	if err := decodeAdminResponse(res.StatusCode >= http.StatusMultipleChoices, res.Status, res.Body, &result); err != nil {
+		logger.ErrorContext(r.Context(), "unable to update cluster settings", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	for scope, settings := range update {
+		for key, value := range settings.(map[string]interface{}) {
+			logger.InfoContext(r.Context(), "cluster setting changed",
+				"scope", scope,
+				"setting", key,
+				"from", previous[scope][key],
+				"to", value,
+				"actor", actor(r),
+			)
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
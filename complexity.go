@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+)
+
+//ComplexityConfig weighs the parts of a query in its complexity score, which
+//is returned in meta.complexity of every search and by /elastic/score before
+//searching. The score is the sum of the clauses, expensive clauses (wildcard,
+//regexp, script...) counting ExpensiveWeight, of DepthWeight per level of
+//nesting and of BucketWeight per aggregation bucket estimated. Histograms,
+//whose bucket count depends on the data, are estimated HistogramBuckets.
+type ComplexityConfig struct {
+	ExpensiveWeight  float64 `json:"expensive_weight"`
+	DepthWeight      float64 `json:"depth_weight"`
+	BucketWeight     float64 `json:"bucket_weight"`
+	HistogramBuckets int     `json:"histogram_buckets"`
+}
+
+//Complexity is the complexity of a search body.
+type Complexity struct {
+	Score float64 `json:"score"`
+	//Clauses counts the queries, leaf and compound
+	Clauses int `json:"clauses"`
+	//Expensive counts the clauses that scan terms or run scripts
+	Expensive int `json:"expensive"`
+	//Depth is the deepest nesting of compound queries
+	Depth int `json:"depth"`
+	//Aggregations counts the aggregations, sub aggregations included
+	Aggregations int `json:"aggregations"`
+	//Buckets estimates the buckets the aggregations return
+	Buckets int `json:"buckets"`
+}
+
+//expensiveQueries are the queries elastic search treats as expensive.
+var expensiveQueries = map[string]bool{
+	"wildcard": true, "regexp": true, "fuzzy": true, "prefix": true, "query_string": true,
+	"script": true, "script_score": true, "percolate": true, "has_child": true, "has_parent": true,
+	"more_like_this": true, "geo_shape": true, "knn": true,
+}
+
+//ScoreRequest is a query to score without running it. Filters and where are
+//applied the way search does.
+type ScoreRequest struct {
+	ElasticQuery interface{} `json:"elasticquery"`
+	Filters      []Filter    `json:"filters"`
+	Where        string      `json:"where"`
+}
+
+//queryComplexity scores a search body. Parts it does not understand count
+//as single clauses.
+func queryComplexity(q interface{}) Complexity {
+	var c Complexity
+	body, ok := searchBody(q)
+	if !ok {
+		return c
+	}
+	for _, key := range []string{"query", "post_filter"} {
+		if v, ok := body[key]; ok {
+			c.query(v, 1)
+		}
+	}
+	for _, key := range []string{"aggs", "aggregations"} {
+		if aggs, ok := body[key].(map[string]interface{}); ok {
+			c.Buckets += c.aggregations(aggs)
+		}
+	}
+	w := config.Complexity
+	score := float64(c.Clauses-c.Expensive) + float64(c.Expensive)*w.ExpensiveWeight + float64(c.Depth)*w.DepthWeight + float64(c.Buckets)*w.BucketWeight
+	c.Score = math.Round(score*100) / 100
+	return c
+}
+
+func (c *Complexity) query(q interface{}, depth int) {
+	obj, ok := q.(map[string]interface{})
+	if !ok {
+		return
+	}
+	if depth > c.Depth {
+		c.Depth = depth
+	}
+	for name, clause := range obj {
+		c.Clauses++
+		if expensiveQueries[name] {
+			c.Expensive++
+		}
+		subs, ok := compoundQueries[name]
+		params, isObject := clause.(map[string]interface{})
+		if !ok || !isObject {
+			continue
+		}
+		for _, sub := range subs {
+			if list, ok := params[sub].([]interface{}); ok {
+				for _, item := range list {
+					c.query(item, depth+1)
+				}
+				continue
+			}
+			if v, ok := params[sub]; ok {
+				c.query(v, depth+1)
+			}
+		}
+	}
+}
+
+//aggregations counts the aggregations and returns the buckets they are
+//estimated to return, sub aggregations multiplying those of their parent.
+func (c *Complexity) aggregations(aggs map[string]interface{}) int {
+	buckets := 0
+	for _, v := range aggs {
+		def, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		c.Aggregations++
+		kind, sub := aggDefinition(def)
+		params, _ := def[kind].(map[string]interface{})
+		n := aggBuckets(kind, params)
+		if len(sub) != 0 {
+			if inner := c.aggregations(sub); inner != 0 {
+				n *= inner
+			}
+		}
+		buckets += n
+	}
+	return buckets
+}
+
+//aggBuckets estimates the buckets of one aggregation, 1 for metrics.
+func aggBuckets(kind string, params map[string]interface{}) int {
+	size := func(key string, def int) int {
+		if v, ok := params[key].(float64); ok && v > 0 {
+			return int(v)
+		}
+		return def
+	}
+	list := func(key string) int {
+		switch v := params[key].(type) {
+		case []interface{}:
+			return len(v)
+		case map[string]interface{}:
+			return len(v)
+		}
+		return 1
+	}
+	switch kind {
+	case "terms", "significant_terms", "significant_text", "multi_terms", "rare_terms", "composite":
+		return size("size", 10)
+	case "histogram", "date_histogram", "auto_date_histogram", "variable_width_histogram":
+		return size("buckets", config.Complexity.HistogramBuckets)
+	case "range", "date_range", "ip_range", "geo_distance":
+		return list("ranges")
+	case "filters":
+		return list("filters")
+	case "geohash_grid", "geotile_grid":
+		return size("size", 10000)
+	}
+	return 1
+}
+
+//scoreHandler scores a query without running it, so callers can check it
+//against their budget before searching.
+func scoreHandler(w http.ResponseWriter, r *http.Request) {
+	var body ScoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var err error
+	if len(body.Filters) != 0 {
+		if body.ElasticQuery, err = withFilters(body.ElasticQuery, body.Filters); err != nil {
+			writeValidationError(w, err)
+			return
+		}
+	}
+	if len(strings.TrimSpace(body.Where)) != 0 {
+		if body.ElasticQuery, err = withWhere(body.ElasticQuery, body.Where); err != nil {
+			writeValidationError(w, err)
+			return
+		}
+	}
+	if _, ok := searchBody(body.ElasticQuery); !ok {
+		writeValidationError(w, &ValidationError{Path: "/elasticquery", Message: "must be a JSON object"})
+		return
+	}
+	writeJSON(w, http.StatusOK, queryComplexity(body.ElasticQuery))
+}
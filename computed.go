@@ -0,0 +1,29 @@
+package main
+
+//withComputedFields merges the runtime mappings and script fields of the
+//request into the search body. Entries already in the query keep precedence.
+func withComputedFields(q interface{}, runtime, scripts map[string]interface{}) (interface{}, error) {
+	body, ok := searchBody(q)
+	if !ok {
+		return nil, &ValidationError{Path: "/", Message: "elasticquery must be a JSON object when computed fields are used"}
+	}
+	for section, fields := range map[string]map[string]interface{}{
+		"runtime_mappings": runtime,
+		"script_fields":    scripts,
+	} {
+		if len(fields) == 0 {
+			continue
+		}
+		merged, _ := body[section].(map[string]interface{})
+		if merged == nil {
+			merged = map[string]interface{}{}
+		}
+		for name, def := range fields {
+			if _, ok := merged[name]; !ok {
+				merged[name] = def
+			}
+		}
+		body[section] = merged
+	}
+	return body, nil
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+//Config is the gateway configuration read from the file passed with -config.
+//Every section is optional; a missing file leaves the defaults in place.
+type Config struct {
+	Cluster     ClusterConfig    `json:"cluster"`
+	Log         LogConfig        `json:"log"`
+	AccessLog   AccessLogConfig  `json:"accesslog"`
+	CORS        CORSConfig       `json:"cors"`
+	Auth        AuthConfig       `json:"auth"`
+	Authz       AuthzConfig      `json:"authz"`
+	Cache       CacheConfig      `json:"cache"`
+	SoftDelete  SoftDeleteConfig `json:"softdelete"`
+	History     HistoryConfig    `json:"history"`
+	Health      HealthConfig     `json:"health"`
+	Sketches    SketchConfig     `json:"sketches"`
+	Tracing     TracingConfig    `json:"tracing"`
+	Demo        DemoConfig       `json:"demo"`
+	Analytics   AnalyticsConfig  `json:"analytics"`
+	Experiments []Experiment     `json:"experiments"`
+	Latency     LatencyConfig    `json:"latency"`
+	Validation  ValidationConfig `json:"validation"`
+	Scoring     ScoringConfig    `json:"scoring"`
+	Freshness   FreshnessConfig  `json:"freshness"`
+	EQL         EQLConfig        `json:"eql"`
+	Boosts      BoostConfig      `json:"boosts"`
+	Words       WordsConfig      `json:"words"`
+	Folding     FoldingConfig    `json:"folding"`
+	TextRanges  TextRangeConfig  `json:"text_ranges"`
+	Retry       RetryConfig      `json:"retry"`
+	//Backpressure sheds ingestion load when the cluster is overloaded
+	Backpressure BackpressureConfig `json:"backpressure"`
+	//TextPipeline preprocesses the text of full-text searches
+	TextPipeline TextPipelineConfig `json:"text_pipeline"`
+	//Environments are other clusters (staging, prod...) admin tools compare
+	Environments map[string]ClusterConfig `json:"environments"`
+	//GraphQL exposes indices through a GraphQL endpoint
+	GraphQL GraphQLConfig `json:"graphql"`
+	//Prepared stores the queries registered for execution by handle
+	Prepared PreparedConfig `json:"prepared"`
+	//GRPC serves the gateway over gRPC on a second port
+	GRPC GRPCConfig `json:"grpc"`
+	//OpenAPI checks request bodies against the document served at /openapi.json
+	OpenAPI OpenAPIConfig `json:"openapi"`
+	//Tenancy routes the requests of each tenant to its cluster and indices
+	Tenancy TenancyConfig `json:"tenancy"`
+	//Flags gate behaviors rolled out gradually, see flags.go
+	Flags map[string]Flag `json:"flags"`
+	//Degradation steps the service down while elastic search fails
+	Degradation DegradationConfig `json:"degradation"`
+	//Percolator stores saved queries for reverse searches
+	Percolator PercolatorConfig `json:"percolator"`
+	//Lint bounds the mappings of the templates applied through the gateway
+	Lint LintConfig `json:"lint"`
+	//DocSchemas validates the documents written through the gateway
+	DocSchemas DocSchemaConfig `json:"doc_schemas"`
+	//Embedding turns the texts of kNN searches into vectors
+	Embedding EmbeddingConfig `json:"embedding"`
+	//Pagination keeps the sessions of guarded paginations
+	Pagination PaginationConfig `json:"pagination"`
+	//RequestTracking keeps the recent requests for /elastic/requests/{id}
+	RequestTracking RequestTrackingConfig `json:"request_tracking"`
+	//Journal keeps the recent requests and responses on disk for forensics
+	Journal JournalConfig `json:"journal"`
+	//ClusterSettings lists the cluster settings admins may change through the gateway
+	ClusterSettings ClusterSettingsConfig `json:"cluster_settings"`
+	//Privacy noises the aggregations of the searches of sensitive indices
+	Privacy PrivacyConfig `json:"privacy"`
+	//NodeStats lists the node stats metric groups exposed for on-call debugging
+	NodeStats NodeStatsConfig `json:"node_stats"`
+	//Webhooks lists the endpoints notified of the events of the gateway
+	Webhooks WebhookConfig `json:"webhooks"`
+	//DataStreams lists the names written as data streams
+	DataStreams DataStreamConfig `json:"data_streams"`
+	//Store keeps the state that must outlive a restart
+	Store StoreConfig `json:"store"`
+	//PIT bounds the points in time opened through the gateway
+	PIT PITConfig `json:"pit"`
+	//Fanout bounds the searches fanned out across indices and clusters
+	Fanout FanoutConfig `json:"fanout"`
+	//Complexity weighs the parts of a query in its complexity score
+	Complexity ComplexityConfig `json:"complexity"`
+	//RemoteClusters lists the remote clusters searches may name (cluster:index)
+	RemoteClusters RemoteClustersConfig `json:"remote_clusters"`
+	//Warmup warms the cache with saved dashboards before business hours
+	Warmup WarmupConfig `json:"warmup"`
+	//Exports keeps the manifests of finished exports
+	Exports ExportConfig `json:"exports"`
+	//Generations lists, per index, the indices it was reindexed from, newest first
+	Generations map[string][]string `json:"generations"`
+}
+
+//ClusterConfig holds the connection details of the default cluster, used
+//whenever a request does not carry its own addresses or credentials.
+type ClusterConfig struct {
+	Addresses []string `json:"addresses"`
+	Username  string   `json:"username"`
+	Password  string   `json:"password"`
+}
+
+//Duration is a time.Duration written as a string ("90s", "720h") in the config file.
+type Duration struct {
+	time.Duration
+}
+
+//UnmarshalJSON parses the duration with time.ParseDuration.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		SoftDelete: SoftDeleteConfig{
+			Field:         "deleted",
+			Indices:       []string{"*"},
+			Retention:     Duration{30 * 24 * time.Hour},
+			PurgeInterval: Duration{time.Hour},
+		},
+		History: HistoryConfig{
+			Index: "elastic-history",
+		},
+		Health: HealthConfig{
+			ReadyTimeout: Duration{2 * time.Second},
+		},
+		Sketches: SketchConfig{
+			Interval: Duration{5 * time.Minute},
+			MaxAge:   Duration{15 * time.Minute},
+		},
+		Auth: AuthConfig{
+			Exempt: []string{"/healthz", "/readyz"},
+			JWT: JWTConfig{
+				IdentityClaim: "sub",
+				RolesClaim:    "roles",
+				Leeway:        Duration{time.Minute},
+				JWKSRefresh:   Duration{10 * time.Minute},
+			},
+		},
+		Cache: CacheConfig{
+			TTL:          Duration{30 * time.Second},
+			MaxTTL:       Duration{5 * time.Minute},
+			MaxEntries:   1000,
+			MaxBytes:     64 << 20,
+			HalfLife:     Duration{time.Minute},
+			HotScore:     5,
+			RefreshAhead: 0.2,
+			Backend:      "memory",
+			Redis: RedisConfig{
+				Addr:     "localhost:6379",
+				Prefix:   "elastic:cache:",
+				PoolSize: 16,
+				Timeout:  Duration{time.Second},
+			},
+		},
+		Latency: LatencyConfig{
+			Headroom: 0.2,
+			Tiers:    defaultLatencyTiers(),
+		},
+		Freshness: FreshnessConfig{
+			TimestampField: "@timestamp",
+			CacheTTL:       Duration{30 * time.Second},
+		},
+		EQL: EQLConfig{
+			TimestampField:     "@timestamp",
+			EventCategoryField: "event.category",
+		},
+		Boosts: BoostConfig{
+			Index:   "elastic-boosts",
+			Refresh: Duration{30 * time.Second},
+		},
+		Words: WordsConfig{
+			Index:           "elastic-words",
+			DefaultLanguage: "en",
+			Refresh:         Duration{30 * time.Second},
+		},
+		Flags:      defaultFlags(),
+		Percolator: PercolatorConfig{Field: "query"},
+		Lint:       LintConfig{MaxFields: 1000, MaxDepth: 20},
+		DocSchemas: DocSchemaConfig{
+			Index:           "elastic-doc-schemas",
+			Refresh:         Duration{30 * time.Second},
+			OnInvalid:       "reject",
+			DeadLetterIndex: "elastic-dead-letters",
+		},
+		Embedding:       EmbeddingConfig{Timeout: Duration{10 * time.Second}},
+		RequestTracking: RequestTrackingConfig{Enabled: true, Keep: 1000},
+		Journal: JournalConfig{
+			Dir:           "journal",
+			MaxBytes:      256 << 20,
+			SegmentBytes:  16 << 20,
+			MaxBodyBytes:  64 << 10,
+			RedactFields:  []string{"password", "secret", "token", "api_key", "apikey", "authorization", "credentials"},
+			RedactHeaders: []string{"Authorization", "Cookie", "Set-Cookie", "X-Api-Key"},
+		},
+		ClusterSettings: ClusterSettingsConfig{
+			Allowed: []string{
+				"cluster.routing.allocation.disk.*",
+				"cluster.routing.allocation.enable",
+				"cluster.routing.rebalance.enable",
+				"cluster.routing.allocation.cluster_concurrent_rebalance",
+				"cluster.routing.allocation.node_concurrent_recoveries",
+				"cluster.routing.allocation.exclude.*",
+				"indices.recovery.max_bytes_per_sec",
+			},
+		},
+		Privacy:   PrivacyConfig{Epsilon: 1, MinBucketSize: 10},
+		NodeStats: NodeStatsConfig{Metrics: []string{"jvm", "os", "process", "fs", "thread_pool", "breaker", "indices"}},
+		Webhooks: WebhookConfig{
+			MaxAttempts: 6,
+			Backoff:     Duration{time.Second},
+			MaxBackoff:  Duration{5 * time.Minute},
+			Timeout:     Duration{10 * time.Second},
+			LogSize:     100,
+		},
+		DataStreams: DataStreamConfig{Patterns: []string{"logs-*-*", "metrics-*-*", "traces-*-*", "synthetics-*-*"}},
+		Store: StoreConfig{
+			Backend: "memory",
+			Path:    "state.json",
+			Redis: RedisConfig{
+				Addr:     "localhost:6379",
+				Prefix:   "elastic:state:",
+				PoolSize: 4,
+				Timeout:  Duration{time.Second},
+			},
+			Table:     "gateway_state",
+			Reload:    Duration{30 * time.Second},
+			BackupDir: "backups",
+		},
+		PIT: PITConfig{
+			KeepAlive:    Duration{5 * time.Minute},
+			MaxKeepAlive: Duration{time.Hour},
+			IdleTimeout:  Duration{15 * time.Minute},
+			ReapInterval: Duration{time.Minute},
+		},
+		Fanout: FanoutConfig{
+			Workers:    8,
+			MaxTargets: 32,
+			Timeout:    Duration{10 * time.Second},
+		},
+		Complexity: ComplexityConfig{
+			ExpensiveWeight:  5,
+			DepthWeight:      2,
+			BucketWeight:     0.01,
+			HistogramBuckets: 100,
+		},
+		Exports: ExportConfig{ManifestKeep: Duration{7 * 24 * time.Hour}},
+		Warmup: WarmupConfig{
+			Actor:   "cache-warmer",
+			Workers: 4,
+		},
+		Pagination: PaginationConfig{
+			SessionTTL:   Duration{10 * time.Minute},
+			PITKeepAlive: Duration{5 * time.Minute},
+		},
+		Degradation: DegradationConfig{
+			Window:      Duration{30 * time.Second},
+			MinCalls:    20,
+			Thresholds:  []float64{0.1, 0.25, 0.4, 0.6},
+			Hold:        Duration{30 * time.Second},
+			ReducedSize: 10,
+			NonInteractive: []string{
+				"/elastic/export/csv",
+				"/elastic/export/ndjson",
+				"/elastic/async/{index}",
+				"/elastic/diagnose/{index}",
+			},
+		},
+		Tenancy: TenancyConfig{
+			Header: "X-Tenant",
+			Regions: RegionConfig{
+				ProbeInterval: Duration{10 * time.Second},
+				ProbeTimeout:  Duration{2 * time.Second},
+				SessionHeader: "X-Session-ID",
+				StickyTTL:     Duration{30 * time.Minute},
+			},
+		},
+		Prepared: PreparedConfig{
+			Index: "elastic-prepared",
+		},
+		TextPipeline: TextPipelineConfig{
+			Steps: []string{"trim", "nfc"},
+		},
+		Backpressure: BackpressureConfig{
+			MaxInFlight:   200,
+			MaxRejections: 20,
+			Window:        Duration{10 * time.Second},
+			WarnRatio:     0.8,
+		},
+		Tracing: TracingConfig{
+			ServiceName: "elastic-gateway",
+		},
+	}
+}
+
+func loadConfig(path string) error {
+	if len(path) == 0 {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&config); err != nil {
+		return err
+	}
+	if err := checkTextPipeline(config.TextPipeline); err != nil {
+		return err
+	}
+	if err := checkCORS(config.CORS); err != nil {
+		return err
+	}
+	if err := checkFanout(config.Fanout); err != nil {
+		return err
+	}
+	return checkWarmup(config.Warmup)
+}
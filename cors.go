@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+//CORSConfig is the default CORS policy, with overrides keyed by route
+//template (for example "/elastic/doc/{index}/{id}").
+type CORSConfig struct {
+	CORSPolicy
+	Routes map[string]CORSPolicy `json:"routes"`
+}
+
+//CORSPolicy lists what browsers may do cross origin. An origin may be "*" or
+//a wildcard subdomain such as "https://*.example.com". "*" may not be allowed
+//with credentials, which would let any site make credentialed calls.
+type CORSPolicy struct {
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods"`
+	AllowedHeaders   []string `json:"allowed_headers"`
+	ExposedHeaders   []string `json:"exposed_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	MaxAge           Duration `json:"max_age"`
+}
+
+func (c CORSConfig) enabled() bool {
+	return len(c.AllowedOrigins) != 0 || len(c.Routes) != 0
+}
+
+//checkCORS rejects policies allowing "*" with credentials when the
+//configuration is loaded.
+func checkCORS(c CORSConfig) error {
+	policies := map[string]CORSPolicy{"default": c.CORSPolicy}
+	for route, p := range c.Routes {
+		policies[route] = p
+	}
+	for route, p := range policies {
+		for _, o := range p.AllowedOrigins {
+			if o == "*" && p.AllowCredentials {
+				return fmt.Errorf("cors policy %s allows origin * with credentials", route)
+			}
+		}
+	}
+	return nil
+}
+
+func corsPolicy(route string) CORSPolicy {
+	if p, ok := config.CORS.Routes[route]; ok {
+		return p
+	}
+	return config.CORS.CORSPolicy
+}
+
+func (p CORSPolicy) allows(origin string) bool {
+	for _, o := range p.AllowedOrigins {
+		if o == "*" || o == origin {
+			return true
+		}
+		if i := strings.Index(o, "*."); i >= 0 && strings.HasPrefix(origin, o[:i]) && strings.HasSuffix(origin, o[i+1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+//allowOrigin sets the headers shared by preflight and actual responses and
+//reports whether the origin is allowed at all.
+func (p CORSPolicy) allowOrigin(w http.ResponseWriter, origin string) bool {
+	w.Header().Add("Vary", "Origin")
+	if len(origin) == 0 || !p.allows(origin) {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if p.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	return true
+}
+
+//CORSMid adds the CORS headers of the matched route to actual requests.
+func CORSMid(app http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions && len(r.Header.Get("Access-Control-Request-Method")) != 0 {
+			app.ServeHTTP(w, r)
+			return
+		}
+		p := corsPolicy(routeTemplate(r))
+		if p.allowOrigin(w, r.Header.Get("Origin")) && len(p.ExposedHeaders) != 0 {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(p.ExposedHeaders, ", "))
+		}
+		app.ServeHTTP(w, r)
+	})
+}
+
+//preflightHandler answers OPTIONS requests for every route. The route the
+//browser is about to call is looked up with the method it announced, so the
+//policy of that route applies.
+func preflightHandler(router *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		method := r.Header.Get("Access-Control-Request-Method")
+		probe := r.Clone(r.Context())
+		probe.Method = method
+		var match mux.RouteMatch
+		if len(method) == 0 || !router.Match(probe, &match) || match.Route == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		tpl, _ := match.Route.GetPathTemplate()
+		p := corsPolicy(tpl)
+		if !p.allowOrigin(w, r.Header.Get("Origin")) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		methods := p.AllowedMethods
+		if len(methods) == 0 {
+			methods, _ = match.Route.GetMethods()
+		}
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		if len(p.AllowedHeaders) != 0 {
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(p.AllowedHeaders, ", "))
+		} else if h := r.Header.Get("Access-Control-Request-Headers"); len(h) != 0 {
+			w.Header().Set("Access-Control-Allow-Headers", h)
+		}
+		if p.MaxAge.Duration > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+//RemoteClustersConfig lists the patterns of the remote clusters searches may
+//name in the cluster:index syntax, those of cluster.remote.* in the settings
+//of the cluster. A wildcard cluster ("*:logs") is only accepted when an
+//allowed pattern covers it ("*"). Without patterns remote indices are
+//refused. Authorization rules see remote indices as named, so a rule grants
+//them with patterns such as "eu-west:logs-*".
+type RemoteClustersConfig struct {
+	Allowed []string `json:"allowed"`
+}
+
+//RemoteClusterRequest connects the cluster to a remote cluster, by its seed
+//nodes in sniff mode or by a proxy address in proxy mode.
+type RemoteClusterRequest struct {
+	Mode            string   `json:"mode"`
+	Seeds           []string `json:"seeds"`
+	ProxyAddress    string   `json:"proxy_address"`
+	SkipUnavailable *bool    `json:"skip_unavailable"`
+}
+
+//remoteClusterSettings are the settings of a remote cluster the gateway sets.
+var remoteClusterSettings = []string{"mode", "seeds", "proxy_address", "skip_unavailable"}
+
+//splitRemote splits cluster:index, cluster being empty for local indices. The
+//colon of a date math name (<logs-{now/d{yyyy.MM.dd|+12:00}}>) is not a
+//cluster separator.
+func splitRemote(index string) (cluster, name string) {
+	i := strings.Index(index, ":")
+	if i < 0 || strings.ContainsAny(index[:i], "<{") {
+		return "", index
+	}
+	return index[:i], index[i+1:]
+}
+
+func remoteAllowed(cluster string) bool {
+	for _, pattern := range config.RemoteClusters.Allowed {
+		if ok, _ := path.Match(pattern, cluster); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//checkRemoteIndices refuses the indices of remote clusters not allowed, and
+//all of them for tenants, which search their own cluster.
+func checkRemoteIndices(ctx context.Context, index []string) error {
+	for _, name := range index {
+		cluster, local := splitRemote(name)
+		switch {
+		case len(cluster) == 0:
+		case tenantFrom(ctx) != nil:
+			return &ValidationError{Path: "/index", Message: "tenants search their own cluster"}
+		case len(local) == 0:
+			return &ValidationError{Path: "/index", Message: "the index of remote cluster " + cluster + " is missing"}
+		case !remoteAllowed(cluster):
+			return &ValidationError{Path: "/index", Message: "remote cluster " + cluster + " is not allowed"}
+		}
+	}
+	return nil
+}
+
+//remoteName returns the remote cluster of the path, answering 400 when it
+//is not an allowed name.
+func remoteName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name := mux.Vars(r)["name"]
+	if strings.ContainsAny(name, "*?[:,") || !remoteAllowed(name) {
+		writeValidationError(w, &ValidationError{Path: "", Message: "remote cluster " + name + " is not allowed"})
+		return "", false
+	}
+	return name, true
+}
+
+//remotesHandler lists the remote clusters of the cluster with their
+//connection state.
+func remotesHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	passthrough(w, r, http.MethodGet, "/_remote/info", nil, nil)
+}
+
+//putRemoteHandler connects the cluster to an allowed remote cluster, or
+//changes its connection, through its persistent settings.
+func putRemoteHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	name, ok := remoteName(w, r)
+	if !ok {
+		return
+	}
+	var body RemoteClusterRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	settings := map[string]interface{}{}
+	switch body.Mode {
+	case "", "sniff":
+		if len(body.Seeds) == 0 {
+			writeValidationError(w, &ValidationError{Path: "/seeds", Message: "is required in sniff mode"})
+			return
+		}
+		settings["seeds"] = body.Seeds
+	case "proxy":
+		if len(body.ProxyAddress) == 0 {
+			writeValidationError(w, &ValidationError{Path: "/proxy_address", Message: "is required in proxy mode"})
+			return
+		}
+		settings["proxy_address"] = body.ProxyAddress
+	default:
+		writeValidationError(w, &ValidationError{Path: "/mode", Message: "must be sniff or proxy"})
+		return
+	}
+	if len(body.Mode) != 0 {
+		settings["mode"] = body.Mode
+	}
+	if body.SkipUnavailable != nil {
+		settings["skip_unavailable"] = *body.SkipUnavailable
+	}
+	logger.InfoContext(r.Context(), "remote cluster connected", "remote", name, "actor", actor(r))
+	putRemoteSettings(w, r, name, settings)
+}
+
+//deleteRemoteHandler disconnects the cluster from a remote cluster.
+func deleteRemoteHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	name, ok := remoteName(w, r)
+	if !ok {
+		return
+	}
+	logger.InfoContext(r.Context(), "remote cluster disconnected", "remote", name, "actor", actor(r))
+	putRemoteSettings(w, r, name, map[string]interface{}{})
+}
+
+//putRemoteSettings sets the settings of the remote cluster, resetting those
+//not given.
+func putRemoteSettings(w http.ResponseWriter, r *http.Request, name string, settings map[string]interface{}) {
+	persistent := map[string]interface{}{}
+	for _, key := range remoteClusterSettings {
+		persistent["cluster.remote."+name+"."+key] = settings[key]
+	}
+	buf, err := encodeBody(map[string]interface{}{"persistent": persistent})
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error encoding cluster settings", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	passthrough(w, r, http.MethodPut, "/_cluster/settings", nil, buf)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch"
+	"github.com/elastic/go-elasticsearch/esapi"
+	"github.com/gorilla/mux"
+)
+
+//Dataset is an example dataset of the catalog, generated rather than shipped:
+//the same seed always gives the same documents, their timestamps spread over
+//the days before the load.
+type Dataset struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Index       string                 `json:"index"`
+	Docs        int                    `json:"docs"`
+	Mappings    map[string]interface{} `json:"-"`
+	seed        int64
+	generate    func(rng *rand.Rand, now time.Time) map[string]interface{}
+}
+
+//DatasetLoad is the outcome of loading a dataset.
+type DatasetLoad struct {
+	Dataset      string `json:"dataset"`
+	Cluster      string `json:"cluster"`
+	Index        string `json:"index"`
+	Indexed      int    `json:"indexed"`
+	Failed       int    `json:"failed"`
+	DeadLettered int    `json:"dead_lettered"`
+	Millis       int64  `json:"ms"`
+}
+
+//datasetBatch is the number of documents sent per bulk request.
+const datasetBatch = 500
+
+func mappedAs(t string) map[string]interface{} {
+	return map[string]interface{}{"type": t}
+}
+
+func pickOne(rng *rand.Rand, values ...string) string {
+	return values[rng.Intn(len(values))]
+}
+
+//datasets is the catalog, by name.
+var datasets = map[string]*Dataset{
+	"logs": {
+		Name:        "logs",
+		Description: "Web server access logs of the last week",
+		Index:       "sample-logs",
+		seed:        1,
+		Docs:        5000,
+		Mappings: map[string]interface{}{
+			"properties": map[string]interface{}{
+				"@timestamp":  mappedAs("date"),
+				"host":        mappedAs("keyword"),
+				"method":      mappedAs("keyword"),
+				"path":        mappedAs("keyword"),
+				"status":      mappedAs("short"),
+				"bytes":       mappedAs("long"),
+				"duration_ms": mappedAs("float"),
+				"client_ip":   mappedAs("ip"),
+				"country":     mappedAs("keyword"),
+				"user_agent":  map[string]interface{}{"type": "text", "fields": map[string]interface{}{"keyword": mappedAs("keyword")}},
+				"message":     mappedAs("text"),
+			},
+		},
+		generate: func(rng *rand.Rand, now time.Time) map[string]interface{} {
+			method := pickOne(rng, "GET", "GET", "GET", "POST", "PUT", "DELETE")
+			path := pickOne(rng, "/", "/login", "/cart", "/search", "/products/"+strconv.Itoa(rng.Intn(500)), "/api/orders", "/static/app.js")
+			status := 200
+			switch n := rng.Intn(100); {
+			case n < 3:
+				status = 500
+			case n < 10:
+				status = 404
+			case n < 15:
+				status = 302
+			}
+			return map[string]interface{}{
+				"@timestamp":  now.Add(-time.Duration(rng.Int63n(int64(7 * 24 * time.Hour)))).Format(time.RFC3339),
+				"host":        fmt.Sprintf("web-%02d", rng.Intn(6)+1),
+				"method":      method,
+				"path":        path,
+				"status":      status,
+				"bytes":       rng.Intn(200000),
+				"duration_ms": float64(rng.Intn(250000)) / 100,
+				"client_ip":   fmt.Sprintf("10.%d.%d.%d", rng.Intn(256), rng.Intn(256), rng.Intn(254)+1),
+				"country":     pickOne(rng, "US", "FR", "DE", "GB", "IN", "BR", "JP", "CA"),
+				"user_agent":  pickOne(rng, "Mozilla/5.0 (Windows NT 10.0) Chrome/120.0", "Mozilla/5.0 (Macintosh) Safari/17.1", "Mozilla/5.0 (X11; Linux) Firefox/121.0", "curl/8.4.0"),
+				"message":     fmt.Sprintf("%s %s %d", method, path, status),
+			}
+		},
+	},
+	"ecommerce": {
+		Name:        "ecommerce",
+		Description: "Orders of an online shop over the last month",
+		Index:       "sample-ecommerce",
+		seed:        2,
+		Docs:        2000,
+		Mappings: map[string]interface{}{
+			"properties": map[string]interface{}{
+				"order_id":   mappedAs("keyword"),
+				"order_date": mappedAs("date"),
+				"status":     mappedAs("keyword"),
+				"customer": map[string]interface{}{
+					"properties": map[string]interface{}{
+						"name":    map[string]interface{}{"type": "text", "fields": map[string]interface{}{"keyword": mappedAs("keyword")}},
+						"email":   mappedAs("keyword"),
+						"country": mappedAs("keyword"),
+					},
+				},
+				"products": map[string]interface{}{
+					"type": "nested",
+					"properties": map[string]interface{}{
+						"name":     map[string]interface{}{"type": "text", "fields": map[string]interface{}{"keyword": mappedAs("keyword")}},
+						"category": mappedAs("keyword"),
+						"price":    map[string]interface{}{"type": "scaled_float", "scaling_factor": 100},
+						"quantity": mappedAs("integer"),
+					},
+				},
+				"total":    mappedAs("double"),
+				"currency": mappedAs("keyword"),
+			},
+		},
+		generate: func(rng *rand.Rand, now time.Time) map[string]interface{} {
+			first := pickOne(rng, "Ada", "Grace", "Alan", "Linus", "Margaret", "Ken", "Barbara", "Dennis")
+			last := pickOne(rng, "Lovelace", "Hopper", "Turing", "Torvalds", "Hamilton", "Thompson", "Liskov", "Ritchie")
+			products := []interface{}{}
+			total := 0.0
+			for i := rng.Intn(4); i >= 0; i-- {
+				category := pickOne(rng, "books", "electronics", "clothing", "garden", "toys")
+				price := float64(rng.Intn(20000)+199) / 100
+				quantity := rng.Intn(3) + 1
+				total += price * float64(quantity)
+				products = append(products, map[string]interface{}{
+					"name":     fmt.Sprintf("%s %s %d", pickOne(rng, "Classic", "Deluxe", "Compact", "Smart", "Organic"), category, rng.Intn(100)),
+					"category": category,
+					"price":    price,
+					"quantity": quantity,
+				})
+			}
+			return map[string]interface{}{
+				"order_id":   fmt.Sprintf("ORD-%08d", rng.Intn(100000000)),
+				"order_date": now.Add(-time.Duration(rng.Int63n(int64(30 * 24 * time.Hour)))).Format(time.RFC3339),
+				"status":     pickOne(rng, "placed", "paid", "paid", "shipped", "shipped", "delivered", "cancelled"),
+				"customer": map[string]interface{}{
+					"name":    first + " " + last,
+					"email":   strings.ToLower(first + "." + last + "@example.com"),
+					"country": pickOne(rng, "US", "FR", "DE", "GB", "IN", "BR", "JP", "CA"),
+				},
+				"products": products,
+				"total":    float64(int(total*100)) / 100,
+				"currency": "USD",
+			}
+		},
+	},
+}
+
+//datasetsHandler lists the catalog of example datasets.
+func datasetsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	list := make([]*Dataset, 0, len(datasets))
+	for _, d := range datasets {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"datasets": list})
+}
+
+//loadDatasetHandler creates the index of a dataset (its default name, or the
+//index parameter) on the default cluster or the environment named by the
+//cluster parameter, then bulk loads the documents. The documents go through
+//the document schemas like any bulk. An existing index is refused with 409,
+//unless replace=true deletes it first.
+func loadDatasetHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	d, ok := datasets[name]
+	if !ok {
+		http.Error(w, "unknown dataset "+name, http.StatusNotFound)
+		return
+	}
+	params := r.URL.Query()
+	load := DatasetLoad{Dataset: name, Cluster: params.Get("cluster"), Index: d.Index}
+	if len(params.Get("index")) != 0 {
+		load.Index = params.Get("index")
+	}
+	es, err := defaultClient()
+	if len(load.Cluster) != 0 {
+		cluster, ok := config.Environments[load.Cluster]
+		if !ok {
+			http.Error(w, "unknown environment "+load.Cluster, http.StatusBadRequest)
+			return
+		}
+		es, err = clusterClient(cluster)
+	} else {
+		load.Cluster = "default"
+	}
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	start := time.Now()
+	status, err := createDatasetIndex(r.Context(), es, d, load.Index, params.Get("replace") == "true")
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create dataset index", "index", load.Index, "error", err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if err := loadDataset(r.Context(), es, d, &load, actor(r)); err != nil {
+		logger.ErrorContext(r.Context(), "error loading dataset", "dataset", name, "index", load.Index, "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	load.Millis = time.Since(start).Milliseconds()
+	logger.InfoContext(r.Context(), "dataset loaded", "dataset", name, "index", load.Index, "cluster", load.Cluster, "indexed", load.Indexed, "actor", actor(r))
+	writeJSON(w, http.StatusOK, load)
+}
+
+//createDatasetIndex creates the index with the mappings of the dataset. The
+//status to answer with is returned with the error.
+func createDatasetIndex(ctx context.Context, es *elasticsearch.Client, d *Dataset, index string, replace bool) (int, error) {
+	if replace {
+		res, err := es.Indices.Delete([]string{index}, es.Indices.Delete.WithContext(ctx))
+		if err != nil {
+			return http.StatusBadGateway, err
+		}
+		res.Body.Close()
+		if res.IsError() && res.StatusCode != http.StatusNotFound {
+			return http.StatusBadGateway, fmt.Errorf("delete index %s: %s", index, res.Status())
+		}
+	}
+	buf, err := encodeBody(map[string]interface{}{"mappings": d.Mappings})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	res, err := es.Indices.Create(index, es.Indices.Create.WithContext(ctx), es.Indices.Create.WithBody(buf))
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusBadRequest {
+		var e ErrorResponse
+		if json.NewDecoder(res.Body).Decode(&e) == nil && e.Error.Type == "resource_already_exists_exception" {
+			return http.StatusConflict, fmt.Errorf("index %s already exists, load with replace=true to overwrite it", index)
+		}
+	}
+	if res.IsError() {
+		return http.StatusBadGateway, fmt.Errorf("create index %s: %s", index, res.Status())
+	}
+	return http.StatusOK, nil
+}
+
+//loadDataset generates the documents of the dataset and bulk loads them in
+//batches, the last one refreshing the index so they are searchable at once.
+func loadDataset(ctx context.Context, es *elasticsearch.Client, d *Dataset, load *DatasetLoad, by string) error {
+	rng := rand.New(rand.NewSource(d.seed))
+	now := time.Now().UTC()
+	for sent := 0; sent < d.Docs; sent += datasetBatch {
+		var body bytes.Buffer
+		for i := sent; i < sent+datasetBatch && i < d.Docs; i++ {
+			source, err := json.Marshal(d.generate(rng, now))
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(&body, `{"index":{"_id":"%d"}}`+"\n", i+1)
+			body.Write(source)
+			body.WriteByte('\n')
+		}
+		screened, dropped, err := screenBulk(ctx, es, load.Index, body.Bytes(), by)
+		if err != nil {
+			return err
+		}
+		load.DeadLettered += dropped
+		if len(screened) == 0 {
+			continue
+		}
+		opts := []func(*esapi.BulkRequest){es.Bulk.WithContext(ctx), es.Bulk.WithIndex(load.Index)}
+		if sent+datasetBatch >= d.Docs {
+			opts = append(opts, es.Bulk.WithRefresh("true"))
+		}
+		res, err := es.Bulk(bytes.NewReader(screened), opts...)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			Items []map[string]struct {
+				Status int `json:"status"`
+			} `json:"items"`
+		}
+		if err := decodeAdminResponse(res.IsError(), res.Status(), res.Body, &result); err != nil {
+			return err
+		}
+		for _, item := range result.Items {
+			for _, outcome := range item {
+				if outcome.Status >= http.StatusMultipleChoices {
+					load.Failed++
+				} else {
+					load.Indexed++
+				}
+			}
+		}
+	}
+	return nil
+}
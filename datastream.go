@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+
+	"github.com/gorilla/mux"
+)
+
+//DataStreamConfig lists the patterns of the names written as data streams,
+//those of the index templates with a data_stream section. Data streams only
+//take new documents, so the index actions of bulk bodies and the document
+//PUTs on these names are sent as creates.
+type DataStreamConfig struct {
+	Patterns []string `json:"patterns"`
+}
+
+//backingIndexRe matches the backing indices of data streams:
+//.ds-<stream>-<yyyy.MM.dd>-<generation>.
+var backingIndexRe = regexp.MustCompile(`^\.ds-(.+)-\d{4}\.\d{2}\.\d{2}-\d{6}$`)
+
+//isDataStream tells whether documents written to name go to a data stream.
+func isDataStream(name string) bool {
+	for _, pattern := range config.DataStreams.Patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//backingStream returns the data stream a backing index belongs to, the way
+//hits name it in _index, or "" for other indices.
+func backingStream(index string) string {
+	if m := backingIndexRe.FindStringSubmatch(index); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+//dataStreamsHandler lists the data streams, or those matching the name
+//pattern, with their backing indices and generation.
+func dataStreamsHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	var indices []string
+	if len(name) != 0 {
+		indices = []string{name}
+	}
+	if !checkAccess(w, r, opSearch, indices) {
+		return
+	}
+	p := "/_data_stream"
+	if len(name) != 0 {
+		p += "/" + url.PathEscape(name)
+	}
+	passthrough(w, r, http.MethodGet, p, forwardParams(r, "expand_wildcards"), nil)
+}
+
+//putDataStreamHandler creates a data stream. A matching index template with
+//a data_stream section must exist; writing the first document to the stream
+//creates it as well.
+func putDataStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	logger.InfoContext(r.Context(), "data stream created", "data_stream", name, "actor", actor(r))
+	passthrough(w, r, http.MethodPut, "/_data_stream/"+url.PathEscape(name), nil, nil)
+}
+
+//deleteDataStreamHandler removes a data stream with all its backing indices.
+func deleteDataStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	logger.InfoContext(r.Context(), "data stream deleted", "data_stream", name, "actor", actor(r))
+	passthrough(w, r, http.MethodDelete, "/_data_stream/"+url.PathEscape(name), forwardParams(r, "expand_wildcards"), nil)
+}
+
+//rolloverDataStreamHandler starts a new backing index for a data stream, at
+//once or, with the conditions of the body (max_age, max_docs...), only when
+//one is met. dry_run=true tells what would happen.
+func rolloverDataStreamHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !checkAccess(w, r, opAdmin, []string{name}) {
+		return
+	}
+	logger.InfoContext(r.Context(), "data stream rolled over", "data_stream", name, "actor", actor(r))
+	passthrough(w, r, http.MethodPost, "/"+url.PathEscape(name)+"/_rollover", forwardParams(r, "dry_run", "wait_for_active_shards"), r.Body)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//Degradation levels, each including the ones below: serve expired cached
+//responses, cap search sizes, drop aggregations, shed non-interactive traffic.
+const (
+	levelNormal = iota
+	levelStale
+	levelReducedSize
+	levelNoAggregations
+	levelShed
+)
+
+var levelNames = []string{"normal", "stale", "reduced_size", "no_aggregations", "shed"}
+
+//DegradationConfig degrades the service step by step while elastic search
+//fails. The error rate of the calls to elastic search over Window, once
+//MinCalls were made, sets the level: Thresholds are the rates from which
+//levels 1 to 4 apply. A level is only left after Hold, so the service does
+//not flap during a brownout.
+type DegradationConfig struct {
+	Enabled    bool      `json:"enabled"`
+	Window     Duration  `json:"window"`
+	MinCalls   int       `json:"min_calls"`
+	Thresholds []float64 `json:"thresholds"`
+	Hold       Duration  `json:"hold"`
+	//ReducedSize caps the size of searches from level 2
+	ReducedSize int `json:"reduced_size"`
+	//NonInteractive lists the route templates shed at level 4
+	NonInteractive []string `json:"non_interactive"`
+}
+
+type callBucket struct {
+	second int64
+	calls  int
+	errors int
+}
+
+//degradation tracks the outcome of the calls to elastic search, per second.
+type degradation struct {
+	mu      sync.Mutex
+	buckets []callBucket
+	level   int
+	raised  time.Time
+}
+
+var brownout = &degradation{}
+
+//observe counts a call to elastic search.
+func (d *degradation) observe(failed bool, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := now.Unix()
+	if n := len(d.buckets); n == 0 || d.buckets[n-1].second != s {
+		d.buckets = append(d.buckets, callBucket{second: s})
+	}
+	b := &d.buckets[len(d.buckets)-1]
+	b.calls++
+	if failed {
+		b.errors++
+	}
+}
+
+//rate returns the error rate and number of calls over the window. The caller
+//holds the lock.
+func (d *degradation) rate(now time.Time) (float64, int) {
+	cutoff := now.Add(-config.Degradation.Window.Duration).Unix()
+	i := 0
+	for i < len(d.buckets) && d.buckets[i].second <= cutoff {
+		i++
+	}
+	d.buckets = d.buckets[i:]
+	calls, errors := 0, 0
+	for _, b := range d.buckets {
+		calls += b.calls
+		errors += b.errors
+	}
+	if calls == 0 {
+		return 0, 0
+	}
+	return float64(errors) / float64(calls), calls
+}
+
+//current returns the level of degradation, with the error rate and number of
+//calls it is based on.
+func (d *degradation) current(now time.Time) (level int, rate float64, calls int) {
+	if !config.Degradation.Enabled {
+		return levelNormal, 0, 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	rate, calls = d.rate(now)
+	target := levelNormal
+	if calls >= config.Degradation.MinCalls {
+		for i, threshold := range config.Degradation.Thresholds {
+			if rate >= threshold && i+1 <= levelShed {
+				target = i + 1
+			}
+		}
+	}
+	switch {
+	case target > d.level:
+		logger.Warn("degradation level raised", "level", levelNames[target], "error_rate", rate, "calls", calls)
+		d.level, d.raised = target, now
+	case target < d.level && now.Sub(d.raised) >= config.Degradation.Hold.Duration:
+		logger.Info("degradation level lowered", "level", levelNames[target], "error_rate", rate, "calls", calls)
+		d.level, d.raised = target, now
+	}
+	return d.level, rate, calls
+}
+
+func degradationLevel() int {
+	level, _, _ := brownout.current(time.Now())
+	return level
+}
+
+//degradationTransport counts the failures of the calls to elastic search:
+//transport errors, rejections and server errors.
+type degradationTransport struct {
+	base http.RoundTripper
+}
+
+func (t degradationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	failed := err != nil || res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= http.StatusInternalServerError
+	brownout.observe(failed, time.Now())
+	return res, err
+}
+
+//degrade applies the size and aggregation steps of the level to a search.
+//It returns what was changed, for the meta section.
+func degrade(level int, q interface{}, size *int) (interface{}, []string) {
+	var applied []string
+	if level >= levelReducedSize && *size > config.Degradation.ReducedSize {
+		*size = config.Degradation.ReducedSize
+		applied = append(applied, levelNames[levelReducedSize])
+	}
+	if level >= levelNoAggregations {
+		if body, ok := searchBody(q); ok {
+			_, aggs := body["aggs"]
+			_, aggregations := body["aggregations"]
+			if aggs || aggregations {
+				delete(body, "aggs")
+				delete(body, "aggregations")
+				q = body
+				applied = append(applied, levelNames[levelNoAggregations])
+			}
+		}
+	}
+	return q, applied
+}
+
+//DegradationMid sheds the non-interactive routes at the last level and tells
+//every caller the level in the X-Degradation-Level header.
+func DegradationMid(app http.Handler) http.Handler {
+	shed := map[string]bool{}
+	for _, route := range config.Degradation.NonInteractive {
+		shed[route] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		level := degradationLevel()
+		if level == levelNormal {
+			app.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("X-Degradation-Level", levelNames[level])
+		if level >= levelShed && shed[routeTemplate(r)] {
+			w.Header().Set("Retry-After", strconv.Itoa(int(config.Degradation.Hold.Seconds())))
+			logger.WarnContext(r.Context(), "shedding non-interactive traffic", "route", routeTemplate(r))
+			http.Error(w, "service degraded, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		app.ServeHTTP(w, r)
+	})
+}
+
+//DegradationState is the current level of degradation.
+type DegradationState struct {
+	Level     int     `json:"level"`
+	Name      string  `json:"name"`
+	ErrorRate float64 `json:"error_rate"`
+	Calls     int     `json:"calls"`
+}
+
+//degradationHandler reports the current level and the error rate behind it.
+func degradationHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	level, rate, calls := brownout.current(time.Now())
+	writeJSON(w, http.StatusOK, DegradationState{Level: level, Name: levelNames[level], ErrorRate: rate, Calls: calls})
+}
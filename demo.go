@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+)
+
+//DemoConfig lists the fields scrambled in demo mode. The same input always
+//scrambles to the same output for a given secret, so joins and counts still
+//look right on screen. Always forces the mode on for every search.
+type DemoConfig struct {
+	Fields []string `json:"fields"`
+	Secret string   `json:"secret"`
+	Always bool     `json:"always"`
+}
+
+//anonymizeHits scrambles the configured fields in the _source of every hit.
+//Highlighted fragments of those fields would give the originals away, so
+//they are dropped.
+func anonymizeHits(response *SearchResponse) {
+	for _, hit := range response.Hits.Hits {
+		for _, field := range config.Demo.Fields {
+			for name := range hit.Highlight {
+				if name == field || strings.HasPrefix(name, field+".") {
+					delete(hit.Highlight, name)
+				}
+			}
+			if hit.Source != nil {
+				scrambleField(hit.Source, strings.Split(field, "."))
+			}
+		}
+	}
+}
+
+func scrambleField(doc map[string]interface{}, path []string) {
+	v, ok := doc[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) > 1 {
+		for _, child := range asList(v) {
+			if m, ok := child.(map[string]interface{}); ok {
+				scrambleField(m, path[1:])
+			}
+		}
+		return
+	}
+	if list, ok := v.([]interface{}); ok {
+		for i := range list {
+			list[i] = scramble(list[i])
+		}
+		return
+	}
+	doc[path[0]] = scramble(v)
+}
+
+func asList(v interface{}) []interface{} {
+	if list, ok := v.([]interface{}); ok {
+		return list
+	}
+	return []interface{}{v}
+}
+
+//scramble keeps the shape of a value (length, case, spaces, email form,
+//number of digits) while replacing its content.
+func scramble(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		if at := strings.LastIndex(v, "@"); at > 0 {
+			return scrambleText(v[:at], v) + "@example.com"
+		}
+		return scrambleText(v, v)
+	case float64:
+		digits := len(fmt.Sprintf("%.0f", math.Abs(v)))
+		lo, hi := math.Pow10(digits-1), math.Pow10(digits)
+		if digits == 1 {
+			lo = 0
+		}
+		n := lo + float64(demoHash(fmt.Sprint(v))%uint64(hi-lo))
+		if v < 0 {
+			n = -n
+		}
+		return n
+	default:
+		return v
+	}
+}
+
+func scrambleText(s, seed string) string {
+	h := demoHash(seed)
+	out := []rune(s)
+	for i, r := range out {
+		h = h*6364136223846793005 + 1442695040888963407
+		pick := rune(h >> 59)
+		switch {
+		case unicode.IsUpper(r):
+			out[i] = 'A' + pick%26
+		case unicode.IsLetter(r):
+			out[i] = 'a' + pick%26
+		case unicode.IsDigit(r):
+			out[i] = '0' + pick%10
+		}
+	}
+	return string(out)
+}
+
+func demoHash(s string) uint64 {
+	mac := hmac.New(sha256.New, []byte(config.Demo.Secret))
+	mac.Write([]byte(s))
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
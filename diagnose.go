@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch"
+	"github.com/gorilla/mux"
+)
+
+//ShardTiming is the time one shard spent on the profiled query.
+type ShardTiming struct {
+	Index    string  `json:"index"`
+	Shard    string  `json:"shard"`
+	Node     string  `json:"node"`
+	NodeName string  `json:"node_name"`
+	Primary  bool    `json:"primary"`
+	TimeMS   float64 `json:"time_ms"`
+}
+
+//NodeTiming sums the shard timings of one node.
+type NodeTiming struct {
+	Node   string  `json:"node"`
+	Name   string  `json:"name"`
+	Shards int     `json:"shards"`
+	TimeMS float64 `json:"time_ms"`
+}
+
+//Diagnosis tells which shards and nodes dominate the latency of a query,
+//slowest first, next to the shards the query could be routed to.
+type Diagnosis struct {
+	Took   int64         `json:"took"`
+	Shards []ShardTiming `json:"shards"`
+	Nodes  []NodeTiming  `json:"nodes"`
+	Routed int           `json:"routed_shards"`
+}
+
+type shardCopy struct {
+	Node    string `json:"node"`
+	Primary bool   `json:"primary"`
+	Index   string `json:"index"`
+	Shard   int    `json:"shard"`
+}
+
+//searchShards returns the node names and the copies of every shard of the indices.
+func searchShards(ctx context.Context, es *elasticsearch.Client, index []string) (nodes map[string]string, shards [][]shardCopy, err error) {
+	res, err := es.SearchShards(es.SearchShards.WithContext(ctx), es.SearchShards.WithIndex(index...))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, nil, fmt.Errorf("search shards %v: %s", index, res.String())
+	}
+	var result struct {
+		Nodes map[string]struct {
+			Name string `json:"name"`
+		} `json:"nodes"`
+		Shards [][]shardCopy `json:"shards"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, nil, err
+	}
+	nodes = map[string]string{}
+	for id, n := range result.Nodes {
+		nodes[id] = n.Name
+	}
+	return nodes, result.Shards, nil
+}
+
+type profiledTime struct {
+	TimeInNanos int64 `json:"time_in_nanos"`
+}
+
+//diagnose runs the query with profiling and attributes its time to shards and nodes.
+func diagnose(ctx context.Context, es *elasticsearch.Client, index []string, query map[string]interface{}) (Diagnosis, error) {
+	nodes, shards, err := searchShards(ctx, es, index)
+	if err != nil {
+		return Diagnosis{}, err
+	}
+	primaries := map[string]bool{}
+	for _, copies := range shards {
+		for _, c := range copies {
+			primaries[fmt.Sprintf("%s/%s/%d", c.Node, c.Index, c.Shard)] = c.Primary
+		}
+	}
+
+	query["profile"] = true
+	var result struct {
+		Took    int64 `json:"took"`
+		Profile struct {
+			Shards []struct {
+				ID       string `json:"id"`
+				Searches []struct {
+					Query     []profiledTime `json:"query"`
+					Rewrite   int64          `json:"rewrite_time"`
+					Collector []profiledTime `json:"collector"`
+				} `json:"searches"`
+				Aggregations []profiledTime `json:"aggregations"`
+			} `json:"shards"`
+		} `json:"profile"`
+	}
+	if err := searchInto(ctx, es, index, query, &result); err != nil {
+		return Diagnosis{}, err
+	}
+
+	d := Diagnosis{Took: result.Took, Routed: len(shards)}
+	byNode := map[string]*NodeTiming{}
+	for _, s := range result.Profile.Shards {
+		//shard ids look like [nodeId][index][shard]
+		parts := strings.Split(strings.Trim(s.ID, "[]"), "][")
+		if len(parts) != 3 {
+			continue
+		}
+		var nanos int64
+		for _, search := range s.Searches {
+			nanos += search.Rewrite
+			for _, t := range search.Query {
+				nanos += t.TimeInNanos
+			}
+			for _, t := range search.Collector {
+				nanos += t.TimeInNanos
+			}
+		}
+		for _, t := range s.Aggregations {
+			nanos += t.TimeInNanos
+		}
+		timing := ShardTiming{
+			Node:     parts[0],
+			Index:    parts[1],
+			Shard:    parts[2],
+			NodeName: nodes[parts[0]],
+			Primary:  primaries[parts[0]+"/"+parts[1]+"/"+parts[2]],
+			TimeMS:   float64(nanos) / 1e6,
+		}
+		d.Shards = append(d.Shards, timing)
+		n, ok := byNode[timing.Node]
+		if !ok {
+			n = &NodeTiming{Node: timing.Node, Name: timing.NodeName}
+			byNode[timing.Node] = n
+		}
+		n.Shards++
+		n.TimeMS += timing.TimeMS
+	}
+	sort.Slice(d.Shards, func(i, j int) bool { return d.Shards[i].TimeMS > d.Shards[j].TimeMS })
+	for _, n := range byNode {
+		d.Nodes = append(d.Nodes, *n)
+	}
+	sort.Slice(d.Nodes, func(i, j int) bool { return d.Nodes[i].TimeMS > d.Nodes[j].TimeMS })
+	return d, nil
+}
+
+//diagnoseHandler profiles the query of the body (match_all without one) on
+//the indices of the path and reports where the time went.
+func diagnoseHandler(w http.ResponseWriter, r *http.Request) {
+	index := strings.Split(mux.Vars(r)["index"], ",")
+	if !checkAccess(w, r, opAdmin, index) {
+		return
+	}
+	query := map[string]interface{}{}
+	if err := json.NewDecoder(r.Body).Decode(&query); err != nil && err != io.EOF {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	d, err := diagnose(r.Context(), es, index, query)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error diagnosing query", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, d)
+}
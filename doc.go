@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/elastic/go-elasticsearch/esapi"
+	"github.com/gorilla/mux"
+)
+
+//deleteDocHandler removes a single document, or only marks it as deleted
+//when soft delete is enabled for its index.
+func deleteDocHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !checkAccess(w, r, opWrite, []string{vars["index"]}) {
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if config.History.Enabled {
+		if err := recordHistory(r.Context(), es, vars["index"], vars["id"], "delete", actor(r)); err != nil {
+			logger.ErrorContext(r.Context(), "unable to record document history", "error", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	//the other indices are never purged, their documents are deleted right away
+	if !softDeletes(r.Context(), vars["index"]) {
+		res, err := es.Delete(vars["index"], vars["id"], es.Delete.WithContext(r.Context()))
+		if err != nil {
+			logger.ErrorContext(r.Context(), "error deleting document", "error", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		writeResponse(w, res)
+		return
+	}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(deletedMarker(actor(r))); err != nil {
+		logger.ErrorContext(r.Context(), "error encoding deleted marker", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res, err := es.Update(vars["index"], vars["id"], &buf, es.Update.WithContext(r.Context()))
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error marking document as deleted", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeResponse(w, res)
+}
+
+//putDocHandler creates or replaces a single document with the request body,
+//once checked against the schema of the index. The pipeline parameter names
+//the ingest pipeline to run the document through.
+func putDocHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !checkAccess(w, r, opWrite, []string{vars["index"]}) {
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	source, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to read request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkDoc(r.Context(), es, vars["index"], source); err != nil {
+		invalid, ok := err.(*DocSchemaError)
+		if !ok {
+			logger.ErrorContext(r.Context(), "unable to read document schema", "error", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if config.DocSchemas.OnInvalid != "dlq" {
+			writeJSON(w, http.StatusUnprocessableEntity, invalid)
+			return
+		}
+		if err := deadLetter(r.Context(), es, vars["id"], source, invalid, actor(r)); err != nil {
+			logger.ErrorContext(r.Context(), "unable to store dead letter", "error", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		logger.WarnContext(r.Context(), "document moved to the dead letter index", "index", vars["index"], "id", vars["id"])
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{"result": "dead_lettered", "index": vars["index"], "errors": invalid.Errors})
+		return
+	}
+	//only a write that goes through replaces the version being recorded
+	if config.History.Enabled {
+		if err := recordHistory(r.Context(), es, vars["index"], vars["id"], "update", actor(r)); err != nil {
+			logger.ErrorContext(r.Context(), "unable to record document history", "error", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	opts := []func(*esapi.IndexRequest){
+		es.Index.WithContext(r.Context()),
+		es.Index.WithDocumentID(vars["id"]),
+	}
+	if pipeline := r.URL.Query().Get("pipeline"); len(pipeline) != 0 {
+		opts = append(opts, es.Index.WithPipeline(pipeline))
+	}
+	if isDataStream(vars["index"]) {
+		opts = append(opts, es.Index.WithOpType("create"))
+	}
+	res, err := es.Index(vars["index"], bytes.NewReader(source), opts...)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error indexing document", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeResponse(w, res)
+}
@@ -0,0 +1,676 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch"
+	"github.com/gorilla/mux"
+)
+
+//DocSchemaConfig stores, per index, the JSON Schema the documents written
+//through the gateway must conform to. OnInvalid is reject (the write fails)
+//or dlq (the document is kept in DeadLetterIndex instead of its index).
+type DocSchemaConfig struct {
+	Index           string   `json:"index"`
+	Refresh         Duration `json:"refresh"`
+	OnInvalid       string   `json:"on_invalid"`
+	DeadLetterIndex string   `json:"dead_letter_index"`
+}
+
+//DocSchema is the JSON Schema registered for an index.
+type DocSchema struct {
+	Index     string                 `json:"index"`
+	Schema    map[string]interface{} `json:"schema"`
+	Actor     string                 `json:"actor"`
+	Timestamp string                 `json:"timestamp"`
+}
+
+//DeadLetter is a document refused by the schema of its index, as stored in
+//the dead letter index.
+type DeadLetter struct {
+	Index     string            `json:"index"`
+	ID        string            `json:"id,omitempty"`
+	Source    json.RawMessage   `json:"source"`
+	Errors    []ValidationError `json:"errors"`
+	Actor     string            `json:"actor"`
+	Timestamp string            `json:"timestamp"`
+}
+
+//DocSchemaError is returned when a document does not conform to the schema
+//of its index.
+type DocSchemaError struct {
+	Index  string            `json:"index"`
+	Errors []ValidationError `json:"errors"`
+}
+
+func (e *DocSchemaError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return "document does not match the schema of " + e.Index + ": " + strings.Join(msgs, "; ")
+}
+
+type docSchemaEntry struct {
+	at     time.Time
+	schema map[string]interface{}
+}
+
+var (
+	docSchemasMu    sync.Mutex
+	docSchemasCache = map[string]docSchemaEntry{}
+	schemaPatterns  sync.Map
+)
+
+//docSchemaMapping keeps the schemas and refused documents out of the mappings,
+//their keys would otherwise clash (a property named type...).
+var docSchemaMapping = map[string]interface{}{
+	"mappings": map[string]interface{}{
+		"properties": map[string]interface{}{
+			"index":     map[string]interface{}{"type": "keyword"},
+			"schema":    map[string]interface{}{"type": "object", "enabled": false},
+			"actor":     map[string]interface{}{"type": "keyword"},
+			"timestamp": map[string]interface{}{"type": "date"},
+		},
+	},
+}
+
+var deadLetterMapping = map[string]interface{}{
+	"mappings": map[string]interface{}{
+		"properties": map[string]interface{}{
+			"index":     map[string]interface{}{"type": "keyword"},
+			"id":        map[string]interface{}{"type": "keyword"},
+			"source":    map[string]interface{}{"type": "object", "enabled": false},
+			"errors":    map[string]interface{}{"type": "object", "enabled": false},
+			"actor":     map[string]interface{}{"type": "keyword"},
+			"timestamp": map[string]interface{}{"type": "date"},
+		},
+	},
+}
+
+func ensureMappedIndex(ctx context.Context, es *elasticsearch.Client, index string, mapping map[string]interface{}) {
+	ensureOnce(ctx, index, func() {
+		buf, err := encodeBody(mapping)
+		if err != nil {
+			logger.ErrorContext(ctx, "error encoding mapping", "index", index, "error", err)
+			return
+		}
+		res, err := es.Indices.Create(index,
+			es.Indices.Create.WithContext(ctx),
+			es.Indices.Create.WithBody(buf),
+		)
+		if err != nil {
+			logger.ErrorContext(ctx, "unable to create index", "index", index, "error", err)
+			return
+		}
+		res.Body.Close()
+	})
+}
+
+//docSchema returns the schema registered for an index, nil when there is
+//none. Lookups are cached for the refresh interval.
+func docSchema(ctx context.Context, es *elasticsearch.Client, index string) (map[string]interface{}, error) {
+	key := tenantScope(ctx, index)
+	docSchemasMu.Lock()
+	e, ok := docSchemasCache[key]
+	docSchemasMu.Unlock()
+	if ok && time.Since(e.at) < config.DocSchemas.Refresh.Duration {
+		return e.schema, nil
+	}
+	ensureMappedIndex(ctx, es, config.DocSchemas.Index, docSchemaMapping)
+	doc, err := getDoc(ctx, es, config.DocSchemas.Index, index)
+	if err != nil {
+		return nil, err
+	}
+	var stored DocSchema
+	if doc.Found {
+		if err := json.Unmarshal(doc.Source, &stored); err != nil {
+			return nil, err
+		}
+	}
+	docSchemasMu.Lock()
+	docSchemasCache[key] = docSchemaEntry{at: time.Now(), schema: stored.Schema}
+	docSchemasMu.Unlock()
+	return stored.Schema, nil
+}
+
+//checkDoc validates a document against the schema of its index. Documents of
+//indices without a schema are accepted as they are.
+func checkDoc(ctx context.Context, es *elasticsearch.Client, index string, source []byte) error {
+	schema, err := docSchema(ctx, es, index)
+	if err != nil || schema == nil {
+		return err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(source, &doc); err != nil {
+		return &DocSchemaError{Index: index, Errors: []ValidationError{{Path: "/", Message: "invalid JSON: " + err.Error()}}}
+	}
+	if errs := validateDoc(schema, doc); len(errs) != 0 {
+		return &DocSchemaError{Index: index, Errors: errs}
+	}
+	return nil
+}
+
+//deadLetter stores a refused document in the dead letter index.
+func deadLetter(ctx context.Context, es *elasticsearch.Client, id string, source []byte, invalid *DocSchemaError, by string) error {
+	ensureMappedIndex(ctx, es, config.DocSchemas.DeadLetterIndex, deadLetterMapping)
+	if !json.Valid(source) {
+		quoted, _ := json.Marshal(string(source))
+		source = quoted
+	}
+	buf, err := encodeBody(DeadLetter{
+		Index:     invalid.Index,
+		ID:        id,
+		Source:    source,
+		Errors:    invalid.Errors,
+		Actor:     by,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	res, err := es.Index(config.DocSchemas.DeadLetterIndex, buf, es.Index.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("dead letter of %s: %s", invalid.Index, res.Status())
+	}
+	return nil
+}
+
+//screenBulk validates the sources of the index and create actions of a bulk
+//body. Invalid documents fail the whole bulk, or are moved to the dead letter
+//index and dropped from the body, which is returned with the number dropped.
+//Update actions carry partial documents and are not validated. Index actions
+//on data streams are turned into creates.
+func screenBulk(ctx context.Context, es *elasticsearch.Client, defaultIndex string, body []byte, by string) ([]byte, int, error) {
+	var out bytes.Buffer
+	var action []byte
+	index, id, check := "", "", false
+	dropped := 0
+	for i, line := range bytes.Split(body, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if action == nil {
+			var a map[string]struct {
+				Index string `json:"_index"`
+				ID    string `json:"_id"`
+			}
+			if err := json.Unmarshal(line, &a); err != nil {
+				return nil, 0, fmt.Errorf("line %d: invalid bulk action", i+1)
+			}
+			for op, meta := range a {
+				index, id, check = meta.Index, meta.ID, op == "index" || op == "create"
+				if len(index) == 0 {
+					index = defaultIndex
+				}
+				if op == "delete" {
+					out.Write(line)
+					out.WriteByte('\n')
+					continue
+				}
+				if op == "index" && isDataStream(index) {
+					var raw map[string]json.RawMessage
+					if err := json.Unmarshal(line, &raw); err != nil {
+						return nil, 0, fmt.Errorf("line %d: invalid bulk action", i+1)
+					}
+					create, err := json.Marshal(map[string]json.RawMessage{"create": raw[op]})
+					if err != nil {
+						return nil, 0, err
+					}
+					line = create
+				}
+				action = line
+			}
+			continue
+		}
+		source := line
+		line, action = action, nil
+		if check {
+			err := checkDoc(ctx, es, index, source)
+			var invalid *DocSchemaError
+			if e, ok := err.(*DocSchemaError); ok {
+				invalid = e
+			} else if err != nil {
+				return nil, 0, err
+			}
+			if invalid != nil && config.DocSchemas.OnInvalid != "dlq" {
+				return nil, 0, fmt.Errorf("line %d: %w", i+1, invalid)
+			}
+			if invalid != nil {
+				if err := deadLetter(ctx, es, id, source, invalid, by); err != nil {
+					return nil, 0, err
+				}
+				dropped++
+				continue
+			}
+		}
+		out.Write(line)
+		out.WriteByte('\n')
+		out.Write(source)
+		out.WriteByte('\n')
+	}
+	return out.Bytes(), dropped, nil
+}
+
+//validateDoc checks doc against a JSON Schema and returns every violation,
+//with the JSON pointer of the offending value. The keywords of draft 2020-12
+//about types, objects, arrays, numbers, strings and combinations are
+//supported, references ($ref) are not.
+func validateDoc(schema map[string]interface{}, doc interface{}) []ValidationError {
+	var errs []ValidationError
+	validateValue(schema, doc, "", &errs)
+	return errs
+}
+
+func validateValue(schema map[string]interface{}, v interface{}, path string, errs *[]ValidationError) {
+	fail := func(format string, args ...interface{}) {
+		p := path
+		if len(p) == 0 {
+			p = "/"
+		}
+		*errs = append(*errs, ValidationError{Path: p, Message: fmt.Sprintf(format, args...)})
+	}
+	if t, ok := schema["type"]; ok {
+		types := []interface{}{t}
+		if list, ok := t.([]interface{}); ok {
+			types = list
+		}
+		match := false
+		for _, t := range types {
+			if name, _ := t.(string); jsonTypeMatches(name, v) {
+				match = true
+			}
+		}
+		if !match {
+			fail("expected %v, got %s", t, jsonType(v))
+			return
+		}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if jsonEqual(e, v) {
+				found = true
+			}
+		}
+		if !found {
+			fail("must be one of %v", enum)
+		}
+	}
+	if c, ok := schema["const"]; ok && !jsonEqual(c, v) {
+		fail("must be %v", c)
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		props, _ := schema["properties"].(map[string]interface{})
+		for _, name := range stringList(schema["required"]) {
+			if _, ok := v[name]; !ok {
+				fail("%s is required", name)
+			}
+		}
+		for _, name := range sortedKeys(v) {
+			p := path + "/" + escapePointer(name)
+			if sub, ok := props[name].(map[string]interface{}); ok {
+				validateValue(sub, v[name], p, errs)
+				continue
+			}
+			switch extra := schema["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					*errs = append(*errs, ValidationError{Path: p, Message: "unexpected property"})
+				}
+			case map[string]interface{}:
+				validateValue(extra, v[name], p, errs)
+			}
+		}
+		if n, ok := schemaNumber(schema, "minProperties"); ok && float64(len(v)) < n {
+			fail("must have at least %v properties", n)
+		}
+		if n, ok := schemaNumber(schema, "maxProperties"); ok && float64(len(v)) > n {
+			fail("must have at most %v properties", n)
+		}
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				validateValue(items, item, fmt.Sprintf("%s/%d", path, i), errs)
+			}
+		}
+		if n, ok := schemaNumber(schema, "minItems"); ok && float64(len(v)) < n {
+			fail("must have at least %v items", n)
+		}
+		if n, ok := schemaNumber(schema, "maxItems"); ok && float64(len(v)) > n {
+			fail("must have at most %v items", n)
+		}
+		if unique, _ := schema["uniqueItems"].(bool); unique {
+			for i := range v {
+				for j := i + 1; j < len(v); j++ {
+					if jsonEqual(v[i], v[j]) {
+						fail("items %d and %d are equal", i, j)
+					}
+				}
+			}
+		}
+	case float64:
+		if n, ok := schemaNumber(schema, "minimum"); ok && v < n {
+			fail("must be at least %v", n)
+		}
+		if n, ok := schemaNumber(schema, "maximum"); ok && v > n {
+			fail("must be at most %v", n)
+		}
+		if n, ok := schemaNumber(schema, "exclusiveMinimum"); ok && v <= n {
+			fail("must be over %v", n)
+		}
+		if n, ok := schemaNumber(schema, "exclusiveMaximum"); ok && v >= n {
+			fail("must be under %v", n)
+		}
+		if n, ok := schemaNumber(schema, "multipleOf"); ok && n > 0 && math.Abs(math.Remainder(v, n)) > 1e-9 {
+			fail("must be a multiple of %v", n)
+		}
+	case string:
+		length := float64(len([]rune(v)))
+		if n, ok := schemaNumber(schema, "minLength"); ok && length < n {
+			fail("must be at least %v characters", n)
+		}
+		if n, ok := schemaNumber(schema, "maxLength"); ok && length > n {
+			fail("must be at most %v characters", n)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			if re, err := schemaPattern(pattern); err == nil && !re.MatchString(v) {
+				fail("must match %s", pattern)
+			}
+		}
+		if format, ok := schema["format"].(string); ok && !formatMatches(format, v) {
+			fail("must be a valid %s", format)
+		}
+	}
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, s := range all {
+			if s, ok := s.(map[string]interface{}); ok {
+				validateValue(s, v, path, errs)
+			}
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok && countMatches(anyOf, v) == 0 {
+		fail("must match at least one schema of anyOf")
+	}
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok && countMatches(oneOf, v) != 1 {
+		fail("must match exactly one schema of oneOf")
+	}
+	if not, ok := schema["not"].(map[string]interface{}); ok && len(validateDoc(not, v)) == 0 {
+		fail("must not match the schema of not")
+	}
+}
+
+func countMatches(schemas []interface{}, v interface{}) int {
+	n := 0
+	for _, s := range schemas {
+		if s, ok := s.(map[string]interface{}); ok && len(validateDoc(s, v)) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func jsonTypeMatches(name string, v interface{}) bool {
+	if name == "integer" {
+		f, ok := v.(float64)
+		return ok && f == math.Trunc(f)
+	}
+	return name == jsonType(v)
+}
+
+func jsonEqual(a, b interface{}) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return bytes.Equal(ja, jb)
+}
+
+func schemaNumber(schema map[string]interface{}, keyword string) (float64, bool) {
+	n, ok := schema[keyword].(float64)
+	return n, ok
+}
+
+func stringList(v interface{}) []string {
+	list, _ := v.([]interface{})
+	out := make([]string, 0, len(list))
+	for _, s := range list {
+		if s, ok := s.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+//schemaPattern compiles the pattern keywords once.
+func schemaPattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := schemaPatterns.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	schemaPatterns.Store(pattern, re)
+	return re, nil
+}
+
+//formatMatches checks the formats documents commonly carry. Unknown formats
+//are annotations only, as the specification has it.
+func formatMatches(format, s string) bool {
+	switch format {
+	case "date-time":
+		_, err := time.Parse(time.RFC3339, s)
+		return err == nil
+	case "date":
+		_, err := time.Parse("2006-01-02", s)
+		return err == nil
+	case "email":
+		_, err := mail.ParseAddress(s)
+		return err == nil && !strings.ContainsAny(s, "<> ")
+	case "uri":
+		u, err := url.Parse(s)
+		return err == nil && len(u.Scheme) != 0
+	}
+	return true
+}
+
+var schemaTypes = map[string]bool{
+	"null": true, "boolean": true, "number": true, "integer": true, "string": true, "array": true, "object": true,
+}
+
+//checkDocSchema rejects schemas with unknown types or invalid patterns, which
+//would otherwise refuse or accept every document silently.
+func checkDocSchema(schema map[string]interface{}, path string) error {
+	if t, ok := schema["type"]; ok {
+		types := []interface{}{t}
+		if list, ok := t.([]interface{}); ok {
+			types = list
+		}
+		for _, t := range types {
+			if name, _ := t.(string); !schemaTypes[name] {
+				return &ValidationError{Path: path + "/type", Message: fmt.Sprintf("unknown type %v", t)}
+			}
+		}
+	}
+	if p, ok := schema["pattern"]; ok {
+		pattern, isString := p.(string)
+		if _, err := schemaPattern(pattern); err != nil || !isString {
+			return &ValidationError{Path: path + "/pattern", Message: "pattern must be a valid regular expression"}
+		}
+	}
+	if _, ok := schema["$ref"]; ok {
+		return &ValidationError{Path: path + "/$ref", Message: "$ref is not supported"}
+	}
+	subs := map[string]interface{}{}
+	if props, ok := schema["properties"].(map[string]interface{}); ok {
+		for name, s := range props {
+			subs["/properties/"+escapePointer(name)] = s
+		}
+	}
+	for _, keyword := range []string{"items", "additionalProperties", "not"} {
+		if s, ok := schema[keyword].(map[string]interface{}); ok {
+			subs["/"+keyword] = s
+		}
+	}
+	for _, keyword := range []string{"allOf", "anyOf", "oneOf"} {
+		list, _ := schema[keyword].([]interface{})
+		for i, s := range list {
+			subs[fmt.Sprintf("/%s/%d", keyword, i)] = s
+		}
+	}
+	keys := make([]string, 0, len(subs))
+	for k := range subs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		sub, ok := subs[k].(map[string]interface{})
+		if !ok {
+			return &ValidationError{Path: path + k, Message: "must be a schema object"}
+		}
+		if err := checkDocSchema(sub, path+k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//docSchemaHandler returns the schema registered for an index.
+func docSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	index := mux.Vars(r)["index"]
+	if !checkAccess(w, r, opAdmin, []string{index}) {
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ensureMappedIndex(r.Context(), es, config.DocSchemas.Index, docSchemaMapping)
+	doc, err := getDoc(r.Context(), es, config.DocSchemas.Index, index)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to read document schema", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if !doc.Found {
+		http.Error(w, "no schema for "+index, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(doc.Source)
+}
+
+//putDocSchemaHandler registers the request body as the JSON Schema of the
+//documents of an index.
+func putDocSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	index := mux.Vars(r)["index"]
+	if !checkAccess(w, r, opAdmin, []string{index}) {
+		return
+	}
+	var schema map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&schema); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkDocSchema(schema, ""); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stored := DocSchema{Index: index, Schema: schema, Actor: actor(r), Timestamp: time.Now().UTC().Format(time.RFC3339)}
+	buf, err := encodeBody(stored)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error encoding document schema", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ensureMappedIndex(r.Context(), es, config.DocSchemas.Index, docSchemaMapping)
+	res, err := es.Index(config.DocSchemas.Index, buf,
+		es.Index.WithContext(r.Context()),
+		es.Index.WithDocumentID(index),
+		es.Index.WithRefresh("wait_for"),
+	)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to save document schema", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if res.IsError() {
+		writeResponse(w, res)
+		return
+	}
+	res.Body.Close()
+	docSchemasMu.Lock()
+	docSchemasCache[tenantScope(r.Context(), index)] = docSchemaEntry{at: time.Now(), schema: schema}
+	docSchemasMu.Unlock()
+	writeJSON(w, http.StatusOK, stored)
+}
+
+//deleteDocSchemaHandler removes the schema of an index, whose documents are
+//then accepted as they are.
+func deleteDocSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	index := mux.Vars(r)["index"]
+	if !checkAccess(w, r, opAdmin, []string{index}) {
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res, err := es.Delete(config.DocSchemas.Index, index,
+		es.Delete.WithContext(r.Context()),
+		es.Delete.WithRefresh("wait_for"),
+	)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to delete document schema", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	docSchemasMu.Lock()
+	delete(docSchemasCache, tenantScope(r.Context(), index))
+	docSchemasMu.Unlock()
+	writeResponse(w, res)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch"
+)
+
+//volatileSettings differ between any two clusters and are left out of drift reports.
+var volatileSettings = []string{
+	"index.uuid",
+	"index.creation_date",
+	"index.provided_name",
+	"index.version.",
+	"index.routing.allocation.initial_recovery",
+	"index.resize.",
+	"index.history.uuid",
+}
+
+//Difference is one setting, mapping entry or template entry that is not the
+//same in both environments. A nil side means it is missing there.
+type Difference struct {
+	Kind string      `json:"kind"`
+	Name string      `json:"name"`
+	Key  string      `json:"key"`
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+//DriftReport lists the differences between two environments.
+type DriftReport struct {
+	From        string       `json:"from"`
+	To          string       `json:"to"`
+	Index       string       `json:"index"`
+	Differences []Difference `json:"differences"`
+}
+
+//clusterState is everything drift reports compare, flattened per index or
+//template into dotted keys.
+type clusterState map[string]map[string]interface{}
+
+func stateOf(ctx context.Context, es *elasticsearch.Client, index string) (clusterState, error) {
+	state := clusterState{}
+
+	res, err := es.Indices.GetSettings(
+		es.Indices.GetSettings.WithContext(ctx),
+		es.Indices.GetSettings.WithIndex(index),
+		es.Indices.GetSettings.WithFlatSettings(true),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var settings map[string]struct {
+		Settings map[string]interface{} `json:"settings"`
+	}
+	if err := decodeAdminResponse(res.IsError(), res.Status(), res.Body, &settings); err != nil {
+		return nil, err
+	}
+	for name, s := range settings {
+		flat := map[string]interface{}{}
+		for k, v := range s.Settings {
+			if !isVolatile(k) {
+				flat[k] = v
+			}
+		}
+		state["settings/"+name] = flat
+	}
+
+	res, err = es.Indices.GetMapping(
+		es.Indices.GetMapping.WithContext(ctx),
+		es.Indices.GetMapping.WithIndex(index),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var mappings map[string]struct {
+		Mappings map[string]interface{} `json:"mappings"`
+	}
+	if err := decodeAdminResponse(res.IsError(), res.Status(), res.Body, &mappings); err != nil {
+		return nil, err
+	}
+	for name, m := range mappings {
+		flat := map[string]interface{}{}
+		flatten("", m.Mappings, flat)
+		state["mappings/"+name] = flat
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/_index_template", nil)
+	if err != nil {
+		return nil, err
+	}
+	tres, err := es.Perform(req)
+	if err != nil {
+		return nil, err
+	}
+	var templates struct {
+		IndexTemplates []struct {
+			Name          string                 `json:"name"`
+			IndexTemplate map[string]interface{} `json:"index_template"`
+		} `json:"index_templates"`
+	}
+	if err := decodeAdminResponse(tres.StatusCode >= http.StatusMultipleChoices, tres.Status, tres.Body, &templates); err != nil {
+		return nil, err
+	}
+	for _, t := range templates.IndexTemplates {
+		flat := map[string]interface{}{}
+		flatten("", t.IndexTemplate, flat)
+		state["templates/"+t.Name] = flat
+	}
+	return state, nil
+}
+
+func decodeAdminResponse(isError bool, status string, body io.ReadCloser, v interface{}) error {
+	defer body.Close()
+	if isError {
+		return fmt.Errorf("elastic search answered %s", status)
+	}
+	return json.NewDecoder(body).Decode(v)
+}
+
+func isVolatile(setting string) bool {
+	for _, v := range volatileSettings {
+		if setting == v || (strings.HasSuffix(v, ".") && strings.HasPrefix(setting, v)) {
+			return true
+		}
+	}
+	return false
+}
+
+//diffStates compares two cluster states, sorted by kind, name and key.
+func diffStates(from, to clusterState) []Difference {
+	diffs := []Difference{}
+	add := func(id, key string, a, b interface{}) {
+		kind, name, _ := strings.Cut(id, "/")
+		diffs = append(diffs, Difference{Kind: kind, Name: name, Key: key, From: a, To: b})
+	}
+	for id, a := range from {
+		b, ok := to[id]
+		if !ok {
+			add(id, "", "present", nil)
+			continue
+		}
+		for k, v := range a {
+			if w, ok := b[k]; !ok || !reflect.DeepEqual(v, w) {
+				add(id, k, v, b[k])
+			}
+		}
+		for k, w := range b {
+			if _, ok := a[k]; !ok {
+				add(id, k, nil, w)
+			}
+		}
+	}
+	for id := range to {
+		if _, ok := from[id]; !ok {
+			add(id, "", nil, "present")
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		a, b := diffs[i], diffs[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Key < b.Key
+	})
+	return diffs
+}
+
+//driftHandler compares the index settings, mappings and index templates of
+//two configured environments, from and to, for the indices matching index
+//(all by default), and reports every difference.
+func driftHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	index := params.Get("index")
+	if len(index) == 0 {
+		index = "*"
+	}
+	if !checkAccess(w, r, opAdmin, []string{index}) {
+		return
+	}
+	report := DriftReport{From: params.Get("from"), To: params.Get("to"), Index: index}
+	var states [2]clusterState
+	for i, env := range []string{report.From, report.To} {
+		cluster, ok := config.Environments[env]
+		if !ok {
+			http.Error(w, "unknown environment "+env, http.StatusBadRequest)
+			return
+		}
+		es, err := clusterClient(cluster)
+		if err != nil {
+			logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if states[i], err = stateOf(r.Context(), es, index); err != nil {
+			logger.ErrorContext(r.Context(), "unable to read cluster state", "environment", env, "error", err)
+			http.Error(w, env+": "+err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	report.Differences = diffStates(states[0], states[1])
+	writeJSON(w, http.StatusOK, report)
+}
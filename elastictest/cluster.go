@@ -0,0 +1,205 @@
+//Package elastictest helps testing services that embed or call the elastic
+//gateway without a real cluster: a fake elastic search cluster, builders for
+//the requests of the gateway and assertions against golden responses.
+package elastictest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//Call is a request the fake cluster received.
+type Call struct {
+	Method string
+	Path   string
+	Query  string
+	Header http.Header
+	Body   []byte
+}
+
+//JSON decodes the body of the call into v.
+func (c Call) JSON(v interface{}) error {
+	return json.Unmarshal(c.Body, v)
+}
+
+//Reply is the canned answer of the fake cluster to a route.
+type Reply struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+type route struct {
+	method  string
+	pattern string
+	reply   func(Call) Reply
+}
+
+//Cluster is a fake elastic search cluster. It answers the routes it was given
+//and records the calls it received. Use it as the Transport of a client, or
+//start a Server and give its URL as the address of the cluster. Patterns are
+//path.Match patterns ("/logs-*/_search") and the last route added that
+//matches answers. Unmatched calls get the 404 elastic search answers for a
+//missing index.
+type Cluster struct {
+	mu     sync.Mutex
+	routes []route
+	calls  []Call
+}
+
+//NewCluster returns a fake cluster answering GET / like elastic search 8.
+func NewCluster() *Cluster {
+	c := &Cluster{}
+	c.OnJSON(http.MethodGet, "/", http.StatusOK, map[string]interface{}{
+		"name":         "elastictest",
+		"cluster_name": "elastictest",
+		"version":      map[string]interface{}{"number": "8.11.0"},
+		"tagline":      "You Know, for Search",
+	})
+	return c
+}
+
+//On answers the calls matching method and pattern with reply. An empty
+//method matches every method.
+func (c *Cluster) On(method, pattern string, reply func(Call) Reply) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.routes = append([]route{{method: method, pattern: pattern, reply: reply}}, c.routes...)
+}
+
+//OnJSON answers the calls matching method and pattern with body as JSON.
+func (c *Cluster) OnJSON(method, pattern string, status int, body interface{}) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		panic(fmt.Sprintf("elastictest: unable to encode reply for %s %s: %v", method, pattern, err))
+	}
+	c.On(method, pattern, func(Call) Reply {
+		return Reply{Status: status, Body: b}
+	})
+}
+
+//OnSearch answers the searches of index, a name or pattern, with the hits.
+func (c *Cluster) OnSearch(index string, hits ...Hit) {
+	c.OnJSON("", "/"+index+"/_search", http.StatusOK, SearchResponse(hits...))
+}
+
+//OnError answers the calls matching method and pattern with an elastic
+//search error.
+func (c *Cluster) OnError(method, pattern string, status int, errorType, reason string) {
+	c.OnJSON(method, pattern, status, ErrorResponse(status, errorType, reason))
+}
+
+//Calls returns the calls received so far.
+func (c *Cluster) Calls() []Call {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Call(nil), c.calls...)
+}
+
+//CallsTo returns the calls received for a path matching pattern.
+func (c *Cluster) CallsTo(pattern string) []Call {
+	var calls []Call
+	for _, call := range c.Calls() {
+		if ok, _ := path.Match(pattern, call.Path); ok {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+//Reset forgets the calls received.
+func (c *Cluster) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = nil
+}
+
+//RoundTrip answers the request as the cluster would, so the cluster can be
+//the Transport of an elastic search or HTTP client.
+func (c *Cluster) RoundTrip(req *http.Request) (*http.Response, error) {
+	call := Call{Method: req.Method, Path: req.URL.Path, Query: req.URL.RawQuery, Header: req.Header.Clone()}
+	if req.Body != nil {
+		b, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		call.Body = b
+	}
+	c.mu.Lock()
+	c.calls = append(c.calls, call)
+	routes := c.routes
+	c.mu.Unlock()
+	reply := notFound(call)
+	for _, r := range routes {
+		if len(r.method) != 0 && r.method != call.Method {
+			continue
+		}
+		if ok, _ := path.Match(r.pattern, call.Path); ok {
+			reply = r.reply(call)
+			break
+		}
+	}
+	header := reply.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	if len(header.Get("Content-Type")) == 0 {
+		header.Set("Content-Type", "application/json")
+	}
+	//clients of elastic search 8 check the product header
+	header.Set("X-Elastic-Product", "Elasticsearch")
+	status := reply.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(reply.Body)),
+		ContentLength: int64(len(reply.Body)),
+		Request:       req,
+	}, nil
+}
+
+//ServeHTTP lets the cluster run behind an httptest.Server.
+func (c *Cluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	res, err := c.RoundTrip(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer res.Body.Close()
+	for name, values := range res.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(res.StatusCode)
+	io.Copy(w, res.Body)
+}
+
+//Server starts the cluster on a local address, closed when the test ends.
+//Its URL is the address to configure.
+func (c *Cluster) Server(t testing.TB) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(c)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func notFound(call Call) Reply {
+	index := strings.SplitN(strings.TrimPrefix(call.Path, "/"), "/", 2)[0]
+	b, _ := json.Marshal(ErrorResponse(http.StatusNotFound, "index_not_found_exception", "no such index ["+index+"]"))
+	return Reply{Status: http.StatusNotFound, Body: b}
+}
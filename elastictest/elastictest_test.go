@@ -0,0 +1,213 @@
+package elastictest
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+//recorder is a testing.TB recording the failures of the assertions under
+//test instead of failing the test running them.
+type recorder struct {
+	testing.TB
+	failed bool
+	fatal  bool
+	log    string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.failed = true
+	r.log += fmt.Sprintf(format, args...)
+}
+
+func (r *recorder) Fatalf(format string, args ...interface{}) {
+	r.Errorf(format, args...)
+	r.fatal = true
+	runtime.Goexit()
+}
+
+func (r *recorder) Fatal(args ...interface{}) {
+	r.Fatalf("%s", fmt.Sprint(args...))
+}
+
+//record runs f against a recorder, in its own goroutine so Fatalf can stop it.
+func record(t *testing.T, f func(tb testing.TB)) *recorder {
+	r := &recorder{TB: t}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f(r)
+	}()
+	<-done
+	return r
+}
+
+//inTempDir runs the test from an empty directory, for the golden files it writes.
+func inTempDir(t *testing.T) string {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+func TestClusterSearch(t *testing.T) {
+	c := NewCluster()
+	c.OnSearch("logs-*", Doc("logs-1", "a", map[string]interface{}{"message": "hello"}))
+	client := &http.Client{Transport: c}
+	res, err := client.Post("http://cluster/logs-1/_search", "application/json", strings.NewReader(`{"query":{"match_all":{}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.Header.Get("X-Elastic-Product"); got != "Elasticsearch" {
+		t.Errorf("X-Elastic-Product = %q", got)
+	}
+	AssertGoldenResponse(t, "cluster_search", res, http.StatusOK)
+
+	calls := c.CallsTo("/logs-*/_search")
+	if len(calls) != 1 {
+		t.Fatalf("got %d search calls, want 1", len(calls))
+	}
+	var body map[string]interface{}
+	if err := calls[0].JSON(&body); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := body["query"]; !ok {
+		t.Errorf("recorded body %s has no query", calls[0].Body)
+	}
+}
+
+func TestClusterRoutes(t *testing.T) {
+	c := NewCluster()
+	c.OnJSON("", "/orders/_doc/*", http.StatusOK, map[string]interface{}{"found": true})
+	c.OnError(http.MethodDelete, "/orders/_doc/*", http.StatusConflict, "version_conflict_engine_exception", "conflict")
+	s := c.Server(t)
+
+	res, err := http.Get(s.URL + "/orders/_doc/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("GET answered %d, want 200", res.StatusCode)
+	}
+
+	//the last route added that matches answers, when the method matches
+	req, _ := http.NewRequest(http.MethodDelete, s.URL+"/orders/_doc/1", nil)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("DELETE answered %d, want 409", res.StatusCode)
+	}
+
+	res, err = http.Get(s.URL + "/missing/_search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound || !strings.Contains(string(b), "no such index [missing]") {
+		t.Errorf("unmatched call answered %d %s", res.StatusCode, b)
+	}
+
+	if n := len(c.Calls()); n != 3 {
+		t.Errorf("recorded %d calls, want 3", n)
+	}
+	c.Reset()
+	if n := len(c.Calls()); n != 0 {
+		t.Errorf("recorded %d calls after Reset", n)
+	}
+}
+
+func TestGoldenUpdate(t *testing.T) {
+	dir := inTempDir(t)
+	t.Setenv(UpdateEnv, "1")
+	AssertGolden(t, "update", []byte(`{"took": 3, "b": 1, "a": {"request_id": "x", "c": [true]}}`))
+	b, err := os.ReadFile(filepath.Join(dir, "testdata", "update.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "{\n  \"a\": {\n    \"c\": [\n      true\n    ]\n  },\n  \"b\": 1\n}\n"
+	if string(b) != want {
+		t.Errorf("golden file is\n%s\nwant\n%s", b, want)
+	}
+
+	t.Setenv(UpdateEnv, "")
+	//volatile fields and key order do not matter
+	r := record(t, func(tb testing.TB) {
+		AssertGolden(tb, "update", []byte(`{"b": 1, "a": {"c": [true], "request_id": "y"}, "took": 9}`))
+	})
+	if r.failed {
+		t.Errorf("equal response failed: %s", r.log)
+	}
+	r = record(t, func(tb testing.TB) {
+		AssertGolden(tb, "update", []byte(`{"b": 2, "a": {"c": [true]}}`))
+	})
+	if !r.failed || r.fatal {
+		t.Errorf("different response: failed %v, fatal %v", r.failed, r.fatal)
+	}
+}
+
+func TestGoldenFailures(t *testing.T) {
+	inTempDir(t)
+	t.Setenv(UpdateEnv, "")
+	r := record(t, func(tb testing.TB) {
+		AssertGolden(tb, "missing", []byte(`{}`))
+	})
+	if !r.fatal || !strings.Contains(r.log, UpdateEnv) {
+		t.Errorf("missing golden file: fatal %v, log %q", r.fatal, r.log)
+	}
+	r = record(t, func(tb testing.TB) {
+		AssertGolden(tb, "missing", []byte(`not json`))
+	})
+	if !r.fatal {
+		t.Error("response not JSON did not fail")
+	}
+	r = record(t, func(tb testing.TB) {
+		res := &http.Response{StatusCode: http.StatusBadGateway, Body: io.NopCloser(strings.NewReader(`{}`))}
+		AssertGoldenResponse(tb, "missing", res, http.StatusOK)
+	})
+	if !r.fatal || !strings.Contains(r.log, "502") {
+		t.Errorf("unexpected status: fatal %v, log %q", r.fatal, r.log)
+	}
+}
+
+func TestRequests(t *testing.T) {
+	c := NewCluster()
+	s := c.Server(t)
+	req := Search{Addresses: s.URL, Index: "orders", Query: Match("status", "paid"), Size: 5}.Request("http://gateway")
+	if req.Method != http.MethodPost || req.URL.Path != "/elastic" {
+		t.Errorf("search request is %s %s", req.Method, req.URL)
+	}
+	b, _ := io.ReadAll(req.Body)
+	want := `{"addresses":"` + s.URL + `","index":"orders","elasticquery":{"query":{"match":{"status":"paid"}}},"size":5}`
+	if string(b) != want {
+		t.Errorf("search body is %s, want %s", b, want)
+	}
+
+	req = WithTenant(WithAPIKey(Lookup("http://gateway", "orders", "paid", 3), "key"), "acme")
+	if got := req.URL.Query().Get("size"); got != "3" {
+		t.Errorf("lookup size is %q", got)
+	}
+	if req.Header.Get("X-API-Key") != "key" || req.Header.Get("X-Tenant") != "acme" {
+		t.Errorf("lookup headers are %v", req.Header)
+	}
+	if req := DeleteDoc("http://gateway", "orders", "a/b"); req.URL.EscapedPath() != "/elastic/doc/orders/a%2Fb" {
+		t.Errorf("delete path is %s", req.URL.EscapedPath())
+	}
+}
@@ -0,0 +1,81 @@
+package elastictest
+
+import "fmt"
+
+//Hit is a document returned by a fake search.
+type Hit struct {
+	Index  string
+	ID     string
+	Score  float64
+	Source map[string]interface{}
+}
+
+//Doc returns a hit of index with the source, and its id.
+func Doc(index, id string, source map[string]interface{}) Hit {
+	return Hit{Index: index, ID: id, Score: 1, Source: source}
+}
+
+//SearchResponse builds the body of a search response with the hits, in the
+//format of elastic search.
+func SearchResponse(hits ...Hit) map[string]interface{} {
+	docs := make([]interface{}, 0, len(hits))
+	var max interface{}
+	for _, h := range hits {
+		docs = append(docs, map[string]interface{}{
+			"_index":  h.Index,
+			"_id":     h.ID,
+			"_score":  h.Score,
+			"_source": h.Source,
+		})
+		if m, ok := max.(float64); !ok || h.Score > m {
+			max = h.Score
+		}
+	}
+	return map[string]interface{}{
+		"took":      1,
+		"timed_out": false,
+		"_shards":   map[string]interface{}{"total": 1, "successful": 1, "skipped": 0, "failed": 0},
+		"hits": map[string]interface{}{
+			"total":     map[string]interface{}{"value": len(hits), "relation": "eq"},
+			"max_score": max,
+			"hits":      docs,
+		},
+	}
+}
+
+//WithAggregations adds aggregation results to a search response.
+func WithAggregations(response map[string]interface{}, aggs map[string]interface{}) map[string]interface{} {
+	response["aggregations"] = aggs
+	return response
+}
+
+//ErrorResponse builds the body of an elastic search error.
+func ErrorResponse(status int, errorType, reason string) map[string]interface{} {
+	cause := map[string]interface{}{"type": errorType, "reason": reason}
+	return map[string]interface{}{
+		"error": map[string]interface{}{
+			"root_cause": []interface{}{cause},
+			"type":       errorType,
+			"reason":     reason,
+		},
+		"status": status,
+	}
+}
+
+//BulkResponse builds the body of a bulk response where the listed items
+//failed with reason, by their position.
+func BulkResponse(items int, failed map[int]string) map[string]interface{} {
+	list := make([]interface{}, 0, items)
+	for i := 0; i < items; i++ {
+		item := map[string]interface{}{"_id": fmt.Sprint(i), "status": 201, "result": "created"}
+		if reason, ok := failed[i]; ok {
+			item = map[string]interface{}{
+				"_id":    fmt.Sprint(i),
+				"status": 400,
+				"error":  map[string]interface{}{"type": "mapper_parsing_exception", "reason": reason},
+			}
+		}
+		list = append(list, map[string]interface{}{"index": item})
+	}
+	return map[string]interface{}{"took": 1, "errors": len(failed) != 0, "items": list}
+}
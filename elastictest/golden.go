@@ -0,0 +1,106 @@
+package elastictest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//UpdateEnv is the environment variable that, set to 1, makes AssertGolden
+//write the golden files instead of comparing against them.
+const UpdateEnv = "ELASTICTEST_UPDATE"
+
+//Volatile lists the fields AssertGolden ignores, at any depth, because they
+//change from one run to the next.
+var Volatile = []string{"took", "request_id", "age"}
+
+//AssertGolden compares a JSON response with testdata/name.golden. Both are
+//compared once indented with sorted keys and without the Volatile fields, so
+//the golden files stay readable and stable.
+func AssertGolden(t testing.TB, name string, got []byte) {
+	t.Helper()
+	normalized, err := normalize(got)
+	if err != nil {
+		t.Fatalf("elastictest: response of %s is not JSON: %v\n%s", name, err, got)
+	}
+	file := filepath.Join("testdata", name+".golden")
+	if os.Getenv(UpdateEnv) == "1" {
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, normalized, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("elastictest: %v (run with %s=1 to create it)", err, UpdateEnv)
+	}
+	if !bytes.Equal(bytes.TrimSpace(want), bytes.TrimSpace(normalized)) {
+		t.Errorf("elastictest: response differs from %s\n--- want\n%s\n--- got\n%s", file, want, normalized)
+	}
+}
+
+//AssertGoldenResponse checks the status of a response and compares its body
+//with testdata/name.golden.
+func AssertGoldenResponse(t testing.TB, name string, res *http.Response, status int) {
+	t.Helper()
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != status {
+		t.Fatalf("elastictest: %s answered %d, want %d\n%s", name, res.StatusCode, status, body)
+	}
+	AssertGolden(t, name, body)
+}
+
+func normalize(b []byte) ([]byte, error) {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	v = dropVolatile(v)
+	//encoding/json sorts the keys of maps
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+func dropVolatile(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if isVolatile(k) {
+				delete(v, k)
+				continue
+			}
+			v[k] = dropVolatile(child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = dropVolatile(child)
+		}
+	}
+	return v
+}
+
+func isVolatile(key string) bool {
+	for _, k := range Volatile {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
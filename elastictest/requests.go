@@ -0,0 +1,104 @@
+package elastictest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+//Search is the body of a search through the gateway (POST /elastic), with
+//the most used fields. Addresses points the gateway at a cluster, such as the
+//URL of a Cluster server.
+type Search struct {
+	Addresses    string      `json:"addresses,omitempty"`
+	Username     string      `json:"username,omitempty"`
+	Password     string      `json:"password,omitempty"`
+	Index        string      `json:"index"`
+	Query        interface{} `json:"elasticquery,omitempty"`
+	Sort         string      `json:"sort,omitempty"`
+	Size         int         `json:"size,omitempty"`
+	From         int         `json:"from,omitempty"`
+	Text         string      `json:"text,omitempty"`
+	Where        string      `json:"where,omitempty"`
+	ResponseMode string      `json:"response_mode,omitempty"`
+	NoCache      bool        `json:"no_cache,omitempty"`
+}
+
+//Request builds the request of the search to the gateway at baseURL.
+func (s Search) Request(baseURL string) *http.Request {
+	return jsonRequest(http.MethodPost, baseURL+"/elastic", s)
+}
+
+//MatchAll is the query matching every document.
+func MatchAll() map[string]interface{} {
+	return map[string]interface{}{"query": map[string]interface{}{"match_all": map[string]interface{}{}}}
+}
+
+//Match is the query matching value in field.
+func Match(field string, value interface{}) map[string]interface{} {
+	return map[string]interface{}{"query": map[string]interface{}{"match": map[string]interface{}{field: value}}}
+}
+
+//Lookup builds a quick lookup (GET /elastic/search) of q in index.
+func Lookup(baseURL, index, q string, size int) *http.Request {
+	params := url.Values{"index": {index}}
+	if len(q) != 0 {
+		params.Set("q", q)
+	}
+	if size != 0 {
+		params.Set("size", strconv.Itoa(size))
+	}
+	req, err := http.NewRequest(http.MethodGet, baseURL+"/elastic/search?"+params.Encode(), nil)
+	if err != nil {
+		panic(fmt.Sprintf("elastictest: %v", err))
+	}
+	return req
+}
+
+//PutDoc builds the request indexing doc as index/id.
+func PutDoc(baseURL, index, id string, doc interface{}) *http.Request {
+	return jsonRequest(http.MethodPut, baseURL+"/elastic/doc/"+url.PathEscape(index)+"/"+url.PathEscape(id), doc)
+}
+
+//DeleteDoc builds the request deleting index/id.
+func DeleteDoc(baseURL, index, id string) *http.Request {
+	req, err := http.NewRequest(http.MethodDelete, baseURL+"/elastic/doc/"+url.PathEscape(index)+"/"+url.PathEscape(id), nil)
+	if err != nil {
+		panic(fmt.Sprintf("elastictest: %v", err))
+	}
+	return req
+}
+
+//WithAPIKey authenticates the request with an API key of the gateway.
+func WithAPIKey(req *http.Request, key string) *http.Request {
+	req.Header.Set("X-API-Key", key)
+	return req
+}
+
+//WithBearer authenticates the request with a token.
+func WithBearer(req *http.Request, token string) *http.Request {
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+//WithTenant names the tenant of the request, in the default tenancy header.
+func WithTenant(req *http.Request, tenant string) *http.Request {
+	req.Header.Set("X-Tenant", tenant)
+	return req
+}
+
+func jsonRequest(method, u string, body interface{}) *http.Request {
+	b, err := json.Marshal(body)
+	if err != nil {
+		panic(fmt.Sprintf("elastictest: unable to encode request body: %v", err))
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(b))
+	if err != nil {
+		panic(fmt.Sprintf("elastictest: %v", err))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+//EmbeddingConfig points at the service turning texts into vectors, so that
+//kNN searches can be sent a text and the API key of the service stays on the
+//server. The service is sent {"model": Model, "input": [texts]} and answers
+//in the format of the OpenAI embeddings API ({"data": [{"embedding": [...]}]})
+//or with {"embeddings": [[...]]}.
+type EmbeddingConfig struct {
+	URL     string            `json:"url"`
+	APIKey  string            `json:"api_key"`
+	Model   string            `json:"model"`
+	Headers map[string]string `json:"headers"`
+	Timeout Duration          `json:"timeout"`
+}
+
+func (c EmbeddingConfig) enabled() bool {
+	return len(c.URL) != 0
+}
+
+//embedder turns texts into vectors, one per text and in the same order.
+type embedder interface {
+	embed(ctx context.Context, texts []string) ([][]float64, error)
+}
+
+//embeddings is the configured provider, nil when there is none.
+var embeddings embedder
+
+//httpEmbedder calls an embeddings HTTP endpoint.
+type httpEmbedder struct {
+	cfg    EmbeddingConfig
+	client *http.Client
+}
+
+func newHTTPEmbedder(cfg EmbeddingConfig) *httpEmbedder {
+	return &httpEmbedder{cfg: cfg, client: &http.Client{Timeout: cfg.Timeout.Duration}}
+}
+
+func (e *httpEmbedder) embed(ctx context.Context, texts []string) ([][]float64, error) {
+	input := map[string]interface{}{"input": texts}
+	if len(e.cfg.Model) != 0 {
+		input["model"] = e.cfg.Model
+	}
+	b, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.cfg.URL, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(e.cfg.APIKey) != 0 {
+		req.Header.Set("Authorization", "Bearer "+e.cfg.APIKey)
+	}
+	for k, v := range e.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	res, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return nil, fmt.Errorf("embedding service answered %s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+	var out struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+		Embeddings [][]float64 `json:"embeddings"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("embedding service answer: %w", err)
+	}
+	vectors := out.Embeddings
+	if len(out.Data) != 0 {
+		//the index is optional, entries are then in input order
+		indexed := false
+		for _, d := range out.Data {
+			indexed = indexed || d.Index != 0
+		}
+		vectors = make([][]float64, len(out.Data))
+		for i, d := range out.Data {
+			if indexed {
+				i = d.Index
+			}
+			if i < 0 || i >= len(vectors) {
+				return nil, fmt.Errorf("embedding service answered index %d for %d texts", i, len(texts))
+			}
+			vectors[i] = d.Embedding
+		}
+	}
+	if len(vectors) != len(texts) {
+		return nil, fmt.Errorf("embedding service answered %d vectors for %d texts", len(vectors), len(texts))
+	}
+	for _, v := range vectors {
+		if len(v) == 0 {
+			return nil, errors.New("embedding service answered an empty vector")
+		}
+	}
+	return vectors, nil
+}
+
+//embedText returns the vector of a single text.
+func embedText(ctx context.Context, text string) ([]float64, error) {
+	if embeddings == nil {
+		return nil, errors.New("no embedding service configured")
+	}
+	vectors, err := embeddings.embed(ctx, []string{text})
+	if err != nil {
+		return nil, err
+	}
+	return vectors[0], nil
+}
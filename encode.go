@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+//Response encodings picked from the Accept header. JSON stays the default;
+//MessagePack suits bandwidth sensitive services, XML a legacy consumer.
+const (
+	contentJSON    = "application/json"
+	contentMsgpack = "application/msgpack"
+	contentXML     = "application/xml"
+)
+
+//negotiate returns the first encoding of the Accept header the gateway supports.
+func negotiate(r *http.Request) string {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mt {
+		case "application/msgpack", "application/x-msgpack", "application/vnd.msgpack":
+			return contentMsgpack
+		case "application/xml", "text/xml":
+			return contentXML
+		case "application/json", "*/*", "application/*":
+			return contentJSON
+		}
+	}
+	return contentJSON
+}
+
+//writeEncoded writes v in the encoding the caller accepts. v is marshaled to
+//JSON first, so every encoding carries exactly what the JSON one would.
+func writeEncoded(w http.ResponseWriter, r *http.Request, status int, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	contentType := negotiate(r)
+	if contentType != contentJSON {
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		var generic interface{}
+		if err := dec.Decode(&generic); err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if contentType == contentMsgpack {
+			encodeMsgpack(&buf, generic)
+		} else {
+			buf.WriteString(xml.Header)
+			encodeXML(&buf, "response", generic)
+		}
+		b = buf.Bytes()
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(status)
+	_, err = w.Write(b)
+	return err
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//encodeMsgpack writes a decoded JSON value as MessagePack.
+func encodeMsgpack(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			buf.WriteByte(0xd3)
+			binary.Write(buf, binary.BigEndian, i)
+			return
+		}
+		f, _ := v.Float64()
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+	case string:
+		msgpackHeader(buf, len(v), 0xa0, 31, 0xd9, 0xda, 0xdb)
+		buf.WriteString(v)
+	case []interface{}:
+		msgpackHeader(buf, len(v), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, e := range v {
+			encodeMsgpack(buf, e)
+		}
+	case map[string]interface{}:
+		msgpackHeader(buf, len(v), 0x80, 15, 0, 0xde, 0xdf)
+		for _, k := range sortedKeys(v) {
+			encodeMsgpack(buf, k)
+			encodeMsgpack(buf, v[k])
+		}
+	}
+}
+
+//msgpackHeader writes the type and length prefix of a string, array or map:
+//the fix form up to fixMax, then the 8 (strings only), 16 and 32 bit forms.
+func msgpackHeader(buf *bytes.Buffer, n int, fix byte, fixMax int, b8, b16, b32 byte) {
+	switch {
+	case n <= fixMax:
+		buf.WriteByte(fix | byte(n))
+	case b8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(b8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(b16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(b32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+//xmlName tells whether a key can be used as an element name as is.
+func xmlName(s string) bool {
+	for i, r := range s {
+		if !(unicode.IsLetter(r) || r == '_' || (i > 0 && (unicode.IsDigit(r) || r == '-' || r == '.'))) {
+			return false
+		}
+	}
+	return len(s) != 0 && !strings.HasPrefix(strings.ToLower(s), "xml")
+}
+
+//encodeXML writes a decoded JSON value as the element name. Array elements
+//become item elements; keys that are not valid names become entry elements
+//with a key attribute.
+func encodeXML(buf *bytes.Buffer, name string, v interface{}) {
+	open, end := "<"+name+">", "</"+name+">"
+	if !xmlName(name) {
+		var key bytes.Buffer
+		xml.EscapeText(&key, []byte(name))
+		open, end = `<entry key="`+key.String()+`">`, "</entry>"
+	}
+	buf.WriteString(open)
+	switch v := v.(type) {
+	case nil:
+	case []interface{}:
+		for _, e := range v {
+			encodeXML(buf, "item", e)
+		}
+	case map[string]interface{}:
+		for _, k := range sortedKeys(v) {
+			encodeXML(buf, k, v[k])
+		}
+	case string:
+		xml.EscapeText(buf, []byte(v))
+	default:
+		b, _ := json.Marshal(v)
+		buf.Write(b)
+	}
+	buf.WriteString(end)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch/esapi"
+	"github.com/gorilla/mux"
+)
+
+//EQLConfig holds the fields EQL searches use when the request does not name
+//its own. Sequence queries are ordered by TimestampField, then TiebreakerField.
+type EQLConfig struct {
+	TimestampField     string `json:"timestamp_field"`
+	EventCategoryField string `json:"event_category_field"`
+	TiebreakerField    string `json:"tiebreaker_field"`
+}
+
+//eqlHandler runs an Event Query Language search, including sequence queries,
+//on the default cluster. The body is the one of the elastic search EQL API;
+//the response is forwarded as is, sequences included.
+func eqlHandler(w http.ResponseWriter, r *http.Request) {
+	index := mux.Vars(r)["index"]
+	if !checkAccess(w, r, opSearch, strings.Split(index, ",")) {
+		return
+	}
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q, _ := body["query"].(string); len(strings.TrimSpace(q)) == 0 {
+		http.Error(w, "query is required", http.StatusBadRequest)
+		return
+	}
+	for field, value := range map[string]string{
+		"timestamp_field":      config.EQL.TimestampField,
+		"event_category_field": config.EQL.EventCategoryField,
+		"tiebreaker_field":     config.EQL.TiebreakerField,
+	} {
+		if _, ok := body[field]; !ok && len(value) != 0 {
+			body[field] = value
+		}
+	}
+	buf, err := encodeBody(body)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error encoding EQL query", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, "/"+index+"/_eql/search", buf)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error creating EQL request", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := es.Perform(req)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error running EQL search", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeResponse(w, &esapi.Response{StatusCode: res.StatusCode, Header: res.Header, Body: res.Body})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"hash/fnv"
+	"net/http"
+	"strings"
+)
+
+//Experiment splits search traffic between variants by hashing the caller's
+//user ID, so a user keeps seeing the same variant. Indices limits the
+//experiment to searches on those indices; empty means every search.
+type Experiment struct {
+	Name     string    `json:"name"`
+	Indices  []string  `json:"indices"`
+	Variants []Variant `json:"variants"`
+}
+
+//Variant is one arm of an experiment. A variant without changes is the control.
+//FunctionScore wraps the query with the given functions, Rescore adds a
+//rescorer (reranker) and Set overrides top level keys of the search body.
+type Variant struct {
+	Name          string                 `json:"name"`
+	Weight        int                    `json:"weight"`
+	FunctionScore []interface{}          `json:"function_score"`
+	Rescore       interface{}            `json:"rescore"`
+	Set           map[string]interface{} `json:"set"`
+}
+
+//assign picks the variant of the experiment for a user.
+func (e Experiment) assign(user string) (Variant, bool) {
+	total := 0
+	for _, v := range e.Variants {
+		total += v.Weight
+	}
+	if total <= 0 {
+		return Variant{}, false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(e.Name + ":" + user))
+	bucket := int(h.Sum32() % uint32(total))
+	for _, v := range e.Variants {
+		if bucket < v.Weight {
+			return v, true
+		}
+		bucket -= v.Weight
+	}
+	return Variant{}, false
+}
+
+func (e Experiment) appliesTo(index []string) bool {
+	if len(e.Indices) == 0 {
+		return true
+	}
+	for _, want := range e.Indices {
+		for _, got := range index {
+			if want == got {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//apply rewrites the search body for the variant.
+func (v Variant) apply(q interface{}) interface{} {
+	body, ok := searchBody(q)
+	if !ok {
+		return q
+	}
+	if len(v.FunctionScore) != 0 {
+		wrapFunctionScore(body, map[string]interface{}{"functions": v.FunctionScore})
+	}
+	if v.Rescore != nil {
+		body["rescore"] = v.Rescore
+	}
+	for k, val := range v.Set {
+		body[k] = val
+	}
+	return body
+}
+
+//experimentUser is the ID traffic is split on. Anonymous callers are not enrolled.
+func experimentUser(r *http.Request) string {
+	if id := r.Header.Get("X-User-ID"); len(id) != 0 {
+		return id
+	}
+	return actor(r)
+}
+
+//applyExperiments enrolls the caller in every running experiment that covers
+//the searched indices, rewrites the query accordingly and logs the exposure.
+//The assignments are returned in the X-Experiment response header.
+func applyExperiments(w http.ResponseWriter, r *http.Request, index []string, q interface{}) interface{} {
+	user := experimentUser(r)
+	if len(user) == 0 {
+		return q
+	}
+	var assigned []string
+	for _, e := range config.Experiments {
+		if !e.appliesTo(index) {
+			continue
+		}
+		v, ok := e.assign(user)
+		if !ok {
+			continue
+		}
+		q = v.apply(q)
+		assigned = append(assigned, e.Name+"="+v.Name)
+		recordEvent(r.Context(), "experiment_exposure", map[string]interface{}{
+			"experiment": e.Name,
+			"variant":    v.Name,
+			"user":       user,
+			"index":      strings.Join(index, ","),
+		})
+	}
+	if len(assigned) != 0 {
+		w.Header().Set("X-Experiment", strings.Join(assigned, ";"))
+	}
+	return q
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch"
+)
+
+//exportPageSize is the number of documents fetched per page of an export.
+const exportPageSize = 1000
+
+//ExportRequest is the body of the export endpoints. Without All, only the
+//first Size documents (10 by default) are exported.
+type ExportRequest struct {
+	Index        string      `json:"index"`
+	ElasticQuery interface{} `json:"elasticquery"`
+	Columns      []string    `json:"columns"`
+	All          bool        `json:"all"`
+	Size         int         `json:"size"`
+}
+
+//openPIT opens a point in time on the indices, so that paging sees one
+//consistent view of the data.
+func openPIT(ctx context.Context, es *elasticsearch.Client, index []string, keepAlive string) (string, error) {
+	u := &url.URL{Path: "/" + strings.Join(index, ",") + "/_pit", RawQuery: url.Values{"keep_alive": {keepAlive}}.Encode()}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	var pit struct {
+		ID string `json:"id"`
+	}
+	res, err := es.Perform(req)
+	if err != nil {
+		return "", err
+	}
+	if err := decodeAdminResponse(res.StatusCode >= http.StatusMultipleChoices, res.Status, res.Body, &pit); err != nil {
+		return "", err
+	}
+	return pit.ID, nil
+}
+
+//closePIT closes a point in time. ctx carries the tenant it was opened for,
+//whose cluster holds it.
+func closePIT(ctx context.Context, es *elasticsearch.Client, id string) {
+	buf, err := encodeBody(map[string]interface{}{"id": id})
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, "/_pit", buf)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := es.Perform(req)
+	if err != nil {
+		logger.ErrorContext(ctx, "unable to close point in time", "error", err)
+		return
+	}
+	res.Body.Close()
+}
+
+//pageThrough runs the query over a point in time and hands the hits to fn one
+//page of pageSize (exportPageSize when 0) at a time, until limit documents
+//were seen (all of them when limit is 0) or fn fails. Pages are fetched only
+//as fast as fn consumes them. The progress of the export job of ctx, if any,
+//is kept up to date.
+func pageThrough(ctx context.Context, es *elasticsearch.Client, index []string, q interface{}, limit, pageSize int, fn func([]Hit) error) error {
+	body, ok := searchBody(q)
+	if !ok {
+		return &ValidationError{Path: "/elasticquery", Message: "must be a JSON object"}
+	}
+	if config.SoftDelete.Enabled {
+		body = excludeSoftDeleted(body).(map[string]interface{})
+	}
+	pit, err := openPIT(ctx, es, index, "1m")
+	if err != nil {
+		return err
+	}
+	//closed even when the caller went away
+	defer func() { closePIT(context.WithoutCancel(ctx), es, pit) }()
+
+	sorts, _ := body["sort"].([]interface{})
+	body["sort"] = append(sorts, map[string]interface{}{"_shard_doc": "asc"})
+	if pageSize <= 0 {
+		pageSize = exportPageSize
+	}
+	progress := progressFrom(ctx)
+	if progress != nil {
+		body["track_total_hits"] = true
+	}
+	seen := 0
+	for {
+		size := pageSize
+		if limit > 0 && limit-seen < size {
+			size = limit - seen
+		}
+		body["size"] = size
+		body["pit"] = map[string]interface{}{"id": pit, "keep_alive": "1m"}
+		var page SearchResponse
+		if err := searchInto(ctx, es, nil, body, &page); err != nil {
+			return err
+		}
+		if id, ok := page.Other["pit_id"]; ok {
+			json.Unmarshal(id, &pit)
+		}
+		hits := page.Hits.Hits
+		if len(hits) == 0 {
+			return nil
+		}
+		if err := fn(hits); err != nil {
+			return err
+		}
+		seen += len(hits)
+		if progress != nil {
+			var total int64
+			if _, first := body["track_total_hits"]; first && page.Hits.Total != nil {
+				total = page.Hits.Total.Value
+				if limit > 0 && int64(limit) < total {
+					total = int64(limit)
+				}
+			}
+			progress.update(int64(seen), total)
+			//the total is known after the first page
+			delete(body, "track_total_hits")
+		}
+		if (limit > 0 && seen >= limit) || len(hits) < size {
+			return nil
+		}
+		body["search_after"] = hits[len(hits)-1].Sort
+	}
+}
+
+//decodeExport reads and checks the body of an export request.
+func decodeExport(w http.ResponseWriter, r *http.Request) (req ExportRequest, index []string, ok bool) {
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return req, nil, false
+	}
+	if len(req.Index) == 0 {
+		http.Error(w, "index is required", http.StatusBadRequest)
+		return req, nil, false
+	}
+	index = stringToArray(req.Index)
+	if !checkAccess(w, r, opSearch, index) {
+		return req, nil, false
+	}
+	if !req.All && req.Size <= 0 {
+		req.Size = defaultSize
+	}
+	if req.All {
+		req.Size = 0
+	}
+	return req, index, true
+}
+
+//csvValue writes scalars as they are and anything else as JSON.
+func csvValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64, bool:
+		return fmt.Sprint(v)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+//exportCSVHandler streams the documents matching the query as CSV. Nested
+//objects are flattened into dotted columns (user.name); Columns sets which
+//columns come out and in what order, _id, _index and _score included.
+//Without Columns, the columns of the first page are used, sorted.
+func exportCSVHandler(w http.ResponseWriter, r *http.Request) {
+	req, index, ok := decodeExport(w, r)
+	if !ok {
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx, progress := trackExport(r.Context(), index)
+	out := csv.NewWriter(progress.output("csv", "export.csv", w))
+	columns := req.Columns
+	started := false
+	start := func() error {
+		started = true
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="export.csv"`)
+		return out.Write(columns)
+	}
+	err = pageThrough(ctx, es, index, req.ElasticQuery, req.Size, 0, func(hits []Hit) error {
+		rows := make([]map[string]interface{}, len(hits))
+		for i, h := range hits {
+			rows[i] = map[string]interface{}{"_id": h.ID, "_index": h.Index}
+			if h.Score != nil {
+				rows[i]["_score"] = *h.Score
+			}
+			flatten("", h.Source, rows[i])
+		}
+		if !started {
+			if len(columns) == 0 {
+				for k := range rows[0] {
+					columns = append(columns, k)
+				}
+				sort.Strings(columns)
+			}
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		record := make([]string, len(columns))
+		for _, row := range rows {
+			for i, c := range columns {
+				record[i] = csvValue(row[c])
+			}
+			if err := out.Write(record); err != nil {
+				return err
+			}
+		}
+		progress.record(rows)
+		out.Flush()
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		return out.Error()
+	})
+	if err != nil {
+		progress.finish(ctx, err)
+		logger.ErrorContext(r.Context(), "error exporting documents", "error", err)
+		//once rows were sent the status can no longer change
+		if !started {
+			writeValidationError(w, err)
+		}
+		return
+	}
+	if !started {
+		start()
+	}
+	out.Flush()
+	progress.finish(ctx, out.Error())
+}
+
+//exportNDJSONHandler streams the documents matching the query as one JSON
+//hit per line. Pages are fetched as the client reads, so exporting millions
+//of documents holds only one page in memory and a slow reader slows the
+//
+//export down rather than piling documents up in the gateway.
+func exportNDJSONHandler(w http.ResponseWriter, r *http.Request) {
+	req, index, ok := decodeExport(w, r)
+	if !ok {
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	started := false
+	ctx, progress := trackExport(r.Context(), index)
+	enc := json.NewEncoder(progress.output("ndjson", "export.ndjson", w))
+	err = pageThrough(ctx, es, index, req.ElasticQuery, req.Size, 0, func(hits []Hit) error {
+		if !started {
+			started = true
+			w.Header().Set("Content-Type", "application/x-ndjson")
+		}
+		rows := make([]map[string]interface{}, len(hits))
+		for i, h := range hits {
+			if err := enc.Encode(h); err != nil {
+				return err
+			}
+			rows[i] = map[string]interface{}{"_id": h.ID, "_index": h.Index}
+			if h.Score != nil {
+				rows[i]["_score"] = *h.Score
+			}
+			flatten("_source.", h.Source, rows[i])
+		}
+		progress.record(rows)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		return nil
+	})
+	progress.finish(ctx, err)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error exporting documents", "error", err)
+		if !started {
+			writeValidationError(w, err)
+		}
+		return
+	}
+	if !started {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch"
+)
+
+//FanoutConfig bounds fan-out searches: at most MaxTargets targets per search,
+//searched by Workers (at least one) at a time, each within Timeout.
+type FanoutConfig struct {
+	Workers    int      `json:"workers"`
+	MaxTargets int      `json:"max_targets"`
+	Timeout    Duration `json:"timeout"`
+}
+
+//FanoutTarget is an index, or comma separated indices, of a configured
+//environment (the default cluster without one).
+type FanoutTarget struct {
+	Cluster string `json:"cluster"`
+	Index   string `json:"index"`
+}
+
+//FanoutRequest runs one query on every target. Hits are merged by the sort
+//fields ("price:desc,name") when given, else by score, and the first Size
+//are returned (10 by default).
+type FanoutRequest struct {
+	Targets      []FanoutTarget `json:"targets"`
+	ElasticQuery interface{}    `json:"elasticquery"`
+	Filters      []Filter       `json:"filters"`
+	Sort         string         `json:"sort"`
+	Size         int            `json:"size"`
+}
+
+//FanoutResult is the outcome of the search of one target. A target that
+//failed has Error set and adds no hits; the others are still merged.
+type FanoutResult struct {
+	Cluster  string `json:"cluster,omitempty"`
+	Index    string `json:"index"`
+	Took     int64  `json:"took"`
+	Total    int64  `json:"total"`
+	TimedOut bool   `json:"timed_out,omitempty"`
+	Error    string `json:"error,omitempty"`
+	hits     []Hit
+}
+
+//FanoutResponse holds the merged hits, each with the _cluster it came from,
+//and the result of every target in the order of the request.
+type FanoutResponse struct {
+	Took    int64          `json:"took"`
+	Total   int64          `json:"total"`
+	Hits    []Hit          `json:"hits"`
+	Targets []FanoutResult `json:"targets"`
+	Partial bool           `json:"partial"`
+}
+
+//checkFanout rejects a configuration no fan-out search could complete with.
+func checkFanout(c FanoutConfig) error {
+	if c.Workers < 1 {
+		return &ValidationError{Path: "/fanout/workers", Message: "must be at least 1"}
+	}
+	return nil
+}
+
+//fanoutSortKey is a field of the merge order.
+type fanoutSortKey struct {
+	field string
+	desc  bool
+}
+
+func fanoutSortKeys(sortFields []string) []fanoutSortKey {
+	var keys []fanoutSortKey
+	for _, s := range sortFields {
+		field, order, _ := strings.Cut(s, ":")
+		keys = append(keys, fanoutSortKey{field: field, desc: order == "desc"})
+	}
+	return keys
+}
+
+//compareSortValues orders two values of a sort key. Missing values come last
+//whatever the order.
+func compareSortValues(a, b interface{}) (int, bool) {
+	switch {
+	case a == nil && b == nil:
+		return 0, false
+	case a == nil:
+		return 1, true
+	case b == nil:
+		return -1, true
+	}
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			switch {
+			case x < y:
+				return -1, false
+			case x > y:
+				return 1, false
+			}
+			return 0, false
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), false
+		}
+	case bool:
+		if y, ok := b.(bool); ok && x != y {
+			if !x {
+				return -1, false
+			}
+			return 1, false
+		}
+		return 0, false
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b)), false
+}
+
+//mergeHits sorts the hits of all the targets by the sort keys, or by score
+//(highest first) without.
+func mergeHits(hits []Hit, keys []fanoutSortKey) {
+	sort.SliceStable(hits, func(i, j int) bool {
+		if len(keys) == 0 {
+			a, b := 0.0, 0.0
+			if hits[i].Score != nil {
+				a = *hits[i].Score
+			}
+			if hits[j].Score != nil {
+				b = *hits[j].Score
+			}
+			return a > b
+		}
+		for k, key := range keys {
+			var a, b interface{}
+			if k < len(hits[i].Sort) {
+				a = hits[i].Sort[k]
+			}
+			if k < len(hits[j].Sort) {
+				b = hits[j].Sort[k]
+			}
+			c, missing := compareSortValues(a, b)
+			if key.desc && !missing {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+}
+
+//searchTarget runs the query on one target, hiding the soft deleted
+//documents of its indices.
+func searchTarget(ctx context.Context, target FanoutTarget, query map[string]interface{}) FanoutResult {
+	result := FanoutResult{Cluster: target.Cluster, Index: target.Index}
+	for _, index := range stringToArray(target.Index) {
+		if softDeletes(ctx, index) {
+			//the workers share the query, the clause goes into a copy of it
+			q := make(map[string]interface{}, len(query))
+			for k, v := range query {
+				q[k] = v
+			}
+			query = excludeSoftDeleted(q).(map[string]interface{})
+			break
+		}
+	}
+	var es *elasticsearch.Client
+	var err error
+	if len(target.Cluster) == 0 {
+		es, err = defaultClient()
+	} else {
+		es, err = clusterClient(config.Environments[target.Cluster])
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	ctx, cancel := context.WithTimeout(ctx, config.Fanout.Timeout.Duration)
+	defer cancel()
+	var response SearchResponse
+	if err := searchInto(ctx, es, stringToArray(target.Index), query, &response); err != nil {
+		result.Error = err.Error()
+		if ctx.Err() == context.DeadlineExceeded {
+			result.TimedOut = true
+		}
+		return result
+	}
+	result.Took, result.TimedOut = response.Took, response.TimedOut
+	if response.Hits.Total != nil {
+		result.Total = response.Hits.Total.Value
+	}
+	cluster, _ := json.Marshal(target.Cluster)
+	for _, h := range response.Hits.Hits {
+		if h.Other == nil {
+			h.Other = map[string]json.RawMessage{}
+		}
+		h.Other["_cluster"] = cluster
+		result.hits = append(result.hits, h)
+	}
+	return result
+}
+
+//fanoutHandler searches several indices and clusters at once and merges
+//their hits. A target failing or timing out is reported in its result and
+//marks the response partial; the request fails only when every target did.
+func fanoutHandler(w http.ResponseWriter, r *http.Request) {
+	var body FanoutRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body.Targets) == 0 {
+		writeValidationError(w, &ValidationError{Path: "/targets", Message: "is required"})
+		return
+	}
+	if len(body.Targets) > config.Fanout.MaxTargets {
+		writeValidationError(w, &ValidationError{Path: "/targets", Message: fmt.Sprintf("at most %d targets", config.Fanout.MaxTargets)})
+		return
+	}
+	var index []string
+	for i, t := range body.Targets {
+		if len(t.Index) == 0 {
+			writeValidationError(w, &ValidationError{Path: fmt.Sprintf("/targets/%d/index", i), Message: "is required"})
+			return
+		}
+		if _, ok := config.Environments[t.Cluster]; len(t.Cluster) != 0 && !ok {
+			writeValidationError(w, &ValidationError{Path: fmt.Sprintf("/targets/%d/cluster", i), Message: "unknown environment " + t.Cluster})
+			return
+		}
+		if len(t.Cluster) != 0 && tenantFrom(r.Context()) != nil {
+			writeValidationError(w, &ValidationError{Path: fmt.Sprintf("/targets/%d/cluster", i), Message: "tenants search their own cluster"})
+			return
+		}
+		index = append(index, stringToArray(t.Index)...)
+	}
+	if !checkAccess(w, r, opSearch, index) {
+		return
+	}
+	if body.Size <= 0 {
+		body.Size = 10
+	}
+	query, err := withFilters(body.ElasticQuery, body.Filters)
+	if err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	q, ok := searchBody(query)
+	if !ok {
+		writeValidationError(w, &ValidationError{Path: "/elasticquery", Message: "must be a JSON object"})
+		return
+	}
+	//every target returns its first Size hits, enough for the merged first Size
+	q["size"], q["from"] = body.Size, 0
+	keys := fanoutSortKeys(stringToArray(body.Sort))
+	if len(keys) != 0 {
+		sorts := []interface{}{}
+		for _, k := range keys {
+			order := "asc"
+			if k.desc {
+				order = "desc"
+			}
+			sorts = append(sorts, map[string]interface{}{k.field: map[string]interface{}{"order": order}})
+		}
+		q["sort"] = sorts
+	}
+
+	start := time.Now()
+	results := make([]FanoutResult, len(body.Targets))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for n := 0; n < config.Fanout.Workers && n < len(body.Targets); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = searchTarget(r.Context(), body.Targets[i], q)
+			}
+		}()
+	}
+	for i := range body.Targets {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	response := FanoutResponse{Hits: []Hit{}, Targets: results}
+	failed := 0
+	for _, result := range results {
+		if len(result.Error) != 0 {
+			failed++
+			logger.WarnContext(r.Context(), "fan-out target failed", "cluster", result.Cluster, "index", result.Index, "error", result.Error)
+		}
+		response.Total += result.Total
+		response.Hits = append(response.Hits, result.hits...)
+	}
+	if failed == len(results) {
+		http.Error(w, "every target failed: "+results[0].Error, http.StatusBadGateway)
+		return
+	}
+	mergeHits(response.Hits, keys)
+	if len(response.Hits) > body.Size {
+		response.Hits = response.Hits[:body.Size]
+	}
+	response.Partial = failed != 0
+	response.Took = time.Since(start).Milliseconds()
+	writeJSON(w, http.StatusOK, response)
+}
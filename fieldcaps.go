@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+//FieldCap is what a field of the indices can be used for. A field mapped with
+//different types across the indices is listed once per type, with Conflict
+//set and the Indices of each type.
+type FieldCap struct {
+	Name                   string   `json:"name"`
+	Type                   string   `json:"type"`
+	Searchable             bool     `json:"searchable"`
+	Aggregatable           bool     `json:"aggregatable"`
+	Conflict               bool     `json:"conflict,omitempty"`
+	Indices                []string `json:"indices,omitempty"`
+	NonSearchableIndices   []string `json:"non_searchable_indices,omitempty"`
+	NonAggregatableIndices []string `json:"non_aggregatable_indices,omitempty"`
+}
+
+//fieldCapsHandler tells which fields of the indices matching the index
+//parameter can be searched and aggregated on, for building filter UIs. fields
+//restricts them by name pattern and types by type. Object fields and the
+//metadata fields (_id, _index...) are left out; format=raw returns the
+//_field_caps answer as it is.
+func fieldCapsHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	if len(params.Get("index")) == 0 {
+		writeValidationError(w, &ValidationError{Path: "/index", Message: "is required"})
+		return
+	}
+	index := stringToArray(params.Get("index"))
+	if !checkAccess(w, r, opSearch, index) {
+		return
+	}
+	path := "/" + url.PathEscape(strings.Join(index, ",")) + "/_field_caps"
+	query := forwardParams(r, "fields", "include_unmapped", "ignore_unavailable", "allow_no_indices", "expand_wildcards")
+	if len(query.Get("fields")) == 0 {
+		query.Set("fields", "*")
+	}
+	if params.Get("format") == "raw" {
+		passthrough(w, r, http.MethodGet, path, query, nil)
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, path+"?"+query.Encode(), nil)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error creating elastic search request", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res, err := es.Perform(req)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error getting response from elastic search cluster", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	var caps struct {
+		Indices []string                       `json:"indices"`
+		Fields  map[string]map[string]FieldCap `json:"fields"`
+	}
+	if err := decodeAdminResponse(res.StatusCode >= http.StatusMultipleChoices, res.Status, res.Body, &caps); err != nil {
+		logger.ErrorContext(r.Context(), "error getting field capabilities", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	types := map[string]bool{}
+	if len(params.Get("types")) != 0 {
+		for _, t := range stringToArray(params.Get("types")) {
+			types[t] = true
+		}
+	}
+	fields := []FieldCap{}
+	for name, byType := range caps.Fields {
+		if strings.HasPrefix(name, "_") {
+			continue
+		}
+		for t, c := range byType {
+			if t == "object" || t == "nested" || len(types) != 0 && !types[t] {
+				continue
+			}
+			c.Name, c.Type, c.Conflict = name, t, len(byType) > 1
+			fields = append(fields, c)
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		if fields[i].Name != fields[j].Name {
+			return fields[i].Name < fields[j].Name
+		}
+		return fields[i].Type < fields[j].Type
+	})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"indices": caps.Indices, "fields": fields})
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+//Flags gating behaviors that are rolled out gradually. They are on by
+//default so that configurations without flags keep working as before.
+const (
+	flagTypedResponses = "typed_responses"
+	flagQueryRewriting = "query_rewriting"
+	flagCaching        = "caching"
+	flagKeywordFields  = "keyword_fields"
+)
+
+//Flag turns a behavior on for everyone (Enabled) or for Percent of the
+//callers, picked by a hash of the caller so each one sees the same behavior
+//on every request. Tenants overrides both for the listed tenants.
+type Flag struct {
+	Enabled bool            `json:"enabled"`
+	Percent float64         `json:"percent,omitempty"`
+	Tenants map[string]bool `json:"tenants,omitempty"`
+}
+
+func defaultFlags() map[string]Flag {
+	return map[string]Flag{
+		flagTypedResponses: {Enabled: true},
+		flagQueryRewriting: {Enabled: true},
+		flagCaching:        {Enabled: true},
+		flagKeywordFields:  {Enabled: true},
+	}
+}
+
+//flagOverrides are the flags changed through the admin API. They replace the
+//configured flag until removed, and are kept in the store.
+var (
+	flagsMu       sync.Mutex
+	flagOverrides = map[string]Flag{}
+)
+
+//flagsNamespace is the namespace of the flag overrides in the store.
+const flagsNamespace = "flags"
+
+//loadFlagOverrides replaces the overrides with those of the store.
+func loadFlagOverrides(ctx context.Context) error {
+	values, err := state.list(ctx, flagsNamespace)
+	if err != nil {
+		return err
+	}
+	overrides := map[string]Flag{}
+	for name, b := range values {
+		var f Flag
+		if err := json.Unmarshal(b, &f); err != nil {
+			return fmt.Errorf("flag override %s: %w", name, err)
+		}
+		overrides[name] = f
+	}
+	flagsMu.Lock()
+	flagOverrides = overrides
+	flagsMu.Unlock()
+	return nil
+}
+
+//currentFlag returns the flag as overridden or configured.
+func currentFlag(name string) (Flag, bool) {
+	flagsMu.Lock()
+	f, ok := flagOverrides[name]
+	flagsMu.Unlock()
+	if ok {
+		return f, true
+	}
+	f, ok = config.Flags[name]
+	return f, ok
+}
+
+//flagEnabled tells whether the flag is on for the caller. Unknown flags are off.
+func flagEnabled(r *http.Request, name string) bool {
+	f, ok := currentFlag(name)
+	if !ok {
+		return false
+	}
+	if t := tenantFrom(r.Context()); t != nil {
+		if on, ok := f.Tenants[t.Name]; ok {
+			return on
+		}
+	}
+	if f.Enabled {
+		return true
+	}
+	if f.Percent <= 0 {
+		return false
+	}
+	caller := experimentUser(r)
+	if len(caller) == 0 {
+		caller = requestID(r.Context())
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name + ":" + caller))
+	return float64(h.Sum32()%10000)/100 < f.Percent
+}
+
+//FlagState is a flag as configured, as overridden and as it applies to the
+//caller of the admin API.
+type FlagState struct {
+	Name       string `json:"name"`
+	Configured Flag   `json:"configured"`
+	Override   *Flag  `json:"override,omitempty"`
+	Enabled    bool   `json:"enabled"`
+}
+
+//flagsHandler lists the flags.
+func flagsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	names := make([]string, 0, len(config.Flags))
+	for name := range config.Flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	states := make([]FlagState, 0, len(names))
+	flagsMu.Lock()
+	for _, name := range names {
+		s := FlagState{Name: name, Configured: config.Flags[name]}
+		if f, ok := flagOverrides[name]; ok {
+			s.Override = &f
+		}
+		states = append(states, s)
+	}
+	flagsMu.Unlock()
+	for i := range states {
+		states[i].Enabled = flagEnabled(r, states[i].Name)
+	}
+	writeJSON(w, http.StatusOK, states)
+}
+
+//putFlagHandler overrides a configured flag.
+func putFlagHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	if _, ok := config.Flags[name]; !ok {
+		http.Error(w, "unknown flag "+name, http.StatusNotFound)
+		return
+	}
+	var f Flag
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f.Percent < 0 || f.Percent > 100 {
+		writeValidationError(w, &ValidationError{Path: "/percent", Message: "percent must be between 0 and 100"})
+		return
+	}
+	if err := saveState(r.Context(), flagsNamespace, name, f); err != nil {
+		logger.ErrorContext(r.Context(), "unable to save flag override", "flag", name, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	flagsMu.Lock()
+	flagOverrides[name] = f
+	flagsMu.Unlock()
+	logger.InfoContext(r.Context(), "flag overridden", "flag", name, "enabled", f.Enabled, "percent", f.Percent, "actor", actor(r))
+	writeJSON(w, http.StatusOK, FlagState{Name: name, Configured: config.Flags[name], Override: &f, Enabled: flagEnabled(r, name)})
+}
+
+//deleteFlagHandler removes the override of a flag, back to its configuration.
+func deleteFlagHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	flagsMu.Lock()
+	_, ok := flagOverrides[name]
+	flagsMu.Unlock()
+	if !ok {
+		http.Error(w, "flag "+name+" is not overridden", http.StatusNotFound)
+		return
+	}
+	if err := saveState(r.Context(), flagsNamespace, name, nil); err != nil {
+		logger.ErrorContext(r.Context(), "unable to remove flag override", "flag", name, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	flagsMu.Lock()
+	delete(flagOverrides, name)
+	flagsMu.Unlock()
+	logger.InfoContext(r.Context(), "flag override removed", "flag", name, "actor", actor(r))
+	w.WriteHeader(http.StatusNoContent)
+}
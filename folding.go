@@ -0,0 +1,27 @@
+package main
+
+//FoldingConfig makes full-text searches with normalize set match regardless
+//of case and accents. Subfields names, per index, the subfield indexed with a
+//folding analyzer (title.folded for "folded"). Searches over indices without
+//one, or over indices that disagree, use Analyzer as search analyzer instead,
+//which only helps where the indexed terms are folded as well.
+type FoldingConfig struct {
+	Subfields map[string]string `json:"subfields"`
+	Analyzer  string            `json:"analyzer"`
+}
+
+//foldingFor returns the folded subfield shared by all the indices, or else
+//the search analyzer to use.
+func foldingFor(index []string) (subfield, analyzer string) {
+	for i, idx := range index {
+		s := config.Folding.Subfields[idx]
+		if len(s) == 0 || (i > 0 && s != subfield) {
+			return "", config.Folding.Analyzer
+		}
+		subfield = s
+	}
+	if len(subfield) == 0 {
+		return "", config.Folding.Analyzer
+	}
+	return subfield, ""
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch"
+)
+
+//FreshnessConfig adds meta.freshness to search responses: the newest
+//TimestampField value and the refresh interval of every queried index.
+//Lookups are cached for CacheTTL.
+type FreshnessConfig struct {
+	Enabled        bool     `json:"enabled"`
+	TimestampField string   `json:"timestamp_field"`
+	CacheTTL       Duration `json:"cache_ttl"`
+}
+
+//IndexFreshness tells how recent the data of one index is.
+type IndexFreshness struct {
+	MaxTimestamp    string `json:"max_timestamp,omitempty"`
+	RefreshInterval string `json:"refresh_interval,omitempty"`
+}
+
+type freshnessEntry struct {
+	at      time.Time
+	indices map[string]IndexFreshness
+}
+
+var (
+	freshnessMu    sync.Mutex
+	freshnessCache = map[string]freshnessEntry{}
+)
+
+//indexFreshness returns the freshness of the indices behind the index patterns.
+func indexFreshness(ctx context.Context, es *elasticsearch.Client, index []string) (map[string]IndexFreshness, error) {
+	key := tenantScope(ctx, strings.Join(index, ","))
+	freshnessMu.Lock()
+	e, ok := freshnessCache[key]
+	freshnessMu.Unlock()
+	if ok && time.Since(e.at) < config.Freshness.CacheTTL.Duration {
+		return e.indices, nil
+	}
+
+	query := map[string]interface{}{
+		"size": 0,
+		"aggs": map[string]interface{}{
+			"indices": map[string]interface{}{
+				"terms": map[string]interface{}{"field": "_index", "size": 100},
+				"aggs": map[string]interface{}{
+					"latest": map[string]interface{}{"max": map[string]interface{}{"field": config.Freshness.TimestampField}},
+				},
+			},
+		},
+	}
+	var result struct {
+		Aggregations struct {
+			Indices struct {
+				Buckets []struct {
+					Key    string `json:"key"`
+					Latest struct {
+						ValueAsString string `json:"value_as_string"`
+					} `json:"latest"`
+				} `json:"buckets"`
+			} `json:"indices"`
+		} `json:"aggregations"`
+	}
+	if err := searchInto(ctx, es, index, query, &result); err != nil {
+		return nil, err
+	}
+	indices := map[string]IndexFreshness{}
+	for _, b := range result.Aggregations.Indices.Buckets {
+		indices[b.Key] = IndexFreshness{MaxTimestamp: b.Latest.ValueAsString}
+	}
+
+	res, err := es.Indices.GetSettings(
+		es.Indices.GetSettings.WithContext(ctx),
+		es.Indices.GetSettings.WithIndex(index...),
+		es.Indices.GetSettings.WithName("index.refresh_interval"),
+		es.Indices.GetSettings.WithIncludeDefaults(true),
+		es.Indices.GetSettings.WithFlatSettings(true),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, fmt.Errorf("index settings: %s", res.Status())
+	}
+	var settings map[string]struct {
+		Settings map[string]string `json:"settings"`
+		Defaults map[string]string `json:"defaults"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&settings); err != nil {
+		return nil, err
+	}
+	for name, s := range settings {
+		f := indices[name]
+		f.RefreshInterval = s.Settings["index.refresh_interval"]
+		if len(f.RefreshInterval) == 0 {
+			f.RefreshInterval = s.Defaults["index.refresh_interval"]
+		}
+		indices[name] = f
+	}
+
+	freshnessMu.Lock()
+	freshnessCache[key] = freshnessEntry{at: time.Now(), indices: indices}
+	freshnessMu.Unlock()
+	return indices, nil
+}
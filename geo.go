@@ -0,0 +1,139 @@
+package main
+
+//Geo filters and sorts a search on the distance to a point of a geo_point
+//field, for callers who do not know the geo queries of the query DSL:
+//
+//	{"field": "location", "distance": {"lat": 48.85, "lon": 2.35, "radius": "5km"}}
+//	{"field": "location", "bounding_box": {"top_left": {...}, "bottom_right": {...}}}
+//	{"field": "location", "sort": {"lat": 48.85, "lon": 2.35}, "unit": "m"}
+//
+//When a point is given, by distance or sort, the distance of every hit to it
+//is returned in its geo_distance field, in Unit (km by default).
+type Geo struct {
+	Field       string       `json:"field"`
+	Distance    *GeoDistance `json:"distance"`
+	BoundingBox *GeoBox      `json:"bounding_box"`
+	Sort        *GeoSort     `json:"sort"`
+	Unit        string       `json:"unit"`
+}
+
+//GeoPoint is a latitude and longitude in degrees.
+type GeoPoint struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+//GeoDistance keeps the documents within Radius ("500m", "5km") of the point.
+type GeoDistance struct {
+	GeoPoint
+	Radius string `json:"radius"`
+}
+
+//GeoBox keeps the documents within the box.
+type GeoBox struct {
+	TopLeft     GeoPoint `json:"top_left"`
+	BottomRight GeoPoint `json:"bottom_right"`
+}
+
+//GeoSort orders the hits by distance to the point, nearest first unless
+//Order is desc.
+type GeoSort struct {
+	GeoPoint
+	Order string `json:"order"`
+}
+
+//geoUnits are the distance units hits can be given in, in meters.
+var geoUnits = map[string]float64{"m": 1, "km": 1000, "mi": 1609.344, "yd": 0.9144, "ft": 0.3048}
+
+//geoDistanceField is the field the distance of a hit is returned in.
+const geoDistanceField = "geo_distance"
+
+//geoDistanceScript computes the distance of a hit to the point, null for
+//documents without the field.
+const geoDistanceScript = "doc[params.field].size() == 0 ? null : doc[params.field].arcDistance(params.lat, params.lon) / params.unit"
+
+func (p GeoPoint) check(path string) error {
+	if p.Lat < -90 || p.Lat > 90 {
+		return &ValidationError{Path: path + "/lat", Message: "lat must be between -90 and 90"}
+	}
+	if p.Lon < -180 || p.Lon > 180 {
+		return &ValidationError{Path: path + "/lon", Message: "lon must be between -180 and 180"}
+	}
+	return nil
+}
+
+//withGeo adds the geo filters, sort and distance of the request to the search body.
+func withGeo(q interface{}, g *Geo) (interface{}, error) {
+	if len(g.Field) == 0 {
+		return nil, &ValidationError{Path: "/geo/field", Message: "field is required"}
+	}
+	if len(g.Unit) == 0 {
+		g.Unit = "km"
+	}
+	unit, ok := geoUnits[g.Unit]
+	if !ok {
+		return nil, &ValidationError{Path: "/geo/unit", Message: "unit must be one of m, km, mi, yd, ft"}
+	}
+	body, ok := searchBody(q)
+	if !ok {
+		return nil, &ValidationError{Path: "/", Message: "elasticquery must be a JSON object when geo options are used"}
+	}
+	var center *GeoPoint
+	if d := g.Distance; d != nil {
+		if err := d.check("/geo/distance"); err != nil {
+			return nil, err
+		}
+		if len(d.Radius) == 0 {
+			return nil, &ValidationError{Path: "/geo/distance/radius", Message: "radius is required"}
+		}
+		addClause(body, "filter", map[string]interface{}{
+			"geo_distance": map[string]interface{}{"distance": d.Radius, g.Field: d.GeoPoint},
+		})
+		center = &d.GeoPoint
+	}
+	if b := g.BoundingBox; b != nil {
+		if err := b.TopLeft.check("/geo/bounding_box/top_left"); err != nil {
+			return nil, err
+		}
+		if err := b.BottomRight.check("/geo/bounding_box/bottom_right"); err != nil {
+			return nil, err
+		}
+		if b.TopLeft.Lat < b.BottomRight.Lat {
+			return nil, &ValidationError{Path: "/geo/bounding_box", Message: "top_left must be north of bottom_right"}
+		}
+		addClause(body, "filter", map[string]interface{}{
+			"geo_bounding_box": map[string]interface{}{g.Field: b},
+		})
+	}
+	if s := g.Sort; s != nil {
+		if err := s.check("/geo/sort"); err != nil {
+			return nil, err
+		}
+		opts := map[string]interface{}{g.Field: s.GeoPoint, "unit": g.Unit}
+		switch s.Order {
+		case "", "asc", "desc":
+			if len(s.Order) != 0 {
+				opts["order"] = s.Order
+			}
+		default:
+			return nil, &ValidationError{Path: "/geo/sort/order", Message: "order must be asc or desc"}
+		}
+		sorts, _ := body["sort"].([]interface{})
+		body["sort"] = append(sorts, map[string]interface{}{"_geo_distance": opts})
+		center = &s.GeoPoint
+	}
+	if center != nil {
+		scripts, _ := body["script_fields"].(map[string]interface{})
+		if scripts == nil {
+			scripts = map[string]interface{}{}
+		}
+		scripts[geoDistanceField] = map[string]interface{}{
+			"script": map[string]interface{}{
+				"source": geoDistanceScript,
+				"params": map[string]interface{}{"field": g.Field, "lat": center.Lat, "lon": center.Lon, "unit": unit},
+			},
+		}
+		body["script_fields"] = scripts
+	}
+	return body, nil
+}
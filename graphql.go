@@ -0,0 +1,562 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch"
+)
+
+//GraphQLConfig exposes indices through a GraphQL endpoint. Each index is a
+//field of the Query type, its document type being read from the mapping:
+//
+//	{ products(query: "shoes", filters: [{field: "price", op: "lte", value: 100}], first: 20) { total hits { _id name price } } }
+//
+//The endpoint is only served when Indices is set.
+type GraphQLConfig struct {
+	Indices []string `json:"indices"`
+}
+
+func (c GraphQLConfig) enabled() bool {
+	return len(c.Indices) != 0
+}
+
+//gqlScalars maps elastic search field types to GraphQL scalars. Other types
+//(geo_point, range...) are exposed as JSON.
+var gqlScalars = map[string]string{
+	"text": "String", "keyword": "String", "constant_keyword": "String", "wildcard": "String",
+	"match_only_text": "String", "search_as_you_type": "String", "ip": "String", "version": "String",
+	"date": "String", "date_nanos": "String",
+	"long": "Int", "integer": "Int", "short": "Int", "byte": "Int", "unsigned_long": "Int",
+	"double": "Float", "float": "Float", "half_float": "Float", "scaled_float": "Float",
+	"boolean": "Boolean",
+}
+
+//gqlType is an object type of the schema.
+type gqlType struct {
+	Name   string
+	Fields []*gqlFieldDef
+}
+
+//gqlFieldDef is a field of an object type. Key is the source field it reads,
+//Name its GraphQL name, which differs when the source name is not a valid
+//GraphQL name (@timestamp is _timestamp).
+type gqlFieldDef struct {
+	Name   string
+	Key    string
+	Scalar string
+	Object *gqlType
+	List   bool
+}
+
+func (t *gqlType) field(name string) *gqlFieldDef {
+	for _, f := range t.Fields {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+//gqlRoot is a field of the Query type: an index and its document type.
+type gqlRoot struct {
+	Name  string
+	Index string
+	Doc   *gqlType
+}
+
+//gqlSchema is the schema built from the mappings of the configured indices.
+type gqlSchema struct {
+	at    time.Time
+	Roots []gqlRoot
+}
+
+func (s *gqlSchema) root(name string) *gqlRoot {
+	for i := range s.Roots {
+		if s.Roots[i].Name == name {
+			return &s.Roots[i]
+		}
+	}
+	return nil
+}
+
+//gqlName turns a field or index name into a valid GraphQL name.
+func gqlName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if !isNameChar(c) {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 || !isNameStart(b[0]) {
+		b = append([]byte{'_'}, b...)
+	}
+	return string(b)
+}
+
+//gqlTypeName turns a name into a type name: logs-2024 is Logs2024.
+func gqlTypeName(s string) string {
+	var b strings.Builder
+	for _, part := range strings.FieldsFunc(s, func(r rune) bool { return r > 127 || !isNameChar(byte(r)) || r == '_' }) {
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	if b.Len() == 0 || !isNameStart(b.String()[0]) {
+		return "T" + b.String()
+	}
+	return b.String()
+}
+
+//gqlObjectType builds the type of a mapping's properties. Object and nested
+//fields become types of their own, named after their path.
+func gqlObjectType(name string, properties map[string]interface{}) *gqlType {
+	t := &gqlType{Name: name}
+	keys := make([]string, 0, len(properties))
+	for k := range properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		prop, _ := properties[k].(map[string]interface{})
+		f := &gqlFieldDef{Name: gqlName(k), Key: k}
+		if strings.HasPrefix(f.Name, "__") || t.field(f.Name) != nil {
+			continue
+		}
+		kind, _ := prop["type"].(string)
+		if sub, ok := prop["properties"].(map[string]interface{}); ok {
+			f.Object = gqlObjectType(name+gqlTypeName(k), sub)
+			f.List = kind == "nested"
+		} else if f.Scalar = gqlScalars[kind]; len(f.Scalar) == 0 {
+			f.Scalar = "JSON"
+		}
+		t.Fields = append(t.Fields, f)
+	}
+	return t
+}
+
+var (
+	gqlSchemaMu    sync.Mutex
+	gqlSchemaCache = map[string]*gqlSchema{}
+)
+
+//graphQLSchema returns the schema of the configured indices. Mappings rarely
+//change, so the schema is rebuilt at most every five minutes.
+func graphQLSchema(ctx context.Context, es *elasticsearch.Client) (*gqlSchema, error) {
+	key := tenantScope(ctx, "")
+	gqlSchemaMu.Lock()
+	cached := gqlSchemaCache[key]
+	gqlSchemaMu.Unlock()
+	if cached != nil && time.Since(cached.at) < 5*time.Minute {
+		return cached, nil
+	}
+	schema := &gqlSchema{at: time.Now()}
+	for _, index := range config.GraphQL.Indices {
+		res, err := es.Indices.GetMapping(
+			es.Indices.GetMapping.WithContext(ctx),
+			es.Indices.GetMapping.WithIndex(index),
+		)
+		if err != nil {
+			return nil, err
+		}
+		var mappings map[string]struct {
+			Mappings struct {
+				Properties map[string]interface{} `json:"properties"`
+			} `json:"mappings"`
+		}
+		if err := decodeAdminResponse(res.IsError(), res.Status(), res.Body, &mappings); err != nil {
+			return nil, err
+		}
+		//an alias or a pattern resolves to several indices: merge their fields
+		properties := map[string]interface{}{}
+		for _, m := range mappings {
+			for k, v := range m.Mappings.Properties {
+				properties[k] = v
+			}
+		}
+		schema.Roots = append(schema.Roots, gqlRoot{
+			Name:  gqlName(index),
+			Index: index,
+			Doc:   gqlObjectType(gqlTypeName(index), properties),
+		})
+	}
+	gqlSchemaMu.Lock()
+	gqlSchemaCache[key] = schema
+	gqlSchemaMu.Unlock()
+	return schema, nil
+}
+
+//sdl writes the schema in the GraphQL schema definition language.
+func (s *gqlSchema) sdl() string {
+	var b bytes.Buffer
+	b.WriteString("scalar JSON\n\ninput Filter {\n  field: String!\n  op: String\n  value: JSON\n}\n\ntype Query {\n")
+	for _, root := range s.Roots {
+		fmt.Fprintf(&b, "  %s(query: String, filters: [Filter!], sort: [String!], first: Int, offset: Int): %sResult\n", root.Name, root.Doc.Name)
+	}
+	b.WriteString("}\n")
+	var types []*gqlType
+	var walk func(t *gqlType)
+	walk = func(t *gqlType) {
+		types = append(types, t)
+		for _, f := range t.Fields {
+			if f.Object != nil {
+				walk(f.Object)
+			}
+		}
+	}
+	for _, root := range s.Roots {
+		fmt.Fprintf(&b, "\ntype %sResult {\n  total: Int\n  took: Int\n  hits: [%s!]!\n}\n", root.Doc.Name, root.Doc.Name)
+		walk(root.Doc)
+	}
+	for _, t := range types {
+		fmt.Fprintf(&b, "\ntype %s {\n", t.Name)
+		if isRootDoc(s, t) {
+			b.WriteString("  _id: ID!\n  _index: String!\n  _score: Float\n")
+		}
+		for _, f := range t.Fields {
+			name := f.Scalar
+			if f.Object != nil {
+				name = f.Object.Name
+			}
+			if f.List {
+				name = "[" + name + "!]"
+			}
+			fmt.Fprintf(&b, "  %s: %s\n", f.Name, name)
+		}
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+func isRootDoc(s *gqlSchema, t *gqlType) bool {
+	for _, root := range s.Roots {
+		if root.Doc == t {
+			return true
+		}
+	}
+	return false
+}
+
+//gqlObject is a JSON object that keeps its keys in selection order, as
+//GraphQL responses do.
+type gqlObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newGQLObject() *gqlObject {
+	return &gqlObject{values: map[string]interface{}{}}
+}
+
+func (o *gqlObject) set(key string, v interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = v
+}
+
+func (o *gqlObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range o.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(k)
+		v, err := json.Marshal(o.values[k])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+//sourcePaths checks the selection against the type and returns the source
+//fields it reads, for _source filtering.
+func sourcePaths(fields []gqlField, t *gqlType, prefix string, root bool) ([]string, error) {
+	var paths []string
+	for _, sel := range fields {
+		if sel.Name == "__typename" || (root && (sel.Name == "_id" || sel.Name == "_index" || sel.Name == "_score")) {
+			continue
+		}
+		f := t.field(sel.Name)
+		if f == nil {
+			return nil, &gqlError{Message: fmt.Sprintf("cannot query field %q on type %s", sel.Name, t.Name), Line: sel.Line}
+		}
+		if f.Object == nil {
+			if len(sel.Selections) != 0 {
+				return nil, &gqlError{Message: fmt.Sprintf("field %q of type %s has no subfields", sel.Name, f.Scalar), Line: sel.Line}
+			}
+			paths = append(paths, prefix+f.Key)
+			continue
+		}
+		if len(sel.Selections) == 0 {
+			return nil, &gqlError{Message: fmt.Sprintf("field %q of type %s must have a selection of subfields", sel.Name, f.Object.Name), Line: sel.Line}
+		}
+		sub, err := sourcePaths(sel.Selections, f.Object, prefix+f.Key+".", false)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, sub...)
+	}
+	return paths, nil
+}
+
+//resolveObject shapes a source object after the selection. hit is the hit
+//of a document, whose metadata fields can be selected too, and nil for
+//inner objects.
+func resolveObject(fields []gqlField, t *gqlType, source map[string]interface{}, hit *Hit) *gqlObject {
+	out := newGQLObject()
+	for _, sel := range fields {
+		switch {
+		case sel.Name == "__typename":
+			out.set(sel.key(), t.Name)
+			continue
+		case hit != nil && sel.Name == "_id":
+			out.set(sel.key(), hit.ID)
+			continue
+		case hit != nil && sel.Name == "_index":
+			out.set(sel.key(), hit.Index)
+			continue
+		case hit != nil && sel.Name == "_score":
+			out.set(sel.key(), hit.Score)
+			continue
+		}
+		f := t.field(sel.Name)
+		if f == nil {
+			continue
+		}
+		out.set(sel.key(), resolveValue(sel, f, source[f.Key]))
+	}
+	return out
+}
+
+func resolveValue(sel gqlField, f *gqlFieldDef, v interface{}) interface{} {
+	if f.Object == nil || v == nil {
+		return v
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		obj := resolveObject(sel.Selections, f.Object, v, nil)
+		if f.List {
+			return []interface{}{obj}
+		}
+		return obj
+	case []interface{}:
+		list := make([]interface{}, 0, len(v))
+		for _, e := range v {
+			if obj, ok := e.(map[string]interface{}); ok {
+				list = append(list, resolveObject(sel.Selections, f.Object, obj, nil))
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+//gqlArgs are the arguments of a Query field.
+type gqlArgs struct {
+	Query   string   `json:"query"`
+	Filters []Filter `json:"filters"`
+	Sort    []string `json:"sort"`
+	First   *int     `json:"first"`
+	Offset  int      `json:"offset"`
+}
+
+//compileGraphQL builds the search body of a Query field.
+func compileGraphQL(sel gqlField, root *gqlRoot) (body map[string]interface{}, args gqlArgs, err error) {
+	b, err := json.Marshal(sel.Args)
+	if err != nil {
+		return nil, args, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&args); err != nil {
+		return nil, args, &gqlError{Message: "invalid arguments: " + err.Error(), Line: sel.Line}
+	}
+	body = map[string]interface{}{}
+	if len(args.Query) != 0 {
+		body["query"] = map[string]interface{}{"query_string": map[string]interface{}{"query": args.Query}}
+	}
+	if len(args.Filters) != 0 {
+		q, err := withFilters(body, args.Filters)
+		if err != nil {
+			return nil, args, err
+		}
+		body = q.(map[string]interface{})
+	}
+	if len(args.Sort) != 0 {
+		var sorts []interface{}
+		for _, s := range args.Sort {
+			field, order, _ := strings.Cut(s, ":")
+			if len(order) == 0 {
+				order = "asc"
+			}
+			sorts = append(sorts, map[string]interface{}{field: map[string]interface{}{"order": order}})
+		}
+		body["sort"] = sorts
+	}
+	size := defaultSize
+	if args.First != nil {
+		size = *args.First
+	}
+	body["size"], body["from"] = size, args.Offset
+	body["_source"] = false
+	for _, f := range sel.Selections {
+		switch f.Name {
+		case "total":
+			body["track_total_hits"] = true
+		case "hits":
+			if len(f.Selections) == 0 {
+				return nil, args, &gqlError{Message: "hits must have a selection of subfields", Line: f.Line}
+			}
+			paths, err := sourcePaths(f.Selections, root.Doc, "", true)
+			if err != nil {
+				return nil, args, err
+			}
+			if len(paths) != 0 {
+				body["_source"] = paths
+			}
+		case "took", "__typename":
+		default:
+			return nil, args, &gqlError{Message: fmt.Sprintf("cannot query field %q on type %sResult", f.Name, root.Doc.Name), Line: f.Line}
+		}
+	}
+	return body, args, nil
+}
+
+//executeGraphQL runs one Query field and shapes its result.
+func executeGraphQL(r *http.Request, es *elasticsearch.Client, schema *gqlSchema, sel gqlField) (interface{}, error) {
+	root := schema.root(sel.Name)
+	if root == nil {
+		return nil, &gqlError{Message: fmt.Sprintf("cannot query field %q on type Query", sel.Name), Line: sel.Line}
+	}
+	if len(sel.Selections) == 0 {
+		return nil, &gqlError{Message: sel.Name + " must have a selection of subfields", Line: sel.Line}
+	}
+	index := []string{root.Index}
+	if err := authorize(r, opSearch, index); err != nil {
+		return nil, err
+	}
+	body, args, err := compileGraphQL(sel, root)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPagination(r.Context(), es, index, args.Offset, body["size"].(int)); err != nil {
+		return nil, err
+	}
+	var q interface{} = body
+	if config.SoftDelete.Enabled {
+		q = excludeSoftDeleted(q)
+	}
+	var res SearchResponse
+	if err := searchInto(r.Context(), es, index, q, &res); err != nil {
+		return nil, err
+	}
+	out := newGQLObject()
+	for _, f := range sel.Selections {
+		switch f.Name {
+		case "__typename":
+			out.set(f.key(), root.Doc.Name+"Result")
+		case "took":
+			out.set(f.key(), res.Took)
+		case "total":
+			var total interface{}
+			if res.Hits.Total != nil {
+				total = res.Hits.Total.Value
+			}
+			out.set(f.key(), total)
+		case "hits":
+			hits := make([]interface{}, 0, len(res.Hits.Hits))
+			for i := range res.Hits.Hits {
+				h := &res.Hits.Hits[i]
+				hits = append(hits, resolveObject(f.Selections, root.Doc, h.Source, h))
+			}
+			out.set(f.key(), hits)
+		}
+	}
+	return out, nil
+}
+
+//GraphQLRequest is the body of a GraphQL request.
+type GraphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+//graphQLHandler executes a GraphQL query. Each Query field is a search of its
+//own; a failing one is null in data and reported in errors, the others are
+//still answered.
+func graphQLHandler(w http.ResponseWriter, r *http.Request) {
+	var req GraphQLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fields, err := parseGraphQL(req.Query, req.OperationName, req.Variables)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"errors": []*gqlError{{Message: err.Error()}}})
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	schema, err := graphQLSchema(r.Context(), es)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error reading index mappings", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	data := newGQLObject()
+	var errs []*gqlError
+	for _, f := range fields {
+		if f.Name == "__typename" {
+			data.set(f.key(), "Query")
+			continue
+		}
+		v, err := executeGraphQL(r, es, schema, f)
+		if err != nil {
+			logger.WarnContext(r.Context(), "graphql field failed", "field", f.Name, "error", err)
+			errs = append(errs, &gqlError{Message: err.Error(), Path: []interface{}{f.key()}})
+		}
+		data.set(f.key(), v)
+	}
+	out := map[string]interface{}{"data": data}
+	if len(errs) != 0 {
+		out["errors"] = errs
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+//graphQLSchemaHandler returns the schema of the GraphQL endpoint in the
+//schema definition language, for client code generators.
+func graphQLSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	schema, err := graphQLSchema(r.Context(), es)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error reading index mappings", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(schema.sdl()))
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+//gqlField is a field of a GraphQL selection set, with its arguments resolved
+//against the variables of the request.
+type gqlField struct {
+	Alias      string
+	Name       string
+	Args       map[string]interface{}
+	Selections []gqlField
+	Line       int
+}
+
+//key is the name of the field in the response.
+func (f gqlField) key() string {
+	if len(f.Alias) != 0 {
+		return f.Alias
+	}
+	return f.Name
+}
+
+type gqlToken struct {
+	kind  string //punct, name, int, float, string or eof
+	text  string
+	value interface{}
+	line  int
+}
+
+//gqlParser parses the subset of GraphQL the gateway executes: query
+//operations with variables, aliases, arguments and nested selections.
+//Fragments and directives are rejected.
+type gqlParser struct {
+	src       string
+	i, line   int
+	tok       gqlToken
+	variables map[string]interface{}
+}
+
+type gqlError struct {
+	Message string        `json:"message"`
+	Line    int           `json:"-"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+func (e *gqlError) Error() string {
+	if e.Line == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+func (p *gqlParser) fail(format string, args ...interface{}) error {
+	return &gqlError{Message: fmt.Sprintf(format, args...), Line: p.tok.line}
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || (c >= '0' && c <= '9')
+}
+
+//next reads the following token into p.tok.
+func (p *gqlParser) next() error {
+	//whitespace, commas and comments are insignificant
+	for p.i < len(p.src) {
+		c := p.src[p.i]
+		if c == '\n' {
+			p.line++
+		}
+		if c == '#' {
+			for p.i < len(p.src) && p.src[p.i] != '\n' {
+				p.i++
+			}
+			continue
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' && c != ',' {
+			break
+		}
+		p.i++
+	}
+	p.tok = gqlToken{line: p.line}
+	if p.i >= len(p.src) {
+		p.tok.kind = "eof"
+		return nil
+	}
+	start := p.i
+	c := p.src[p.i]
+	switch {
+	case strings.HasPrefix(p.src[p.i:], "..."):
+		p.i += 3
+		p.tok.kind, p.tok.text = "punct", "..."
+	case strings.IndexByte("!$():=@[]{}|", c) >= 0:
+		p.i++
+		p.tok.kind, p.tok.text = "punct", string(c)
+	case isNameStart(c):
+		for p.i < len(p.src) && isNameChar(p.src[p.i]) {
+			p.i++
+		}
+		p.tok.kind, p.tok.text = "name", p.src[start:p.i]
+	case c == '-' || (c >= '0' && c <= '9'):
+		p.i++
+		float := false
+		for p.i < len(p.src) && strings.IndexByte("0123456789.eE+-", p.src[p.i]) >= 0 {
+			if strings.IndexByte(".eE", p.src[p.i]) >= 0 {
+				float = true
+			}
+			p.i++
+		}
+		p.tok.text = p.src[start:p.i]
+		var err error
+		if float {
+			p.tok.kind = "float"
+			p.tok.value, err = strconv.ParseFloat(p.tok.text, 64)
+		} else {
+			p.tok.kind = "int"
+			p.tok.value, err = strconv.ParseInt(p.tok.text, 10, 64)
+		}
+		if err != nil {
+			return p.fail("invalid number %s", p.tok.text)
+		}
+	case strings.HasPrefix(p.src[p.i:], `"""`):
+		end := strings.Index(p.src[p.i+3:], `"""`)
+		if end < 0 {
+			return p.fail("unterminated string")
+		}
+		s := p.src[p.i+3 : p.i+3+end]
+		p.line += strings.Count(s, "\n")
+		p.i += end + 6
+		p.tok.kind, p.tok.value = "string", strings.TrimSpace(s)
+	case c == '"':
+		s, err := p.string()
+		if err != nil {
+			return err
+		}
+		p.tok.kind, p.tok.value = "string", s
+	default:
+		r, _ := utf8.DecodeRuneInString(p.src[p.i:])
+		return p.fail("unexpected character %q", r)
+	}
+	return nil
+}
+
+//string reads a quoted string, escapes included.
+func (p *gqlParser) string() (string, error) {
+	var b strings.Builder
+	for p.i++; p.i < len(p.src); p.i++ {
+		c := p.src[p.i]
+		switch c {
+		case '"':
+			p.i++
+			return b.String(), nil
+		case '\n':
+			return "", p.fail("unterminated string")
+		case '\\':
+			if p.i+1 >= len(p.src) {
+				return "", p.fail("unterminated string")
+			}
+			p.i++
+			switch e := p.src[p.i]; e {
+			case 'u':
+				if p.i+4 >= len(p.src) {
+					return "", p.fail("invalid unicode escape")
+				}
+				n, err := strconv.ParseUint(p.src[p.i+1:p.i+5], 16, 32)
+				if err != nil {
+					return "", p.fail("invalid unicode escape")
+				}
+				b.WriteRune(rune(n))
+				p.i += 4
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case '"', '\\', '/':
+				b.WriteByte(e)
+			default:
+				return "", p.fail("invalid escape \\%c", e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", p.fail("unterminated string")
+}
+
+func (p *gqlParser) is(kind, text string) bool {
+	return p.tok.kind == kind && (len(text) == 0 || p.tok.text == text)
+}
+
+func (p *gqlParser) expect(kind, text string) (gqlToken, error) {
+	t := p.tok
+	if !p.is(kind, text) {
+		want := text
+		if len(want) == 0 {
+			want = kind
+		}
+		got := t.text
+		if t.kind == "eof" {
+			got = "end of document"
+		}
+		return t, p.fail("expected %s, got %q", want, got)
+	}
+	return t, p.next()
+}
+
+//parseGraphQL returns the selections of the operation to run: the one named
+//operationName, or the only one of the document.
+func parseGraphQL(src, operationName string, variables map[string]interface{}) ([]gqlField, error) {
+	p := &gqlParser{src: src, line: 1}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	var selected []gqlField
+	found := 0
+	for !p.is("eof", "") {
+		name, fields, err := p.operation(variables)
+		if err != nil {
+			return nil, err
+		}
+		if len(operationName) == 0 || name == operationName {
+			selected = fields
+			found++
+		}
+	}
+	switch {
+	case found == 0 && len(operationName) != 0:
+		return nil, &gqlError{Message: "unknown operation " + strconv.Quote(operationName)}
+	case found == 0:
+		return nil, &gqlError{Message: "no operation in the document"}
+	case found > 1:
+		return nil, &gqlError{Message: "operationName is required when the document has several operations"}
+	}
+	return selected, nil
+}
+
+func (p *gqlParser) operation(variables map[string]interface{}) (string, []gqlField, error) {
+	p.variables = map[string]interface{}{}
+	var name string
+	if p.is("name", "") {
+		switch p.tok.text {
+		case "query":
+		case "fragment":
+			return "", nil, p.fail("fragments are not supported")
+		case "mutation", "subscription":
+			return "", nil, p.fail("only queries are supported")
+		default:
+			return "", nil, p.fail("unexpected %q", p.tok.text)
+		}
+		if err := p.next(); err != nil {
+			return "", nil, err
+		}
+		if p.is("name", "") {
+			name = p.tok.text
+			if err := p.next(); err != nil {
+				return "", nil, err
+			}
+		}
+		if p.is("punct", "(") {
+			if err := p.variableDefinitions(variables); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+	fields, err := p.selectionSet()
+	return name, fields, err
+}
+
+//variableDefinitions binds the declared variables to the values of the
+//request, falling back to their defaults. Types are not checked.
+func (p *gqlParser) variableDefinitions(variables map[string]interface{}) error {
+	if err := p.next(); err != nil {
+		return err
+	}
+	for !p.is("punct", ")") {
+		if _, err := p.expect("punct", "$"); err != nil {
+			return err
+		}
+		name, err := p.expect("name", "")
+		if err != nil {
+			return err
+		}
+		if _, err := p.expect("punct", ":"); err != nil {
+			return err
+		}
+		required, err := p.typeRef()
+		if err != nil {
+			return err
+		}
+		v, ok := variables[name.text]
+		if p.is("punct", "=") {
+			if err := p.next(); err != nil {
+				return err
+			}
+			def, err := p.value(true)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				v, ok = def, true
+			}
+		}
+		if required && (!ok || v == nil) {
+			return p.fail("variable $%s is required", name.text)
+		}
+		p.variables[name.text] = v
+	}
+	return p.next()
+}
+
+//typeRef skips a type reference and reports whether it is non null.
+func (p *gqlParser) typeRef() (bool, error) {
+	if p.is("punct", "[") {
+		if err := p.next(); err != nil {
+			return false, err
+		}
+		if _, err := p.typeRef(); err != nil {
+			return false, err
+		}
+		if _, err := p.expect("punct", "]"); err != nil {
+			return false, err
+		}
+	} else if _, err := p.expect("name", ""); err != nil {
+		return false, err
+	}
+	if p.is("punct", "!") {
+		return true, p.next()
+	}
+	return false, nil
+}
+
+func (p *gqlParser) selectionSet() ([]gqlField, error) {
+	if _, err := p.expect("punct", "{"); err != nil {
+		return nil, err
+	}
+	var fields []gqlField
+	for !p.is("punct", "}") {
+		if p.is("punct", "...") {
+			return nil, p.fail("fragments are not supported")
+		}
+		f, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	if len(fields) == 0 {
+		return nil, p.fail("empty selection set")
+	}
+	return fields, p.next()
+}
+
+func (p *gqlParser) field() (gqlField, error) {
+	f := gqlField{Line: p.tok.line}
+	t, err := p.expect("name", "")
+	if err != nil {
+		return f, err
+	}
+	f.Name = t.text
+	if p.is("punct", ":") {
+		if err := p.next(); err != nil {
+			return f, err
+		}
+		if t, err = p.expect("name", ""); err != nil {
+			return f, err
+		}
+		f.Alias, f.Name = f.Name, t.text
+	}
+	if p.is("punct", "(") {
+		if err := p.next(); err != nil {
+			return f, err
+		}
+		f.Args = map[string]interface{}{}
+		for !p.is("punct", ")") {
+			name, err := p.expect("name", "")
+			if err != nil {
+				return f, err
+			}
+			if _, err := p.expect("punct", ":"); err != nil {
+				return f, err
+			}
+			if f.Args[name.text], err = p.value(false); err != nil {
+				return f, err
+			}
+		}
+		if err := p.next(); err != nil {
+			return f, err
+		}
+	}
+	if p.is("punct", "@") {
+		return f, p.fail("directives are not supported")
+	}
+	if p.is("punct", "{") {
+		if f.Selections, err = p.selectionSet(); err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+//value reads an argument value. Enum values are returned as strings.
+//Variables are not allowed in constant values (defaults).
+func (p *gqlParser) value(constant bool) (interface{}, error) {
+	t := p.tok
+	switch {
+	case p.is("punct", "$") && !constant:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		name, err := p.expect("name", "")
+		if err != nil {
+			return nil, err
+		}
+		v, ok := p.variables[name.text]
+		if !ok {
+			return nil, &gqlError{Message: fmt.Sprintf("variable $%s is not defined", name.text), Line: name.line}
+		}
+		return v, nil
+	case p.is("punct", "["):
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		list := []interface{}{}
+		for !p.is("punct", "]") {
+			v, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, p.next()
+	case p.is("punct", "{"):
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		obj := map[string]interface{}{}
+		for !p.is("punct", "}") {
+			name, err := p.expect("name", "")
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect("punct", ":"); err != nil {
+				return nil, err
+			}
+			if obj[name.text], err = p.value(constant); err != nil {
+				return nil, err
+			}
+		}
+		return obj, p.next()
+	case t.kind == "int" || t.kind == "float" || t.kind == "string":
+		return t.value, p.next()
+	case t.kind == "name":
+		var v interface{} = t.text
+		switch t.text {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+			v = nil
+		}
+		return v, p.next()
+	}
+	return nil, p.fail("expected a value")
+}
@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/esapi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+//GRPCConfig serves the Elastic service of proto/elastic.proto on Addr
+//(":9090"). Without an address, no gRPC server is started.
+type GRPCConfig struct {
+	Addr string `json:"addr"`
+}
+
+//The messages of proto/elastic.proto. They are few and flat, so they are
+//encoded by hand with protowire rather than generated.
+type (
+	GRPCSearchRequest struct {
+		Index string
+		Query []byte
+		Size  int32
+		From  int32
+		Sort  []string
+	}
+	GRPCGetRequest struct {
+		Index string
+		ID    string
+	}
+	GRPCBulkRequest struct {
+		Index    string
+		Body     []byte
+		Pipeline string
+	}
+	GRPCCountRequest struct {
+		Index string
+		Query []byte
+	}
+	GRPCScrollRequest struct {
+		Index    string
+		Query    []byte
+		Size     int32
+		PageSize int32
+	}
+	GRPCResponse struct {
+		Status int32
+		Body   []byte
+	}
+)
+
+//wireField binds a field number to the Go field holding its value.
+type wireField struct {
+	num     protowire.Number
+	str     *string
+	bytes   *[]byte
+	int32   *int32
+	strings *[]string
+}
+
+//wireMessage is implemented by the messages of the service.
+type wireMessage interface {
+	wire() []wireField
+}
+
+func (m *GRPCSearchRequest) wire() []wireField {
+	return []wireField{{num: 1, str: &m.Index}, {num: 2, bytes: &m.Query}, {num: 3, int32: &m.Size}, {num: 4, int32: &m.From}, {num: 5, strings: &m.Sort}}
+}
+
+func (m *GRPCGetRequest) wire() []wireField {
+	return []wireField{{num: 1, str: &m.Index}, {num: 2, str: &m.ID}}
+}
+
+func (m *GRPCBulkRequest) wire() []wireField {
+	return []wireField{{num: 1, str: &m.Index}, {num: 2, bytes: &m.Body}, {num: 3, str: &m.Pipeline}}
+}
+
+func (m *GRPCCountRequest) wire() []wireField {
+	return []wireField{{num: 1, str: &m.Index}, {num: 2, bytes: &m.Query}}
+}
+
+func (m *GRPCScrollRequest) wire() []wireField {
+	return []wireField{{num: 1, str: &m.Index}, {num: 2, bytes: &m.Query}, {num: 3, int32: &m.Size}, {num: 4, int32: &m.PageSize}}
+}
+
+func (m *GRPCResponse) wire() []wireField {
+	return []wireField{{num: 1, int32: &m.Status}, {num: 2, bytes: &m.Body}}
+}
+
+//wireCodec encodes the messages in the protobuf wire format, so clients
+//generated from proto/elastic.proto talk to the server as usual.
+type wireCodec struct{}
+
+func (wireCodec) Name() string { return "proto" }
+
+func (wireCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return nil, fmt.Errorf("cannot encode %T", v)
+	}
+	var b []byte
+	//proto3 leaves fields with their zero value out
+	for _, f := range m.wire() {
+		switch {
+		case f.str != nil && len(*f.str) != 0:
+			b = protowire.AppendTag(b, f.num, protowire.BytesType)
+			b = protowire.AppendString(b, *f.str)
+		case f.bytes != nil && len(*f.bytes) != 0:
+			b = protowire.AppendTag(b, f.num, protowire.BytesType)
+			b = protowire.AppendBytes(b, *f.bytes)
+		case f.int32 != nil && *f.int32 != 0:
+			b = protowire.AppendTag(b, f.num, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(int64(*f.int32)))
+		case f.strings != nil:
+			for _, s := range *f.strings {
+				b = protowire.AppendTag(b, f.num, protowire.BytesType)
+				b = protowire.AppendString(b, s)
+			}
+		}
+	}
+	return b, nil
+}
+
+func (wireCodec) Unmarshal(b []byte, v interface{}) error {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return fmt.Errorf("cannot decode %T", v)
+	}
+	fields := map[protowire.Number]wireField{}
+	for _, f := range m.wire() {
+		fields[f.num] = f
+	}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		f, known := fields[num]
+		switch {
+		case known && typ == protowire.BytesType && (f.str != nil || f.bytes != nil || f.strings != nil):
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			switch {
+			case f.str != nil:
+				*f.str = string(v)
+			case f.bytes != nil:
+				*f.bytes = append([]byte(nil), v...)
+			default:
+				*f.strings = append(*f.strings, string(v))
+			}
+			b = b[n:]
+		case known && typ == protowire.VarintType && f.int32 != nil:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			*f.int32 = int32(v)
+			b = b[n:]
+		default:
+			//unknown fields are skipped, for clients built from a newer proto
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+//grpcRequest stands in for the HTTP request of a call, carrying its context
+//and credentials, so authentication and authorization are shared with the
+//HTTP API.
+func grpcRequest(ctx context.Context, method string) *http.Request {
+	r, _ := http.NewRequestWithContext(ctx, http.MethodPost, method, nil)
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, h := range []string{"Authorization", "X-API-Key", "X-Request-ID", config.Tenancy.Header} {
+		if v := md.Get(strings.ToLower(h)); len(v) != 0 {
+			r.Header.Set(h, v[0])
+		}
+	}
+	return r
+}
+
+//grpcContext gives the call a request ID and, when authentication and
+//tenancy are on, the identity and tenant of the caller, as RequestIDMid,
+//AuthMid and TenancyMid do for HTTP.
+func grpcContext(ctx context.Context, method string) (context.Context, error) {
+	r := grpcRequest(ctx, method)
+	id := r.Header.Get("X-Request-ID")
+	if len(id) == 0 {
+		b := make([]byte, 16)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	ctx = context.WithValue(ctx, requestIDKey, id)
+	if config.Auth.enabled() {
+		identity, err := authenticate(r.WithContext(ctx))
+		if err != nil {
+			logger.WarnContext(ctx, "authentication failed", "method", method, "error", err)
+			return nil, status.Error(codes.Unauthenticated, "unauthorized")
+		}
+		ctx = context.WithValue(ctx, identityKey, identity)
+	}
+	if config.Tenancy.enabled() {
+		tenant, err := resolveTenant(r.WithContext(ctx))
+		if err != nil {
+			logger.WarnContext(ctx, "tenant refused", "method", method, "error", err)
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+		if tenant != nil {
+			ctx = context.WithValue(ctx, tenantKey, tenant)
+		}
+	}
+	return ctx, nil
+}
+
+func grpcUnaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := grpcContext(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+//authStream overrides the context of a stream.
+type authStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s authStream) Context() context.Context { return s.ctx }
+
+func grpcStreamAuth(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := grpcContext(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, authStream{ServerStream: ss, ctx: ctx})
+}
+
+//grpcAuthorize applies the authorization rules to a call.
+func grpcAuthorize(ctx context.Context, op string, indices []string) error {
+	if err := authorize(grpcRequest(ctx, ""), op, indices); err != nil {
+		if _, ok := err.(*ValidationError); ok {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		logger.WarnContext(ctx, "access denied", "error", err)
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return nil
+}
+
+func grpcIndex(index string) ([]string, error) {
+	if len(index) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "index is required")
+	}
+	return stringToArray(index), nil
+}
+
+//grpcResponse reads the elastic search answer into a Response.
+func grpcResponse(ctx context.Context, res *esapi.Response, err error) (*GRPCResponse, error) {
+	if err != nil {
+		logger.ErrorContext(ctx, "error getting response from elastic search cluster", "error", err)
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &GRPCResponse{Status: int32(res.StatusCode), Body: b}, nil
+}
+
+//grpcServer implements the Elastic service over the default cluster.
+type grpcServer struct{}
+
+func (grpcServer) Search(ctx context.Context, req *GRPCSearchRequest) (*GRPCResponse, error) {
+	index, err := grpcIndex(req.Index)
+	if err != nil {
+		return nil, err
+	}
+	if err := grpcAuthorize(ctx, opSearch, index); err != nil {
+		return nil, err
+	}
+	var q interface{}
+	if len(req.Query) != 0 {
+		if err := json.Unmarshal(req.Query, &q); err != nil {
+			return nil, status.Error(codes.InvalidArgument, "query: "+err.Error())
+		}
+	}
+	if config.SoftDelete.Enabled {
+		q = excludeSoftDeleted(q)
+	}
+	es, err := defaultClient()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := checkPagination(ctx, es, index, int(req.From), int(req.Size)); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	buf, err := encodeBody(q)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	opts := []func(*esapi.SearchRequest){
+		es.Search.WithContext(ctx),
+		es.Search.WithIndex(index...),
+		es.Search.WithBody(buf),
+	}
+	if len(req.Sort) != 0 {
+		opts = append(opts, es.Search.WithSort(req.Sort...))
+	}
+	if req.Size != 0 {
+		opts = append(opts, es.Search.WithSize(int(req.Size)))
+	}
+	if req.From != 0 {
+		opts = append(opts, es.Search.WithFrom(int(req.From)))
+	}
+	res, err := es.Search(opts...)
+	return grpcResponse(ctx, res, err)
+}
+
+func (grpcServer) Get(ctx context.Context, req *GRPCGetRequest) (*GRPCResponse, error) {
+	if len(req.Index) == 0 || len(req.ID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "index and id are required")
+	}
+	if err := grpcAuthorize(ctx, opSearch, []string{req.Index}); err != nil {
+		return nil, err
+	}
+	es, err := defaultClient()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	res, err := es.Get(req.Index, req.ID, es.Get.WithContext(ctx))
+	out, err := grpcResponse(ctx, res, err)
+	if err != nil || !config.SoftDelete.Enabled || out.Status != http.StatusOK {
+		return out, err
+	}
+	//soft deleted documents are not found, as they are hidden from searches
+	var doc struct {
+		Source map[string]json.RawMessage `json:"_source"`
+	}
+	if json.Unmarshal(out.Body, &doc) == nil && doc.Source[config.SoftDelete.Field] != nil {
+		return nil, status.Error(codes.NotFound, "document not found")
+	}
+	return out, nil
+}
+
+//Bulk checks write access to the default index and to every index named in
+//the action lines, then the documents against the schemas of their indices.
+//Under backpressure it is refused with ResourceExhausted and the seconds to
+//wait in the retry-after header, as BackpressureMid does for HTTP.
+func (grpcServer) Bulk(ctx context.Context, req *GRPCBulkRequest) (out *GRPCResponse, err error) {
+	indices := map[string]bool{}
+	if len(req.Index) != 0 {
+		indices[req.Index] = true
+	}
+	source := false
+	for i, line := range bytes.Split(req.Body, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		//index, create and update actions are followed by a source line
+		if source {
+			source = false
+			continue
+		}
+		var action map[string]struct {
+			Index string `json:"_index"`
+		}
+		if err := json.Unmarshal(line, &action); err != nil || len(action) != 1 {
+			return nil, status.Errorf(codes.InvalidArgument, "line %d: invalid bulk action", i+1)
+		}
+		for op, a := range action {
+			switch op {
+			case "index", "create", "update":
+				source = true
+			case "delete":
+			default:
+				return nil, status.Errorf(codes.InvalidArgument, "line %d: unknown bulk action %s", i+1, op)
+			}
+			if len(a.Index) == 0 && len(req.Index) == 0 {
+				return nil, status.Errorf(codes.InvalidArgument, "line %d: no index", i+1)
+			}
+			if len(a.Index) != 0 {
+				indices[a.Index] = true
+			}
+		}
+	}
+	list := make([]string, 0, len(indices))
+	for index := range indices {
+		list = append(list, index)
+	}
+	if err := grpcAuthorize(ctx, opWrite, list); err != nil {
+		return nil, err
+	}
+	if config.Backpressure.Enabled {
+		ok, reason, retryAfter := ingestPressure.admit(time.Now())
+		if !ok {
+			seconds := retrySeconds(retryAfter)
+			grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.Itoa(seconds), "x-backpressure", reason))
+			logger.WarnContext(ctx, "shedding ingestion load", "reason", reason, "retry_after", seconds)
+			return nil, status.Errorf(codes.ResourceExhausted, "too many requests, retry in %ds", seconds)
+		}
+		defer func() {
+			code := 0
+			if out != nil {
+				code = int(out.Status)
+			}
+			ingestPressure.done(code, time.Now())
+		}()
+	}
+	es, err := defaultClient()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	body := req.Body
+	if !bytes.HasSuffix(body, []byte("\n")) {
+		body = append(body, '\n')
+	}
+	body, dropped, err := screenBulk(ctx, es, req.Index, body, actor(grpcRequest(ctx, "")))
+	if err != nil {
+		if _, ok := errors.Unwrap(err).(*DocSchemaError); ok {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	if dropped != 0 {
+		logger.WarnContext(ctx, "bulk documents moved to the dead letter index", "count", dropped)
+	}
+	//every document was dead lettered, there is nothing left to send
+	if len(body) == 0 {
+		b, _ := json.Marshal(map[string]interface{}{"errors": false, "items": []interface{}{}, "dead_lettered": dropped})
+		return &GRPCResponse{Status: http.StatusAccepted, Body: b}, nil
+	}
+	opts := []func(*esapi.BulkRequest){es.Bulk.WithContext(ctx)}
+	if len(req.Index) != 0 {
+		opts = append(opts, es.Bulk.WithIndex(req.Index))
+	}
+	if len(req.Pipeline) != 0 {
+		opts = append(opts, es.Bulk.WithPipeline(req.Pipeline))
+	}
+	res, err := es.Bulk(bytes.NewReader(body), opts...)
+	return grpcResponse(ctx, res, err)
+}
+
+func (grpcServer) Count(ctx context.Context, req *GRPCCountRequest) (*GRPCResponse, error) {
+	index, err := grpcIndex(req.Index)
+	if err != nil {
+		return nil, err
+	}
+	if err := grpcAuthorize(ctx, opSearch, index); err != nil {
+		return nil, err
+	}
+	var q interface{}
+	if len(req.Query) != 0 {
+		if err := json.Unmarshal(req.Query, &q); err != nil {
+			return nil, status.Error(codes.InvalidArgument, "query: "+err.Error())
+		}
+	}
+	if config.SoftDelete.Enabled {
+		q = excludeSoftDeleted(q)
+	}
+	buf, err := encodeBody(q)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	es, err := defaultClient()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	res, err := es.Count(
+		es.Count.WithContext(ctx),
+		es.Count.WithIndex(index...),
+		es.Count.WithBody(buf),
+	)
+	return grpcResponse(ctx, res, err)
+}
+
+//Scroll streams pages over a point in time, as the export endpoints do. A
+//client going away cancels the stream context, which stops the paging.
+func (grpcServer) Scroll(req *GRPCScrollRequest, stream grpc.ServerStream) error {
+	ctx := stream.Context()
+	index, err := grpcIndex(req.Index)
+	if err != nil {
+		return err
+	}
+	if err := grpcAuthorize(ctx, opSearch, index); err != nil {
+		return err
+	}
+	var q interface{}
+	if len(req.Query) != 0 {
+		if err := json.Unmarshal(req.Query, &q); err != nil {
+			return status.Error(codes.InvalidArgument, "query: "+err.Error())
+		}
+	}
+	if config.SoftDelete.Enabled {
+		q = excludeSoftDeleted(q)
+	}
+	es, err := defaultClient()
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	pageSize := int(req.PageSize)
+	if pageSize > exportPageSize {
+		pageSize = exportPageSize
+	}
+	err = pageThrough(ctx, es, index, q, int(req.Size), pageSize, func(hits []Hit) error {
+		b, err := json.Marshal(hits)
+		if err != nil {
+			return err
+		}
+		return stream.SendMsg(&GRPCResponse{Status: http.StatusOK, Body: b})
+	})
+	var v *ValidationError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &v):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case ctx.Err() != nil:
+		return status.Error(codes.Canceled, ctx.Err().Error())
+	}
+	logger.ErrorContext(ctx, "error streaming documents", "error", err)
+	return status.Error(codes.Unavailable, err.Error())
+}
+
+//elasticServer is the Elastic service of proto/elastic.proto.
+type elasticServer interface {
+	Search(context.Context, *GRPCSearchRequest) (*GRPCResponse, error)
+	Get(context.Context, *GRPCGetRequest) (*GRPCResponse, error)
+	Bulk(context.Context, *GRPCBulkRequest) (*GRPCResponse, error)
+	Count(context.Context, *GRPCCountRequest) (*GRPCResponse, error)
+	Scroll(*GRPCScrollRequest, grpc.ServerStream) error
+}
+
+//elasticService describes the Elastic service the way protoc-gen-go-grpc
+//would, binding its methods to an elasticServer.
+var elasticService = grpc.ServiceDesc{
+	ServiceName: "elastic.v1.Elastic",
+	HandlerType: (*elasticServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Search", Handler: unaryMethod("Search", func() wireMessage { return &GRPCSearchRequest{} },
+			func(s elasticServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return s.Search(ctx, req.(*GRPCSearchRequest))
+			})},
+		{MethodName: "Get", Handler: unaryMethod("Get", func() wireMessage { return &GRPCGetRequest{} },
+			func(s elasticServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return s.Get(ctx, req.(*GRPCGetRequest))
+			})},
+		{MethodName: "Bulk", Handler: unaryMethod("Bulk", func() wireMessage { return &GRPCBulkRequest{} },
+			func(s elasticServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return s.Bulk(ctx, req.(*GRPCBulkRequest))
+			})},
+		{MethodName: "Count", Handler: unaryMethod("Count", func() wireMessage { return &GRPCCountRequest{} },
+			func(s elasticServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return s.Count(ctx, req.(*GRPCCountRequest))
+			})},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Scroll",
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				req := &GRPCScrollRequest{}
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				return srv.(elasticServer).Scroll(req, stream)
+			},
+		},
+	},
+	Metadata: "proto/elastic.proto",
+}
+
+//unaryMethod adapts a method to the handler signature of grpc.MethodDesc,
+//decoding the request and running the interceptor around the call.
+func unaryMethod(name string, newReq func() wireMessage, call func(elasticServer, context.Context, interface{}) (interface{}, error)) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		req := newReq()
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		if interceptor == nil {
+			return call(srv.(elasticServer), ctx, req)
+		}
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/elastic.v1.Elastic/" + name}
+		return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return call(srv.(elasticServer), ctx, req)
+		})
+	}
+}
+
+//serveGRPC runs the gRPC server until it fails.
+func serveGRPC() error {
+	lis, err := net.Listen("tcp", config.GRPC.Addr)
+	if err != nil {
+		return err
+	}
+	s := grpc.NewServer(
+		grpc.ForceServerCodec(wireCodec{}),
+		grpc.UnaryInterceptor(grpcUnaryAuth),
+		grpc.StreamInterceptor(grpcStreamAuth),
+	)
+	s.RegisterService(&elasticService, grpcServer{})
+	return s.Serve(lis)
+}
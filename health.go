@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+//HealthConfig tunes the readiness probe.
+type HealthConfig struct {
+	ReadyTimeout Duration `json:"ready_timeout"`
+}
+
+//healthzHandler reports that the process is alive. It never touches the cluster.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+//readyzHandler reports whether the default cluster answers a ping within the
+//configured timeout, so traffic is only routed to a gateway that can serve it.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), config.Health.ReadyTimeout.Duration)
+	defer cancel()
+	res, err := es.Ping(es.Ping.WithContext(ctx))
+	if err != nil {
+		logger.ErrorContext(r.Context(), "readiness ping failed", "error", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		http.Error(w, "cluster answered "+res.Status(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
@@ -0,0 +1,46 @@
+package main
+
+//Highlight asks elastic search for highlighted fragments of the given fields,
+//returned in the highlight section of every hit. Zero values keep the
+//elastic search defaults.
+type Highlight struct {
+	Fields            []string `json:"fields"`
+	FragmentSize      int      `json:"fragment_size"`
+	NumberOfFragments int      `json:"number_of_fragments"`
+	PreTags           []string `json:"pre_tags"`
+	PostTags          []string `json:"post_tags"`
+}
+
+//withHighlight merges the highlight section into the search body. A highlight
+//section already present in the query is left alone.
+func withHighlight(q interface{}, h *Highlight) (interface{}, error) {
+	body, ok := searchBody(q)
+	if !ok {
+		return q, nil
+	}
+	if len(h.Fields) == 0 {
+		return q, &ValidationError{Path: "/highlight/fields", Message: "at least one field is required"}
+	}
+	if _, ok := body["highlight"]; ok {
+		return body, nil
+	}
+	fields := map[string]interface{}{}
+	for _, f := range h.Fields {
+		fields[f] = map[string]interface{}{}
+	}
+	section := map[string]interface{}{"fields": fields}
+	if h.FragmentSize > 0 {
+		section["fragment_size"] = h.FragmentSize
+	}
+	if h.NumberOfFragments > 0 {
+		section["number_of_fragments"] = h.NumberOfFragments
+	}
+	if len(h.PreTags) != 0 {
+		section["pre_tags"] = h.PreTags
+	}
+	if len(h.PostTags) != 0 {
+		section["post_tags"] = h.PostTags
+	}
+	body["highlight"] = section
+	return body, nil
+}
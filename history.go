@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/elastic/go-elasticsearch"
+	"github.com/gorilla/mux"
+)
+
+//HistoryConfig enables keeping the prior version of a document in a
+//separate index every time it is replaced or deleted through the gateway.
+type HistoryConfig struct {
+	Enabled bool   `json:"enabled"`
+	Index   string `json:"index"`
+}
+
+//HistoryEntry is one prior version of a document as stored in the history index.
+type HistoryEntry struct {
+	Index     string          `json:"index"`
+	ID        string          `json:"id"`
+	Version   int64           `json:"version"`
+	Action    string          `json:"action"`
+	Actor     string          `json:"actor"`
+	Timestamp string          `json:"timestamp"`
+	Source    json.RawMessage `json:"source"`
+}
+
+//storedDoc is the part of a get response the gateway cares about.
+type storedDoc struct {
+	Found   bool            `json:"found"`
+	Version int64           `json:"_version"`
+	Source  json.RawMessage `json:"_source"`
+}
+
+//historyMapping keeps the stored sources out of the history index mapping.
+var historyMapping = map[string]interface{}{
+	"mappings": map[string]interface{}{
+		"properties": map[string]interface{}{
+			"index":     map[string]interface{}{"type": "keyword"},
+			"id":        map[string]interface{}{"type": "keyword"},
+			"version":   map[string]interface{}{"type": "long"},
+			"action":    map[string]interface{}{"type": "keyword"},
+			"actor":     map[string]interface{}{"type": "keyword"},
+			"timestamp": map[string]interface{}{"type": "date"},
+			"source":    map[string]interface{}{"type": "object", "enabled": false},
+		},
+	},
+}
+
+//historyEntryID names an entry by the time it was recorded as well as by the
+//version, which starts over when a document is deleted and created again.
+func historyEntryID(index, id string, version int64, at time.Time) string {
+	return fmt.Sprintf("%s:%s:%d:%d", index, id, version, at.UnixNano())
+}
+
+//ensureHistoryIndex creates the history index with its mapping the first time
+//it is needed. An already existing index is left as it is.
+func ensureHistoryIndex(ctx context.Context, es *elasticsearch.Client) {
+	ensureOnce(ctx, config.History.Index, func() {
+		buf, err := encodeBody(historyMapping)
+		if err != nil {
+			logger.ErrorContext(ctx, "error encoding history mapping", "error", err)
+			return
+		}
+		res, err := es.Indices.Create(config.History.Index,
+			es.Indices.Create.WithContext(ctx),
+			es.Indices.Create.WithBody(buf),
+		)
+		if err != nil {
+			logger.ErrorContext(ctx, "unable to create history index", "error", err)
+			return
+		}
+		res.Body.Close()
+	})
+}
+
+//getDoc fetches the current version of a document. found is false when it does not exist.
+func getDoc(ctx context.Context, es *elasticsearch.Client, index, id string) (doc storedDoc, err error) {
+	res, err := es.Get(index, id, es.Get.WithContext(ctx))
+	if err != nil {
+		return doc, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return doc, nil
+	}
+	if res.IsError() {
+		return doc, fmt.Errorf("get %s/%s: %s", index, id, res.Status())
+	}
+	err = json.NewDecoder(res.Body).Decode(&doc)
+	return doc, err
+}
+
+//recordHistory copies the current version of a document into the history index
+//before it is changed by action. Missing documents are silently skipped.
+func recordHistory(ctx context.Context, es *elasticsearch.Client, index, id, action, by string) error {
+	doc, err := getDoc(ctx, es, index, id)
+	if err != nil || !doc.Found {
+		return err
+	}
+	ensureHistoryIndex(ctx, es)
+	now := time.Now().UTC()
+	buf, err := encodeBody(HistoryEntry{
+		Index:     index,
+		ID:        id,
+		Version:   doc.Version,
+		Action:    action,
+		Actor:     by,
+		Timestamp: now.Format(time.RFC3339),
+		Source:    doc.Source,
+	})
+	if err != nil {
+		return err
+	}
+	res, err := es.Index(config.History.Index, buf,
+		es.Index.WithContext(ctx),
+		es.Index.WithDocumentID(historyEntryID(index, id, doc.Version, now)),
+	)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("history write for %s/%s: %s", index, id, res.Status())
+	}
+	return nil
+}
+
+//historyHandler lists the recorded versions of a document, newest first.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !checkAccess(w, r, opSearch, []string{vars["index"]}) {
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": []interface{}{
+					map[string]interface{}{"term": map[string]interface{}{"index": vars["index"]}},
+					map[string]interface{}{"term": map[string]interface{}{"id": vars["id"]}},
+				},
+			},
+		},
+		//versions start over when a document is created again, the time does not
+		"sort": []interface{}{map[string]interface{}{"timestamp": "desc"}, map[string]interface{}{"version": "desc"}},
+	}
+	buf, err := encodeBody(query)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error encoding history query", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res, err := es.Search(
+		es.Search.WithContext(r.Context()),
+		es.Search.WithIndex(config.History.Index),
+		es.Search.WithBody(buf),
+		es.Search.WithSize(100),
+	)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error searching document history", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		writeResponse(w, res)
+		return
+	}
+	var result struct {
+		Hits struct {
+			Hits []struct {
+				Source HistoryEntry `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		logger.ErrorContext(r.Context(), "error parsing the response body of elastic search", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	entries := make([]HistoryEntry, 0, len(result.Hits.Hits))
+	for _, h := range result.Hits.Hits {
+		entries = append(entries, h.Source)
+	}
+	b, err := json.Marshal(entries)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error in json marshaling", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+//historyVersion returns the latest recorded entry of a version of a document:
+//a document created again goes through the same versions anew.
+func historyVersion(ctx context.Context, es *elasticsearch.Client, index, id string, version int64) (HistoryEntry, bool, error) {
+	var entry HistoryEntry
+	buf, err := encodeBody(map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": []interface{}{
+					map[string]interface{}{"term": map[string]interface{}{"index": index}},
+					map[string]interface{}{"term": map[string]interface{}{"id": id}},
+					map[string]interface{}{"term": map[string]interface{}{"version": version}},
+				},
+			},
+		},
+		"sort": []interface{}{map[string]interface{}{"timestamp": "desc"}},
+	})
+	if err != nil {
+		return entry, false, err
+	}
+	res, err := es.Search(
+		es.Search.WithContext(ctx),
+		es.Search.WithIndex(config.History.Index),
+		es.Search.WithBody(buf),
+		es.Search.WithSize(1),
+	)
+	if err != nil {
+		return entry, false, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return entry, false, fmt.Errorf("history search for %s/%s: %s", index, id, res.Status())
+	}
+	var result struct {
+		Hits struct {
+			Hits []struct {
+				Source HistoryEntry `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return entry, false, err
+	}
+	if len(result.Hits.Hits) == 0 {
+		return entry, false, nil
+	}
+	return result.Hits.Hits[0].Source, true, nil
+}
+
+//restoreHandler puts a recorded version of a document back in place. The
+//version being replaced is itself recorded, so a restore can be undone.
+func restoreHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !checkAccess(w, r, opWrite, []string{vars["index"]}) {
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	version, err := strconv.ParseInt(vars["version"], 10, 64)
+	if err != nil {
+		http.Error(w, "version must be a number", http.StatusBadRequest)
+		return
+	}
+	entry, found, err := historyVersion(r.Context(), es, vars["index"], vars["id"], version)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error reading document history", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if !found {
+		http.Error(w, "unknown version "+vars["version"], http.StatusNotFound)
+		return
+	}
+	if err := recordHistory(r.Context(), es, vars["index"], vars["id"], "restore", actor(r)); err != nil {
+		logger.ErrorContext(r.Context(), "unable to record document history", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	res, err := es.Index(vars["index"], bytes.NewReader(entry.Source),
+		es.Index.WithContext(r.Context()),
+		es.Index.WithDocumentID(vars["id"]),
+	)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error restoring document", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeResponse(w, res)
+}
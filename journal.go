@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//JournalConfig keeps the last requests with their responses on disk, for
+//reconstructing an incident after the fact. Entries are appended to segment
+//files of SegmentBytes in Dir and the oldest segments are removed past
+//MaxBytes, so the journal is a ring buffer of bounded size. Bodies are kept up
+//to MaxBodyBytes. The values of the RedactFields of JSON bodies and of the
+//query, and the RedactHeaders, are replaced before anything is written.
+type JournalConfig struct {
+	Enabled       bool     `json:"enabled"`
+	Dir           string   `json:"dir"`
+	MaxBytes      int64    `json:"max_bytes"`
+	SegmentBytes  int64    `json:"segment_bytes"`
+	MaxBodyBytes  int      `json:"max_body_bytes"`
+	RedactFields  []string `json:"redact_fields"`
+	RedactHeaders []string `json:"redact_headers"`
+}
+
+//JournalEntry is one request of the journal with its response.
+type JournalEntry struct {
+	Timestamp       time.Time         `json:"@timestamp"`
+	RequestID       string            `json:"request_id,omitempty"`
+	Actor           string            `json:"actor,omitempty"`
+	Method          string            `json:"method"`
+	Path            string            `json:"path"`
+	Query           string            `json:"query,omitempty"`
+	RequestHeaders  map[string]string `json:"request_headers,omitempty"`
+	RequestBody     json.RawMessage   `json:"request_body,omitempty"`
+	Status          int               `json:"status"`
+	ResponseHeaders map[string]string `json:"response_headers,omitempty"`
+	ResponseBody    json.RawMessage   `json:"response_body,omitempty"`
+	DurationMS      float64           `json:"duration_ms"`
+	Truncated       bool              `json:"truncated,omitempty"`
+}
+
+//redacted replaces the sensitive values kept out of the journal.
+const redacted = "[REDACTED]"
+
+//journalSegment is the name pattern of the segment files, numbered in order.
+const journalSegment = "journal-%08d.ndjson"
+
+//journal is the segment being written and the size of the whole journal,
+//guarded by journalMu.
+var (
+	journalMu   sync.Mutex
+	journalFile *os.File
+	journalSeq  int
+	journalSize int64
+	journalUsed int64
+)
+
+//setupJournal opens the journal, continuing after the segments of a previous run.
+func setupJournal() error {
+	if err := os.MkdirAll(config.Journal.Dir, 0700); err != nil {
+		return err
+	}
+	segments, err := journalSegments()
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		info, err := os.Stat(s.path)
+		if err != nil {
+			return err
+		}
+		journalUsed += info.Size()
+		journalSeq = s.seq
+	}
+	return rotateJournal()
+}
+
+type segmentFile struct {
+	seq  int
+	path string
+}
+
+//journalSegments lists the segment files, oldest first.
+func journalSegments() ([]segmentFile, error) {
+	paths, err := filepath.Glob(filepath.Join(config.Journal.Dir, "journal-*.ndjson"))
+	if err != nil {
+		return nil, err
+	}
+	var segments []segmentFile
+	for _, p := range paths {
+		var seq int
+		if _, err := fmt.Sscanf(filepath.Base(p), journalSegment, &seq); err == nil {
+			segments = append(segments, segmentFile{seq: seq, path: p})
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].seq < segments[j].seq })
+	return segments, nil
+}
+
+//rotateJournal starts a new segment and removes the oldest ones until it
+//fits in the journal. Called with journalMu held.
+func rotateJournal() error {
+	if journalFile != nil {
+		journalFile.Close()
+	}
+	journalSeq++
+	f, err := os.OpenFile(filepath.Join(config.Journal.Dir, fmt.Sprintf(journalSegment, journalSeq)), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		journalFile = nil
+		return err
+	}
+	journalFile, journalSize = f, 0
+	segments, err := journalSegments()
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if journalUsed+config.Journal.SegmentBytes <= config.Journal.MaxBytes || s.seq == journalSeq {
+			break
+		}
+		info, err := os.Stat(s.path)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(s.path); err != nil {
+			return err
+		}
+		journalUsed -= info.Size()
+	}
+	return nil
+}
+
+func writeJournal(e JournalEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	if journalFile == nil || journalSize > 0 && journalSize+int64(len(b)) > config.Journal.SegmentBytes {
+		if err := rotateJournal(); err != nil {
+			return err
+		}
+	}
+	n, err := journalFile.Write(b)
+	journalSize += int64(n)
+	journalUsed += int64(n)
+	return err
+}
+
+//journalWriter keeps the beginning of the response body for the journal.
+type journalWriter struct {
+	*statusWriter
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (w *journalWriter) Write(b []byte) (int, error) {
+	switch room := config.Journal.MaxBodyBytes - w.body.Len(); {
+	case room >= len(b):
+		w.body.Write(b)
+	case room > 0:
+		w.body.Write(b[:room])
+		w.truncated = true
+	default:
+		w.truncated = true
+	}
+	return w.statusWriter.Write(b)
+}
+
+//JournalMid records the request and its response in the journal. It runs
+//after authentication, so the journal tells who sent each request; rejected
+//credentials are left to the access log.
+func JournalMid(app http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//reading the journal would journal the journal
+		if strings.HasPrefix(r.URL.Path, "/elastic/admin/journal") {
+			app.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		var reqBody []byte
+		truncated := false
+		if r.Body != nil {
+			//the handler still reads the whole body
+			var err error
+			reqBody, err = io.ReadAll(io.LimitReader(r.Body, int64(config.Journal.MaxBodyBytes)+1))
+			if err != nil {
+				logger.WarnContext(r.Context(), "unable to read request body for the journal", "error", err)
+			}
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(reqBody), r.Body), r.Body}
+			if len(reqBody) > config.Journal.MaxBodyBytes {
+				reqBody, truncated = reqBody[:config.Journal.MaxBodyBytes], true
+			}
+		}
+		jw := &journalWriter{statusWriter: &statusWriter{ResponseWriter: w}}
+		app.ServeHTTP(jw, r)
+		if jw.status == 0 {
+			jw.status = http.StatusOK
+		}
+		err := writeJournal(JournalEntry{
+			Timestamp:       start.UTC(),
+			RequestID:       requestID(r.Context()),
+			Actor:           actor(r),
+			Method:          r.Method,
+			Path:            r.URL.Path,
+			Query:           redactQuery(r.URL.Query()),
+			RequestHeaders:  redactHeaders(r.Header),
+			RequestBody:     journalBody(reqBody, truncated),
+			Status:          jw.status,
+			ResponseHeaders: redactHeaders(jw.Header()),
+			ResponseBody:    journalBody(jw.body.Bytes(), jw.truncated),
+			DurationMS:      float64(time.Since(start).Microseconds()) / 1000,
+			Truncated:       truncated || jw.truncated,
+		})
+		if err != nil {
+			logger.ErrorContext(r.Context(), "error writing journal entry", "error", err)
+		}
+	})
+}
+
+//journalBody is a body as kept in the journal: JSON with its sensitive fields
+//redacted, anything else, or a truncated body, as a string. The string still
+//has the "field": "value" pairs of the sensitive fields redacted.
+func journalBody(b []byte, truncated bool) json.RawMessage {
+	if len(b) == 0 {
+		return nil
+	}
+	var v interface{}
+	if !truncated && json.Unmarshal(b, &v) == nil {
+		if out, err := json.Marshal(redactValue(v)); err == nil {
+			return out
+		}
+	}
+	text := string(b)
+	if len(config.Journal.RedactFields) != 0 {
+		names := make([]string, len(config.Journal.RedactFields))
+		for i, field := range config.Journal.RedactFields {
+			names[i] = regexp.QuoteMeta(field)
+		}
+		pairs := regexp.MustCompile(`(?i)"(` + strings.Join(names, "|") + `)"(\s*:\s*)("(?:[^"\\]|\\.)*"?|[^,}\]\s]*)`)
+		text = pairs.ReplaceAllString(text, `"$1"$2"`+redacted+`"`)
+	}
+	out, _ := json.Marshal(text)
+	return out
+}
+
+func isRedactedField(name string) bool {
+	for _, field := range config.Journal.RedactFields {
+		if strings.EqualFold(field, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if isRedactedField(key) {
+				v[key] = redacted
+			} else {
+				v[key] = redactValue(value)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+	}
+	return v
+}
+
+func redactQuery(q url.Values) string {
+	for key := range q {
+		if isRedactedField(key) {
+			q[key] = []string{redacted}
+		}
+	}
+	return q.Encode()
+}
+
+func redactHeaders(h http.Header) map[string]string {
+	out := map[string]string{}
+	for name := range h {
+		out[name] = h.Get(name)
+		for _, sensitive := range config.Journal.RedactHeaders {
+			if strings.EqualFold(sensitive, name) {
+				out[name] = redacted
+			}
+		}
+	}
+	return out
+}
+
+//journalHandler returns the journal entries matching the request_id, actor,
+//method, path prefix, status and since/until parameters, newest first, up to
+//size of them.
+func journalHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	params := r.URL.Query()
+	size := 100
+	if s := params.Get("size"); len(s) != 0 {
+		var err error
+		if size, err = strconv.Atoi(s); err != nil || size < 0 {
+			http.Error(w, "size must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+	var since, until time.Time
+	for name, t := range map[string]*time.Time{"since": &since, "until": &until} {
+		if s := params.Get(name); len(s) != 0 {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, s); err != nil {
+				http.Error(w, name+" must be an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	status := 0
+	if s := params.Get("status"); len(s) != 0 {
+		var err error
+		if status, err = strconv.Atoi(s); err != nil {
+			http.Error(w, "status must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+	match := func(e *JournalEntry) bool {
+		switch {
+		case len(params.Get("request_id")) != 0 && e.RequestID != params.Get("request_id"),
+			len(params.Get("actor")) != 0 && e.Actor != params.Get("actor"),
+			len(params.Get("method")) != 0 && !strings.EqualFold(e.Method, params.Get("method")),
+			!strings.HasPrefix(e.Path, params.Get("path")),
+			status != 0 && e.Status != status,
+			!since.IsZero() && e.Timestamp.Before(since),
+			!until.IsZero() && e.Timestamp.After(until):
+			return false
+		}
+		return true
+	}
+	entries, err := readJournal(size, match)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error reading journal", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"entries": entries})
+}
+
+//readJournal returns up to size entries matching, newest first.
+func readJournal(size int, match func(*JournalEntry) bool) ([]JournalEntry, error) {
+	journalMu.Lock()
+	segments, err := journalSegments()
+	journalMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	entries := []JournalEntry{}
+	for i := len(segments) - 1; i >= 0 && len(entries) < size; i-- {
+		f, err := os.Open(segments[i].path)
+		if os.IsNotExist(err) {
+			//removed by a rotation meanwhile
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var found []JournalEntry
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 4*config.Journal.MaxBodyBytes+1<<20)
+		for scanner.Scan() {
+			var e JournalEntry
+			//a line being written is skipped
+			if json.Unmarshal(scanner.Bytes(), &e) == nil && match(&e) {
+				found = append(found, e)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		for j := len(found) - 1; j >= 0 && len(entries) < size; j-- {
+			entries = append(entries, found[j])
+		}
+	}
+	return entries, nil
+}
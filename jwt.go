@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//JWTConfig validates bearer tokens. Tokens are verified with the keys of the
+//JWKS URL (RS256, ES256) or with the shared Secret (HS256).
+type JWTConfig struct {
+	Issuer        string   `json:"issuer"`
+	Audience      string   `json:"audience"`
+	JWKSURL       string   `json:"jwks_url"`
+	Secret        string   `json:"secret"`
+	IdentityClaim string   `json:"identity_claim"`
+	RolesClaim    string   `json:"roles_claim"`
+	Leeway        Duration `json:"leeway"`
+	JWKSRefresh   Duration `json:"jwks_refresh"`
+}
+
+var errUnauthenticated = errors.New("missing or invalid credentials")
+
+func (c JWTConfig) enabled() bool {
+	return len(c.JWKSURL) != 0 || len(c.Secret) != 0
+}
+
+//jwtIdentity verifies the token and turns its claims into an identity.
+func jwtIdentity(ctx context.Context, token string) (*Identity, error) {
+	claims, err := verifyJWT(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	c := config.Auth.JWT
+	name, _ := claims[c.IdentityClaim].(string)
+	id := &Identity{Name: name, Method: "jwt", Claims: claims}
+	switch roles := claims[c.RolesClaim].(type) {
+	case []interface{}:
+		for _, role := range roles {
+			if s, ok := role.(string); ok {
+				id.Roles = append(id.Roles, s)
+			}
+		}
+	case string:
+		id.Roles = strings.Fields(roles)
+	}
+	return id, nil
+}
+
+func verifyJWT(ctx context.Context, token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	if err := verifySignature(ctx, header.Alg, header.Kid, signed, sig); err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	return claims, checkClaims(claims)
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func verifySignature(ctx context.Context, alg, kid string, signed, sig []byte) error {
+	c := config.Auth.JWT
+	digest := sha256.Sum256(signed)
+	switch alg {
+	case "HS256":
+		if len(c.Secret) == 0 {
+			return errors.New("HS256 tokens are not accepted")
+		}
+		mac := hmac.New(sha256.New, []byte(c.Secret))
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	case "RS256":
+		key, err := jwks.key(ctx, kid)
+		if err != nil {
+			return err
+		}
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key " + kid + " is not an RSA key")
+		}
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig)
+	case "ES256":
+		key, err := jwks.key(ctx, kid)
+		if err != nil {
+			return err
+		}
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("key " + kid + " is not an EC key")
+		}
+		if len(sig) != 64 {
+			return errors.New("malformed ES256 signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported token algorithm %q", alg)
+}
+
+func checkClaims(claims map[string]interface{}) error {
+	c := config.Auth.JWT
+	now := time.Now()
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(c.Leeway.Duration)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0).Add(-c.Leeway.Duration)) {
+		return errors.New("token not valid yet")
+	}
+	if len(c.Issuer) != 0 && claims["iss"] != c.Issuer {
+		return errors.New("unexpected token issuer")
+	}
+	if len(c.Audience) != 0 && !hasAudience(claims["aud"], c.Audience) {
+		return errors.New("unexpected token audience")
+	}
+	return nil
+}
+
+func hasAudience(aud interface{}, want string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == want
+	case []interface{}:
+		for _, a := range aud {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//keySet caches the keys of the JWKS URL. An unknown kid triggers a refetch,
+//at most once a minute, so key rotation is picked up without a restart.
+type keySet struct {
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+var jwks = &keySet{}
+
+func (s *keySet) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[kid]
+	age := time.Since(s.fetchedAt)
+	if (!ok && age > time.Minute) || age > config.Auth.JWT.JWKSRefresh.Duration {
+		keys, err := fetchJWKS(ctx, config.Auth.JWT.JWKSURL)
+		if err != nil {
+			logger.ErrorContext(ctx, "unable to fetch JWKS", "error", err)
+		} else {
+			s.keys, s.fetchedAt = keys, time.Now()
+			key, ok = s.keys[kid]
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown token key %q", kid)
+	}
+	return key, nil
+}
+
+func fetchJWKS(ctx context.Context, url string) (map[string]crypto.PublicKey, error) {
+	if len(url) == 0 {
+		return nil, errors.New("no JWKS URL configured")
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS endpoint answered %s", res.Status)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		switch {
+		case k.Kty == "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	return keys, nil
+}
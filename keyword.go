@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch"
+)
+
+//mappedField is how a field of the queried indices is mapped. Keyword is the
+//keyword subfield of a text field, Text the text parent of a keyword subfield.
+type mappedField struct {
+	Type    string
+	Keyword string
+	Text    string
+}
+
+type fieldsEntry struct {
+	at     time.Time
+	fields map[string]mappedField
+}
+
+var (
+	fieldsMu    sync.Mutex
+	fieldsCache = map[string]fieldsEntry{}
+)
+
+//fieldsRefresh is how long mappings are cached. New fields are rare and a
+//stale mapping only means a field is used as the caller named it.
+const fieldsRefresh = 5 * time.Minute
+
+//keywordAggs are the aggregations needing doc values, which text fields do
+//not have.
+var keywordAggs = map[string]bool{
+	"terms": true, "rare_terms": true, "significant_terms": true, "cardinality": true,
+	"missing": true, "value_count": true,
+}
+
+//indexFields returns the fields of the indices, keyed by their full dotted
+//name. Indices behind an alias or a pattern are merged.
+func indexFields(ctx context.Context, es *elasticsearch.Client, index []string) (map[string]mappedField, error) {
+	names := append([]string(nil), index...)
+	sort.Strings(names)
+	key := tenantScope(ctx, strings.Join(names, ","))
+	fieldsMu.Lock()
+	e, ok := fieldsCache[key]
+	fieldsMu.Unlock()
+	if ok && time.Since(e.at) < fieldsRefresh {
+		return e.fields, nil
+	}
+	res, err := es.Indices.GetMapping(
+		es.Indices.GetMapping.WithContext(ctx),
+		es.Indices.GetMapping.WithIndex(index...),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var mappings map[string]struct {
+		Mappings struct {
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"mappings"`
+	}
+	if err := decodeAdminResponse(res.IsError(), res.Status(), res.Body, &mappings); err != nil {
+		return nil, err
+	}
+	fields := map[string]mappedField{}
+	for _, m := range mappings {
+		collectFields(m.Mappings.Properties, "", fields)
+	}
+	fieldsMu.Lock()
+	fieldsCache[key] = fieldsEntry{at: time.Now(), fields: fields}
+	fieldsMu.Unlock()
+	return fields, nil
+}
+
+func collectFields(props map[string]interface{}, prefix string, fields map[string]mappedField) {
+	for name, p := range props {
+		prop, _ := p.(map[string]interface{})
+		full := prefix + name
+		if sub, ok := prop["properties"].(map[string]interface{}); ok {
+			collectFields(sub, full+".", fields)
+			continue
+		}
+		f := fields[full]
+		if t, _ := prop["type"].(string); len(f.Type) == 0 {
+			f.Type = t
+		}
+		multi, _ := prop["fields"].(map[string]interface{})
+		for _, subName := range sortedKeys(multi) {
+			sub, _ := multi[subName].(map[string]interface{})
+			if sub["type"] != "keyword" {
+				continue
+			}
+			if f.Type == "text" && len(f.Keyword) == 0 {
+				f.Keyword = full + "." + subName
+			}
+			fields[full+"."+subName] = mappedField{Type: "keyword", Text: textParent(f, full)}
+		}
+		fields[full] = f
+	}
+}
+
+func textParent(f mappedField, name string) string {
+	if f.Type == "text" {
+		return name
+	}
+	return ""
+}
+
+//exactField is the field to match exact values, sort and aggregate on: the
+//keyword subfield of a text field.
+func exactField(fields map[string]mappedField, name string) string {
+	if f := fields[name]; f.Type == "text" && len(f.Keyword) != 0 {
+		return f.Keyword
+	}
+	return name
+}
+
+//fullTextField is the field to run full-text queries on: the analyzed parent
+//of a keyword subfield.
+func fullTextField(fields map[string]mappedField, name string) string {
+	if f := fields[name]; len(f.Text) != 0 {
+		return f.Text
+	}
+	return name
+}
+
+//keywordFilters points the exact filters at keyword subfields and match
+//filters at analyzed fields.
+func keywordFilters(fields map[string]mappedField, filters []Filter) []Filter {
+	out := make([]Filter, len(filters))
+	for i, f := range filters {
+		switch f.Op {
+		case "match":
+			f.Field = fullTextField(fields, f.Field)
+		case "exists":
+		default:
+			f.Field = exactField(fields, f.Field)
+		}
+		out[i] = f
+	}
+	return out
+}
+
+//keywordSort points the fields of a field:order sort string at keyword subfields.
+func keywordSort(fields map[string]mappedField, sorts []string) []string {
+	out := make([]string, len(sorts))
+	for i, s := range sorts {
+		name, order, ok := strings.Cut(s, ":")
+		out[i] = exactField(fields, name)
+		if ok {
+			out[i] += ":" + order
+		}
+	}
+	return out
+}
+
+func keywordSortSpecs(fields map[string]mappedField, specs []SortSpec) []SortSpec {
+	out := make([]SortSpec, len(specs))
+	for i, s := range specs {
+		if len(s.Field) != 0 {
+			s.Field = exactField(fields, s.Field)
+		}
+		out[i] = s
+	}
+	return out
+}
+
+//keywordAggregations points the field of the aggregations of the search body
+//needing doc values at keyword subfields. Those would fail on a text field,
+//so aggregations that worked are left unchanged.
+func keywordAggregations(fields map[string]mappedField, aggs map[string]interface{}) {
+	for _, a := range aggs {
+		agg, _ := a.(map[string]interface{})
+		for kind, opts := range agg {
+			opts, _ := opts.(map[string]interface{})
+			switch {
+			case kind == "aggs" || kind == "aggregations":
+				keywordAggregations(fields, opts)
+			case kind == "composite":
+				sources, _ := opts["sources"].([]interface{})
+				for _, s := range sources {
+					s, _ := s.(map[string]interface{})
+					for _, source := range s {
+						source, _ := source.(map[string]interface{})
+						if terms, ok := source["terms"].(map[string]interface{}); ok {
+							keywordAggField(fields, terms)
+						}
+					}
+				}
+			case kind == "multi_terms":
+				terms, _ := opts["terms"].([]interface{})
+				for _, t := range terms {
+					if t, ok := t.(map[string]interface{}); ok {
+						keywordAggField(fields, t)
+					}
+				}
+			case keywordAggs[kind]:
+				keywordAggField(fields, opts)
+			}
+		}
+	}
+}
+
+func keywordAggField(fields map[string]mappedField, opts map[string]interface{}) {
+	if name, ok := opts["field"].(string); ok {
+		opts["field"] = exactField(fields, name)
+	}
+}
+
+//withKeywordFields applies the dual-field rules to the query builder parts of
+//the request (filters and sorts) and to the aggregations of the search body.
+//The sort string is returned rewritten.
+func withKeywordFields(ctx context.Context, es *elasticsearch.Client, index []string, body *RequestBody, sorts []string) ([]string, error) {
+	q, _ := body.ElasticQuery.(map[string]interface{})
+	_, aggs := q["aggs"]
+	_, aggregations := q["aggregations"]
+	//searches of every index would need every mapping
+	if len(index) == 0 || len(body.Filters)+len(body.Sorts)+len(sorts) == 0 && !aggs && !aggregations {
+		return sorts, nil
+	}
+	fields, err := indexFields(ctx, es, index)
+	if err != nil {
+		return sorts, err
+	}
+	body.Filters = keywordFilters(fields, body.Filters)
+	body.Sorts = keywordSortSpecs(fields, body.Sorts)
+	for _, key := range []string{"aggs", "aggregations"} {
+		if aggs, ok := q[key].(map[string]interface{}); ok {
+			keywordAggregations(fields, aggs)
+		}
+	}
+	return keywordSort(fields, sorts), nil
+}
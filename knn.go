@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/elastic/go-elasticsearch/esapi"
+)
+
+//maxNumCandidates is the largest num_candidates elastic search accepts.
+const maxNumCandidates = 10000
+
+//KNNRequest is an approximate nearest neighbour search on a dense_vector
+//field. Filter (query DSL) and Filters (simplified filters) restrict the
+//documents considered, before the k nearest are picked. QueryText is turned
+//into the query vector by the embedding service of the configuration.
+type KNNRequest struct {
+	Index       string    `json:"index"`
+	Field       string    `json:"field"`
+	QueryVector []float64 `json:"query_vector"`
+	QueryText   string    `json:"query_text"`
+	K           int       `json:"k"`
+	//NumCandidates is the number of candidates per shard, elastic search picks it when zero
+	NumCandidates int         `json:"num_candidates"`
+	Filter        interface{} `json:"filter"`
+	Filters       []Filter    `json:"filters"`
+	//Similarity is the minimum similarity of a returned document
+	Similarity     *float64 `json:"similarity"`
+	SourceIncludes string   `json:"source_includes"`
+	SourceExcludes string   `json:"source_excludes"`
+}
+
+//knnBody builds the search body of the request.
+func knnBody(req KNNRequest) (map[string]interface{}, error) {
+	switch {
+	case len(req.Index) == 0:
+		return nil, &ValidationError{Path: "/index", Message: "index is required"}
+	case len(req.Field) == 0:
+		return nil, &ValidationError{Path: "/field", Message: "field is required"}
+	case len(req.QueryVector) == 0:
+		return nil, &ValidationError{Path: "/query_vector", Message: "query_vector or query_text is required"}
+	case req.K <= 0:
+		return nil, &ValidationError{Path: "/k", Message: "k must be positive"}
+	case req.NumCandidates != 0 && (req.NumCandidates < req.K || req.NumCandidates > maxNumCandidates):
+		return nil, &ValidationError{Path: "/num_candidates", Message: "num_candidates must be between k and 10000"}
+	}
+	knn := map[string]interface{}{
+		"field":        req.Field,
+		"query_vector": req.QueryVector,
+		"k":            req.K,
+	}
+	if req.NumCandidates != 0 {
+		knn["num_candidates"] = req.NumCandidates
+	}
+	if req.Similarity != nil {
+		knn["similarity"] = *req.Similarity
+	}
+	//the filters are compiled as the query of a search body, then moved
+	//to the filter of the knn section
+	filter := map[string]interface{}{}
+	if req.Filter != nil {
+		filter["query"] = req.Filter
+	}
+	var q interface{} = filter
+	if len(req.Filters) != 0 {
+		var err error
+		if q, err = withFilters(q, req.Filters); err != nil {
+			return nil, err
+		}
+	}
+	if config.SoftDelete.Enabled {
+		q = excludeSoftDeleted(q)
+	}
+	if f, ok := q.(map[string]interface{})["query"]; ok {
+		knn["filter"] = f
+	}
+	return map[string]interface{}{"knn": knn, "size": req.K}, nil
+}
+
+//knnHandler runs a vector similarity search.
+func knnHandler(w http.ResponseWriter, r *http.Request) {
+	var body KNNRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body.QueryText) != 0 {
+		if len(body.QueryVector) != 0 {
+			writeValidationError(w, &ValidationError{Path: "/query_text", Message: "query_text and query_vector are exclusive"})
+			return
+		}
+		if embeddings == nil {
+			writeValidationError(w, &ValidationError{Path: "/query_text", Message: "no embedding service configured"})
+			return
+		}
+		vector, err := embedText(r.Context(), body.QueryText)
+		if err != nil {
+			logger.ErrorContext(r.Context(), "unable to embed query text", "error", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		body.QueryVector = vector
+	}
+	query, err := knnBody(body)
+	if err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	index := stringToArray(body.Index)
+	if !checkAccess(w, r, opSearch, index) {
+		return
+	}
+	buf, err := encodeBody(query)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error encoding elastic search query", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	opts := []func(*esapi.SearchRequest){
+		es.Search.WithContext(r.Context()),
+		es.Search.WithIndex(index...),
+		es.Search.WithBody(buf),
+	}
+	if len(body.SourceIncludes) != 0 {
+		opts = append(opts, es.Search.WithSourceIncludes(stringToArray(body.SourceIncludes)...))
+	}
+	if len(body.SourceExcludes) != 0 {
+		opts = append(opts, es.Search.WithSourceExcludes(stringToArray(body.SourceExcludes)...))
+	}
+	res, err := es.Search(opts...)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error getting response from elastic search cluster", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeResponse(w, res)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/elastic/go-elasticsearch/esapi"
+	"github.com/gorilla/mux"
+)
+
+//LintConfig bounds the mappings templates may declare. MaxFields defaults to
+//the field limit of elastic search, MaxDepth to its object depth limit.
+type LintConfig struct {
+	MaxFields int `json:"max_fields"`
+	MaxDepth  int `json:"max_depth"`
+}
+
+//Lint severities: errors stop a template from being applied, warnings do not.
+const (
+	lintError   = "error"
+	lintWarning = "warning"
+)
+
+//LintFinding is one issue of a template or mapping. Path is the JSON pointer
+//of the offending part of the body.
+type LintFinding struct {
+	Severity string `json:"severity"`
+	Rule     string `json:"rule"`
+	Path     string `json:"path"`
+	Message  string `json:"message"`
+}
+
+//LintReport is the outcome of linting a template or mapping.
+type LintReport struct {
+	OK       bool          `json:"ok"`
+	Fields   int           `json:"fields"`
+	Findings []LintFinding `json:"findings"`
+}
+
+type linter struct {
+	findings []LintFinding
+	fields   int
+	mapped   map[string]string
+}
+
+func (l *linter) add(severity, rule, path, format string, args ...interface{}) {
+	l.findings = append(l.findings, LintFinding{Severity: severity, Rule: rule, Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+//lintBody checks an index template (composable or not), the body of an index
+//creation or a bare mapping.
+func lintBody(body map[string]interface{}) LintReport {
+	l := &linter{mapped: map[string]string{}}
+	var mappings, settings map[string]interface{}
+	base := ""
+	_, isTemplate := body["index_patterns"]
+	switch {
+	case body["template"] != nil:
+		template, _ := body["template"].(map[string]interface{})
+		mappings, _ = template["mappings"].(map[string]interface{})
+		settings, _ = template["settings"].(map[string]interface{})
+		base = "/template"
+	case body["mappings"] != nil || body["settings"] != nil:
+		mappings, _ = body["mappings"].(map[string]interface{})
+		settings, _ = body["settings"].(map[string]interface{})
+	default:
+		mappings = body
+	}
+	if isTemplate {
+		patterns, _ := body["index_patterns"].([]interface{})
+		if s, ok := body["index_patterns"].(string); ok {
+			patterns = []interface{}{s}
+		}
+		if len(patterns) == 0 {
+			l.add(lintError, "index_patterns", "/index_patterns", "a template needs index patterns")
+		}
+		for i, p := range patterns {
+			if p == "*" {
+				l.add(lintWarning, "index_patterns", fmt.Sprintf("/index_patterns/%d", i), "* also matches system and hidden indices")
+			}
+		}
+	}
+	if mappings != nil {
+		mappingsPath := base + "/mappings"
+		if base == "" && body["mappings"] == nil {
+			mappingsPath = ""
+		}
+		l.lintDynamic(mappings, mappingsPath)
+		props, _ := mappings["properties"].(map[string]interface{})
+		l.lintProperties(props, mappingsPath+"/properties", "", 1)
+	}
+	limit := config.Lint.MaxFields
+	if s := settingValue(settings, "index.mapping.total_fields.limit"); len(s) != 0 {
+		if n, err := strconv.Atoi(s); err == nil {
+			limit = n
+		}
+	}
+	switch {
+	case limit > 0 && l.fields > limit:
+		l.add(lintError, "too_many_fields", base+"/mappings", "%d fields, over the limit of %d", l.fields, limit)
+	case limit > 0 && l.fields > limit*8/10:
+		l.add(lintWarning, "too_many_fields", base+"/mappings", "%d fields, close to the limit of %d", l.fields, limit)
+	}
+	if _, ok := body["data_stream"]; ok {
+		switch l.mapped["@timestamp"] {
+		case "date", "date_nanos":
+		case "":
+			l.add(lintError, "data_stream_timestamp", base+"/mappings/properties", "data streams need a @timestamp field mapped as date or date_nanos")
+		default:
+			l.add(lintError, "data_stream_timestamp", base+"/mappings/properties/@timestamp", "@timestamp is mapped as %s, data streams need date or date_nanos", l.mapped["@timestamp"])
+		}
+	}
+	report := LintReport{OK: true, Fields: l.fields, Findings: l.findings}
+	if report.Findings == nil {
+		report.Findings = []LintFinding{}
+	}
+	sort.SliceStable(report.Findings, func(i, j int) bool {
+		return report.Findings[i].Severity == lintError && report.Findings[j].Severity != lintError
+	})
+	for _, f := range report.Findings {
+		if f.Severity == lintError {
+			report.OK = false
+		}
+	}
+	return report
+}
+
+//lintDynamic warns about objects that map any new field they receive, which
+//lets a single bad document add thousands of fields.
+func (l *linter) lintDynamic(object map[string]interface{}, path string) {
+	switch dynamic := object["dynamic"]; dynamic {
+	case nil:
+		if len(path) == 0 || path == "/mappings" || path == "/template/mappings" {
+			l.add(lintWarning, "dynamic_mapping", path, "dynamic mapping is on by default, set dynamic to strict, false or runtime")
+		}
+	case true, "true":
+		l.add(lintWarning, "dynamic_mapping", path+"/dynamic", "dynamic mapping adds every new field of the documents")
+	}
+}
+
+func (l *linter) lintProperties(props map[string]interface{}, path, prefix string, depth int) {
+	if depth > config.Lint.MaxDepth && config.Lint.MaxDepth > 0 {
+		l.add(lintWarning, "depth", path, "objects nested %d deep, over %d", depth, config.Lint.MaxDepth)
+	}
+	for _, name := range sortedKeys(props) {
+		field, _ := props[name].(map[string]interface{})
+		fieldPath := path + "/" + escapePointer(name)
+		full := prefix + name
+		typ, _ := field["type"].(string)
+		if sub, ok := field["properties"].(map[string]interface{}); ok {
+			if len(typ) == 0 {
+				typ = "object"
+			}
+			l.mapped[full] = typ
+			l.lintDynamic(field, fieldPath)
+			l.lintProperties(sub, fieldPath+"/properties", full+".", depth+1)
+			continue
+		}
+		l.fields++
+		l.mapped[full] = typ
+		multi, _ := field["fields"].(map[string]interface{})
+		l.fields += len(multi)
+		if typ == "text" {
+			keyword := false
+			for _, m := range multi {
+				if m, ok := m.(map[string]interface{}); ok && m["type"] == "keyword" {
+					keyword = true
+				}
+			}
+			if !keyword {
+				l.add(lintWarning, "text_without_keyword", fieldPath, "text field %s has no keyword subfield to sort and aggregate on", full)
+			}
+		}
+	}
+}
+
+//settingValue reads a setting given nested ({"index": {"mapping": ...}}) or
+//flat ("index.mapping.total_fields.limit"), with or without the index prefix.
+func settingValue(settings map[string]interface{}, name string) string {
+	flat := map[string]interface{}{}
+	flatten("", settings, flat)
+	for _, key := range []string{name, name[len("index."):]} {
+		if v, ok := flat[key]; ok {
+			return fmt.Sprint(v)
+		}
+	}
+	return ""
+}
+
+//lintHandler lints the template, index body or mapping of the request.
+func lintHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, lintBody(body))
+}
+
+//putIndexTemplateHandler lints a composable index template then applies it.
+//Templates with errors are refused with the lint report, unless force=true.
+func putIndexTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report := lintBody(body)
+	if !report.OK && r.URL.Query().Get("force") != "true" {
+		writeJSON(w, http.StatusUnprocessableEntity, report)
+		return
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error encoding index template", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPut, "/_index_template/"+name, bytes.NewReader(b))
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error creating index template request", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := es.Perform(req)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error applying index template", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("X-Lint-Findings", strconv.Itoa(len(report.Findings)))
+	logger.InfoContext(r.Context(), "index template applied", "template", name, "findings", len(report.Findings), "forced", !report.OK, "actor", actor(r))
+	writeResponse(w, &esapi.Response{StatusCode: res.StatusCode, Header: res.Header, Body: res.Body})
+}
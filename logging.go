@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+//LogConfig selects the level and output format (json or text) of the logs.
+type LogConfig struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
+}
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	upstreamKey
+	identityKey
+	retryKey
+	progressKey
+	tenantKey
+	trackedKey
+)
+
+var logger = slog.New(contextHandler{slog.NewJSONHandler(os.Stderr, nil)})
+
+//setupLogging replaces the default logger according to the configuration.
+//The standard log package is routed through it as well.
+func setupLogging() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.Log.Level)); err != nil {
+		level = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler = slog.NewJSONHandler(os.Stderr, opts)
+	if strings.EqualFold(config.Log.Format, "text") {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	}
+	logger = slog.New(contextHandler{h})
+	slog.SetDefault(logger)
+}
+
+//contextHandler adds the request ID found in the context to every record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if id := requestID(ctx); len(id) != 0 {
+		rec.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+//requestID returns the ID of the request being served, if any.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+//RequestIDMid gives every request an ID, reusing the X-Request-ID sent by the
+//caller when there is one, and echoes it in the response headers.
+func RequestIDMid(app http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if len(id) == 0 {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		app.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+//requestIDTransport forwards the request ID to elastic search as X-Opaque-Id,
+//so it shows up in the slow logs and task list of the cluster. The name of an
+//authenticated caller follows it (id/name), so the tasks of a request are not
+//mistaken for those of another caller sending the same ID.
+type requestIDTransport struct {
+	base http.RoundTripper
+}
+
+func (t requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if id := requestID(req.Context()); len(id) != 0 {
+		if ident := identityFrom(req.Context()); ident != nil {
+			id += "/" + ident.Name
+		}
+		req = req.Clone(req.Context())
+		req.Header.Set("X-Opaque-Id", id)
+	}
+	return t.base.RoundTrip(req)
+}
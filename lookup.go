@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/elastic/go-elasticsearch/esapi"
+)
+
+//lookupHandler is a search built from query parameters, for quick lookups
+//from curl or a browser: index, q (query_string syntax), size and sort, the
+//last two being optional. Soft deleted documents are excluded as usual.
+func lookupHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	var index []string
+	if len(params.Get("index")) != 0 {
+		index = stringToArray(params.Get("index"))
+	}
+	if !checkAccess(w, r, opSearch, index) {
+		return
+	}
+	var size int
+	if s := params.Get("size"); len(s) != 0 {
+		var err error
+		if size, err = strconv.Atoi(s); err != nil || size < 0 {
+			http.Error(w, "size must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+	var query interface{} = map[string]interface{}{}
+	if q := params.Get("q"); len(q) != 0 {
+		query = map[string]interface{}{
+			"query": map[string]interface{}{"query_string": map[string]interface{}{"query": q}},
+		}
+	}
+	if config.SoftDelete.Enabled {
+		query = excludeSoftDeleted(query)
+	}
+	buf, err := encodeBody(query)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error encoding elastic search query", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	opts := []func(*esapi.SearchRequest){
+		es.Search.WithContext(r.Context()),
+		es.Search.WithIndex(index...),
+		es.Search.WithBody(buf),
+		es.Search.WithTrackTotalHits(true),
+		es.Search.WithPretty(),
+	}
+	if len(params.Get("sort")) != 0 {
+		opts = append(opts, es.Search.WithSort(stringToArray(params.Get("sort"))...))
+	}
+	if size != 0 {
+		opts = append(opts, es.Search.WithSize(size))
+	}
+	res, err := es.Search(opts...)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error getting response from elastic search cluster", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeResponse(w, res)
+}
@@ -1,27 +1,278 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
-	"log"
+	"flag"
+	"fmt"
 	"net/http"
+	"os"
 	"runtime/debug"
 	"strings"
+	"time"
 
 	"github.com/elastic/go-elasticsearch"
+	"github.com/elastic/go-elasticsearch/esapi"
 	"github.com/gorilla/mux"
 )
 
 func main() {
+	configPath := flag.String("config", "", "path of the JSON configuration file")
+	checkConfig := flag.Bool("check-config", false, "check the configuration and the cluster, then exit")
+	restore := flag.String("restore-state", "", "path of a state backup to restore into the store, then exit")
+	flag.Parse()
+	//"validate" is the subcommand form of -check-config
+	if flag.Arg(0) == "validate" {
+		flag.CommandLine.Parse(flag.Args()[1:])
+		*checkConfig = true
+	}
+	if err := loadConfig(*configPath); err != nil {
+		logger.Error("error loading configuration", "error", err)
+		os.Exit(1)
+	}
+	if len(*restore) != 0 {
+		s, err := openStore(config.Store)
+		if err == nil {
+			err = restoreState(context.Background(), s, *restore)
+		}
+		if err != nil {
+			logger.Error("error restoring state", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+	results := selfCheck(context.Background())
+	if *checkConfig {
+		if !printReport(os.Stdout, results) {
+			os.Exit(1)
+		}
+		return
+	}
+	//the cluster may come up after the gateway, only configuration errors
+	//stop the start
+	var failed []checkResult
+	for _, result := range results {
+		if result.Err != nil && !result.Remote {
+			failed = append(failed, result)
+		}
+	}
+	if len(failed) != 0 {
+		printReport(os.Stderr, failed)
+		os.Exit(1)
+	}
+	setupLogging()
+	for _, result := range results {
+		if result.Err != nil {
+			logger.Warn("self check failed", "check", result.Name, "error", result.Err)
+		}
+	}
+	if config.AccessLog.Enabled {
+		if err := setupAccessLog(); err != nil {
+			logger.Error("error opening access log", "error", err)
+			os.Exit(1)
+		}
+	}
+	if config.Journal.Enabled {
+		if err := setupJournal(); err != nil {
+			logger.Error("error opening journal", "error", err)
+			os.Exit(1)
+		}
+	}
+	if config.Tracing.Enabled {
+		if err := setupTracing(context.Background()); err != nil {
+			logger.Error("error setting up tracing", "error", err)
+			os.Exit(1)
+		}
+	}
+	if err := setupStore(); err != nil {
+		logger.Error("error opening store", "error", err)
+		os.Exit(1)
+	}
+	if config.Cache.Backend == "redis" {
+		searchCache = newRedisCache(config.Cache.Redis)
+	}
+	if config.Embedding.enabled() {
+		embeddings = newHTTPEmbedder(config.Embedding)
+	}
+	if config.SoftDelete.Enabled {
+		go purgeSoftDeleted()
+	}
+	if len(config.Analytics.Index) != 0 {
+		go shipAnalytics()
+	}
+	if len(config.Sketches.Fields) != 0 {
+		go maintainSketches()
+	}
+	if len(regionClusters()) != 0 {
+		go probeRegions()
+	}
+	go reapPITs()
+	if len(config.Warmup.Schedules) != 0 {
+		go scheduleWarmups()
+	}
+	if len(config.GRPC.Addr) != 0 {
+		go func() {
+			if err := serveGRPC(); err != nil {
+				logger.Error("error running grpc server", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
 	err := http.ListenAndServe(":8888", getMux())
 	if err != nil {
-		log.Panicln("Error running server")
+		logger.Error("error running server", "error", err)
+		os.Exit(1)
 	}
 }
 func getMux() *mux.Router {
 	r := mux.NewRouter()
+	r.Use(RequestIDMid)
+	if config.RequestTracking.Enabled {
+		r.Use(RequestTrackingMid)
+	}
+	if config.AccessLog.Enabled {
+		r.Use(AccessLogMid)
+	}
+	if config.Tracing.Enabled {
+		r.Use(TracingMid)
+	}
+	if config.CORS.enabled() {
+		r.Use(CORSMid)
+	}
+	if config.Auth.enabled() {
+		r.Use(AuthMid)
+	}
+	if config.Tenancy.enabled() {
+		r.Use(TenancyMid)
+	}
+	if config.Journal.Enabled {
+		r.Use(JournalMid)
+	}
+	if config.OpenAPI.Validate {
+		r.Use(OpenAPIMid)
+	}
+	if config.Retry.enabled() {
+		r.Use(RetryMid)
+	}
+	if config.Degradation.Enabled {
+		r.Use(DegradationMid)
+	}
 	r.Handle("/elastic", RecoveryMid(http.HandlerFunc(elasticSearchHandler))).Methods("POST")
+	r.Handle("/v2/elastic", RecoveryMid(http.HandlerFunc(searchV2Handler))).Methods("POST")
+	r.Handle("/elastic/search", RecoveryMid(http.HandlerFunc(lookupHandler))).Methods("GET")
+	r.Handle("/elastic/translate", RecoveryMid(http.HandlerFunc(translateHandler))).Methods("POST")
+	r.Handle("/elastic/mlt", RecoveryMid(http.HandlerFunc(mltHandler))).Methods("POST")
+	r.Handle("/elastic/knn", RecoveryMid(http.HandlerFunc(knnHandler))).Methods("POST")
+	r.Handle("/elastic/odata/{index}", RecoveryMid(http.HandlerFunc(odataHandler))).Methods("GET")
+	r.Handle("/elastic/prepared", RecoveryMid(http.HandlerFunc(prepareHandler))).Methods("POST")
+	r.Handle("/elastic/prepared/{handle}", RecoveryMid(http.HandlerFunc(preparedHandler))).Methods("GET")
+	r.Handle("/elastic/prepared/{handle}", RecoveryMid(http.HandlerFunc(executePreparedHandler))).Methods("POST")
+	r.Handle("/elastic/suggest", RecoveryMid(http.HandlerFunc(suggestHandler))).Methods("POST")
+	r.Handle("/elastic/export/csv", RecoveryMid(http.HandlerFunc(exportCSVHandler))).Methods("POST")
+	r.Handle("/elastic/export/ndjson", RecoveryMid(http.HandlerFunc(exportNDJSONHandler))).Methods("POST")
+	r.Handle("/elastic/export/{id}/progress", RecoveryMid(http.HandlerFunc(exportProgressHandler))).Methods("GET")
+	r.Handle("/elastic/export/{id}/manifest", RecoveryMid(http.HandlerFunc(exportManifestHandler))).Methods("GET")
+	r.Handle("/elastic/async/{index}", RecoveryMid(http.HandlerFunc(submitAsyncHandler))).Methods("POST")
+	r.Handle("/elastic/async/{id}", RecoveryMid(http.HandlerFunc(getAsyncHandler))).Methods("GET")
+	r.Handle("/elastic/async/{id}", RecoveryMid(http.HandlerFunc(deleteAsyncHandler))).Methods("DELETE")
+	r.Handle("/elastic/async/{id}/status", RecoveryMid(http.HandlerFunc(asyncStatusHandler))).Methods("GET")
+	r.Handle("/elastic/ws", RecoveryMid(http.HandlerFunc(wsHandler))).Methods("GET")
+	r.Handle("/elastic/requests/{id}", RecoveryMid(http.HandlerFunc(requestStatusHandler))).Methods("GET")
+	r.Handle("/elastic/doc/{index}/{id}", RecoveryMid(BackpressureMid(http.HandlerFunc(putDocHandler)))).Methods("PUT")
+	r.Handle("/elastic/doc/{index}/{id}", RecoveryMid(BackpressureMid(http.HandlerFunc(deleteDocHandler)))).Methods("DELETE")
+	r.Handle("/elastic/doc/{index}/{id}/history", RecoveryMid(http.HandlerFunc(historyHandler))).Methods("GET")
+	r.Handle("/elastic/doc/{index}/{id}/history/{version}/restore", RecoveryMid(http.HandlerFunc(restoreHandler))).Methods("POST")
+	r.Handle("/elastic/mget", RecoveryMid(http.HandlerFunc(mgetHandler))).Methods("POST")
+	r.Handle("/elastic/mget/{index}", RecoveryMid(http.HandlerFunc(mgetFallbackHandler))).Methods("POST")
+	r.Handle("/elastic/fieldcaps", RecoveryMid(http.HandlerFunc(fieldCapsHandler))).Methods("GET")
+	r.Handle("/elastic/termvectors/{index}/{id}", RecoveryMid(http.HandlerFunc(termVectorsHandler))).Methods("GET", "POST")
+	r.Handle("/elastic/explain/{index}/{id}", RecoveryMid(http.HandlerFunc(explainHandler))).Methods("POST")
+	r.Handle("/elastic/eql/{index}", RecoveryMid(http.HandlerFunc(eqlHandler))).Methods("POST")
+	r.Handle("/elastic/percolate/{index}", RecoveryMid(http.HandlerFunc(percolateHandler))).Methods("POST")
+	r.Handle("/elastic/percolate/{index}/queries/{id}", RecoveryMid(BackpressureMid(http.HandlerFunc(putPercolatorHandler)))).Methods("PUT")
+	r.Handle("/elastic/percolate/{index}/queries/{id}", RecoveryMid(BackpressureMid(http.HandlerFunc(deletePercolatorHandler)))).Methods("DELETE")
+	r.Handle("/elastic/admin/boosts/{index}", RecoveryMid(http.HandlerFunc(boostsHandler))).Methods("GET")
+	r.Handle("/elastic/admin/boosts/{index}", RecoveryMid(http.HandlerFunc(putBoostsHandler))).Methods("PUT")
+	r.Handle("/elastic/admin/boosts/{index}/versions", RecoveryMid(http.HandlerFunc(boostVersionsHandler))).Methods("GET")
+	r.Handle("/elastic/admin/boosts/{index}/versions/{version}/rollback", RecoveryMid(http.HandlerFunc(rollbackBoostsHandler))).Methods("POST")
+	r.Handle("/elastic/admin/words/{index}/{language}", RecoveryMid(http.HandlerFunc(wordsHandler))).Methods("GET")
+	r.Handle("/elastic/admin/words/{index}/{language}", RecoveryMid(http.HandlerFunc(putWordsHandler))).Methods("PUT")
+	r.Handle("/elastic/admin/templates/{id}", RecoveryMid(http.HandlerFunc(putTemplateHandler))).Methods("PUT")
+	r.Handle("/elastic/admin/templates/{id}", RecoveryMid(http.HandlerFunc(deleteTemplateHandler))).Methods("DELETE")
+	r.Handle("/elastic/diagnose/{index}", RecoveryMid(http.HandlerFunc(diagnoseHandler))).Methods("POST")
+	r.Handle("/elastic/admin/hot_threads", RecoveryMid(http.HandlerFunc(hotThreadsHandler))).Methods("GET")
+	r.Handle("/elastic/admin/nodes/stats", RecoveryMid(http.HandlerFunc(nodeStatsHandler))).Methods("GET")
+	r.Handle("/elastic/admin/pending_tasks", RecoveryMid(http.HandlerFunc(pendingTasksHandler))).Methods("GET")
+	r.Handle("/elastic/admin/reindex/{task}/progress", RecoveryMid(http.HandlerFunc(reindexProgressHandler))).Methods("GET")
+	r.Handle("/elastic/cluster/allocation/explain", RecoveryMid(http.HandlerFunc(allocationExplainHandler))).Methods("GET")
+	r.Handle("/elastic/admin/journal", RecoveryMid(http.HandlerFunc(journalHandler))).Methods("GET")
+	r.Handle("/elastic/admin/cluster/settings", RecoveryMid(http.HandlerFunc(clusterSettingsHandler))).Methods("GET")
+	r.Handle("/elastic/admin/cluster/settings", RecoveryMid(http.HandlerFunc(putClusterSettingsHandler))).Methods("PUT")
+	r.Handle("/elastic/admin/regions", RecoveryMid(http.HandlerFunc(regionsHandler))).Methods("GET")
+	r.Handle("/elastic/admin/drift", RecoveryMid(http.HandlerFunc(driftHandler))).Methods("GET")
+	r.Handle("/elastic/admin/pipelines", RecoveryMid(http.HandlerFunc(pipelinesHandler))).Methods("GET")
+	r.Handle("/elastic/admin/pipelines/_simulate", RecoveryMid(http.HandlerFunc(simulatePipelineHandler))).Methods("POST")
+	r.Handle("/elastic/admin/pipelines/{id}", RecoveryMid(http.HandlerFunc(pipelinesHandler))).Methods("GET")
+	r.Handle("/elastic/admin/pipelines/{id}", RecoveryMid(http.HandlerFunc(putPipelineHandler))).Methods("PUT")
+	r.Handle("/elastic/admin/pipelines/{id}", RecoveryMid(http.HandlerFunc(deletePipelineHandler))).Methods("DELETE")
+	r.Handle("/elastic/admin/pipelines/{id}/_simulate", RecoveryMid(http.HandlerFunc(simulatePipelineHandler))).Methods("POST")
+	r.Handle("/elastic/admin/webhooks", RecoveryMid(http.HandlerFunc(webhooksHandler))).Methods("GET")
+	r.Handle("/elastic/admin/webhooks/{id}/deliveries", RecoveryMid(http.HandlerFunc(webhookDeliveriesHandler))).Methods("GET")
+	r.Handle("/elastic/admin/webhooks/{id}/redrive", RecoveryMid(http.HandlerFunc(redriveWebhookHandler))).Methods("POST")
+	r.Handle("/elastic/pit/_keep_alive", RecoveryMid(http.HandlerFunc(keepAlivePITHandler))).Methods("POST")
+	r.Handle("/elastic/pit/{index}", RecoveryMid(http.HandlerFunc(openPITHandler))).Methods("POST")
+	r.Handle("/elastic/pit", RecoveryMid(http.HandlerFunc(closePITHandler))).Methods("DELETE")
+	r.Handle("/elastic/fanout", RecoveryMid(http.HandlerFunc(fanoutHandler))).Methods("POST")
+	r.Handle("/elastic/score", RecoveryMid(http.HandlerFunc(scoreHandler))).Methods("POST")
+	r.Handle("/elastic/admin/store", RecoveryMid(http.HandlerFunc(storeHandler))).Methods("GET")
+	r.Handle("/elastic/admin/dashboards", RecoveryMid(http.HandlerFunc(dashboardsHandler))).Methods("GET")
+	r.Handle("/elastic/admin/dashboards/{name}", RecoveryMid(http.HandlerFunc(putDashboardHandler))).Methods("PUT")
+	r.Handle("/elastic/admin/dashboards/{name}", RecoveryMid(http.HandlerFunc(deleteDashboardHandler))).Methods("DELETE")
+	r.Handle("/elastic/admin/dashboards/{name}/_warm", RecoveryMid(http.HandlerFunc(warmDashboardHandler))).Methods("POST")
+	r.Handle("/elastic/admin/remotes", RecoveryMid(http.HandlerFunc(remotesHandler))).Methods("GET")
+	r.Handle("/elastic/admin/remotes/{name}", RecoveryMid(http.HandlerFunc(putRemoteHandler))).Methods("PUT")
+	r.Handle("/elastic/admin/remotes/{name}", RecoveryMid(http.HandlerFunc(deleteRemoteHandler))).Methods("DELETE")
+	r.Handle("/elastic/admin/pits", RecoveryMid(http.HandlerFunc(pitsHandler))).Methods("GET")
+	r.Handle("/elastic/data_streams", RecoveryMid(http.HandlerFunc(dataStreamsHandler))).Methods("GET")
+	r.Handle("/elastic/data_streams/{name}", RecoveryMid(http.HandlerFunc(dataStreamsHandler))).Methods("GET")
+	r.Handle("/elastic/data_streams/{name}", RecoveryMid(http.HandlerFunc(putDataStreamHandler))).Methods("PUT")
+	r.Handle("/elastic/data_streams/{name}", RecoveryMid(http.HandlerFunc(deleteDataStreamHandler))).Methods("DELETE")
+	r.Handle("/elastic/data_streams/{name}/_rollover", RecoveryMid(http.HandlerFunc(rolloverDataStreamHandler))).Methods("POST")
+	r.Handle("/elastic/admin/transforms", RecoveryMid(http.HandlerFunc(transformsHandler))).Methods("GET")
+	r.Handle("/elastic/admin/transforms/_preview", RecoveryMid(http.HandlerFunc(previewTransformHandler))).Methods("POST")
+	r.Handle("/elastic/admin/transforms/{id}", RecoveryMid(http.HandlerFunc(transformsHandler))).Methods("GET")
+	r.Handle("/elastic/admin/transforms/{id}", RecoveryMid(http.HandlerFunc(putTransformHandler))).Methods("PUT")
+	r.Handle("/elastic/admin/transforms/{id}", RecoveryMid(http.HandlerFunc(deleteTransformHandler))).Methods("DELETE")
+	r.Handle("/elastic/admin/transforms/{id}/_stats", RecoveryMid(http.HandlerFunc(transformStatsHandler))).Methods("GET")
+	r.Handle("/elastic/admin/transforms/{id}/_start", RecoveryMid(http.HandlerFunc(startTransformHandler))).Methods("POST")
+	r.Handle("/elastic/admin/transforms/{id}/_stop", RecoveryMid(http.HandlerFunc(stopTransformHandler))).Methods("POST")
+	r.Handle("/elastic/admin/transforms/{id}/_preview", RecoveryMid(http.HandlerFunc(previewTransformHandler))).Methods("GET")
+	r.Handle("/elastic/admin/schemas/{index}", RecoveryMid(http.HandlerFunc(docSchemaHandler))).Methods("GET")
+	r.Handle("/elastic/admin/schemas/{index}", RecoveryMid(http.HandlerFunc(putDocSchemaHandler))).Methods("PUT")
+	r.Handle("/elastic/admin/schemas/{index}", RecoveryMid(http.HandlerFunc(deleteDocSchemaHandler))).Methods("DELETE")
+	r.Handle("/elastic/admin/lint", RecoveryMid(http.HandlerFunc(lintHandler))).Methods("POST")
+	r.Handle("/elastic/admin/index-templates/{name}", RecoveryMid(http.HandlerFunc(putIndexTemplateHandler))).Methods("PUT")
+	r.Handle("/elastic/admin/datasets", RecoveryMid(http.HandlerFunc(datasetsHandler))).Methods("GET")
+	r.Handle("/elastic/admin/datasets/{name}", RecoveryMid(BackpressureMid(http.HandlerFunc(loadDatasetHandler)))).Methods("POST")
+	r.Handle("/elastic/admin/smoke", RecoveryMid(http.HandlerFunc(smokeHandler))).Methods("POST")
+	r.Handle("/elastic/admin/degradation", RecoveryMid(http.HandlerFunc(degradationHandler))).Methods("GET")
+	r.Handle("/elastic/admin/cache", RecoveryMid(http.HandlerFunc(cacheStatsHandler))).Methods("GET")
+	r.Handle("/elastic/admin/cache", RecoveryMid(http.HandlerFunc(purgeCacheHandler))).Methods("DELETE")
+	r.Handle("/elastic/admin/flags", RecoveryMid(http.HandlerFunc(flagsHandler))).Methods("GET")
+	r.Handle("/elastic/admin/flags/{name}", RecoveryMid(http.HandlerFunc(putFlagHandler))).Methods("PUT")
+	r.Handle("/elastic/admin/flags/{name}", RecoveryMid(http.HandlerFunc(deleteFlagHandler))).Methods("DELETE")
+	r.Handle("/elastic/distinct/{index}/{field}", RecoveryMid(http.HandlerFunc(distinctHandler))).Methods("GET")
+	if config.GraphQL.enabled() {
+		r.Handle("/elastic/graphql", RecoveryMid(http.HandlerFunc(graphQLHandler))).Methods("POST")
+		r.Handle("/elastic/graphql/schema", RecoveryMid(http.HandlerFunc(graphQLSchemaHandler))).Methods("GET")
+	}
+	r.HandleFunc("/healthz", healthzHandler).Methods("GET")
+	r.HandleFunc("/readyz", readyzHandler).Methods("GET")
+	r.HandleFunc("/version", versionHandler).Methods("GET")
+	r.HandleFunc("/openapi.json", openAPIHandler(r)).Methods("GET")
+	if config.CORS.enabled() {
+		r.PathPrefix("/").Methods("OPTIONS").HandlerFunc(preflightHandler(r))
+	}
 	return r
 }
 
@@ -31,9 +282,8 @@ func RecoveryMid(app http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
-				log.Println(err)
 				stack := debug.Stack()
-				log.Println(string(stack))
+				logger.ErrorContext(r.Context(), "recovered from panic", "panic", err, "stack", string(stack))
 				w.WriteHeader(http.StatusInternalServerError)
 			}
 		}()
@@ -43,29 +293,61 @@ func RecoveryMid(app http.Handler) http.HandlerFunc {
 
 func elasticSearchHandler(w http.ResponseWriter, r *http.Request) {
 	var body RequestBody
-	var sort, addresses, index []string
 	err := json.NewDecoder(r.Body).Decode(&body)
 	if err != nil {
-		log.Println("unable to decode request body :: ", err)
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
+	runSearch(w, r, body)
+}
+
+//runSearch runs the search of a decoded body, for /elastic and /v2/elastic.
+func runSearch(w http.ResponseWriter, r *http.Request, body RequestBody) {
+	var sort, addresses, index []string
+	var err error
 
 	//this will have the response returned from elastic search
-	var elasticResponse map[string]interface{}
+	var elasticResponse SearchResponse
 	var es *elasticsearch.Client
 	if len(body.Addresses) != 0 {
-		addresses = stringToArray(body.Addresses)
+		addresses = stringToArray(string(body.Addresses))
 	}
 	if len(body.Sort) != 0 {
-		sort = stringToArray(body.Sort)
+		sort = stringToArray(string(body.Sort))
 	}
 	if len(body.Index) != 0 {
-		index = stringToArray(body.Index)
+		index = stringToArray(string(body.Index))
+	}
+	var pit *PointInTime
+	if len(body.PIT) != 0 {
+		if pit = trackedPIT(body.PIT); pit == nil {
+			writeValidationError(w, &ValidationError{Path: "/pit", Message: "unknown or closed point in time"})
+			return
+		}
+		//the point in time names the indices
+		index = pit.Index
+	}
+	if !checkAccess(w, r, opSearch, index) {
+		return
+	}
+	if err := checkResponseMode(body.ResponseMode); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	schema, err := responseSchema(r)
+	if err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	if schema == schemaV2 && !flagEnabled(r, flagTypedResponses) {
+		schema = schemaV1
 	}
+	w.Header().Set("X-Response-Schema", schema)
 	if len(body.Username) == 0 && len(body.Password) == 0 && len(body.Addresses) == 0 {
-		es, err = elasticsearch.NewDefaultClient()
+		es, err = defaultClient()
 		if err != nil {
-			log.Println("unable to create es client object :: ", err)
+			logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -75,79 +357,403 @@ func elasticSearchHandler(w http.ResponseWriter, r *http.Request) {
 			Username:  body.Username,
 			Password:  body.Password,
 		}
-		es, err = elasticsearch.NewClient(cfg)
+		es, err = newClient(cfg)
 		if err != nil {
-			log.Println("unable to create es client object :: ", err)
+			logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 	}
-	var buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(body.ElasticQuery); err != nil {
-		log.Println("Error encoding elastic search query : ", err)
+	if len(body.Template) != 0 {
+		if body.ElasticQuery != nil {
+			writeValidationError(w, &ValidationError{Path: "/template", Message: "template and elasticquery are exclusive"})
+			return
+		}
+		body.ElasticQuery, err = renderTemplate(r.Context(), es, body.Template, body.TemplateParams)
+		if err != nil {
+			logger.ErrorContext(r.Context(), "unable to render search template", "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if config.Validation.Enabled {
+		err := validateSearchBody(body.ElasticQuery)
+		if err == nil && config.Validation.Remote {
+			err = validateRemote(r.Context(), es, index, body.ElasticQuery)
+		}
+		if err != nil {
+			logger.InfoContext(r.Context(), "invalid elastic query", "error", err)
+			writeValidationError(w, err)
+			return
+		}
+	}
+	if len(body.Text) != 0 {
+		body.Text = preprocessText(body.Text)
+		body.Text, body.ElasticQuery = extractRanges(index, body.Text, body.ElasticQuery)
+	}
+	if len(body.Text) != 0 {
+		body.Text, err = removeStopwords(r.Context(), index, body.Language, body.Text)
+		if err != nil {
+			logger.ErrorContext(r.Context(), "unable to apply stopwords", "error", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		body.ElasticQuery, err = withText(r.Context(), index, body.ElasticQuery, body.Text, body.Normalize)
+		if err != nil {
+			logger.ErrorContext(r.Context(), "unable to apply field boosts", "error", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	if flagEnabled(r, flagKeywordFields) {
+		keywordSort, err := withKeywordFields(r.Context(), es, index, &body, sort)
+		if err != nil {
+			logger.WarnContext(r.Context(), "unable to read mappings, fields are used as named", "error", err)
+		}
+		sort = keywordSort
+	}
+	if len(body.Filters) != 0 {
+		body.ElasticQuery, err = withFilters(body.ElasticQuery, body.Filters)
+		if err != nil {
+			writeValidationError(w, err)
+			return
+		}
+	}
+	if len(strings.TrimSpace(body.Where)) != 0 {
+		body.ElasticQuery, err = withWhere(body.ElasticQuery, body.Where)
+		if err != nil {
+			writeValidationError(w, err)
+			return
+		}
+	}
+	if len(body.Sorts) != 0 {
+		if len(sort) != 0 {
+			writeValidationError(w, &ValidationError{Path: "/sorts", Message: "sort and sorts are exclusive"})
+			return
+		}
+		body.ElasticQuery, err = withSorts(body.ElasticQuery, body.Sorts)
+		if err != nil {
+			writeValidationError(w, err)
+			return
+		}
+	}
+	if body.Geo != nil {
+		if len(sort) != 0 && body.Geo.Sort != nil {
+			writeValidationError(w, &ValidationError{Path: "/geo/sort", Message: "sort and geo sort are exclusive"})
+			return
+		}
+		body.ElasticQuery, err = withGeo(body.ElasticQuery, body.Geo)
+		if err != nil {
+			writeValidationError(w, err)
+			return
+		}
+	}
+	if len(body.RuntimeMappings) != 0 || len(body.ScriptFields) != 0 {
+		body.ElasticQuery, err = withComputedFields(body.ElasticQuery, body.RuntimeMappings, body.ScriptFields)
+		if err != nil {
+			writeValidationError(w, err)
+			return
+		}
+	}
+	if body.Highlight != nil {
+		body.ElasticQuery, err = withHighlight(body.ElasticQuery, body.Highlight)
+		if err != nil {
+			writeValidationError(w, err)
+			return
+		}
+	}
+	if config.SoftDelete.Enabled && !body.IncludeDeleted {
+		body.ElasticQuery = excludeSoftDeleted(body.ElasticQuery)
+	}
+	profile, ok, err := scoringProfile(body.Profile, routeTemplate(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ok && flagEnabled(r, flagQueryRewriting) {
+		body.ElasticQuery = profile.apply(body.ElasticQuery)
+	}
+	if body.Sample > 0 {
+		body.ElasticQuery = sampleQuery(body.ElasticQuery, body.SampleSeed)
+		body.Size = body.Sample
+		body.From = 0
+		sort = nil
+	}
+	if len(config.Experiments) != 0 && flagEnabled(r, flagQueryRewriting) {
+		body.ElasticQuery = applyExperiments(w, r, index, body.ElasticQuery)
+	}
+	level := degradationLevel()
+	var degraded []string
+	if level >= levelReducedSize {
+		body.ElasticQuery, degraded = degrade(level, body.ElasticQuery, &body.Size)
+	}
+	private := privateSearch(index, body.Private)
+	if private {
+		//the documents are what the noise protects
+		body.Size, body.From = 0, 0
+	}
+	if body.ProfileQuery {
+		q, ok := searchBody(body.ElasticQuery)
+		if !ok {
+			writeValidationError(w, &ValidationError{Path: "/elasticquery", Message: "must be a JSON object to profile the query"})
+			return
+		}
+		q["profile"] = true
+		body.ElasticQuery = q
+		//the timings of a cached response would be those of another search
+		body.NoCache = true
+	}
+	if err := checkPagination(r.Context(), es, index, body.From, body.Size); err != nil {
+		logger.InfoContext(r.Context(), "invalid pagination", "error", err)
+		writeValidationError(w, err)
+		return
+	}
+	var guard *pageGuard
+	searchIndex := index
+	if body.Pagination != nil {
+		guard, err = startPage(r.Context(), es, body.Pagination, index, sort, &body)
+		if err != nil {
+			writeValidationError(w, err)
+			return
+		}
+		//searches over a point in time name no index
+		if len(guard.session.pit) != 0 {
+			searchIndex = nil
+		}
+	}
+	if pit != nil {
+		if body.Pagination != nil {
+			writeValidationError(w, &ValidationError{Path: "/pit", Message: "pit and pagination are exclusive"})
+			return
+		}
+		if body.ElasticQuery, err = withPIT(body.ElasticQuery, pit); err != nil {
+			writeValidationError(w, err)
+			return
+		}
+		searchIndex = nil
+		body.NoCache = true
+	}
+	complexity := queryComplexity(body.ElasticQuery)
+	query, err := json.Marshal(body.ElasticQuery)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error encoding elastic search query", "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Perform the search request.
-	res, err := es.Search(
-		es.Search.WithContext(context.Background()),
-		es.Search.WithIndex(index...),
-		es.Search.WithBody(&buf),
+	opts := []func(*esapi.SearchRequest){
+		es.Search.WithIndex(searchIndex...),
 		es.Search.WithSort(sort...),
 		es.Search.WithTrackTotalHits(true),
 		es.Search.WithPretty(),
 		es.Search.WithSize(body.Size),
-	)
+	}
+	if body.From != 0 {
+		opts = append(opts, es.Search.WithFrom(body.From))
+	}
+	var includes, excludes []string
+	if len(body.SourceIncludes) != 0 {
+		includes = stringToArray(body.SourceIncludes)
+		opts = append(opts, es.Search.WithSourceIncludes(includes...))
+	}
+	if len(body.SourceExcludes) != 0 {
+		excludes = stringToArray(body.SourceExcludes)
+		opts = append(opts, es.Search.WithSourceExcludes(excludes...))
+	}
+	opts = append(opts, budgetOptions(es, body.LatencyBudget.Duration)...)
+	search := doSearch(es, query, opts)
+	hash := queryHash(index, sort, body.From, body.Size, body.ElasticQuery)
+	w.Header().Set("X-Query-Hash", hash)
+	if info := upstreamFrom(r.Context()); info != nil {
+		info.setQueryHash(hash)
+	}
+
+	// Perform the search request.
+	var res searchResult
+	var hit bool
+	cc := requestCacheControl(r)
+	cc.stale = level >= levelStale
+	if config.Cache.Enabled && !body.NoCache && !cc.noStore && flagEnabled(r, flagCaching) {
+		key := cacheKey(tenantScope(r.Context(), ""), addresses, body.Username, body.Password, body.LatencyBudget.Duration, includes, excludes, hash)
+		res, hit, err = searchCache.get(r.Context(), key, search, cc)
+		setCacheHeader(w, hit, res)
+	} else {
+		res, err = search(r.Context())
+	}
+	if err == errNotCached {
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		return
+	}
 	if err != nil {
-		log.Println("Error getting response from elastic search cluster : ", err)
+		logger.ErrorContext(r.Context(), "error getting response from elastic search cluster", "error", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer res.Body.Close()
 	if res.IsError() {
-		var e map[string]interface{}
-		if err := json.NewDecoder(res.Body).Decode(&e); err != nil {
-			log.Printf("Error parsing the response body: %s", err)
+		var e ErrorResponse
+		if err := json.Unmarshal(res.Body, &e); err != nil {
+			logger.ErrorContext(r.Context(), "error parsing the response body", "error", err)
 		} else {
 			// Print the response status and error information.
-			log.Printf("[%s] %s: %s",
-				res.Status(),
-				e["error"].(map[string]interface{})["type"],
-				e["error"].(map[string]interface{})["reason"],
+			logger.ErrorContext(r.Context(), "elastic search returned an error",
+				"status", res.StatusCode,
+				"type", e.Error.Type,
+				"reason", e.Error.Reason,
 			)
 		}
-		buf := new(bytes.Buffer)
-		buf.ReadFrom(res.Body)
-		http.Error(w, buf.String(), http.StatusInternalServerError)
+		http.Error(w, string(res.Body), http.StatusInternalServerError)
 		return
 	}
-	if err := json.NewDecoder(res.Body).Decode(&elasticResponse); err != nil {
-		log.Println("Error parsing the response body of elastic search : ", err)
+	if err := json.Unmarshal(res.Body, &elasticResponse); err != nil {
+		logger.ErrorContext(r.Context(), "error parsing the response body of elastic search", "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	b, err := json.Marshal(elasticResponse)
-	if err != nil {
-		log.Println("error in json marshaling :: ", err)
+	if len(config.Analytics.Index) != 0 {
+		recordEvent(r.Context(), "search", map[string]interface{}{
+			"query_hash": hash,
+			"index":      strings.Join(index, ","),
+			"cached":     hit,
+		})
+	}
+	responseMeta(&elasticResponse)["complexity"] = complexity
+	if config.Freshness.Enabled {
+		freshness, err := indexFreshness(r.Context(), es, index)
+		if err != nil {
+			logger.WarnContext(r.Context(), "unable to get index freshness", "error", err)
+		} else {
+			responseMeta(&elasticResponse)["freshness"] = freshness
+		}
+	}
+	if private {
+		if err := privatizeResponse(&elasticResponse, body.ElasticQuery, hash); err != nil {
+			logger.ErrorContext(r.Context(), "unable to apply privacy to the response", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if body.ProfileQuery {
+		if err := withProfileSummary(&elasticResponse); err != nil {
+			logger.WarnContext(r.Context(), "unable to summarize the query profile", "error", err)
+		}
+	}
+	if pit != nil {
+		usePIT(pit.ID, elasticResponse.Other["pit_id"])
+	}
+	if guard != nil {
+		guard.finish(r.Context(), es, index, sort, body.From, query, &elasticResponse)
+	}
+	if level != levelNormal {
+		meta := map[string]interface{}{"level": levelNames[level]}
+		if len(degraded) != 0 {
+			meta["applied"] = degraded
+		}
+		if res.Stale {
+			meta["stale"] = true
+			meta["age"] = int(time.Since(res.At).Seconds())
+		}
+		responseMeta(&elasticResponse)["degradation"] = meta
+	}
+	if body.Demo || config.Demo.Always {
+		anonymizeHits(&elasticResponse)
+	}
+	var shaped interface{} = shapeResponse(&elasticResponse, body.ResponseMode)
+	if schema == schemaV2 && (body.ResponseMode == "" || body.ResponseMode == modeRaw) {
+		shaped = toV2(r.Context(), &elasticResponse)
+	}
+	if err := writeEncoded(w, r, http.StatusOK, shaped); err != nil {
+		logger.ErrorContext(r.Context(), "error in response encoding", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("error in getting data"))
 		return
 	}
-	w.Write(b)
 }
 
 //RequestBody is the structure to store body of request
 type RequestBody struct {
 	Username     string      `json:"username"`
 	Password     string      `json:"password"`
-	Addresses    string      `json:"addresses"`
+	Addresses    StringList  `json:"addresses"`
 	ElasticQuery interface{} `json:"elasticquery"`
-	Index        string      `json:"index"`
-	Sort         string      `json:"sort"`
+	Index        StringList  `json:"index"`
+	Sort         StringList  `json:"sort"`
 	Size         int         `json:"size"`
+	//Sorts is the structured alternative to Sort, with nested and script sorts
+	Sorts []SortSpec `json:"sorts"`
+	//From is the offset of the first hit returned
+	From int `json:"from"`
+	//SourceIncludes and SourceExcludes are comma separated _source field patterns
+	SourceIncludes string `json:"source_includes"`
+	SourceExcludes string `json:"source_excludes"`
+	//IncludeDeleted returns soft deleted documents as well
+	IncludeDeleted bool `json:"include_deleted"`
+	//Sample returns that many randomly chosen matching documents instead of the top hits
+	Sample     int   `json:"sample"`
+	SampleSeed int64 `json:"sample_seed"`
+	//Demo scrambles the configured sensitive fields of the returned documents
+	Demo bool `json:"demo"`
+	//LatencyBudget ("250ms") lets elastic search cut the search short to answer in time
+	LatencyBudget Duration `json:"latency_budget"`
+	//NoCache bypasses the response cache for this search
+	NoCache bool `json:"no_cache"`
+	//Profile names the scoring profile to apply, overriding the route default
+	Profile string `json:"profile"`
+	//ProfileQuery profiles the query on elastic search, its timings in meta.profile
+	ProfileQuery bool `json:"profile_query"`
+	//Filters is the simplified alternative to writing the query DSL
+	Filters []Filter `json:"filters"`
+	//Text is matched against the boosted fields of the index (full-text mode)
+	Text string `json:"text"`
+	//Language selects the stopword lists applied to Text
+	Language string `json:"language"`
+	//Normalize makes Text match regardless of case and accents
+	Normalize bool `json:"normalize"`
+	//Highlight returns highlighted fragments of the given fields with every hit
+	Highlight *Highlight `json:"highlight"`
+	//Template runs the stored search template of that id with TemplateParams
+	Template       string                 `json:"template"`
+	TemplateParams map[string]interface{} `json:"template_params"`
+	//RuntimeMappings and ScriptFields compute fields at search time
+	RuntimeMappings map[string]interface{} `json:"runtime_mappings"`
+	ScriptFields    map[string]interface{} `json:"script_fields"`
+	//Pagination checks that the pages of a from/size pagination stay consistent
+	Pagination *PageGuard `json:"pagination"`
+	//PIT searches a point in time opened through /elastic/pit, by its id
+	PIT string `json:"pit"`
+	//ResponseMode is raw (the default), hits or flat
+	ResponseMode string `json:"response_mode"`
+	//Where is a SQL like condition ("status = 'open' AND age > 30") added as a filter
+	Where string `json:"where"`
+	//Geo filters and sorts on the distance to a point
+	Geo *Geo `json:"geo"`
+	//Private answers only noisy aggregations, as searches of sensitive indices do
+	Private bool `json:"private"`
 }
 
 func stringToArray(input string) []string {
 	return strings.Split(input, ",")
 }
+
+//StringList is a comma separated list that clients may also send as a JSON
+//array of strings, kept joined for stringToArray.
+type StringList string
+
+//UnmarshalJSON reads a comma separated string or an array of strings.
+func (l *StringList) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*l = StringList(s)
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("must be a string or an array of strings")
+	}
+	for _, item := range list {
+		if len(item) == 0 || strings.Contains(item, ",") {
+			return fmt.Errorf("array items must be names without commas, got %q", item)
+		}
+	}
+	*l = StringList(strings.Join(list, ","))
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//ExportConfig sets how long the manifests of finished exports are kept.
+type ExportConfig struct {
+	ManifestKeep Duration `json:"manifest_keep"`
+}
+
+//manifestVersion is the version of the manifest format. Fields are only
+//added within a version.
+const manifestVersion = 1
+
+//manifestsNamespace is the namespace of the export manifests in the store.
+const manifestsNamespace = "export_manifests"
+
+//ExportManifest describes the output of a finished export, so downstream
+//jobs can check they received all of it before ingesting it. Status is
+//"complete" or "failed"; the files of a failed export are incomplete.
+type ExportManifest struct {
+	ManifestVersion int            `json:"manifest_version"`
+	ExportID        string         `json:"export_id"`
+	Status          string         `json:"status"`
+	Format          string         `json:"format"`
+	Index           []string       `json:"index"`
+	Started         time.Time      `json:"started"`
+	Finished        time.Time      `json:"finished"`
+	Rows            int64          `json:"rows"`
+	Files           []ManifestFile `json:"files"`
+	Schema          []SchemaField  `json:"schema"`
+	Error           string         `json:"error,omitempty"`
+	Expires         time.Time      `json:"expires"`
+}
+
+//ManifestFile is one file of an export. SHA256 is the checksum of the bytes
+//of the file as written by the gateway, before any content encoding.
+type ManifestFile struct {
+	Name   string `json:"name"`
+	Rows   int64  `json:"rows"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+}
+
+//SchemaField is a column of the export with the JSON type of its values:
+//string, number, boolean, array, object, or mixed. Nested fields are dotted
+//(user.name), those of NDJSON hits under _source.
+type SchemaField struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+//exportOutput counts and checksums what an export writes.
+type exportOutput struct {
+	w      io.Writer
+	format string
+	file   string
+	hash   hash.Hash
+	bytes  int64
+	rows   int64
+	schema map[string]string
+}
+
+func (o *exportOutput) Write(p []byte) (int, error) {
+	n, err := o.w.Write(p)
+	o.hash.Write(p[:n])
+	o.bytes += int64(n)
+	return n, err
+}
+
+//output makes w the file of the export, so its manifest describes it.
+func (j *job) output(format, file string, w io.Writer) io.Writer {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.out = &exportOutput{w: w, format: format, file: file, hash: sha256.New(), schema: map[string]string{}}
+	return j.out
+}
+
+//record counts rows written to the output, learning the types of their columns.
+func (j *job) record(rows []map[string]interface{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, row := range rows {
+		for k, v := range row {
+			if v == nil {
+				continue
+			}
+			t := jsonType(v)
+			if seen, ok := j.out.schema[k]; ok && seen != t {
+				t = "mixed"
+			}
+			j.out.schema[k] = t
+		}
+	}
+	j.out.rows += int64(len(rows))
+}
+
+//saveManifest writes the manifest of the finished export, and removes the
+//expired ones.
+func (j *job) saveManifest(id string) {
+	j.mu.Lock()
+	out := j.out
+	m := ExportManifest{
+		ManifestVersion: manifestVersion,
+		ExportID:        id,
+		Status:          "complete",
+		Index:           j.index,
+		Started:         j.started.UTC(),
+		Finished:        time.Now().UTC(),
+		Files:           []ManifestFile{},
+		Schema:          []SchemaField{},
+	}
+	if j.err != nil {
+		m.Status, m.Error = "failed", j.err.Error()
+	}
+	if out != nil {
+		m.Format, m.Rows = out.format, out.rows
+		m.Files = append(m.Files, ManifestFile{Name: out.file, Rows: out.rows, Bytes: out.bytes, SHA256: hex.EncodeToString(out.hash.Sum(nil))})
+		for name, t := range out.schema {
+			m.Schema = append(m.Schema, SchemaField{Name: name, Type: t})
+		}
+	}
+	j.mu.Unlock()
+	if out == nil {
+		return
+	}
+	sort.Slice(m.Schema, func(a, b int) bool { return m.Schema[a].Name < m.Schema[b].Name })
+	m.Expires = m.Finished.Add(config.Exports.ManifestKeep.Duration)
+	ctx := context.Background()
+	if err := saveState(ctx, manifestsNamespace, id, m); err != nil {
+		logger.Error("unable to save export manifest", "export", id, "error", err)
+		return
+	}
+	values, err := state.list(ctx, manifestsNamespace)
+	if err != nil {
+		return
+	}
+	for key, b := range values {
+		var old ExportManifest
+		if json.Unmarshal(b, &old) == nil && time.Now().After(old.Expires) {
+			state.delete(ctx, manifestsNamespace, key)
+		}
+	}
+}
+
+//exportManifestHandler answers the manifest of a finished export by the
+//request id it was sent with (X-Request-ID), 409 while it is running.
+func exportManifestHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	jobsMu.Lock()
+	j, tracked := jobs[id]
+	jobsMu.Unlock()
+	if tracked && !j.progress().Finished {
+		if !checkAccess(w, r, opSearch, j.index) {
+			return
+		}
+		http.Error(w, "export still running", http.StatusConflict)
+		return
+	}
+	b, ok, err := state.get(r.Context(), manifestsNamespace, id)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to read export manifest", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var m ExportManifest
+	if ok {
+		if err := json.Unmarshal(b, &m); err != nil {
+			logger.ErrorContext(r.Context(), "unable to read export manifest", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if !ok || time.Now().After(m.Expires) {
+		http.Error(w, "unknown export", http.StatusNotFound)
+		return
+	}
+	if !checkAccess(w, r, opSearch, m.Index) {
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
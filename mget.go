@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/elastic/go-elasticsearch"
+	"github.com/gorilla/mux"
+)
+
+//mgetDoc is one document of a multi get response.
+type mgetDoc struct {
+	Index   string          `json:"_index"`
+	ID      string          `json:"_id"`
+	Version int64           `json:"_version,omitempty"`
+	Found   bool            `json:"found"`
+	Source  json.RawMessage `json:"_source,omitempty"`
+	Error   interface{}     `json:"error,omitempty"`
+}
+
+//mgetIDs fetches ids from one index, in order.
+func mgetIDs(ctx context.Context, es *elasticsearch.Client, index string, ids []string) ([]mgetDoc, error) {
+	buf, err := encodeBody(map[string]interface{}{"ids": ids})
+	if err != nil {
+		return nil, err
+	}
+	res, err := es.Mget(buf, es.Mget.WithContext(ctx), es.Mget.WithIndex(index))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return make([]mgetDoc, len(ids)), nil
+	}
+	if res.IsError() {
+		return nil, fmt.Errorf("mget on %s: %s", index, res.String())
+	}
+	var result struct {
+		Docs []mgetDoc `json:"docs"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	return result.Docs, err
+}
+
+//mgetFallbackHandler gets documents by ID from an index and looks the ones it
+//misses up in the previous generations configured for that index, oldest last.
+//Clients keep reading through a reindex without knowing it happened.
+func mgetFallbackHandler(w http.ResponseWriter, r *http.Request) {
+	index := mux.Vars(r)["index"]
+	generations := append([]string{index}, config.Generations[index]...)
+	if !checkAccess(w, r, opSearch, generations) {
+		return
+	}
+	var body struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	docs := make([]mgetDoc, len(body.IDs))
+	missing := make([]int, len(body.IDs))
+	for i := range missing {
+		missing[i] = i
+	}
+	for _, gen := range generations {
+		if len(missing) == 0 {
+			break
+		}
+		ids := make([]string, len(missing))
+		for i, pos := range missing {
+			ids[i] = body.IDs[pos]
+		}
+		found, err := mgetIDs(r.Context(), es, gen, ids)
+		if err != nil {
+			logger.ErrorContext(r.Context(), "error getting documents", "index", gen, "error", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		var still []int
+		for i, pos := range missing {
+			if i < len(found) && found[i].Found {
+				docs[pos] = found[i]
+				continue
+			}
+			still = append(still, pos)
+		}
+		missing = still
+	}
+	for _, pos := range missing {
+		docs[pos] = mgetDoc{Index: index, ID: body.IDs[pos]}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"docs": docs})
+}
+
+//maxMgetDocs caps the documents of one multi get request.
+const maxMgetDocs = 1000
+
+//MgetRequest lists the documents to get, from any indices.
+type MgetRequest struct {
+	Docs []struct {
+		Index string `json:"index"`
+		ID    string `json:"id"`
+	} `json:"docs"`
+}
+
+//mgetHandler gets documents by index and ID and answers them in the order
+//asked, with found false for those missing. Documents are fetched with one
+//multi get per index.
+func mgetHandler(w http.ResponseWriter, r *http.Request) {
+	var body MgetRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body.Docs) > maxMgetDocs {
+		writeValidationError(w, &ValidationError{Path: "/docs", Message: fmt.Sprintf("at most %d documents", maxMgetDocs)})
+		return
+	}
+	var indices []string
+	positions := map[string][]int{}
+	for i, d := range body.Docs {
+		switch {
+		case len(d.Index) == 0:
+			writeValidationError(w, &ValidationError{Path: fmt.Sprintf("/docs/%d/index", i), Message: "index is required"})
+			return
+		case len(d.ID) == 0:
+			writeValidationError(w, &ValidationError{Path: fmt.Sprintf("/docs/%d/id", i), Message: "id is required"})
+			return
+		}
+		if _, ok := positions[d.Index]; !ok {
+			indices = append(indices, d.Index)
+		}
+		positions[d.Index] = append(positions[d.Index], i)
+	}
+	if !checkAccess(w, r, opSearch, indices) {
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	docs := make([]mgetDoc, len(body.Docs))
+	found := 0
+	for _, index := range indices {
+		ids := make([]string, len(positions[index]))
+		for i, pos := range positions[index] {
+			ids[i] = body.Docs[pos].ID
+		}
+		got, err := mgetIDs(r.Context(), es, index, ids)
+		if err != nil {
+			logger.ErrorContext(r.Context(), "error getting documents", "index", index, "error", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		for i, pos := range positions[index] {
+			docs[pos] = mgetDoc{Index: index, ID: ids[i]}
+			if i < len(got) && got[i].Found {
+				docs[pos] = got[i]
+				found++
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"docs": docs, "found": found, "missing": len(docs) - found})
+}
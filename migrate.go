@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//migration upgrades the state of the store from version-1 to version.
+type migration struct {
+	version int
+	name    string
+	up      func(ctx context.Context, s stateStore) error
+}
+
+//migrations are applied in order on boot, from the version the store is at.
+//They are never changed once released: a change of the state gets a new one.
+var migrations = []migration{
+	//the state of the gateway before versioning, stamped as is
+	{version: 1, name: "baseline", up: func(ctx context.Context, s stateStore) error { return nil }},
+}
+
+//stateNamespaces are the namespaces of the store, backed up before migrating.
+var stateNamespaces = []string{flagsNamespace, deliveriesNamespace, dashboardsNamespace, manifestsNamespace}
+
+const (
+	//metaNamespace holds the version of the state and its applied migrations.
+	metaNamespace = "meta"
+	versionKey    = "version"
+	migrationsKey = "migrations"
+)
+
+//latestVersion is the version of the state this gateway writes.
+func latestVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+//AppliedMigration is a migration applied to the store.
+type AppliedMigration struct {
+	Version int       `json:"version"`
+	Name    string    `json:"name"`
+	Applied time.Time `json:"applied"`
+	Backup  string    `json:"backup,omitempty"`
+}
+
+//StateBackup is a copy of the store taken before migrating it.
+type StateBackup struct {
+	Version    int                          `json:"version"`
+	Taken      time.Time                    `json:"taken"`
+	Namespaces map[string]map[string][]byte `json:"namespaces"`
+}
+
+func stateVersion(ctx context.Context, s stateStore) (int, error) {
+	b, ok, err := s.get(ctx, metaNamespace, versionKey)
+	if err != nil || !ok {
+		return 0, err
+	}
+	var v int
+	if err := json.Unmarshal(b, &v); err != nil {
+		return 0, fmt.Errorf("state version: %w", err)
+	}
+	return v, nil
+}
+
+func appliedMigrations(ctx context.Context, s stateStore) ([]AppliedMigration, error) {
+	applied := []AppliedMigration{}
+	b, ok, err := s.get(ctx, metaNamespace, migrationsKey)
+	if err != nil || !ok {
+		return applied, err
+	}
+	if err := json.Unmarshal(b, &applied); err != nil {
+		return nil, fmt.Errorf("applied migrations: %w", err)
+	}
+	return applied, nil
+}
+
+//migrateState brings the store to latestVersion. A store written by a newer
+//gateway is refused rather than read wrong: restore the backup taken before
+//its upgrade instead. The store is backed up to BackupDir before the first
+//migration, and restored from that backup when one fails.
+func migrateState(ctx context.Context, s stateStore) error {
+	version, err := stateVersion(ctx, s)
+	if err != nil {
+		return err
+	}
+	if version > latestVersion() {
+		return fmt.Errorf("the state is at version %d, this gateway only knows up to %d: restore the backup taken before the upgrade with -restore-state", version, latestVersion())
+	}
+	if version == latestVersion() {
+		return nil
+	}
+	empty, err := emptyState(ctx, s)
+	if err != nil {
+		return err
+	}
+	if empty {
+		//nothing to migrate in a new store
+		return saveState(ctx, metaNamespace, versionKey, latestVersion())
+	}
+	backup, err := backupState(ctx, s, version)
+	if err != nil {
+		return fmt.Errorf("backing up the state: %w", err)
+	}
+	applied, err := appliedMigrations(ctx, s)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		logger.Info("migrating state", "version", m.version, "migration", m.name)
+		err := m.up(ctx, s)
+		if err == nil {
+			applied = append(applied, AppliedMigration{Version: m.version, Name: m.name, Applied: time.Now().UTC(), Backup: backup})
+			if err = saveState(ctx, metaNamespace, migrationsKey, applied); err == nil {
+				err = saveState(ctx, metaNamespace, versionKey, m.version)
+			}
+		}
+		if err != nil {
+			if rerr := restoreState(ctx, s, backup); rerr != nil {
+				return fmt.Errorf("migration %d %s: %v, and restoring %s failed: %v", m.version, m.name, err, backup, rerr)
+			}
+			return fmt.Errorf("migration %d %s: %w; the state was restored from %s", m.version, m.name, err, backup)
+		}
+	}
+	return nil
+}
+
+func emptyState(ctx context.Context, s stateStore) (bool, error) {
+	for _, ns := range stateNamespaces {
+		values, err := s.list(ctx, ns)
+		if err != nil || len(values) != 0 {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+//backupState writes the namespaces of the store to a new file of BackupDir
+//and returns its path.
+func backupState(ctx context.Context, s stateStore, version int) (string, error) {
+	backup := StateBackup{Version: version, Taken: time.Now().UTC(), Namespaces: map[string]map[string][]byte{}}
+	for _, ns := range append([]string{metaNamespace}, stateNamespaces...) {
+		values, err := s.list(ctx, ns)
+		if err != nil {
+			return "", err
+		}
+		backup.Namespaces[ns] = values
+	}
+	b, err := json.Marshal(backup)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(config.Store.BackupDir, 0700); err != nil {
+		return "", err
+	}
+	name := filepath.Join(config.Store.BackupDir, fmt.Sprintf("state-v%d-%s.json", version, backup.Taken.Format("20060102T150405Z")))
+	if err := os.WriteFile(name, b, 0600); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+//restoreState puts the store back as it was in a backup: the keys of the
+//backed up namespaces not in the backup are removed.
+func restoreState(ctx context.Context, s stateStore, name string) error {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	var backup StateBackup
+	if err := json.Unmarshal(b, &backup); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	for ns, values := range backup.Namespaces {
+		current, err := s.list(ctx, ns)
+		if err != nil {
+			return err
+		}
+		for key := range current {
+			if _, ok := values[key]; !ok {
+				if err := s.delete(ctx, ns, key); err != nil {
+					return err
+				}
+			}
+		}
+		for key, value := range values {
+			if err := s.put(ctx, ns, key, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//storeHandler tells the version of the state and the migrations applied to it.
+func storeHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	version, err := stateVersion(r.Context(), state)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to read state version", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	applied, err := appliedMigrations(r.Context(), state)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to read applied migrations", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"backend":    config.Store.Backend,
+		"version":    version,
+		"latest":     latestVersion(),
+		"migrations": applied,
+	})
+}
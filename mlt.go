@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch/esapi"
+)
+
+//MLTRequest finds the documents like a stored document (ID) or like Text,
+//compared on Fields. The tuning parameters are those of the more_like_this
+//query; zero leaves the elastic search default.
+type MLTRequest struct {
+	Index  string   `json:"index"`
+	ID     string   `json:"id"`
+	Text   string   `json:"text"`
+	Fields []string `json:"fields"`
+	Size   int      `json:"size"`
+	//MinTermFreq is the number of times a term must appear in the input to count
+	MinTermFreq int `json:"min_term_freq"`
+	//MaxQueryTerms caps the number of terms picked from the input
+	MaxQueryTerms int `json:"max_query_terms"`
+	//MinDocFreq ignores the terms found in fewer documents
+	MinDocFreq int `json:"min_doc_freq"`
+	//MinimumShouldMatch is the part of the picked terms a document must have ("30%")
+	MinimumShouldMatch string `json:"minimum_should_match"`
+}
+
+//mltQuery builds the more_like_this search of the request. index is the name
+//elastic search knows the index of the document by.
+func mltQuery(req MLTRequest, index string) map[string]interface{} {
+	var like []interface{}
+	if len(req.ID) != 0 {
+		like = append(like, map[string]interface{}{"_index": index, "_id": req.ID})
+	}
+	if len(req.Text) != 0 {
+		like = append(like, req.Text)
+	}
+	mlt := map[string]interface{}{"like": like}
+	if len(req.Fields) != 0 {
+		mlt["fields"] = req.Fields
+	}
+	for name, v := range map[string]int{
+		"min_term_freq":   req.MinTermFreq,
+		"max_query_terms": req.MaxQueryTerms,
+		"min_doc_freq":    req.MinDocFreq,
+	} {
+		if v != 0 {
+			mlt[name] = v
+		}
+	}
+	if len(req.MinimumShouldMatch) != 0 {
+		mlt["minimum_should_match"] = req.MinimumShouldMatch
+	}
+	return map[string]interface{}{"query": map[string]interface{}{"more_like_this": mlt}}
+}
+
+//mltHandler returns the documents like a given document or text, for
+//"related items" features. The given document is not among the results.
+func mltHandler(w http.ResponseWriter, r *http.Request) {
+	var body MLTRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body.Index) == 0 {
+		writeValidationError(w, &ValidationError{Path: "/index", Message: "index is required"})
+		return
+	}
+	if len(body.ID) == 0 && len(strings.TrimSpace(body.Text)) == 0 {
+		writeValidationError(w, &ValidationError{Path: "/id", Message: "an id or a text is required"})
+		return
+	}
+	if len(body.ID) != 0 && strings.Contains(body.Index, ",") {
+		writeValidationError(w, &ValidationError{Path: "/index", Message: "a single index is required to find the document"})
+		return
+	}
+	index := stringToArray(body.Index)
+	if !checkAccess(w, r, opSearch, index) {
+		return
+	}
+	var query interface{} = mltQuery(body, tenantIndex(r.Context(), body.Index))
+	if config.SoftDelete.Enabled {
+		query = excludeSoftDeleted(query)
+	}
+	buf, err := encodeBody(query)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error encoding elastic search query", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	opts := []func(*esapi.SearchRequest){
+		es.Search.WithContext(r.Context()),
+		es.Search.WithIndex(index...),
+		es.Search.WithBody(buf),
+		es.Search.WithTrackTotalHits(true),
+	}
+	if body.Size != 0 {
+		opts = append(opts, es.Search.WithSize(body.Size))
+	}
+	res, err := es.Search(opts...)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error getting response from elastic search cluster", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeResponse(w, res)
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+//odataToken is a token of an OData $filter expression. Literals carry their
+//decoded value; kind is "(", ")", ",", "ident", "string" or "literal".
+type odataToken struct {
+	kind  string
+	text  string
+	value interface{}
+	pos   int
+}
+
+func odataError(param string, pos int, msg string) error {
+	return &ValidationError{Path: "/$" + param, Message: fmt.Sprintf("at %d: %s", pos, msg)}
+}
+
+//odataLiteral decodes an unquoted literal: numbers, true, false, null. Other
+//words (dates such as 2024-01-31T00:00:00Z) are kept as strings, which
+//elastic search parses for date fields.
+func odataLiteral(s string) interface{} {
+	switch s {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "null":
+		return nil
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	return s
+}
+
+func odataTokens(s string) ([]odataToken, error) {
+	var tokens []odataToken
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')' || r == ',':
+			tokens = append(tokens, odataToken{kind: string(r), text: string(r), pos: i})
+			i++
+		case r == '\'':
+			var b strings.Builder
+			start := i
+			for i++; ; i++ {
+				if i >= len(rs) {
+					return nil, odataError("filter", start, "unterminated string")
+				}
+				if rs[i] == '\'' {
+					//quotes are escaped by doubling them
+					if i+1 < len(rs) && rs[i+1] == '\'' {
+						i++
+					} else {
+						break
+					}
+				}
+				b.WriteRune(rs[i])
+			}
+			i++
+			tokens = append(tokens, odataToken{kind: "string", text: b.String(), value: b.String(), pos: start})
+		case r == '-' || unicode.IsDigit(r):
+			start := i
+			for i++; i < len(rs) && (unicode.IsLetter(rs[i]) || unicode.IsDigit(rs[i]) || strings.ContainsRune(".:+-", rs[i])); i++ {
+			}
+			text := string(rs[start:i])
+			tokens = append(tokens, odataToken{kind: "literal", text: text, value: odataLiteral(text), pos: start})
+		case unicode.IsLetter(r) || r == '_' || r == '@':
+			start := i
+			for i++; i < len(rs) && (unicode.IsLetter(rs[i]) || unicode.IsDigit(rs[i]) || strings.ContainsRune("_@./", rs[i])); i++ {
+			}
+			text := string(rs[start:i])
+			tokens = append(tokens, odataToken{kind: "ident", text: text, pos: start})
+		default:
+			return nil, odataError("filter", i, "unexpected "+strconv.QuoteRune(r))
+		}
+	}
+	return tokens, nil
+}
+
+//odataParser compiles a $filter expression into a query, by recursive descent:
+//
+//	or      = and {"or" and}
+//	and     = unary {"and" unary}
+//	unary   = "not" unary | primary
+//	primary = "(" or ")" | function "(" field "," value ")" | field op value | field "in" "(" value {"," value} ")"
+type odataParser struct {
+	tokens []odataToken
+	i      int
+	end    int
+}
+
+var odataRanges = map[string]string{"gt": "gt", "ge": "gte", "lt": "lt", "le": "lte"}
+
+//odataFunctions are the string functions of $filter and their wildcard pattern.
+var odataFunctions = map[string]string{"contains": "*%s*", "startswith": "%s*", "endswith": "*%s"}
+
+var wildcardEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`)
+
+func (p *odataParser) peek() (odataToken, bool) {
+	if p.i >= len(p.tokens) {
+		return odataToken{pos: p.end}, false
+	}
+	return p.tokens[p.i], true
+}
+
+//keyword consumes the next token when it is the given operator or keyword.
+func (p *odataParser) keyword(word string) bool {
+	if t, ok := p.peek(); ok && t.kind == "ident" && t.text == word {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *odataParser) expect(kind string) (odataToken, error) {
+	t, ok := p.peek()
+	if !ok || t.kind != kind {
+		return t, odataError("filter", t.pos, "expected "+kind)
+	}
+	p.i++
+	return t, nil
+}
+
+func (p *odataParser) field() (string, error) {
+	t, err := p.expect("ident")
+	if err != nil {
+		return "", err
+	}
+	return strings.ReplaceAll(t.text, "/", "."), nil
+}
+
+func (p *odataParser) value() (interface{}, error) {
+	t, ok := p.peek()
+	if !ok || (t.kind != "string" && t.kind != "literal" && !(t.kind == "ident" && odataLiteral(t.text) != t.text)) {
+		return nil, odataError("filter", t.pos, "expected a value")
+	}
+	p.i++
+	if t.kind == "ident" {
+		return odataLiteral(t.text), nil
+	}
+	return t.value, nil
+}
+
+func (p *odataParser) or() (interface{}, error) {
+	return p.list("or", "should", p.and)
+}
+
+func (p *odataParser) and() (interface{}, error) {
+	return p.list("and", "filter", p.unary)
+}
+
+//list parses operands separated by op and joins them in the occur section of
+//a bool query; a single operand is returned as is.
+func (p *odataParser) list(op, occur string, operand func() (interface{}, error)) (interface{}, error) {
+	first, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	clauses := []interface{}{first}
+	for p.keyword(op) {
+		next, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, next)
+	}
+	if len(clauses) == 1 {
+		return first, nil
+	}
+	return map[string]interface{}{"bool": map[string]interface{}{occur: clauses}}, nil
+}
+
+func (p *odataParser) unary() (interface{}, error) {
+	if p.keyword("not") {
+		inner, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return negate(inner), nil
+	}
+	return p.primary()
+}
+
+func negate(clause interface{}) interface{} {
+	return map[string]interface{}{"bool": map[string]interface{}{"must_not": []interface{}{clause}}}
+}
+
+func (p *odataParser) primary() (interface{}, error) {
+	t, ok := p.peek()
+	if ok && t.kind == "(" {
+		p.i++
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	}
+	if pattern, isFunc := odataFunctions[t.text]; ok && isFunc && t.kind == "ident" {
+		p.i++
+		if _, err := p.expect("("); err != nil {
+			return nil, err
+		}
+		field, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(","); err != nil {
+			return nil, err
+		}
+		s, err := p.expect("string")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return leaf("wildcard", field, map[string]interface{}{"value": fmt.Sprintf(pattern, wildcardEscaper.Replace(s.text))}), nil
+	}
+	field, err := p.field()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.peek()
+	if !ok || op.kind != "ident" {
+		return nil, odataError("filter", op.pos, "expected an operator")
+	}
+	p.i++
+	if op.text == "in" {
+		if _, err := p.expect("("); err != nil {
+			return nil, err
+		}
+		var values []interface{}
+		for {
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+			if _, err := p.expect(","); err != nil {
+				break
+			}
+		}
+		if _, err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return leaf("terms", field, values), nil
+	}
+	v, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	exists := map[string]interface{}{"exists": map[string]interface{}{"field": field}}
+	switch op.text {
+	case "eq":
+		if v == nil {
+			return negate(exists), nil
+		}
+		return leaf("term", field, v), nil
+	case "ne":
+		if v == nil {
+			return exists, nil
+		}
+		return negate(leaf("term", field, v)), nil
+	case "gt", "ge", "lt", "le":
+		return leaf("range", field, map[string]interface{}{odataRanges[op.text]: v}), nil
+	}
+	return nil, odataError("filter", op.pos, "unknown operator "+strconv.Quote(op.text))
+}
+
+//compileODataFilter turns a $filter expression into a query.
+func compileODataFilter(filter string) (interface{}, error) {
+	tokens, err := odataTokens(filter)
+	if err != nil {
+		return nil, err
+	}
+	p := &odataParser{tokens: tokens, end: len([]rune(filter))}
+	q, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := p.peek(); ok {
+		return nil, odataError("filter", t.pos, "unexpected "+strconv.Quote(t.text))
+	}
+	return q, nil
+}
+
+//compileODataOrderBy turns "name desc, age" into a sort.
+func compileODataOrderBy(orderBy string) ([]interface{}, error) {
+	var sorts []interface{}
+	for _, item := range strings.Split(orderBy, ",") {
+		parts := strings.Fields(item)
+		if len(parts) == 0 || len(parts) > 2 {
+			return nil, &ValidationError{Path: "/$orderby", Message: "expected field [asc|desc], got " + strconv.Quote(item)}
+		}
+		order := "asc"
+		if len(parts) == 2 {
+			if order = parts[1]; order != "asc" && order != "desc" {
+				return nil, &ValidationError{Path: "/$orderby", Message: "unknown direction " + strconv.Quote(order)}
+			}
+		}
+		field := strings.ReplaceAll(parts[0], "/", ".")
+		sorts = append(sorts, map[string]interface{}{field: map[string]interface{}{"order": order}})
+	}
+	return sorts, nil
+}
+
+func odataInt(params map[string][]string, name string, fallback int) (int, error) {
+	s := ""
+	if v := params["$"+name]; len(v) != 0 {
+		s = v[0]
+	}
+	if len(s) == 0 {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, &ValidationError{Path: "/$" + name, Message: "must be a positive number"}
+	}
+	return n, nil
+}
+
+//compileOData builds the search body of the OData query options $filter,
+//$orderby, $top, $skip and $select.
+func compileOData(params map[string][]string) (body map[string]interface{}, top, skip int, err error) {
+	get := func(name string) string {
+		if v := params["$"+name]; len(v) != 0 {
+			return strings.TrimSpace(v[0])
+		}
+		return ""
+	}
+	body = map[string]interface{}{"track_total_hits": true}
+	if filter := get("filter"); len(filter) != 0 {
+		q, err := compileODataFilter(filter)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		body["query"] = map[string]interface{}{"bool": map[string]interface{}{"filter": []interface{}{q}}}
+	}
+	if orderBy := get("orderby"); len(orderBy) != 0 {
+		sorts, err := compileODataOrderBy(orderBy)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		body["sort"] = sorts
+	}
+	if sel := get("select"); len(sel) != 0 {
+		var fields []string
+		for _, f := range strings.Split(sel, ",") {
+			fields = append(fields, strings.ReplaceAll(strings.TrimSpace(f), "/", "."))
+		}
+		body["_source"] = fields
+	}
+	if top, err = odataInt(params, "top", defaultSize); err != nil {
+		return nil, 0, 0, err
+	}
+	if skip, err = odataInt(params, "skip", 0); err != nil {
+		return nil, 0, 0, err
+	}
+	body["size"], body["from"] = top, skip
+	return body, top, skip, nil
+}
+
+//odataHandler searches an index with OData style query options, for teams
+//coming from REST APIs with those conventions:
+//
+//	GET /elastic/odata/products?$filter=price le 100 and contains(name,'shoe')&$orderby=price desc&$top=20&$skip=40&$count=true
+//
+//The answer follows OData too: the documents come in value, with their id in
+//_id, the total in @odata.count when $count=true and, when more documents
+//match, the link to the next page in @odata.nextLink.
+func odataHandler(w http.ResponseWriter, r *http.Request) {
+	index := stringToArray(mux.Vars(r)["index"])
+	if !checkAccess(w, r, opSearch, index) {
+		return
+	}
+	params := r.URL.Query()
+	body, top, skip, err := compileOData(params)
+	if err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := checkPagination(r.Context(), es, index, skip, top); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	var q interface{} = body
+	if config.SoftDelete.Enabled {
+		q = excludeSoftDeleted(q)
+	}
+	var res SearchResponse
+	if err := searchInto(r.Context(), es, index, q, &res); err != nil {
+		logger.ErrorContext(r.Context(), "error getting response from elastic search cluster", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	values := make([]map[string]interface{}, 0, len(res.Hits.Hits))
+	for _, h := range res.Hits.Hits {
+		v := map[string]interface{}{"_id": h.ID}
+		for k, f := range h.Source {
+			v[k] = f
+		}
+		values = append(values, v)
+	}
+	out := map[string]interface{}{"value": values}
+	if params.Get("$count") == "true" && res.Hits.Total != nil {
+		out["@odata.count"] = res.Hits.Total.Value
+	}
+	if res.Hits.Total != nil && int64(skip+len(values)) < res.Hits.Total.Value && len(values) != 0 {
+		next := *r.URL
+		params.Set("$skip", strconv.Itoa(skip+len(values)))
+		next.RawQuery = params.Encode()
+		out["@odata.nextLink"] = next.RequestURI()
+	}
+	writeJSON(w, http.StatusOK, out)
+}
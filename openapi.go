@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+//OpenAPIConfig turns on checking request bodies against the schemas of the
+//OpenAPI document served at /openapi.json.
+type OpenAPIConfig struct {
+	Validate bool `json:"validate"`
+}
+
+//apiOperation documents a route. Body is the type the handler decodes its
+//request body into, nil for routes without one; Query lists the query
+//parameters the handler reads.
+type apiOperation struct {
+	Summary  string
+	Body     reflect.Type
+	Optional bool
+	Query    []string
+}
+
+var (
+	anyType       = reflect.TypeOf((*interface{})(nil)).Elem()
+	objectType    = reflect.TypeOf(map[string]interface{}{})
+	durationType  = reflect.TypeOf(Duration{})
+	listType      = reflect.TypeOf(StringList(""))
+	unmarshalType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+//apiOperations is keyed by method and route template. Routes missing here
+//are still listed in the document, without summary or body.
+var apiOperations = map[string]apiOperation{
+	"POST /elastic":           {Summary: "Search", Body: reflect.TypeOf(RequestBody{})},
+	"POST /v2/elastic":        {Summary: "Search with the typed v2 request body", Body: reflect.TypeOf(RequestBodyV2{})},
+	"GET /elastic/search":     {Summary: "Search with query string parameters", Query: []string{"index", "q", "size", "sort"}},
+	"POST /elastic/translate": {Summary: "Translate a query between SQL, filters, where and the query DSL", Body: reflect.TypeOf(TranslateRequest{})},
+	"POST /elastic/mlt":       {Summary: "Find documents like a document or text", Body: reflect.TypeOf(MLTRequest{})},
+	"POST /elastic/knn":       {Summary: "Find the nearest neighbours of a vector", Body: reflect.TypeOf(KNNRequest{})},
+	"GET /elastic/odata/{index}": {
+		Summary: "Search with OData query options",
+		Query:   []string{"$filter", "$orderby", "$top", "$skip", "$select", "$count"},
+	},
+	"POST /elastic/prepared":         {Summary: "Prepare a query", Body: reflect.TypeOf(PreparedQuery{})},
+	"GET /elastic/prepared/{handle}": {Summary: "Get a prepared query"},
+	"POST /elastic/prepared/{handle}": {Summary: "Execute a prepared query", Body: reflect.TypeOf(struct {
+		Params map[string]interface{} `json:"params"`
+	}{})},
+	"POST /elastic/suggest":                                    {Summary: "Suggest completions", Body: reflect.TypeOf(SuggestRequest{})},
+	"POST /elastic/export/csv":                                 {Summary: "Export matching documents as CSV", Body: reflect.TypeOf(ExportRequest{})},
+	"POST /elastic/export/ndjson":                              {Summary: "Export matching documents as NDJSON", Body: reflect.TypeOf(ExportRequest{})},
+	"GET /elastic/export/{id}/progress":                        {Summary: "Stream the progress of an export"},
+	"GET /elastic/export/{id}/manifest":                        {Summary: "Get the files, row counts, checksums and schema of a finished export"},
+	"POST /elastic/async/{index}":                              {Summary: "Submit an async search", Body: anyType, Optional: true},
+	"GET /elastic/async/{id}":                                  {Summary: "Get the result of an async search"},
+	"DELETE /elastic/async/{id}":                               {Summary: "Delete an async search"},
+	"GET /elastic/async/{id}/status":                           {Summary: "Get the status of an async search"},
+	"GET /elastic/ws":                                          {Summary: "Search over a websocket"},
+	"GET /elastic/requests/{id}":                               {Summary: "Show a request with its calls and cluster tasks"},
+	"PUT /elastic/doc/{index}/{id}":                            {Summary: "Index a document", Body: objectType, Query: []string{"pipeline"}},
+	"DELETE /elastic/doc/{index}/{id}":                         {Summary: "Delete a document"},
+	"GET /elastic/doc/{index}/{id}/history":                    {Summary: "List the versions of a document"},
+	"POST /elastic/doc/{index}/{id}/history/{version}/restore": {Summary: "Restore a version of a document"},
+	"POST /elastic/mget":                                       {Summary: "Get documents by index and id", Body: reflect.TypeOf(MgetRequest{})},
+	"POST /elastic/mget/{index}": {Summary: "Get documents by id", Body: reflect.TypeOf(struct {
+		IDs []string `json:"ids"`
+	}{})},
+	"GET /elastic/fieldcaps": {
+		Summary: "List the searchable and aggregatable fields of indices",
+		Query:   []string{"index", "fields", "types", "include_unmapped", "ignore_unavailable", "allow_no_indices", "expand_wildcards", "format"},
+	},
+	"GET /elastic/termvectors/{index}/{id}": {
+		Summary: "Get the analyzed terms of a document",
+		Query:   []string{"fields", "field_statistics", "term_statistics", "offsets", "positions", "payloads", "routing"},
+	},
+	"POST /elastic/termvectors/{index}/{id}":         {Summary: "Get the analyzed terms of a document or an artificial one", Body: objectType},
+	"POST /elastic/explain/{index}/{id}":             {Summary: "Explain the score of a document", Body: reflect.TypeOf(ExplainRequest{}), Query: []string{"format"}},
+	"POST /elastic/eql/{index}":                      {Summary: "Run an EQL search", Body: objectType},
+	"POST /elastic/percolate/{index}":                {Summary: "Find the saved queries matching documents", Body: reflect.TypeOf(PercolateRequest{})},
+	"PUT /elastic/percolate/{index}/queries/{id}":    {Summary: "Save a percolator query", Body: objectType},
+	"DELETE /elastic/percolate/{index}/queries/{id}": {Summary: "Delete a percolator query"},
+	"GET /elastic/admin/boosts/{index}":              {Summary: "Get the field boosts of an index"},
+	"PUT /elastic/admin/boosts/{index}": {Summary: "Set the field boosts of an index", Body: reflect.TypeOf(struct {
+		Fields map[string]float64 `json:"fields"`
+	}{})},
+	"GET /elastic/admin/boosts/{index}/versions":                     {Summary: "List the field boost versions of an index"},
+	"POST /elastic/admin/boosts/{index}/versions/{version}/rollback": {Summary: "Roll the field boosts back to a version"},
+	"GET /elastic/admin/words/{index}/{language}":                    {Summary: "Get the word lists of an index"},
+	"PUT /elastic/admin/words/{index}/{language}":                    {Summary: "Set the word lists of an index", Body: reflect.TypeOf(WordList{})},
+	"PUT /elastic/admin/templates/{id}": {Summary: "Store a search template", Body: reflect.TypeOf(struct {
+		Source interface{} `json:"source"`
+	}{})},
+	"DELETE /elastic/admin/templates/{id}":       {Summary: "Delete a search template"},
+	"POST /elastic/diagnose/{index}":             {Summary: "Explain why a query matches nothing", Body: anyType, Optional: true},
+	"GET /elastic/admin/hot_threads":             {Summary: "Get the hot threads of the cluster", Query: []string{"nodes", "format"}},
+	"GET /elastic/admin/nodes/stats":             {Summary: "Get the stats of the cluster nodes", Query: []string{"nodes", "metric", "level", "fields", "groups"}},
+	"GET /elastic/admin/pending_tasks":           {Summary: "Get the pending cluster tasks"},
+	"GET /elastic/admin/reindex/{task}/progress": {Summary: "Stream the progress of a reindex"},
+	"GET /elastic/cluster/allocation/explain":    {Summary: "Explain a shard allocation", Query: []string{"index", "shard", "primary"}},
+	"GET /elastic/admin/journal": {
+		Summary: "Search the journal of recent requests",
+		Query:   []string{"request_id", "actor", "method", "path", "status", "since", "until", "size"},
+	},
+	"GET /elastic/admin/cluster/settings":          {Summary: "Get the cluster settings", Query: []string{"flat_settings", "include_defaults", "master_timeout"}},
+	"PUT /elastic/admin/cluster/settings":          {Summary: "Change allowed persistent or transient cluster settings", Body: objectType},
+	"GET /elastic/admin/regions":                   {Summary: "Get the probed latency and health of the tenant regions"},
+	"GET /elastic/admin/drift":                     {Summary: "Compare two environments", Query: []string{"from", "to", "index"}},
+	"POST /elastic/admin/lint":                     {Summary: "Lint an index template or mapping", Body: objectType},
+	"GET /elastic/admin/pipelines":                 {Summary: "List the ingest pipelines"},
+	"POST /elastic/admin/pipelines/_simulate":      {Summary: "Run documents through a pipeline given in the body", Body: objectType},
+	"GET /elastic/admin/pipelines/{id}":            {Summary: "Get an ingest pipeline"},
+	"PUT /elastic/admin/pipelines/{id}":            {Summary: "Create or replace an ingest pipeline", Body: objectType},
+	"DELETE /elastic/admin/pipelines/{id}":         {Summary: "Remove an ingest pipeline"},
+	"POST /elastic/admin/pipelines/{id}/_simulate": {Summary: "Run documents through an ingest pipeline", Body: objectType, Query: []string{"verbose"}},
+	"POST /elastic/pit/_keep_alive":                {Summary: "Extend a point in time", Body: reflect.TypeOf(PITRequest{})},
+	"POST /elastic/pit/{index}":                    {Summary: "Open a point in time", Query: []string{"keep_alive"}},
+	"DELETE /elastic/pit":                          {Summary: "Close a point in time", Body: reflect.TypeOf(PITRequest{})},
+	"POST /elastic/fanout":                         {Summary: "Search several indices and clusters at once, merging the hits", Body: reflect.TypeOf(FanoutRequest{})},
+	"POST /elastic/score":                          {Summary: "Score the complexity of a query without running it", Body: reflect.TypeOf(ScoreRequest{})},
+	"GET /elastic/admin/store":                     {Summary: "Get the version of the stored state and its migrations"},
+	"GET /elastic/admin/dashboards":                {Summary: "List the saved dashboards and their last cache warmup"},
+	"PUT /elastic/admin/dashboards/{name}":         {Summary: "Save a dashboard whose panels warm the cache", Body: reflect.TypeOf(Dashboard{})},
+	"DELETE /elastic/admin/dashboards/{name}":      {Summary: "Remove a saved dashboard"},
+	"POST /elastic/admin/dashboards/{name}/_warm":  {Summary: "Warm the cache with the panels of a dashboard now"},
+	"GET /elastic/admin/remotes":                   {Summary: "List the remote clusters and their connections"},
+	"PUT /elastic/admin/remotes/{name}":            {Summary: "Connect an allowed remote cluster", Body: reflect.TypeOf(RemoteClusterRequest{})},
+	"DELETE /elastic/admin/remotes/{name}":         {Summary: "Disconnect a remote cluster"},
+	"GET /elastic/admin/pits":                      {Summary: "List the points in time opened through the gateway"},
+	"GET /elastic/data_streams":                    {Summary: "List the data streams"},
+	"GET /elastic/data_streams/{name}":             {Summary: "Get the data streams matching a name"},
+	"PUT /elastic/data_streams/{name}":             {Summary: "Create a data stream"},
+	"DELETE /elastic/data_streams/{name}":          {Summary: "Remove a data stream and its backing indices"},
+	"POST /elastic/data_streams/{name}/_rollover":  {Summary: "Roll a data stream over to a new backing index", Body: objectType, Query: []string{"dry_run"}},
+	"GET /elastic/admin/webhooks":                  {Summary: "List the webhook endpoints"},
+	"GET /elastic/admin/webhooks/{id}/deliveries":  {Summary: "Get the logged deliveries of a webhook endpoint", Query: []string{"status"}},
+	"POST /elastic/admin/webhooks/{id}/redrive":    {Summary: "Deliver the failed deliveries of a webhook endpoint again", Query: []string{"delivery"}},
+	"GET /elastic/admin/transforms":                {Summary: "List the transforms", Query: []string{"from", "size"}},
+	"POST /elastic/admin/transforms/_preview":      {Summary: "Preview a transform given in the body", Body: objectType},
+	"GET /elastic/admin/transforms/{id}":           {Summary: "Get a transform"},
+	"PUT /elastic/admin/transforms/{id}":           {Summary: "Create a transform", Body: objectType, Query: []string{"defer_validation"}},
+	"DELETE /elastic/admin/transforms/{id}":        {Summary: "Remove a transform", Query: []string{"force"}},
+	"GET /elastic/admin/transforms/{id}/_stats":    {Summary: "Get the state and progress of a transform"},
+	"POST /elastic/admin/transforms/{id}/_start":   {Summary: "Start a transform"},
+	"POST /elastic/admin/transforms/{id}/_stop":    {Summary: "Stop a transform", Query: []string{"force", "wait_for_checkpoint", "wait_for_completion"}},
+	"GET /elastic/admin/transforms/{id}/_preview":  {Summary: "Preview a transform"},
+	"GET /elastic/admin/schemas/{index}":           {Summary: "Get the document schema of an index"},
+	"PUT /elastic/admin/schemas/{index}":           {Summary: "Set the document schema of an index", Body: objectType},
+	"DELETE /elastic/admin/schemas/{index}":        {Summary: "Remove the document schema of an index"},
+	"PUT /elastic/admin/index-templates/{name}":    {Summary: "Lint then apply an index template", Body: objectType, Query: []string{"force"}},
+	"GET /elastic/admin/datasets":                  {Summary: "List the example datasets"},
+	"POST /elastic/admin/datasets/{name}":          {Summary: "Load an example dataset", Query: []string{"index", "cluster", "replace"}},
+	"POST /elastic/admin/smoke":                    {Summary: "Run a smoke test against a cluster", Query: []string{"cluster"}},
+	"GET /elastic/admin/degradation":               {Summary: "Get the degradation level"},
+	"GET /elastic/admin/cache":                     {Summary: "Get the statistics of the response cache"},
+	"DELETE /elastic/admin/cache":                  {Summary: "Empty the response cache"},
+	"GET /elastic/admin/flags":                     {Summary: "List the feature flags"},
+	"PUT /elastic/admin/flags/{name}":              {Summary: "Override a feature flag", Body: reflect.TypeOf(Flag{})},
+	"DELETE /elastic/admin/flags/{name}":           {Summary: "Remove the override of a feature flag"},
+	"GET /elastic/distinct/{index}/{field}":        {Summary: "Estimate the distinct values of a field"},
+	"POST /elastic/graphql":                        {Summary: "Run a GraphQL query", Body: reflect.TypeOf(GraphQLRequest{})},
+	"GET /elastic/graphql/schema":                  {Summary: "Get the GraphQL schema"},
+	"GET /healthz":                                 {Summary: "Liveness"},
+	"GET /readyz":                                  {Summary: "Readiness"},
+	"GET /version":                                 {Summary: "Build information and capabilities"},
+	"GET /openapi.json":                            {Summary: "This document"},
+}
+
+//apiSpec holds the schemas of the request bodies, built once from the Go
+//types so they follow the handlers.
+var apiSpec struct {
+	once   sync.Once
+	bodies map[string]map[string]interface{}
+	defs   map[string]interface{}
+}
+
+func apiSchemas() (map[string]map[string]interface{}, map[string]interface{}) {
+	apiSpec.once.Do(func() {
+		apiSpec.defs = map[string]interface{}{}
+		apiSpec.bodies = map[string]map[string]interface{}{}
+		apiSchema(reflect.TypeOf(ValidationError{}), apiSpec.defs)
+		for key, op := range apiOperations {
+			if op.Body != nil {
+				apiSpec.bodies[key] = apiSchema(op.Body, apiSpec.defs)
+			}
+		}
+	})
+	return apiSpec.bodies, apiSpec.defs
+}
+
+//apiSchema builds the JSON schema of t as encoding/json reads it. Named
+//structs are added to defs and referenced.
+func apiSchema(t reflect.Type, defs map[string]interface{}) map[string]interface{} {
+	if t == durationType {
+		return map[string]interface{}{"type": "string", "format": "duration"}
+	}
+	if t == listType {
+		return map[string]interface{}{"oneOf": []interface{}{
+			map[string]interface{}{"type": "string"},
+			map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+		}}
+	}
+	if t.Kind() != reflect.Ptr && t.Kind() != reflect.Interface && reflect.PtrTo(t).Implements(unmarshalType) {
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return apiSchema(t.Elem(), defs)
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": apiSchema(t.Elem(), defs)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": apiSchema(t.Elem(), defs)}
+	case reflect.Struct:
+		if len(t.Name()) == 0 {
+			return apiStruct(t, defs)
+		}
+		if _, ok := defs[t.Name()]; !ok {
+			//registered first, for the types that refer to themselves
+			defs[t.Name()] = map[string]interface{}{}
+			defs[t.Name()] = apiStruct(t, defs)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+func apiStruct(t reflect.Type, defs map[string]interface{}) map[string]interface{} {
+	props := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		//the fields of embedded structs are promoted, as encoding/json does
+		if f.Anonymous && len(name) == 0 && f.Type.Kind() == reflect.Struct {
+			embedded := apiStruct(f.Type, defs)["properties"].(map[string]interface{})
+			for k, v := range embedded {
+				props[k] = v
+			}
+			continue
+		}
+		if len(f.PkgPath) != 0 || name == "-" {
+			continue
+		}
+		if len(name) == 0 {
+			name = f.Name
+		}
+		props[name] = apiSchema(f.Type, defs)
+	}
+	return map[string]interface{}{"type": "object", "properties": props, "additionalProperties": false}
+}
+
+//apiParameters lists the path parameters of the route template and the
+//query parameters of the operation.
+func apiParameters(tpl string, op apiOperation) []interface{} {
+	params := []interface{}{}
+	for _, part := range strings.Split(tpl, "/") {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			name := strings.SplitN(part[1:len(part)-1], ":", 2)[0]
+			params = append(params, map[string]interface{}{
+				"name": name, "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"},
+			})
+		}
+	}
+	for _, name := range op.Query {
+		params = append(params, map[string]interface{}{
+			"name": name, "in": "query", "schema": map[string]interface{}{"type": "string"},
+		})
+	}
+	return params
+}
+
+//openAPIDocument describes every route of the router.
+func openAPIDocument(router *mux.Router) map[string]interface{} {
+	bodies, defs := apiSchemas()
+	paths := map[string]interface{}{}
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, method := range methods {
+			if method == http.MethodOptions {
+				continue
+			}
+			key := method + " " + tpl
+			op := apiOperations[key]
+			operation := map[string]interface{}{
+				"responses": map[string]interface{}{"200": map[string]interface{}{"description": "OK"}},
+			}
+			if len(op.Summary) != 0 {
+				operation["summary"] = op.Summary
+			}
+			if params := apiParameters(tpl, op); len(params) != 0 {
+				operation["parameters"] = params
+			}
+			if body, ok := bodies[key]; ok {
+				operation["requestBody"] = map[string]interface{}{
+					"required": !op.Optional,
+					"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": body}},
+				}
+				operation["responses"].(map[string]interface{})["400"] = map[string]interface{}{
+					"description": "Invalid request",
+					"content": map[string]interface{}{"application/json": map[string]interface{}{
+						"schema": map[string]interface{}{"$ref": "#/components/schemas/ValidationError"},
+					}},
+				}
+			}
+			item, ok := paths[tpl].(map[string]interface{})
+			if !ok {
+				item = map[string]interface{}{}
+				paths[tpl] = item
+			}
+			item[strings.ToLower(method)] = operation
+		}
+		return nil
+	})
+	return map[string]interface{}{
+		"openapi":    "3.0.3",
+		"info":       map[string]interface{}{"title": "elastic", "version": "1"},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": defs},
+	}
+}
+
+//openAPIHandler serves the OpenAPI document of the router, built on the
+//first request once all routes are registered.
+func openAPIHandler(router *mux.Router) http.HandlerFunc {
+	var once sync.Once
+	var doc map[string]interface{}
+	return func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() {
+			doc = openAPIDocument(router)
+		})
+		writeJSON(w, http.StatusOK, doc)
+	}
+}
+
+//OpenAPIMid rejects requests whose body does not match the schema of the
+//route, before the handler sees them. The body is put back for the handler.
+func OpenAPIMid(app http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Method + " " + routeTemplate(r)
+		bodies, defs := apiSchemas()
+		schema, ok := bodies[key]
+		if !ok {
+			app.ServeHTTP(w, r)
+			return
+		}
+		raw, err := io.ReadAll(r.Body)
+		if err != nil {
+			logger.ErrorContext(r.Context(), "unable to read request body", "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(raw))
+		if err := checkBody(raw, schema, defs, apiOperations[key].Optional); err != nil {
+			writeValidationError(w, err)
+			return
+		}
+		app.ServeHTTP(w, r)
+	})
+}
+
+func checkBody(raw []byte, schema map[string]interface{}, defs map[string]interface{}, optional bool) error {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		if optional {
+			return nil
+		}
+		return &ValidationError{Path: "/", Message: "request body is required"}
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return &ValidationError{Path: "/", Message: "invalid JSON: " + err.Error()}
+	}
+	return checkSchema("", schema, v, defs)
+}
+
+//checkSchema checks the decoded value v against schema and points at the
+//first value that does not match.
+func checkSchema(path string, schema map[string]interface{}, v interface{}, defs map[string]interface{}) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		schema, _ = defs[strings.TrimPrefix(ref, "#/components/schemas/")].(map[string]interface{})
+	}
+	//null leaves the field at its zero value
+	if v == nil {
+		return nil
+	}
+	at := path
+	if len(at) == 0 {
+		at = "/"
+	}
+	kind, _ := schema["type"].(string)
+	switch kind {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return &ValidationError{Path: at, Message: "must be an object"}
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		for _, k := range sortedKeys(obj) {
+			p := path + "/" + escapePointer(k)
+			if sub, ok := props[k].(map[string]interface{}); ok {
+				if err := checkSchema(p, sub, obj[k], defs); err != nil {
+					return err
+				}
+				continue
+			}
+			switch extra := schema["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					return &ValidationError{Path: p, Message: "unknown field"}
+				}
+			case map[string]interface{}:
+				if err := checkSchema(p, extra, obj[k], defs); err != nil {
+					return err
+				}
+			}
+		}
+	case "array":
+		list, ok := v.([]interface{})
+		if !ok {
+			return &ValidationError{Path: at, Message: "must be an array"}
+		}
+		items, _ := schema["items"].(map[string]interface{})
+		for i, item := range list {
+			if err := checkSchema(path+"/"+strconv.Itoa(i), items, item, defs); err != nil {
+				return err
+			}
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			return &ValidationError{Path: at, Message: "must be a string"}
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return &ValidationError{Path: at, Message: "must be a boolean"}
+		}
+	case "integer":
+		n, ok := v.(json.Number)
+		if !ok {
+			return &ValidationError{Path: at, Message: "must be an integer"}
+		}
+		if _, err := n.Int64(); err != nil {
+			return &ValidationError{Path: at, Message: "must be an integer"}
+		}
+	case "number":
+		if _, ok := v.(json.Number); !ok {
+			return &ValidationError{Path: at, Message: "must be a number"}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+//forwardParams keeps the listed query parameters of the request.
+func forwardParams(r *http.Request, names ...string) url.Values {
+	query := url.Values{}
+	for _, n := range names {
+		if v, ok := r.URL.Query()[n]; ok {
+			query[n] = v
+		}
+	}
+	return query
+}
+
+//passthrough sends a request for path to the default cluster and copies the
+//answer back as it came, content type included, since several diagnostic
+//APIs answer in plain text.
+func passthrough(w http.ResponseWriter, r *http.Request, method, path string, query url.Values, body io.Reader) {
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	//the names in path are escaped already
+	target := path
+	if len(query) != 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(r.Context(), method, target, body)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error creating elastic search request", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := es.Perform(req)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error calling elastic search", "path", path, "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); len(ct) != 0 {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.WriteHeader(res.StatusCode)
+	io.Copy(w, res.Body)
+}
+
+//hotThreadsHandler shows the busiest threads of the cluster nodes, or of the
+//nodes listed in the nodes parameter, as the plain text report of elastic search.
+func hotThreadsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	path := "/_nodes/hot_threads"
+	if nodes := r.URL.Query().Get("nodes"); len(nodes) != 0 {
+		path = "/_nodes/" + url.PathEscape(nodes) + "/hot_threads"
+	}
+	passthrough(w, r, http.MethodGet, path, forwardParams(r, "threads", "interval", "snapshots", "type", "ignore_idle_threads"), nil)
+}
+
+//NodeStatsConfig lists the metric groups of _nodes/stats (jvm, os, fs...)
+//exposed through the gateway.
+type NodeStatsConfig struct {
+	Metrics []string `json:"metrics"`
+}
+
+//nodeStatsHandler returns the stats of the cluster nodes, or of the nodes
+//listed in the nodes parameter, for the metric groups of the metric
+//parameter, all the configured ones by default.
+func nodeStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	params := r.URL.Query()
+	metrics := config.NodeStats.Metrics
+	if len(params.Get("metric")) != 0 {
+		exposed := map[string]bool{}
+		for _, m := range config.NodeStats.Metrics {
+			exposed[m] = true
+		}
+		metrics = stringToArray(params.Get("metric"))
+		for _, m := range metrics {
+			if !exposed[m] {
+				writeValidationError(w, &ValidationError{Path: "/metric", Message: fmt.Sprintf("%q is not one of %s", m, strings.Join(config.NodeStats.Metrics, ", "))})
+				return
+			}
+		}
+	}
+	if len(metrics) == 0 {
+		http.Error(w, "no node stats metric is exposed", http.StatusForbidden)
+		return
+	}
+	path := "/_nodes/stats/"
+	if nodes := params.Get("nodes"); len(nodes) != 0 {
+		path = "/_nodes/" + url.PathEscape(nodes) + "/stats/"
+	}
+	path += url.PathEscape(strings.Join(metrics, ","))
+	passthrough(w, r, http.MethodGet, path, forwardParams(r, "level", "timeout", "fields", "groups"), nil)
+}
+
+//pendingTasksHandler lists the cluster state updates waiting on the master,
+//as JSON, or as a plain text table with format=text.
+func pendingTasksHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	if r.URL.Query().Get("format") == "text" {
+		passthrough(w, r, http.MethodGet, "/_cat/pending_tasks", url.Values{"v": {"true"}}, nil)
+		return
+	}
+	passthrough(w, r, http.MethodGet, "/_cluster/pending_tasks", forwardParams(r, "local", "master_timeout"), nil)
+}
+
+//allocationExplainHandler tells why a shard is unassigned or where it lives.
+//Without index, elastic search explains the first unassigned shard it finds.
+func allocationExplainHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	var indices []string
+	if index := params.Get("index"); len(index) != 0 {
+		indices = []string{index}
+	}
+	if !checkAccess(w, r, opAdmin, indices) {
+		return
+	}
+	var body io.Reader
+	if len(indices) != 0 {
+		shard, err := strconv.Atoi(params.Get("shard"))
+		if err != nil {
+			http.Error(w, "shard must be a number when index is given", http.StatusBadRequest)
+			return
+		}
+		buf, err := encodeBody(map[string]interface{}{
+			"index":   indices[0],
+			"shard":   shard,
+			"primary": params.Get("primary") != "false",
+		})
+		if err != nil {
+			logger.ErrorContext(r.Context(), "error encoding allocation explain request", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body = buf
+	}
+	passthrough(w, r, http.MethodGet, "/_cluster/allocation/explain", forwardParams(r, "include_disk_info", "include_yes_decisions"), body)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch"
+)
+
+//PaginationConfig keeps the sessions of guarded from/size paginations for
+//SessionTTL after their last page, in the memory of each instance. The point
+//in time of a session is kept alive PITKeepAlive between pages.
+type PaginationConfig struct {
+	SessionTTL   Duration `json:"session_ttl"`
+	PITKeepAlive Duration `json:"pit_keep_alive"`
+}
+
+//PageGuard asks the gateway to check that the pages of a from/size pagination
+//see the same ordering. The first page opens a session, whose id is returned
+//in meta.pagination.session and sent back with the next pages. Each page
+//checks that the last hit of the previous page is still at the same
+//position; when a refresh moved it, meta.pagination.consistent is false and,
+//with AutoPIT, the rest of the session runs over a point in time.
+type PageGuard struct {
+	Session string `json:"session"`
+	AutoPIT bool   `json:"auto_pit"`
+}
+
+//pageSession is the state of a guarded pagination between pages.
+type pageSession struct {
+	hash string
+	//next is the from of the page following the last one served, and
+	//lastIndex/lastID the last hit of that page
+	next      int
+	lastIndex string
+	lastID    string
+	pit       string
+	at        time.Time
+	//tenant and identity are those of the request that opened pit
+	tenant   *Tenant
+	identity *Identity
+}
+
+var (
+	pageSessionsMu sync.Mutex
+	pageSessions   = map[string]*pageSession{}
+)
+
+//pageGuard ties one page to its session.
+type pageGuard struct {
+	id      string
+	session pageSession
+	autoPIT bool
+}
+
+func newPageSessionID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+//startPage looks the session of the request up, or opens one. Sessions are
+//bound to the query: a session sent with another query starts over. When the
+//session runs over a point in time, the search body is pointed at it.
+func startPage(ctx context.Context, es *elasticsearch.Client, g *PageGuard, index, sort []string, body *RequestBody) (*pageGuard, error) {
+	hash := queryHash(index, sort, 0, body.Size, body.ElasticQuery)
+	pageSessionsMu.Lock()
+	for id, s := range pageSessions {
+		if time.Since(s.at) > config.Pagination.SessionTTL.Duration {
+			delete(pageSessions, id)
+			if len(s.pit) != 0 {
+				go closePIT(scopedContext(s.tenant, s.identity), es, s.pit)
+			}
+		}
+	}
+	s, ok := pageSessions[tenantScope(ctx, g.Session)]
+	guard := &pageGuard{id: g.Session, autoPIT: g.AutoPIT}
+	if ok {
+		guard.session = *s
+	}
+	pageSessionsMu.Unlock()
+	switch {
+	case len(g.Session) == 0:
+		guard.id = newPageSessionID()
+		guard.session = pageSession{hash: hash}
+	case !ok:
+		return nil, &ValidationError{Path: "/pagination/session", Message: "unknown or expired session, start over without one"}
+	case guard.session.hash != hash:
+		if len(guard.session.pit) != 0 {
+			closePIT(ctx, es, guard.session.pit)
+		}
+		guard.session = pageSession{hash: hash}
+	}
+	if pit := guard.session.pit; len(pit) != 0 {
+		q, ok := searchBody(body.ElasticQuery)
+		if !ok {
+			return nil, &ValidationError{Path: "/elasticquery", Message: "must be a JSON object when paging over a point in time"}
+		}
+		q["pit"] = map[string]interface{}{"id": pit, "keep_alive": keepAlive(config.Pagination.PITKeepAlive)}
+		body.ElasticQuery = q
+	}
+	//a cached page would hide the changes the guard looks for
+	body.NoCache = true
+	return guard, nil
+}
+
+//finish checks the page against the previous one, records where it ended and
+//reports the state of the session in the response meta. query is the search
+//body of the page, run again for the hit before the page.
+func (g *pageGuard) finish(ctx context.Context, es *elasticsearch.Client, index, sort []string, from int, query []byte, response *SearchResponse) {
+	s := &g.session
+	meta := map[string]interface{}{"session": g.id}
+	switch {
+	case len(s.pit) != 0:
+		meta["consistent"] = true
+	case from > 0 && from == s.next && len(s.lastID) != 0:
+		hitIndex, hitID, err := hitAt(ctx, es, index, sort, from-1, query)
+		if err != nil {
+			logger.WarnContext(ctx, "unable to check pagination consistency", "error", err)
+			break
+		}
+		meta["consistent"] = hitIndex == s.lastIndex && hitID == s.lastID
+		if hitIndex == s.lastIndex && hitID == s.lastID {
+			break
+		}
+		meta["warning"] = fmt.Sprintf("the results changed since the previous page, hit %d is no longer %s", from-1, s.lastID)
+		if !g.autoPIT {
+			break
+		}
+		pit, err := openPIT(ctx, es, index, keepAlive(config.Pagination.PITKeepAlive))
+		if err != nil {
+			logger.WarnContext(ctx, "unable to open a point in time for the pagination session", "error", err)
+			break
+		}
+		s.pit = pit
+	}
+	if id, ok := response.Other["pit_id"]; ok {
+		json.Unmarshal(id, &s.pit)
+	}
+	if len(s.pit) != 0 {
+		//the session may expire after the request, its point in time is closed for its tenant
+		s.tenant, s.identity = tenantFrom(ctx), identityFrom(ctx)
+		meta["pit"] = true
+	}
+	hits := response.Hits.Hits
+	s.next = from + len(hits)
+	if len(hits) != 0 {
+		s.lastIndex, s.lastID = hits[len(hits)-1].Index, hits[len(hits)-1].ID
+	}
+	s.at = time.Now()
+	pageSessionsMu.Lock()
+	pageSessions[tenantScope(ctx, g.id)] = s
+	pageSessionsMu.Unlock()
+	responseMeta(response)["pagination"] = meta
+}
+
+//hitAt returns the hit at position pos of the search, without its source or
+//aggregations.
+func hitAt(ctx context.Context, es *elasticsearch.Client, index, sort []string, pos int, query []byte) (string, string, error) {
+	var q map[string]interface{}
+	if err := json.Unmarshal(query, &q); err != nil {
+		return "", "", err
+	}
+	if q == nil {
+		q = map[string]interface{}{}
+	}
+	for _, key := range []string{"aggs", "aggregations", "highlight", "suggest", "script_fields"} {
+		delete(q, key)
+	}
+	q["_source"] = false
+	q["from"], q["size"] = pos, 1
+	if len(sort) != 0 {
+		sorts := make([]interface{}, len(sort))
+		for i, spec := range sort {
+			field, order, ok := strings.Cut(spec, ":")
+			sorts[i] = field
+			if ok {
+				sorts[i] = map[string]interface{}{field: order}
+			}
+		}
+		q["sort"] = sorts
+	}
+	var page SearchResponse
+	if err := searchInto(ctx, es, index, q, &page); err != nil {
+		return "", "", err
+	}
+	if len(page.Hits.Hits) == 0 {
+		return "", "", nil
+	}
+	return page.Hits.Hits[0].Index, page.Hits.Hits[0].ID, nil
+}
+
+//keepAlive formats a duration the way elastic search expects it.
+func keepAlive(d Duration) string {
+	return fmt.Sprintf("%ds", int(d.Seconds()))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch"
+)
+
+//defaultMaxResultWindow is the index.max_result_window elastic search applies
+//when an index does not set one.
+const defaultMaxResultWindow = 10000
+
+type windowEntry struct {
+	at     time.Time
+	window int
+}
+
+var (
+	windowMu    sync.Mutex
+	windowCache = map[string]windowEntry{}
+)
+
+//maxResultWindow returns the smallest index.max_result_window of the indices.
+//Settings rarely change, so lookups are cached for five minutes.
+func maxResultWindow(ctx context.Context, es *elasticsearch.Client, index []string) (int, error) {
+	key := tenantScope(ctx, strings.Join(index, ","))
+	windowMu.Lock()
+	e, ok := windowCache[key]
+	windowMu.Unlock()
+	if ok && time.Since(e.at) < 5*time.Minute {
+		return e.window, nil
+	}
+	res, err := es.Indices.GetSettings(
+		es.Indices.GetSettings.WithContext(ctx),
+		es.Indices.GetSettings.WithIndex(index...),
+		es.Indices.GetSettings.WithName("index.max_result_window"),
+		es.Indices.GetSettings.WithFlatSettings(true),
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return 0, fmt.Errorf("index settings: %s", res.Status())
+	}
+	var settings map[string]struct {
+		Settings map[string]string `json:"settings"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&settings); err != nil {
+		return 0, err
+	}
+	window := defaultMaxResultWindow
+	for _, s := range settings {
+		if v, err := strconv.Atoi(s.Settings["index.max_result_window"]); err == nil && v < window {
+			window = v
+		}
+	}
+	windowMu.Lock()
+	windowCache[key] = windowEntry{at: time.Now(), window: window}
+	windowMu.Unlock()
+	return window, nil
+}
+
+//checkPagination rejects pages past the max_result_window of the indices
+//before elastic search does, with a hint at search_after.
+func checkPagination(ctx context.Context, es *elasticsearch.Client, index []string, from, size int) error {
+	if from < 0 || size < 0 {
+		return &ValidationError{Path: "/from", Message: "from and size must not be negative"}
+	}
+	if size == 0 {
+		size = defaultSize
+	}
+	if from+size <= defaultSize {
+		return nil
+	}
+	window, err := maxResultWindow(ctx, es, index)
+	if err != nil {
+		return err
+	}
+	if from+size > window {
+		return &ValidationError{
+			Path:    "/from",
+			Message: fmt.Sprintf("from + size is %d, past the max_result_window of %d; page deeper with search_after", from+size, window),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch"
+	"github.com/gorilla/mux"
+)
+
+//PercolatorConfig names the percolator field saved queries are stored in.
+//Queries are saved in the index of the documents they match, whose mapping
+//gives the type of the fields they use.
+type PercolatorConfig struct {
+	Field string `json:"field"`
+}
+
+//PercolateRequest is the body of a percolation: one document, or several.
+type PercolateRequest struct {
+	Document  map[string]interface{}   `json:"document"`
+	Documents []map[string]interface{} `json:"documents"`
+	//Size is the number of matching queries returned, 10 by default
+	Size int `json:"size"`
+}
+
+//PercolateMatch is a saved query matching the percolated documents. Documents
+//are the positions of the documents it matched, for percolations of several.
+type PercolateMatch struct {
+	ID        string                 `json:"id"`
+	Score     *float64               `json:"score"`
+	Documents []int                  `json:"documents,omitempty"`
+	Query     map[string]interface{} `json:"query"`
+}
+
+//PercolateResponse lists the saved queries matching the documents.
+type PercolateResponse struct {
+	Total   int64            `json:"total"`
+	Matches []PercolateMatch `json:"matches"`
+}
+
+//putPercolatorMapping declares the percolator field in the index. It is
+//idempotent, so it runs on every registration.
+func putPercolatorMapping(r *http.Request, es *elasticsearch.Client, index string) error {
+	buf, err := encodeBody(map[string]interface{}{
+		"properties": map[string]interface{}{
+			config.Percolator.Field: map[string]interface{}{"type": "percolator"},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPut, "/"+index+"/_mapping", buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := es.Perform(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("percolator mapping of %s: %s", index, res.Status)
+	}
+	return nil
+}
+
+//putPercolatorHandler saves a query to match incoming documents against. The
+//body holds the query in the percolator field, next to any other fields
+//(owner, channel...) returned with the matches.
+func putPercolatorHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !checkAccess(w, r, opWrite, []string{vars["index"]}) {
+		return
+	}
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := body[config.Percolator.Field].(map[string]interface{}); !ok {
+		writeValidationError(w, &ValidationError{Path: "/" + escapePointer(config.Percolator.Field), Message: "a query object is required"})
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := putPercolatorMapping(r, es, vars["index"]); err != nil {
+		logger.ErrorContext(r.Context(), "unable to map percolator field", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	buf, err := encodeBody(body)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error encoding percolator query", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	//the query applies to the next percolation
+	res, err := es.Index(vars["index"], buf,
+		es.Index.WithContext(r.Context()),
+		es.Index.WithDocumentID(vars["id"]),
+		es.Index.WithRefresh("wait_for"),
+	)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error saving percolator query", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeResponse(w, res)
+}
+
+//deletePercolatorHandler removes a saved query.
+func deletePercolatorHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !checkAccess(w, r, opWrite, []string{vars["index"]}) {
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res, err := es.Delete(vars["index"], vars["id"],
+		es.Delete.WithContext(r.Context()),
+		es.Delete.WithRefresh("wait_for"),
+	)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error deleting percolator query", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeResponse(w, res)
+}
+
+//percolateHandler runs documents through the saved queries of the index and
+//returns the queries they match.
+func percolateHandler(w http.ResponseWriter, r *http.Request) {
+	index := mux.Vars(r)["index"]
+	if !checkAccess(w, r, opSearch, strings.Split(index, ",")) {
+		return
+	}
+	var body PercolateRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	docs := body.Documents
+	if body.Document != nil {
+		docs = append([]map[string]interface{}{body.Document}, docs...)
+	}
+	if len(docs) == 0 {
+		writeValidationError(w, &ValidationError{Path: "/document", Message: "a document or documents are required"})
+		return
+	}
+	if body.Size <= 0 {
+		body.Size = defaultSize
+	}
+	buf, err := encodeBody(map[string]interface{}{
+		"query": map[string]interface{}{
+			"percolate": map[string]interface{}{"field": config.Percolator.Field, "documents": docs},
+		},
+		"size": body.Size,
+	})
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error encoding percolate query", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res, err := es.Search(
+		es.Search.WithContext(r.Context()),
+		es.Search.WithIndex(strings.Split(index, ",")...),
+		es.Search.WithBody(buf),
+		es.Search.WithTrackTotalHits(true),
+	)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error percolating documents", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if res.IsError() {
+		writeResponse(w, res)
+		return
+	}
+	defer res.Body.Close()
+	var sr SearchResponse
+	if err := json.NewDecoder(res.Body).Decode(&sr); err != nil {
+		logger.ErrorContext(r.Context(), "error parsing the response body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	out := PercolateResponse{Matches: make([]PercolateMatch, 0, len(sr.Hits.Hits))}
+	if sr.Hits.Total != nil {
+		out.Total = sr.Hits.Total.Value
+	}
+	for _, h := range sr.Hits.Hits {
+		m := PercolateMatch{ID: h.ID, Score: h.Score, Query: h.Source}
+		//_percolator_document_slot lists the matched documents by position
+		slots, _ := h.Fields["_percolator_document_slot"].([]interface{})
+		for _, s := range slots {
+			if n, ok := s.(float64); ok {
+				m.Documents = append(m.Documents, int(n))
+			}
+		}
+		out.Matches = append(out.Matches, m)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
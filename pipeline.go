@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/mux"
+)
+
+//Ingest pipelines are cluster wide, so only admins manage them. Writes pick
+//one with the pipeline parameter (PUT /elastic/doc) or field (gRPC Bulk).
+
+//pipelinesHandler lists the ingest pipelines, or returns the one named by id.
+func pipelinesHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	path := "/_ingest/pipeline"
+	if id := mux.Vars(r)["id"]; len(id) != 0 {
+		path += "/" + url.PathEscape(id)
+	}
+	passthrough(w, r, http.MethodGet, path, forwardParams(r, "summary", "master_timeout"), nil)
+}
+
+//putPipelineHandler creates or replaces an ingest pipeline with the request body.
+func putPipelineHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	logger.InfoContext(r.Context(), "ingest pipeline updated", "pipeline", id, "actor", actor(r))
+	passthrough(w, r, http.MethodPut, "/_ingest/pipeline/"+url.PathEscape(id), forwardParams(r, "if_version", "master_timeout", "timeout"), r.Body)
+}
+
+//deletePipelineHandler removes an ingest pipeline.
+func deletePipelineHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	logger.InfoContext(r.Context(), "ingest pipeline deleted", "pipeline", id, "actor", actor(r))
+	passthrough(w, r, http.MethodDelete, "/_ingest/pipeline/"+url.PathEscape(id), forwardParams(r, "master_timeout", "timeout"), nil)
+}
+
+//simulatePipelineHandler runs the documents of the request body through a
+//pipeline without indexing them: the stored pipeline named by id, or the
+//pipeline given in the body. verbose=true shows the result of every processor.
+func simulatePipelineHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	path := "/_ingest/pipeline/_simulate"
+	if id := mux.Vars(r)["id"]; len(id) != 0 {
+		path = "/_ingest/pipeline/" + url.PathEscape(id) + "/_simulate"
+	}
+	passthrough(w, r, http.MethodPost, path, forwardParams(r, "verbose"), r.Body)
+}
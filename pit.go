@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//PITConfig bounds the points in time opened through the gateway, tracked in
+//the memory of each instance. KeepAlive is the keep alive of a point in time
+//opened or extended without one, MaxKeepAlive the longest accepted. Every
+//ReapInterval the points in time left unused (searched or kept alive) for
+//IdleTimeout are closed, however long their keep alive, so clients that
+//forget them do not hold the segments of the cluster.
+type PITConfig struct {
+	KeepAlive    Duration `json:"keep_alive"`
+	MaxKeepAlive Duration `json:"max_keep_alive"`
+	IdleTimeout  Duration `json:"idle_timeout"`
+	ReapInterval Duration `json:"reap_interval"`
+}
+
+//PointInTime is a point in time opened through the gateway.
+type PointInTime struct {
+	ID        string    `json:"id"`
+	Index     []string  `json:"index"`
+	Owner     string    `json:"owner,omitempty"`
+	KeepAlive string    `json:"keep_alive"`
+	Opened    time.Time `json:"opened"`
+	Used      time.Time `json:"used"`
+	Expires   time.Time `json:"expires"`
+	keepAlive time.Duration
+	//tenant and identity are those of the request that opened it
+	tenant   *Tenant
+	identity *Identity
+}
+
+//PITRequest names a point in time to keep alive or close.
+type PITRequest struct {
+	ID        string `json:"id"`
+	KeepAlive string `json:"keep_alive"`
+}
+
+var (
+	pitsMu sync.Mutex
+	pits   = map[string]*PointInTime{}
+)
+
+//pitKeepAlive reads a keep alive ("5m"), KeepAlive when empty.
+func pitKeepAlive(s string) (time.Duration, error) {
+	if len(s) == 0 {
+		return config.PIT.KeepAlive.Duration, nil
+	}
+	d, err := parseESDuration(s)
+	if err != nil || d <= 0 {
+		return 0, &ValidationError{Path: "/keep_alive", Message: "must be a positive duration (5m)"}
+	}
+	if d > config.PIT.MaxKeepAlive.Duration {
+		return 0, &ValidationError{Path: "/keep_alive", Message: fmt.Sprintf("must be at most %s", config.PIT.MaxKeepAlive.Duration)}
+	}
+	return d, nil
+}
+
+//esTimeUnits are the units of the time values of elastic search.
+var esTimeUnits = map[string]time.Duration{
+	"d": 24 * time.Hour, "h": time.Hour, "m": time.Minute, "s": time.Second,
+	"ms": time.Millisecond, "micros": time.Microsecond, "nanos": time.Nanosecond,
+}
+
+//parseESDuration reads a time value of elastic search ("5d", "30s"), or a Go
+//duration ("1h30m").
+func parseESDuration(s string) (time.Duration, error) {
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i > 0 {
+		if unit, ok := esTimeUnits[s[i:]]; ok {
+			n, err := strconv.ParseFloat(s[:i], 64)
+			if err == nil {
+				return time.Duration(n * float64(unit)), nil
+			}
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+//trackedPIT returns a copy of the point in time, nil when the gateway did
+//not open it or closed it.
+func trackedPIT(id string) *PointInTime {
+	pitsMu.Lock()
+	defer pitsMu.Unlock()
+	p, ok := pits[id]
+	if !ok {
+		return nil
+	}
+	c := *p
+	return &c
+}
+
+//usePIT records a use of the point in time, under the id elastic search
+//answered with when it changed, and returns a copy of it, nil when it is not
+//tracked.
+func usePIT(id string, next json.RawMessage) *PointInTime {
+	pitsMu.Lock()
+	defer pitsMu.Unlock()
+	p, ok := pits[id]
+	if !ok {
+		return nil
+	}
+	p.Used = time.Now()
+	p.Expires = p.Used.Add(p.keepAlive)
+	var nextID string
+	if json.Unmarshal(next, &nextID) == nil && len(nextID) != 0 && nextID != id {
+		delete(pits, id)
+		p.ID = nextID
+		pits[nextID] = p
+	}
+	c := *p
+	return &c
+}
+
+//reapPITs closes the idle points in time forever, and forgets the expired ones.
+func reapPITs() {
+	for {
+		time.Sleep(config.PIT.ReapInterval.Duration)
+		var idle []*PointInTime
+		pitsMu.Lock()
+		for id, p := range pits {
+			switch {
+			case time.Now().After(p.Expires):
+				delete(pits, id)
+			case time.Since(p.Used) > config.PIT.IdleTimeout.Duration:
+				delete(pits, id)
+				idle = append(idle, p)
+			}
+		}
+		pitsMu.Unlock()
+		if len(idle) == 0 {
+			continue
+		}
+		es, err := defaultClient()
+		if err != nil {
+			logger.Error("unable to create es client object", "error", err)
+			continue
+		}
+		for _, p := range idle {
+			logger.Info("closing abandoned point in time", "index", strings.Join(p.Index, ","), "owner", p.Owner, "idle", time.Since(p.Used).Round(time.Second).String())
+			closePIT(scopedContext(p.tenant, p.identity), es, p.ID)
+		}
+	}
+}
+
+//openPITHandler opens a point in time on the indices, kept alive for the
+//keep_alive parameter. Searches use it by its id in pit.
+func openPITHandler(w http.ResponseWriter, r *http.Request) {
+	index := strings.Split(mux.Vars(r)["index"], ",")
+	if !checkAccess(w, r, opSearch, index) {
+		return
+	}
+	d, err := pitKeepAlive(r.URL.Query().Get("keep_alive"))
+	if err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id, err := openPIT(r.Context(), es, index, keepAlive(Duration{d}))
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to open point in time", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	now := time.Now()
+	p := &PointInTime{ID: id, Index: index, Owner: actor(r), KeepAlive: d.String(), Opened: now, Used: now, Expires: now.Add(d), keepAlive: d,
+		tenant: tenantFrom(r.Context()), identity: identityFrom(r.Context())}
+	pitsMu.Lock()
+	pits[id] = p
+	pitsMu.Unlock()
+	writeJSON(w, http.StatusOK, p)
+}
+
+//decodePITRequest reads the body naming a point in time the gateway opened
+//and checks the caller may search its indices.
+func decodePITRequest(w http.ResponseWriter, r *http.Request) (PITRequest, *PointInTime, bool) {
+	var req PITRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return req, nil, false
+	}
+	p := trackedPIT(req.ID)
+	if p == nil {
+		http.Error(w, "unknown or closed point in time", http.StatusNotFound)
+		return req, nil, false
+	}
+	if !checkAccess(w, r, opSearch, p.Index) {
+		return req, nil, false
+	}
+	return req, p, true
+}
+
+//keepAlivePITHandler extends a point in time by keep_alive from now, with an
+//empty search over it, and answers its id, which elastic search may change.
+func keepAlivePITHandler(w http.ResponseWriter, r *http.Request) {
+	req, p, ok := decodePITRequest(w, r)
+	if !ok {
+		return
+	}
+	d, err := pitKeepAlive(req.KeepAlive)
+	if err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	query := map[string]interface{}{
+		"size":             0,
+		"track_total_hits": false,
+		"pit":              map[string]interface{}{"id": p.ID, "keep_alive": keepAlive(Duration{d})},
+	}
+	var result struct {
+		PITID json.RawMessage `json:"pit_id"`
+	}
+	if err := searchInto(r.Context(), es, nil, query, &result); err != nil {
+		logger.ErrorContext(r.Context(), "unable to keep point in time alive", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	pitsMu.Lock()
+	if tracked, ok := pits[p.ID]; ok {
+		tracked.keepAlive, tracked.KeepAlive = d, d.String()
+	}
+	pitsMu.Unlock()
+	if p = usePIT(p.ID, result.PITID); p == nil {
+		http.Error(w, "point in time closed meanwhile", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+//closePITHandler closes a point in time before its keep alive runs out.
+func closePITHandler(w http.ResponseWriter, r *http.Request) {
+	_, p, ok := decodePITRequest(w, r)
+	if !ok {
+		return
+	}
+	pitsMu.Lock()
+	delete(pits, p.ID)
+	pitsMu.Unlock()
+	buf, err := encodeBody(map[string]interface{}{"id": p.ID})
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error encoding point in time", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger.InfoContext(r.Context(), "point in time closed", "index", strings.Join(p.Index, ","), "actor", actor(r))
+	passthrough(w, r, http.MethodDelete, "/_pit", nil, buf)
+}
+
+//pitsHandler lists the points in time opened through this instance.
+func pitsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	list := []PointInTime{}
+	pitsMu.Lock()
+	for _, p := range pits {
+		list = append(list, *p)
+	}
+	pitsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Opened.Before(list[j].Opened) })
+	writeJSON(w, http.StatusOK, list)
+}
+
+//withPIT points the search body at a point in time opened through the
+//gateway, with its keep alive.
+func withPIT(q interface{}, p *PointInTime) (interface{}, error) {
+	body, ok := searchBody(q)
+	if !ok {
+		return nil, &ValidationError{Path: "/elasticquery", Message: "must be a JSON object when searching a point in time"}
+	}
+	body["pit"] = map[string]interface{}{"id": p.ID, "keep_alive": keepAlive(Duration{p.keepAlive})}
+	return body, nil
+}
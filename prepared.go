@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch"
+	"github.com/gorilla/mux"
+)
+
+//PreparedConfig sets where prepared queries are stored.
+type PreparedConfig struct {
+	Index string `json:"index"`
+}
+
+//PreparedQuery is a search registered once and run many times by handle.
+//Parameters appear in the query as "{{name}}": a string that is just the
+//placeholder takes the value as is (number, array...), one that contains it
+//gets the value written into it. In where, placeholders are quoted like
+//strings ('{{status}}') and still take the value as is.
+//
+//	{"index": "orders", "where": "status = '{{status}}'", "elasticquery": {"size": "{{size}}"},
+//	 "params": {"status": {"type": "string", "required": true}, "size": {"type": "number", "default": 10}}}
+type PreparedQuery struct {
+	Index        string                   `json:"index"`
+	ElasticQuery interface{}              `json:"elasticquery,omitempty"`
+	Filters      []Filter                 `json:"filters,omitempty"`
+	Where        string                   `json:"where,omitempty"`
+	Params       map[string]PreparedParam `json:"params,omitempty"`
+}
+
+//PreparedParam declares a parameter. Type is string, number, boolean, array
+//or any (the default).
+type PreparedParam struct {
+	Type     string      `json:"type,omitempty"`
+	Required bool        `json:"required,omitempty"`
+	Default  interface{} `json:"default,omitempty"`
+}
+
+//preparedPlan is a registered query with its transforms (filters, where,
+//soft delete) already applied, ready to be bound.
+type preparedPlan struct {
+	Handle    string                   `json:"handle"`
+	Index     string                   `json:"index"`
+	Body      interface{}              `json:"body"`
+	Params    map[string]PreparedParam `json:"params,omitempty"`
+	Actor     string                   `json:"actor"`
+	Timestamp string                   `json:"timestamp"`
+}
+
+var placeholder = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+//Plans never change once registered, as the handle is the hash of the
+//definition, so they are cached for the life of the process.
+var (
+	plansMu sync.Mutex
+	plans   = map[string]*preparedPlan{}
+)
+
+var preparedMapping = map[string]interface{}{
+	"mappings": map[string]interface{}{
+		"properties": map[string]interface{}{
+			"handle":    map[string]interface{}{"type": "keyword"},
+			"index":     map[string]interface{}{"type": "keyword"},
+			"body":      map[string]interface{}{"type": "object", "enabled": false},
+			"params":    map[string]interface{}{"type": "object", "enabled": false},
+			"actor":     map[string]interface{}{"type": "keyword"},
+			"timestamp": map[string]interface{}{"type": "date"},
+		},
+	},
+}
+
+func ensurePreparedIndex(ctx context.Context, es *elasticsearch.Client) {
+	ensureOnce(ctx, config.Prepared.Index, func() {
+		buf, err := encodeBody(preparedMapping)
+		if err != nil {
+			logger.ErrorContext(ctx, "error encoding prepared query mapping", "error", err)
+			return
+		}
+		res, err := es.Indices.Create(config.Prepared.Index,
+			es.Indices.Create.WithContext(ctx),
+			es.Indices.Create.WithBody(buf),
+		)
+		if err != nil {
+			logger.ErrorContext(ctx, "unable to create prepared query index", "error", err)
+			return
+		}
+		res.Body.Close()
+	})
+}
+
+//placeholders lists the parameters used in v.
+func placeholders(v interface{}, found map[string]bool) {
+	switch v := v.(type) {
+	case string:
+		for _, m := range placeholder.FindAllStringSubmatch(v, -1) {
+			found[m[1]] = true
+		}
+	case map[string]interface{}:
+		for _, e := range v {
+			placeholders(e, found)
+		}
+	case []interface{}:
+		for _, e := range v {
+			placeholders(e, found)
+		}
+	}
+}
+
+//bindParams replaces the placeholders of v with the parameter values.
+func bindParams(v interface{}, values map[string]interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		if m := placeholder.FindStringSubmatch(v); m != nil && m[0] == v {
+			return values[m[1]]
+		}
+		return placeholder.ReplaceAllStringFunc(v, func(s string) string {
+			value := values[placeholder.FindStringSubmatch(s)[1]]
+			if str, ok := value.(string); ok {
+				return str
+			}
+			b, _ := json.Marshal(value)
+			return string(b)
+		})
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			out[k] = bindParams(e, values)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = bindParams(e, values)
+		}
+		return out
+	}
+	return v
+}
+
+var paramTypes = map[string]bool{"": true, "any": true, "string": true, "number": true, "boolean": true, "array": true}
+
+func paramTypeOK(kind string, v interface{}) bool {
+	switch kind {
+	case "", "any":
+		return true
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "array":
+		_, ok := v.([]interface{})
+		return ok
+	}
+	return false
+}
+
+//compilePrepared checks a prepared query and applies its transforms.
+func compilePrepared(p PreparedQuery) (interface{}, error) {
+	if len(p.Index) == 0 {
+		return nil, &ValidationError{Path: "/index", Message: "index is required"}
+	}
+	for name, param := range p.Params {
+		if !paramTypes[param.Type] {
+			return nil, &ValidationError{Path: "/params/" + escapePointer(name) + "/type", Message: "unknown type " + param.Type}
+		}
+		if param.Default != nil && !paramTypeOK(param.Type, param.Default) {
+			return nil, &ValidationError{Path: "/params/" + escapePointer(name) + "/default", Message: "default is not a " + param.Type}
+		}
+	}
+	q := p.ElasticQuery
+	var err error
+	if len(p.Filters) != 0 {
+		if q, err = withFilters(q, p.Filters); err != nil {
+			return nil, err
+		}
+	}
+	if len(strings.TrimSpace(p.Where)) != 0 {
+		if q, err = withWhere(q, p.Where); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateSearchBody(q); err != nil {
+		return nil, err
+	}
+	used := map[string]bool{}
+	placeholders(q, used)
+	for name := range used {
+		if _, ok := p.Params[name]; !ok {
+			return nil, &ValidationError{Path: "/params", Message: "parameter " + name + " is used but not declared"}
+		}
+	}
+	if config.SoftDelete.Enabled {
+		q = excludeSoftDeleted(q)
+	}
+	return q, nil
+}
+
+//bind checks the values against the declared parameters, fills in defaults
+//and returns the body to run.
+func (p *preparedPlan) bind(values map[string]interface{}) (interface{}, error) {
+	bound := map[string]interface{}{}
+	for name := range values {
+		if _, ok := p.Params[name]; !ok {
+			return nil, &ValidationError{Path: "/params/" + escapePointer(name), Message: "unknown parameter"}
+		}
+	}
+	for name, param := range p.Params {
+		v, ok := values[name]
+		if !ok || v == nil {
+			if param.Required {
+				return nil, &ValidationError{Path: "/params/" + escapePointer(name), Message: "parameter is required"}
+			}
+			v = param.Default
+		}
+		if v != nil && !paramTypeOK(param.Type, v) {
+			return nil, &ValidationError{Path: "/params/" + escapePointer(name), Message: "must be a " + param.Type}
+		}
+		bound[name] = v
+	}
+	return bindParams(p.Body, bound), nil
+}
+
+//preparedHandle is the hash of a compiled prepared query, so registering the
+//same query twice gives the same handle.
+func preparedHandle(index string, body interface{}, params map[string]PreparedParam) string {
+	b, _ := json.Marshal(map[string]interface{}{"index": index, "body": normalizeJSON(body), "params": params})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:12])
+}
+
+//loadPlan returns the plan of a handle, from the cache or the prepared index.
+func loadPlan(ctx context.Context, es *elasticsearch.Client, handle string) (*preparedPlan, error) {
+	plansMu.Lock()
+	plan, ok := plans[handle]
+	plansMu.Unlock()
+	if ok {
+		return plan, nil
+	}
+	res, err := es.Get(config.Prepared.Index, handle, es.Get.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.IsError() {
+		return nil, fmt.Errorf("get prepared query %s: %s", handle, res.Status())
+	}
+	var doc struct {
+		Source preparedPlan `json:"_source"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	plansMu.Lock()
+	plans[handle] = &doc.Source
+	plansMu.Unlock()
+	return &doc.Source, nil
+}
+
+//prepareHandler registers a prepared query and answers its handle. The query
+//is validated and its transforms applied once, here, instead of on every run.
+func prepareHandler(w http.ResponseWriter, r *http.Request) {
+	var p PreparedQuery
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(p.Index) != 0 && !checkAccess(w, r, opSearch, stringToArray(p.Index)) {
+		return
+	}
+	body, err := compilePrepared(p)
+	if err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	plan := &preparedPlan{
+		Handle:    preparedHandle(p.Index, body, p.Params),
+		Index:     p.Index,
+		Body:      body,
+		Params:    p.Params,
+		Actor:     actor(r),
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ensurePreparedIndex(r.Context(), es)
+	buf, err := encodeBody(plan)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error encoding prepared query", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res, err := es.Index(config.Prepared.Index, buf,
+		es.Index.WithContext(r.Context()),
+		es.Index.WithDocumentID(plan.Handle),
+		es.Index.WithOpType("create"),
+		es.Index.WithRefresh("wait_for"),
+	)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error storing prepared query", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	res.Body.Close()
+	//a conflict means the same query was registered before
+	if res.IsError() && res.StatusCode != http.StatusConflict {
+		logger.ErrorContext(r.Context(), "prepared query rejected by elastic search", "status", res.Status())
+		http.Error(w, res.Status(), http.StatusBadGateway)
+		return
+	}
+	plansMu.Lock()
+	plans[plan.Handle] = plan
+	plansMu.Unlock()
+	params := make([]string, 0, len(p.Params))
+	for name := range p.Params {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"handle": plan.Handle, "params": params})
+}
+
+//preparedHandler returns the compiled form of a prepared query.
+func preparedHandler(w http.ResponseWriter, r *http.Request) {
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	plan, err := loadPlan(r.Context(), es, mux.Vars(r)["handle"])
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error reading prepared query", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if plan == nil {
+		http.Error(w, "unknown handle", http.StatusNotFound)
+		return
+	}
+	if !checkAccess(w, r, opSearch, stringToArray(plan.Index)) {
+		return
+	}
+	writeJSON(w, http.StatusOK, plan)
+}
+
+//executePreparedHandler runs a prepared query with the parameters of the
+//body ({"params": {...}}) and answers the elastic search response.
+func executePreparedHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Params map[string]interface{} `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	plan, err := loadPlan(r.Context(), es, mux.Vars(r)["handle"])
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error reading prepared query", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if plan == nil {
+		http.Error(w, "unknown handle", http.StatusNotFound)
+		return
+	}
+	index := stringToArray(plan.Index)
+	if !checkAccess(w, r, opSearch, index) {
+		return
+	}
+	q, err := plan.bind(body.Params)
+	if err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	buf, err := encodeBody(q)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error encoding elastic search query", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res, err := es.Search(
+		es.Search.WithContext(r.Context()),
+		es.Search.WithIndex(index...),
+		es.Search.WithBody(buf),
+	)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error getting response from elastic search cluster", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeResponse(w, res)
+}
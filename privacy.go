@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"path"
+	"sort"
+	"strings"
+)
+
+//PrivacyConfig lists the patterns of the sensitive indices, whose searches
+//only answer noisy aggregations: no hits are returned, counts get Laplace
+//noise of scale 1/Epsilon and buckets left with fewer than MinBucketSize
+//documents are suppressed, sub-aggregations included. Aggregations that give
+//individual values away (top_hits, min, max...) are removed. A search names a
+//sensitive index when one of its indices matches a pattern or is itself a
+//pattern, so wildcards cannot reach around the list; aliases of sensitive
+//indices must be listed as well. Searches can ask for the same treatment with
+//"private": true.
+type PrivacyConfig struct {
+	Indices       []string `json:"indices"`
+	Epsilon       float64  `json:"epsilon"`
+	MinBucketSize int64    `json:"min_bucket_size"`
+}
+
+//revealingAggs are the aggregations answering values of single documents.
+var revealingAggs = map[string]bool{
+	"top_hits": true, "top_metrics": true, "min": true, "max": true, "stats": true,
+	"extended_stats": true, "string_stats": true, "scripted_metric": true, "geo_bounds": true,
+	"matrix_stats": true, "boxplot": true,
+}
+
+//countAggs are the metric aggregations answering a count of documents or values.
+var countAggs = map[string]bool{"value_count": true, "cardinality": true}
+
+//privateSearch tells whether a search of the indices gets the privacy treatment.
+func privateSearch(index []string, requested bool) bool {
+	if requested {
+		return true
+	}
+	if len(config.Privacy.Indices) == 0 {
+		return false
+	}
+	if len(index) == 0 {
+		return true
+	}
+	for _, name := range index {
+		if strings.ContainsAny(name, "*?") || name == "_all" {
+			return true
+		}
+		for _, pattern := range config.Privacy.Indices {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//privacyNoise draws the noise of a response. It is seeded by the query so
+//that asking the same question again gives the same answer rather than new
+//draws to average out.
+type privacyNoise struct {
+	rng        *rand.Rand
+	suppressed int
+}
+
+func newPrivacyNoise(queryHash string) *privacyNoise {
+	h := fnv.New64a()
+	h.Write([]byte(queryHash))
+	return &privacyNoise{rng: rand.New(rand.NewSource(int64(h.Sum64())))}
+}
+
+//count adds Laplace noise to a count, rounded and never negative.
+func (n *privacyNoise) count(v float64) float64 {
+	u := n.rng.Float64() - 0.5
+	noise := -math.Copysign(1/config.Privacy.Epsilon, u) * math.Log(1-2*math.Abs(u))
+	return math.Max(0, math.Round(v+noise))
+}
+
+//distinctValue is the distinct count of the field of the index as answered,
+//noised when the index is sensitive.
+func distinctValue(index, field string, v float64) float64 {
+	if !privateSearch([]string{index}, false) {
+		return v
+	}
+	return newPrivacyNoise(index + "\x00" + field).count(v)
+}
+
+//privatizeResponse applies the privacy treatment to the response of the
+//search body q, and reports it in meta.privacy. Results are walked in a fixed
+//order for the noise to be the same for the same query.
+func privatizeResponse(response *SearchResponse, q interface{}, queryHash string) error {
+	body, _ := searchBody(q)
+	aggs, ok := body["aggs"].(map[string]interface{})
+	if !ok {
+		aggs, _ = body["aggregations"].(map[string]interface{})
+	}
+	n := newPrivacyNoise(queryHash)
+	response.Hits.Hits = []Hit{}
+	response.Hits.MaxScore = nil
+	if response.Hits.Total != nil {
+		response.Hits.Total.Value = int64(n.count(float64(response.Hits.Total.Value)))
+	}
+	names := make([]string, 0, len(response.Aggregations))
+	for name := range response.Aggregations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		raw := response.Aggregations[name]
+		def, _ := aggs[name].(map[string]interface{})
+		kind, sub := aggDefinition(def)
+		if revealingAggs[kind] {
+			delete(response.Aggregations, name)
+			continue
+		}
+		var result map[string]interface{}
+		if err := json.Unmarshal(raw, &result); err != nil {
+			return err
+		}
+		n.aggregation(kind, sub, result)
+		b, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		response.Aggregations[name] = b
+	}
+	responseMeta(response)["privacy"] = map[string]interface{}{
+		"epsilon":         config.Privacy.Epsilon,
+		"min_bucket_size": config.Privacy.MinBucketSize,
+		"suppressed":      n.suppressed,
+	}
+	return nil
+}
+
+//aggDefinition returns the kind of an aggregation definition and its
+//sub-aggregations.
+func aggDefinition(def map[string]interface{}) (string, map[string]interface{}) {
+	kind := ""
+	var sub map[string]interface{}
+	for key, v := range def {
+		switch key {
+		case "aggs", "aggregations":
+			sub, _ = v.(map[string]interface{})
+		case "meta":
+		default:
+			kind = key
+		}
+	}
+	return kind, sub
+}
+
+//aggregation noises the result of one aggregation, recursing into its buckets.
+func (n *privacyNoise) aggregation(kind string, sub map[string]interface{}, result map[string]interface{}) {
+	if countAggs[kind] {
+		if v, ok := result["value"].(float64); ok {
+			result["value"] = n.count(v)
+		}
+		return
+	}
+	if v, ok := result["sum_other_doc_count"].(float64); ok {
+		result["sum_other_doc_count"] = n.count(v)
+	}
+	switch buckets := result["buckets"].(type) {
+	case []interface{}:
+		kept := []interface{}{}
+		for _, b := range buckets {
+			if bucket, ok := b.(map[string]interface{}); ok && n.bucket(sub, bucket) {
+				kept = append(kept, bucket)
+			}
+		}
+		result["buckets"] = kept
+	case map[string]interface{}:
+		for _, key := range sortedKeys(buckets) {
+			if bucket, ok := buckets[key].(map[string]interface{}); !ok || !n.bucket(sub, bucket) {
+				delete(buckets, key)
+			}
+		}
+	default:
+		//single bucket aggregations (filter, nested, missing...)
+		if _, ok := result["doc_count"]; ok && !n.bucket(sub, result) {
+			result["suppressed"] = true
+		}
+	}
+}
+
+//bucket noises the count of a bucket and its sub-aggregations. false is
+//returned when the bucket is too small to be shown, its sub-aggregations
+//removed.
+func (n *privacyNoise) bucket(sub map[string]interface{}, bucket map[string]interface{}) bool {
+	count, _ := bucket["doc_count"].(float64)
+	count = n.count(count)
+	bucket["doc_count"] = count
+	if int64(count) < config.Privacy.MinBucketSize {
+		n.suppressed++
+		for name := range sub {
+			delete(bucket, name)
+		}
+		return false
+	}
+	for _, name := range sortedKeys(sub) {
+		def, _ := sub[name].(map[string]interface{})
+		kind, subSub := aggDefinition(def)
+		result, ok := bucket[name].(map[string]interface{})
+		switch {
+		case !ok:
+		case revealingAggs[kind]:
+			delete(bucket, name)
+		default:
+			n.aggregation(kind, subSub, result)
+		}
+	}
+	return true
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+//QueryTiming is the time spent on one query of a shard, its phases condensed
+//into building the scorer, iterating the matching documents and scoring them.
+type QueryTiming struct {
+	Type        string  `json:"type"`
+	Description string  `json:"description"`
+	TimeMS      float64 `json:"time_ms"`
+	BuildMS     float64 `json:"build_ms"`
+	IterateMS   float64 `json:"iterate_ms"`
+	ScoreMS     float64 `json:"score_ms"`
+}
+
+//ShardProfile is the time one shard spent on the profiled search, by phase.
+type ShardProfile struct {
+	Index          string        `json:"index"`
+	Shard          string        `json:"shard"`
+	Node           string        `json:"node"`
+	TimeMS         float64       `json:"time_ms"`
+	QueryMS        float64       `json:"query_ms"`
+	RewriteMS      float64       `json:"rewrite_ms"`
+	CollectorMS    float64       `json:"collector_ms"`
+	AggregationsMS float64       `json:"aggregations_ms"`
+	FetchMS        float64       `json:"fetch_ms"`
+	Queries        []QueryTiming `json:"queries"`
+}
+
+//queryPhases groups the breakdown keys of the query profile.
+var queryPhases = map[string]string{
+	"create_weight":             "build",
+	"build_scorer":              "build",
+	"next_doc":                  "iterate",
+	"advance":                   "iterate",
+	"match":                     "iterate",
+	"shallow_advance":           "iterate",
+	"score":                     "score",
+	"compute_max_score":         "score",
+	"set_min_competitive_score": "score",
+}
+
+type profiledQuery struct {
+	Type        string           `json:"type"`
+	Description string           `json:"description"`
+	TimeInNanos int64            `json:"time_in_nanos"`
+	Breakdown   map[string]int64 `json:"breakdown"`
+}
+
+//summarizeProfile condenses the profile section of a search response into
+//per-shard timings, slowest shard first. Only the top level queries are kept:
+//their times include the ones of the queries they are made of.
+func summarizeProfile(raw json.RawMessage) ([]ShardProfile, error) {
+	var profile struct {
+		Shards []struct {
+			ID       string `json:"id"`
+			Searches []struct {
+				Query     []profiledQuery `json:"query"`
+				Rewrite   int64           `json:"rewrite_time"`
+				Collector []profiledTime  `json:"collector"`
+			} `json:"searches"`
+			Aggregations []profiledTime `json:"aggregations"`
+			Fetch        *profiledTime  `json:"fetch"`
+		} `json:"shards"`
+	}
+	if err := json.Unmarshal(raw, &profile); err != nil {
+		return nil, err
+	}
+	shards := make([]ShardProfile, 0, len(profile.Shards))
+	for _, s := range profile.Shards {
+		var shard ShardProfile
+		//shard ids look like [nodeId][index][shard]
+		if parts := strings.Split(strings.Trim(s.ID, "[]"), "]["); len(parts) == 3 {
+			shard.Node, shard.Index, shard.Shard = parts[0], parts[1], parts[2]
+		}
+		shard.Queries = []QueryTiming{}
+		for _, search := range s.Searches {
+			shard.RewriteMS += nanosToMS(search.Rewrite)
+			for _, q := range search.Query {
+				timing := QueryTiming{Type: q.Type, Description: q.Description, TimeMS: nanosToMS(q.TimeInNanos)}
+				for key, nanos := range q.Breakdown {
+					switch queryPhases[key] {
+					case "build":
+						timing.BuildMS += nanosToMS(nanos)
+					case "iterate":
+						timing.IterateMS += nanosToMS(nanos)
+					case "score":
+						timing.ScoreMS += nanosToMS(nanos)
+					}
+				}
+				shard.QueryMS += timing.TimeMS
+				shard.Queries = append(shard.Queries, timing)
+			}
+			for _, t := range search.Collector {
+				shard.CollectorMS += nanosToMS(t.TimeInNanos)
+			}
+		}
+		for _, t := range s.Aggregations {
+			shard.AggregationsMS += nanosToMS(t.TimeInNanos)
+		}
+		if s.Fetch != nil {
+			shard.FetchMS = nanosToMS(s.Fetch.TimeInNanos)
+		}
+		//elastic search times queries and collectors independently
+		shard.TimeMS = shard.RewriteMS + shard.QueryMS + shard.CollectorMS + shard.AggregationsMS + shard.FetchMS
+		shards = append(shards, shard)
+	}
+	sort.Slice(shards, func(i, j int) bool { return shards[i].TimeMS > shards[j].TimeMS })
+	return shards, nil
+}
+
+func nanosToMS(nanos int64) float64 {
+	return float64(nanos) / 1e6
+}
+
+//withProfileSummary replaces the raw profile of the response, large enough to
+//dwarf the hits, with its summary in meta.profile.
+func withProfileSummary(response *SearchResponse) error {
+	raw, ok := response.Other["profile"]
+	if !ok {
+		return nil
+	}
+	shards, err := summarizeProfile(raw)
+	if err != nil {
+		return err
+	}
+	delete(response.Other, "profile")
+	responseMeta(response)["profile"] = map[string]interface{}{"took": response.Took, "shards": shards}
+	return nil
+}
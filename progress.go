@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	//progressInterval is how often progress events are sent.
+	progressInterval = time.Second
+	//progressKeep is how long a finished export can still be followed.
+	progressKeep = time.Minute
+)
+
+//Progress is the data of a progress event. Total, Percent and ETA are left
+//out while the total is unknown.
+type Progress struct {
+	Done     int64   `json:"done"`
+	Total    int64   `json:"total,omitempty"`
+	Percent  float64 `json:"percent,omitempty"`
+	ETA      string  `json:"eta,omitempty"`
+	Finished bool    `json:"finished"`
+	Error    string  `json:"error,omitempty"`
+}
+
+//job tracks the progress of an export, under the request id of the export.
+type job struct {
+	index    []string
+	started  time.Time
+	mu       sync.Mutex
+	done     int64
+	total    int64
+	finished bool
+	err      error
+	//out is the output of the export, described by its manifest
+	out *exportOutput
+}
+
+var (
+	jobsMu sync.Mutex
+	jobs   = map[string]*job{}
+)
+
+//trackExport registers the export of ctx so its progress can be followed.
+//The returned context carries the job for pageThrough to update.
+func trackExport(ctx context.Context, index []string) (context.Context, *job) {
+	j := &job{index: index, started: time.Now()}
+	jobsMu.Lock()
+	jobs[requestID(ctx)] = j
+	jobsMu.Unlock()
+	return context.WithValue(ctx, progressKey, j), j
+}
+
+//update records the documents seen so far and the total, when known.
+func (j *job) update(done, total int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.done = done
+	if total > 0 {
+		j.total = total
+	}
+}
+
+//finish marks the export of ctx as over, saves its manifest, notifies the
+//webhooks, and forgets it after progressKeep.
+func (j *job) finish(ctx context.Context, err error) {
+	j.mu.Lock()
+	j.finished, j.err = true, err
+	done := j.done
+	j.mu.Unlock()
+	id := requestID(ctx)
+	j.saveManifest(id)
+	payload := map[string]interface{}{"request_id": id, "index": j.index, "documents": done}
+	if err != nil {
+		payload["error"] = err.Error()
+		notify("export.failed", payload)
+	} else {
+		notify("export.finished", payload)
+	}
+	time.AfterFunc(progressKeep, func() {
+		jobsMu.Lock()
+		delete(jobs, id)
+		jobsMu.Unlock()
+	})
+}
+
+func (j *job) progress() Progress {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	p := newProgress(j.done, j.total, time.Since(j.started))
+	p.Finished = j.finished
+	if j.err != nil {
+		p.Error = j.err.Error()
+	}
+	return p
+}
+
+func progressFrom(ctx context.Context) *job {
+	j, _ := ctx.Value(progressKey).(*job)
+	return j
+}
+
+//newProgress computes the percentage and the time left, assuming the rate
+//seen so far holds.
+func newProgress(done, total int64, elapsed time.Duration) Progress {
+	p := Progress{Done: done, Total: total}
+	if total <= 0 {
+		return p
+	}
+	p.Percent = float64(done) * 100 / float64(total)
+	if done > 0 && done < total {
+		p.ETA = (time.Duration(float64(elapsed) / float64(done) * float64(total-done))).Round(time.Second).String()
+	}
+	return p
+}
+
+//streamProgress sends the progress returned by next as server-sent events
+//until it is finished or the client leaves. The last event is "done", or
+//"error" when the operation failed.
+func streamProgress(w http.ResponseWriter, r *http.Request, next func() (Progress, error)) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		p, err := next()
+		if err != nil {
+			logger.ErrorContext(r.Context(), "error getting progress", "error", err)
+			p = Progress{Error: err.Error(), Finished: true}
+		}
+		event := "progress"
+		if p.Finished {
+			event = "done"
+			if len(p.Error) != 0 {
+				event = "error"
+			}
+		}
+		b, _ := json.Marshal(p)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+		f.Flush()
+		if p.Finished {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//exportProgressHandler follows an export by the request id it was sent with
+//(X-Request-ID) as server-sent events.
+func exportProgressHandler(w http.ResponseWriter, r *http.Request) {
+	jobsMu.Lock()
+	j, ok := jobs[mux.Vars(r)["id"]]
+	jobsMu.Unlock()
+	if !ok {
+		http.Error(w, "unknown export", http.StatusNotFound)
+		return
+	}
+	if !checkAccess(w, r, opSearch, j.index) {
+		return
+	}
+	streamProgress(w, r, func() (Progress, error) {
+		return j.progress(), nil
+	})
+}
+
+//reindexTask is the part of the task API response progress is read from.
+type reindexTask struct {
+	Completed bool `json:"completed"`
+	Task      struct {
+		Status struct {
+			Total            int64 `json:"total"`
+			Created          int64 `json:"created"`
+			Updated          int64 `json:"updated"`
+			Deleted          int64 `json:"deleted"`
+			Noops            int64 `json:"noops"`
+			VersionConflicts int64 `json:"version_conflicts"`
+		} `json:"status"`
+		RunningTimeInNanos int64 `json:"running_time_in_nanos"`
+	} `json:"task"`
+	Error    *ErrorCause `json:"error"`
+	Response struct {
+		Failures []json.RawMessage `json:"failures"`
+	} `json:"response"`
+}
+
+//reindexProgressHandler follows a reindex (or update/delete by query) task
+//of the cluster as server-sent events, polling the task API.
+func reindexProgressHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	path := "/_tasks/" + mux.Vars(r)["task"]
+	streamProgress(w, r, func() (Progress, error) {
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, path, nil)
+		if err != nil {
+			return Progress{}, err
+		}
+		res, err := es.Perform(req)
+		if err != nil {
+			return Progress{}, err
+		}
+		var task reindexTask
+		if err := decodeAdminResponse(res.StatusCode >= http.StatusMultipleChoices, res.Status, res.Body, &task); err != nil {
+			return Progress{}, err
+		}
+		s := task.Task.Status
+		done := s.Created + s.Updated + s.Deleted + s.Noops + s.VersionConflicts
+		p := newProgress(done, s.Total, time.Duration(task.Task.RunningTimeInNanos))
+		p.Finished = task.Completed
+		switch {
+		case task.Error != nil:
+			p.Error = task.Error.Reason
+		case len(task.Response.Failures) != 0:
+			p.Error = fmt.Sprintf("%d documents failed", len(task.Response.Failures))
+		}
+		return p, nil
+	})
+}
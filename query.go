@@ -0,0 +1,39 @@
+package main
+
+//searchBody returns the elastic query of a request as a JSON object so that
+//the gateway can add clauses to it. ok is false when the caller sent something
+//other than an object, in which case it is forwarded untouched.
+func searchBody(q interface{}) (body map[string]interface{}, ok bool) {
+	if q == nil {
+		return map[string]interface{}{}, true
+	}
+	body, ok = q.(map[string]interface{})
+	return body, ok
+}
+
+//addClause wraps the query of body into a bool query and appends clause to
+//its occur section (filter, must_not, should...). The caller's own query is
+//kept as the must clause so scoring is unaffected.
+func addClause(body map[string]interface{}, occur string, clause interface{}) {
+	boolQuery := map[string]interface{}{}
+	if inner, ok := body["query"]; ok {
+		boolQuery["must"] = []interface{}{inner}
+	}
+	list, _ := boolQuery[occur].([]interface{})
+	boolQuery[occur] = append(list, clause)
+	body["query"] = map[string]interface{}{"bool": boolQuery}
+}
+
+//wrapFunctionScore wraps the query of body into a function_score query with
+//the given parameters (functions, score_mode, boost_mode...).
+func wrapFunctionScore(body map[string]interface{}, params map[string]interface{}) {
+	inner, ok := body["query"]
+	if !ok {
+		inner = map[string]interface{}{"match_all": map[string]interface{}{}}
+	}
+	fs := map[string]interface{}{"query": inner}
+	for k, v := range params {
+		fs[k] = v
+	}
+	body["query"] = map[string]interface{}{"function_score": fs}
+}
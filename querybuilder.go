@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+//Filter is one condition of the simplified filter API, for callers who do not
+//know the query DSL:
+//
+//	{"field": "status", "op": "eq", "value": "active"}
+//	{"field": "age", "op": "between", "value": [18, 65]}
+//	{"field": "title", "op": "match", "value": "running shoes"}
+//
+//All filters of a request must hold. Only match contributes to the score.
+type Filter struct {
+	Field string      `json:"field"`
+	Op    string      `json:"op"`
+	Value interface{} `json:"value"`
+}
+
+var rangeOps = map[string]string{"gt": "gt", "gte": "gte", "lt": "lt", "lte": "lte"}
+
+//compileFilters turns the filters into a bool query. Errors name the offending
+//filter by its position.
+func compileFilters(filters []Filter) (map[string]interface{}, error) {
+	must, filter, mustNot := []interface{}{}, []interface{}{}, []interface{}{}
+	for i, f := range filters {
+		if len(f.Field) == 0 {
+			return nil, filterError(i, "field is required")
+		}
+		switch f.Op {
+		case "eq", "":
+			filter = append(filter, leaf("term", f.Field, f.Value))
+		case "ne":
+			mustNot = append(mustNot, leaf("term", f.Field, f.Value))
+		case "in", "not_in":
+			values, ok := f.Value.([]interface{})
+			if !ok {
+				return nil, filterError(i, f.Op+" needs an array value")
+			}
+			if f.Op == "in" {
+				filter = append(filter, leaf("terms", f.Field, values))
+			} else {
+				mustNot = append(mustNot, leaf("terms", f.Field, values))
+			}
+		case "gt", "gte", "lt", "lte":
+			filter = append(filter, leaf("range", f.Field, map[string]interface{}{rangeOps[f.Op]: f.Value}))
+		case "between":
+			bounds, ok := f.Value.([]interface{})
+			if !ok || len(bounds) != 2 {
+				return nil, filterError(i, "between needs a [from, to] value")
+			}
+			r := map[string]interface{}{}
+			if bounds[0] != nil {
+				r["gte"] = bounds[0]
+			}
+			if bounds[1] != nil {
+				r["lte"] = bounds[1]
+			}
+			filter = append(filter, leaf("range", f.Field, r))
+		case "match":
+			must = append(must, leaf("match", f.Field, f.Value))
+		case "prefix":
+			filter = append(filter, leaf("prefix", f.Field, f.Value))
+		case "exists":
+			clause := map[string]interface{}{"exists": map[string]interface{}{"field": f.Field}}
+			if f.Value == false {
+				mustNot = append(mustNot, clause)
+			} else {
+				filter = append(filter, clause)
+			}
+		default:
+			return nil, filterError(i, "unknown op "+strconv.Quote(f.Op))
+		}
+	}
+	boolQuery := map[string]interface{}{}
+	if len(must) != 0 {
+		boolQuery["must"] = must
+	}
+	if len(filter) != 0 {
+		boolQuery["filter"] = filter
+	}
+	if len(mustNot) != 0 {
+		boolQuery["must_not"] = mustNot
+	}
+	return map[string]interface{}{"bool": boolQuery}, nil
+}
+
+func leaf(kind, field string, value interface{}) map[string]interface{} {
+	return map[string]interface{}{kind: map[string]interface{}{field: value}}
+}
+
+func filterError(i int, msg string) error {
+	return &ValidationError{Path: fmt.Sprintf("/filters/%d", i), Message: msg}
+}
+
+//withFilters merges the compiled filters into the elastic query of the request.
+func withFilters(q interface{}, filters []Filter) (interface{}, error) {
+	compiled, err := compileFilters(filters)
+	if err != nil {
+		return nil, err
+	}
+	body, ok := searchBody(q)
+	if !ok {
+		return nil, &ValidationError{Path: "/", Message: "elasticquery must be a JSON object when filters are used"}
+	}
+	if _, ok := body["query"]; !ok {
+		body["query"] = compiled
+		return body, nil
+	}
+	addClause(body, "must", compiled)
+	return body, nil
+}
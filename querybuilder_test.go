@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+//canonical re-encodes a JSON document so that documents differing only in
+//key order or spacing compare equal.
+func canonical(t *testing.T, s string) string {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("invalid JSON %s: %v", s, err)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func decodeFilters(t *testing.T, s string) []Filter {
+	t.Helper()
+	var filters []Filter
+	if err := json.Unmarshal([]byte(s), &filters); err != nil {
+		t.Fatalf("invalid filters %s: %v", s, err)
+	}
+	return filters
+}
+
+func TestCompileFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters string
+		want    string
+	}{
+		{"eq", `[{"field": "status", "op": "eq", "value": "active"}]`,
+			`{"bool": {"filter": [{"term": {"status": "active"}}]}}`},
+		{"eq by default", `[{"field": "status", "value": "active"}]`,
+			`{"bool": {"filter": [{"term": {"status": "active"}}]}}`},
+		{"ne", `[{"field": "status", "op": "ne", "value": "deleted"}]`,
+			`{"bool": {"must_not": [{"term": {"status": "deleted"}}]}}`},
+		{"in", `[{"field": "tags", "op": "in", "value": ["a", "b"]}]`,
+			`{"bool": {"filter": [{"terms": {"tags": ["a", "b"]}}]}}`},
+		{"not_in", `[{"field": "tags", "op": "not_in", "value": ["c"]}]`,
+			`{"bool": {"must_not": [{"terms": {"tags": ["c"]}}]}}`},
+		{"gte", `[{"field": "age", "op": "gte", "value": 18}]`,
+			`{"bool": {"filter": [{"range": {"age": {"gte": 18}}}]}}`},
+		{"lt", `[{"field": "price", "op": "lt", "value": 9.5}]`,
+			`{"bool": {"filter": [{"range": {"price": {"lt": 9.5}}}]}}`},
+		{"between", `[{"field": "age", "op": "between", "value": [18, 65]}]`,
+			`{"bool": {"filter": [{"range": {"age": {"gte": 18, "lte": 65}}}]}}`},
+		{"between open ended", `[{"field": "age", "op": "between", "value": [null, 65]}]`,
+			`{"bool": {"filter": [{"range": {"age": {"lte": 65}}}]}}`},
+		{"match", `[{"field": "title", "op": "match", "value": "running shoes"}]`,
+			`{"bool": {"must": [{"match": {"title": "running shoes"}}]}}`},
+		{"prefix", `[{"field": "sku", "op": "prefix", "value": "AB-"}]`,
+			`{"bool": {"filter": [{"prefix": {"sku": "AB-"}}]}}`},
+		{"exists", `[{"field": "email", "op": "exists"}]`,
+			`{"bool": {"filter": [{"exists": {"field": "email"}}]}}`},
+		{"missing", `[{"field": "email", "op": "exists", "value": false}]`,
+			`{"bool": {"must_not": [{"exists": {"field": "email"}}]}}`},
+		{"combined", `[{"field": "title", "op": "match", "value": "shoes"}, {"field": "status", "value": "active"}, {"field": "stock", "op": "gt", "value": 0}, {"field": "brand", "op": "ne", "value": "acme"}]`,
+			`{"bool": {
+				"must": [{"match": {"title": "shoes"}}],
+				"filter": [{"term": {"status": "active"}}, {"range": {"stock": {"gt": 0}}}],
+				"must_not": [{"term": {"brand": "acme"}}]}}`},
+		{"none", `[]`, `{"bool": {}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := compileFilters(decodeFilters(t, tt.filters))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			b, err := json.Marshal(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := canonical(t, tt.want); string(b) != want {
+				t.Errorf("got %s\nwant %s", b, want)
+			}
+		})
+	}
+}
+
+func TestCompileFiltersErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters string
+		path    string
+		message string
+	}{
+		{"unknown op", `[{"field": "status", "op": "like", "value": "a%"}]`, "/filters/0", `unknown op "like"`},
+		{"no field", `[{"field": "status", "value": 1}, {"op": "eq", "value": 1}]`, "/filters/1", "field is required"},
+		{"in without array", `[{"field": "tags", "op": "in", "value": "a"}]`, "/filters/0", "in needs an array value"},
+		{"not_in without array", `[{"field": "tags", "op": "not_in", "value": 3}]`, "/filters/0", "not_in needs an array value"},
+		{"between one bound", `[{"field": "age", "op": "between", "value": [18]}]`, "/filters/0", "between needs a [from, to] value"},
+		{"between not an array", `[{"field": "age", "op": "between", "value": 18}]`, "/filters/0", "between needs a [from, to] value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileFilters(decodeFilters(t, tt.filters))
+			v, ok := err.(*ValidationError)
+			if !ok {
+				t.Fatalf("got error %v, want a *ValidationError", err)
+			}
+			if v.Path != tt.path || v.Message != tt.message {
+				t.Errorf("got %s: %s, want %s: %s", v.Path, v.Message, tt.path, tt.message)
+			}
+		})
+	}
+}
+
+func TestWithFilters(t *testing.T) {
+	filters := decodeFilters(t, `[{"field": "status", "value": "active"}]`)
+	tests := []struct {
+		name  string
+		query interface{}
+		want  string
+	}{
+		{"no query", nil,
+			`{"query": {"bool": {"filter": [{"term": {"status": "active"}}]}}}`},
+		{"body without query", map[string]interface{}{"size": 5},
+			`{"size": 5, "query": {"bool": {"filter": [{"term": {"status": "active"}}]}}}`},
+		{"query kept as must", map[string]interface{}{"query": map[string]interface{}{"match_all": map[string]interface{}{}}},
+			`{"query": {"bool": {"must": [{"match_all": {}}, {"bool": {"filter": [{"term": {"status": "active"}}]}}]}}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := withFilters(tt.query, filters)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			b, err := json.Marshal(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := canonical(t, tt.want); string(b) != want {
+				t.Errorf("got %s\nwant %s", b, want)
+			}
+		})
+	}
+
+	if _, err := withFilters("match_all", filters); err == nil {
+		t.Error("a query that is not an object was accepted")
+	}
+	if _, err := withFilters(nil, decodeFilters(t, `[{"field": "a", "op": "nope"}]`)); err == nil {
+		t.Error("an unknown op was accepted")
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//RedisConfig locates the Redis server the instances of the gateway share the
+//response cache through. Prefix namespaces the keys so that several gateways
+//can use one server.
+type RedisConfig struct {
+	Addr     string   `json:"addr"`
+	Password string   `json:"password"`
+	DB       int      `json:"db"`
+	Prefix   string   `json:"prefix"`
+	PoolSize int      `json:"pool_size"`
+	Timeout  Duration `json:"timeout"`
+}
+
+//redisError is an error reply of the server. The connection stays usable.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+//redisClient runs commands over a pool of connections, speaking the RESP
+//protocol. Replies are nil, int64, string, []interface{} or a redisError.
+type redisClient struct {
+	config RedisConfig
+	conns  chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newRedisClient(c RedisConfig) *redisClient {
+	return &redisClient{config: c, conns: make(chan *redisConn, c.PoolSize)}
+}
+
+func (c *redisClient) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case cn := <-c.conns:
+		return cn, nil
+	default:
+	}
+	d := net.Dialer{Timeout: c.config.Timeout.Duration}
+	nc, err := d.DialContext(ctx, "tcp", c.config.Addr)
+	if err != nil {
+		return nil, err
+	}
+	cn := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	nc.SetDeadline(time.Now().Add(c.config.Timeout.Duration))
+	if len(c.config.Password) != 0 {
+		if _, err := cn.do("AUTH", c.config.Password); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	if c.config.DB != 0 {
+		if _, err := cn.do("SELECT", strconv.Itoa(c.config.DB)); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+//do runs a command within the timeout, or the deadline of ctx if sooner.
+func (c *redisClient) do(ctx context.Context, args ...string) (interface{}, error) {
+	cn, err := c.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(c.config.Timeout.Duration)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	cn.SetDeadline(deadline)
+	reply, err := cn.do(args...)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		//the connection may hold half a reply
+		cn.Close()
+		return nil, err
+	}
+	select {
+	case c.conns <- cn:
+	default:
+		cn.Close()
+	}
+	return reply, err
+}
+
+func (cn *redisConn) do(args ...string) (interface{}, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := cn.Write(b.Bytes()); err != nil {
+		return nil, err
+	}
+	return cn.read()
+}
+
+func (cn *redisConn) read() (interface{}, error) {
+	line, err := cn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(cn.r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = cn.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+//redisEntry is a cached response as stored in Redis.
+type redisEntry struct {
+	StatusCode int       `json:"status_code"`
+	Body       []byte    `json:"body"`
+	At         time.Time `json:"at"`
+	StoredAt   time.Time `json:"stored_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	popularity
+}
+
+//redisCache shares the response cache between the instances of the gateway,
+//with the TTLs of the memory cache. Entries are kept in Redis for MaxTTL
+//after they expire so they can be served stale while elastic search fails;
+//eviction is left to the maxmemory-policy of the server. Concurrent identical
+//searches and the statistics are per instance.
+type redisCache struct {
+	client   *redisClient
+	prefix   string
+	mu       sync.Mutex
+	inflight map[string]*flight
+	stats    CacheStats
+}
+
+func newRedisCache(c RedisConfig) *redisCache {
+	return &redisCache{client: newRedisClient(c), prefix: c.Prefix, inflight: map[string]*flight{}}
+}
+
+func (c *redisCache) load(ctx context.Context, key string) (*redisEntry, error) {
+	reply, err := c.client.do(ctx, "GET", c.prefix+key)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	s, ok := reply.(string)
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected reply to GET")
+	}
+	var e redisEntry
+	if err := json.Unmarshal([]byte(s), &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+//save writes the entry, "KEEPTTL" keeping the expiry of the key for updates
+//of the popularity of an entry.
+func (c *redisCache) save(ctx context.Context, key string, e *redisEntry, expiry ...string) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = c.client.do(ctx, append([]string{"SET", c.prefix + key, string(b)}, expiry...)...)
+	return err
+}
+
+func (c *redisCache) store(ctx context.Context, key string, e *redisEntry, result searchResult, now time.Time) {
+	if config.Cache.MaxBytes > 0 && int64(len(key)+len(result.Body)) > config.Cache.MaxBytes {
+		return
+	}
+	ttl := e.ttl()
+	e.StatusCode, e.Body, e.At = result.StatusCode, result.Body, result.At
+	e.StoredAt, e.ExpiresAt = now, now.Add(ttl)
+	keep := ttl + config.Cache.MaxTTL.Duration
+	if err := c.save(ctx, key, e, "PX", strconv.FormatInt(keep.Milliseconds(), 10)); err != nil {
+		logger.WarnContext(ctx, "unable to store response in redis", "error", err)
+	}
+}
+
+func (c *redisCache) count(stat *int64) {
+	c.mu.Lock()
+	*stat++
+	c.mu.Unlock()
+}
+
+func (c *redisCache) get(ctx context.Context, key string, fetch searchFunc, cc cacheControl) (searchResult, bool, error) {
+	now := time.Now()
+	e, err := c.load(ctx, key)
+	if err != nil {
+		//an unreachable cache only costs the hits
+		logger.WarnContext(ctx, "unable to read response from redis", "error", err)
+	}
+	if e != nil {
+		result := searchResult{StatusCode: e.StatusCode, Body: e.Body, At: e.At, Stale: !now.Before(e.ExpiresAt)}
+		if (!result.Stale || cc.stale) && cc.fresh(result, now) {
+			c.count(&c.stats.Hits)
+			e.touch(now)
+			if err := c.save(ctx, key, e, "KEEPTTL", "XX"); err != nil {
+				logger.WarnContext(ctx, "unable to update response in redis", "error", err)
+			}
+			ttl := e.ExpiresAt.Sub(e.StoredAt)
+			if e.Score >= config.Cache.HotScore && e.ExpiresAt.Sub(now) < time.Duration(float64(ttl)*config.Cache.RefreshAhead) {
+				c.refresh(detachedContext(ctx), key, e, fetch)
+			}
+			return result, true, nil
+		}
+	}
+	if cc.onlyIfCached {
+		c.count(&c.stats.Misses)
+		return searchResult{}, false, errNotCached
+	}
+	c.mu.Lock()
+	if f, ok := c.inflight[key]; ok && !cc.noCache {
+		c.stats.Hits++
+		c.mu.Unlock()
+		select {
+		case <-f.done:
+			return f.result, true, f.err
+		case <-ctx.Done():
+			return searchResult{}, false, ctx.Err()
+		}
+	}
+	c.stats.Misses++
+	f := &flight{done: make(chan struct{})}
+	c.inflight[key] = f
+	c.mu.Unlock()
+
+	result, err := fetch(ctx)
+	c.mu.Lock()
+	f.result, f.err = result, err
+	if c.inflight[key] == f {
+		delete(c.inflight, key)
+	}
+	close(f.done)
+	c.mu.Unlock()
+	if err != nil || result.IsError() {
+		return result, false, err
+	}
+	if e == nil {
+		e = &redisEntry{popularity: popularity{SeenAt: now}}
+	}
+	e.touch(now)
+	c.store(ctx, key, e, result, now)
+	return result, false, nil
+}
+
+//refresh runs the query of a hot entry again ahead of its expiry. A lock key
+//lets a single instance refresh it, in the context of the request that found
+//it hot.
+func (c *redisCache) refresh(ctx context.Context, key string, e *redisEntry, fetch searchFunc) {
+	lock := strconv.FormatInt(e.ExpiresAt.Sub(time.Now()).Milliseconds()+1, 10)
+	reply, err := c.client.do(ctx, "SET", c.prefix+"refresh:"+key, "1", "NX", "PX", lock)
+	if err != nil || reply == nil {
+		return
+	}
+	go func() {
+		result, err := fetch(ctx)
+		if err != nil || result.IsError() {
+			logger.Warn("cache refresh failed", "key", key, "error", err)
+			return
+		}
+		c.count(&c.stats.Refreshes)
+		c.store(ctx, key, e, result, time.Now())
+	}()
+}
+
+//snapshot returns the statistics of this instance. Entries and bytes are
+//left to the INFO of the Redis server.
+func (c *redisCache) snapshot() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	if total := s.Hits + s.Misses; total != 0 {
+		s.HitRatio = float64(s.Hits) / float64(total)
+	}
+	return s
+}
+
+//purge deletes the keys under the prefix.
+func (c *redisCache) purge(ctx context.Context) error {
+	cursor := "0"
+	for {
+		reply, err := c.client.do(ctx, "SCAN", cursor, "MATCH", c.prefix+"*", "COUNT", "1000")
+		if err != nil {
+			return err
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return fmt.Errorf("redis: unexpected reply to SCAN")
+		}
+		cursor, _ = page[0].(string)
+		keys, _ := page[1].([]interface{})
+		if len(keys) != 0 {
+			args := []string{"DEL"}
+			for _, k := range keys {
+				if s, ok := k.(string); ok {
+					args = append(args, s)
+				}
+			}
+			if _, err := c.client.do(ctx, args...); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" || len(cursor) == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+//RegionConfig tunes the routing of the tenants with clusters in several
+//regions. Every ProbeInterval each cluster is asked for its health, with
+//ProbeTimeout; the requests of a tenant go to its healthy cluster with the
+//lowest smoothed probe latency. The requests of one session, named by the
+//SessionHeader (the identity of the caller without one), stick to the
+//cluster first picked for StickyTTL after their last request, unless it turns
+//unhealthy, so a session reads its own writes.
+type RegionConfig struct {
+	ProbeInterval Duration `json:"probe_interval"`
+	ProbeTimeout  Duration `json:"probe_timeout"`
+	SessionHeader string   `json:"session_header"`
+	StickyTTL     Duration `json:"sticky_ttl"`
+}
+
+//RegionStatus is what the probes know of a cluster.
+type RegionStatus struct {
+	Cluster   string    `json:"cluster"`
+	Healthy   bool      `json:"healthy"`
+	LatencyMS float64   `json:"latency_ms"`
+	Probed    time.Time `json:"probed"`
+	Error     string    `json:"error,omitempty"`
+}
+
+//regionSmoothing is the weight of the last probe in the smoothed latency.
+const regionSmoothing = 0.3
+
+type stickyRegion struct {
+	cluster string
+	at      time.Time
+}
+
+var (
+	regionsMu sync.Mutex
+	regions   = map[string]*RegionStatus{}
+	sticky    = map[string]stickyRegion{}
+)
+
+//regionClusters are the clusters of the tenants with regions.
+func regionClusters() []string {
+	seen := map[string]bool{}
+	var clusters []string
+	for _, t := range config.Tenancy.Tenants {
+		for _, c := range t.Regions {
+			if !seen[c] {
+				seen[c] = true
+				clusters = append(clusters, c)
+			}
+		}
+	}
+	sort.Strings(clusters)
+	return clusters
+}
+
+//probeRegions probes the clusters of the regions forever.
+func probeRegions() {
+	for {
+		var wg sync.WaitGroup
+		for _, name := range regionClusters() {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				probeRegion(name)
+			}(name)
+		}
+		wg.Wait()
+		regionsMu.Lock()
+		for key, s := range sticky {
+			if time.Since(s.at) > config.Tenancy.Regions.StickyTTL.Duration {
+				delete(sticky, key)
+			}
+		}
+		regionsMu.Unlock()
+		time.Sleep(config.Tenancy.Regions.ProbeInterval.Duration)
+	}
+}
+
+//probeRegion times a cluster health call. A red cluster, or one that does not
+//answer, is unhealthy.
+func probeRegion(name string) {
+	latency, err := regionLatency(name)
+	regionsMu.Lock()
+	defer regionsMu.Unlock()
+	s, ok := regions[name]
+	if !ok {
+		s = &RegionStatus{Cluster: name}
+		regions[name] = s
+	}
+	s.Probed = time.Now()
+	if err != nil {
+		if s.Healthy {
+			logger.Warn("region unhealthy", "cluster", name, "error", err)
+		}
+		s.Healthy, s.Error = false, err.Error()
+		return
+	}
+	ms := float64(latency.Microseconds()) / 1000
+	if s.Healthy {
+		ms = regionSmoothing*ms + (1-regionSmoothing)*s.LatencyMS
+	}
+	s.Healthy, s.Error, s.LatencyMS = true, "", ms
+}
+
+func regionLatency(name string) (time.Duration, error) {
+	cluster, ok := config.Environments[name]
+	if !ok {
+		return 0, fmt.Errorf("cluster %q is not configured", name)
+	}
+	es, err := clusterClient(cluster)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.Tenancy.Regions.ProbeTimeout.Duration)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/_cluster/health", nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	res, err := es.Perform(req)
+	if err != nil {
+		return 0, err
+	}
+	var health struct {
+		Status string `json:"status"`
+	}
+	if err := decodeAdminResponse(res.StatusCode >= http.StatusMultipleChoices, res.Status, res.Body, &health); err != nil {
+		return 0, err
+	}
+	latency := time.Since(start)
+	if health.Status == "red" {
+		return 0, fmt.Errorf("cluster health is red")
+	}
+	return latency, nil
+}
+
+//regionCluster picks the cluster of the tenant for a call: the cluster its
+//session sticks to while healthy, else the fastest healthy one. Before the
+//first probes, or when no region is healthy, the first region is used.
+func (t *Tenant) regionCluster() string {
+	key := t.Name + "\x00" + t.session
+	regionsMu.Lock()
+	defer regionsMu.Unlock()
+	if s, ok := sticky[key]; ok && len(t.session) != 0 {
+		if r := regions[s.cluster]; r == nil || r.Healthy {
+			sticky[key] = stickyRegion{cluster: s.cluster, at: time.Now()}
+			return s.cluster
+		}
+	}
+	best := ""
+	for _, name := range t.Regions {
+		r := regions[name]
+		if r != nil && r.Healthy && (len(best) == 0 || r.LatencyMS < regions[best].LatencyMS) {
+			best = name
+		}
+	}
+	if len(best) == 0 {
+		best = t.Regions[0]
+	}
+	if len(t.session) != 0 {
+		sticky[key] = stickyRegion{cluster: best, at: time.Now()}
+	}
+	return best
+}
+
+//regionsHandler shows the probed state of the clusters of the regions.
+func regionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	regionsMu.Lock()
+	list := []RegionStatus{}
+	for _, name := range regionClusters() {
+		s := RegionStatus{Cluster: name}
+		if probed, ok := regions[name]; ok {
+			s = *probed
+		}
+		list = append(list, s)
+	}
+	sessions := len(sticky)
+	regionsMu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"regions": list, "sticky_sessions": sessions})
+}
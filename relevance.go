@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+//termVectorsHandler returns the terms of the fields of a document as they
+//were analyzed, with their frequencies and, with term_statistics=true, their
+//document frequencies. A POST body can select fields or analyze an
+//artificial document, as with _termvectors.
+func termVectorsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !checkAccess(w, r, opSearch, []string{vars["index"]}) {
+		return
+	}
+	path := "/" + url.PathEscape(vars["index"]) + "/_termvectors/" + url.PathEscape(vars["id"])
+	query := forwardParams(r, "fields", "field_statistics", "term_statistics", "offsets", "positions", "payloads", "routing")
+	if r.Method == http.MethodPost {
+		passthrough(w, r, http.MethodPost, path, query, r.Body)
+		return
+	}
+	passthrough(w, r, http.MethodGet, path, query, nil)
+}
+
+//ExplainRequest is the query to explain the score of a document for, in the
+//query DSL or as simplified filters.
+type ExplainRequest struct {
+	Query   interface{} `json:"query"`
+	Filters []Filter    `json:"filters"`
+}
+
+//Explanation is a node of the score explanation tree of elastic search.
+type Explanation struct {
+	Value       float64       `json:"value"`
+	Description string        `json:"description"`
+	Details     []Explanation `json:"details,omitempty"`
+}
+
+//ExplainResponse is the explanation of a document score, with Breakdown
+//rendering the tree one indented line per node.
+type ExplainResponse struct {
+	Index       string       `json:"index"`
+	ID          string       `json:"id"`
+	Matched     bool         `json:"matched"`
+	Score       float64      `json:"score"`
+	Breakdown   []string     `json:"breakdown"`
+	Explanation *Explanation `json:"explanation,omitempty"`
+}
+
+//breakdown renders the explanation tree, children indented under their parent.
+func (e *Explanation) breakdown(depth int, lines []string) []string {
+	lines = append(lines, fmt.Sprintf("%s%.4g = %s", strings.Repeat("  ", depth), e.Value, e.Description))
+	for i := range e.Details {
+		lines = e.Details[i].breakdown(depth+1, lines)
+	}
+	return lines
+}
+
+//explainHandler tells why a document matched the query or not, and how its
+//score was computed. format=text answers the breakdown as plain text.
+func explainHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !checkAccess(w, r, opSearch, []string{vars["index"]}) {
+		return
+	}
+	var body ExplainRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var q interface{} = map[string]interface{}{}
+	if body.Query != nil {
+		q = map[string]interface{}{"query": body.Query}
+	}
+	if len(body.Filters) != 0 {
+		var err error
+		if q, err = withFilters(q, body.Filters); err != nil {
+			writeValidationError(w, err)
+			return
+		}
+	}
+	search, _ := searchBody(q)
+	if _, ok := search["query"]; !ok {
+		writeValidationError(w, &ValidationError{Path: "/query", Message: "query or filters is required"})
+		return
+	}
+	b, err := json.Marshal(map[string]interface{}{"query": search["query"]})
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error encoding explain query", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	path := "/" + url.PathEscape(vars["index"]) + "/_explain/" + url.PathEscape(vars["id"])
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, path, bytes.NewReader(b))
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error creating explain request", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := es.Perform(req)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error getting response from elastic search cluster", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	var result struct {
+		Index       string       `json:"_index"`
+		ID          string       `json:"_id"`
+		Matched     bool         `json:"matched"`
+		Explanation *Explanation `json:"explanation"`
+	}
+	//a missing document is answered 404 with matched false
+	if err := decodeAdminResponse(res.StatusCode >= http.StatusMultipleChoices && res.StatusCode != http.StatusNotFound, res.Status, res.Body, &result); err != nil {
+		logger.ErrorContext(r.Context(), "error explaining document score", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if res.StatusCode == http.StatusNotFound && len(result.ID) == 0 {
+		http.Error(w, "document "+vars["id"]+" not found in "+vars["index"], http.StatusNotFound)
+		return
+	}
+	explained := ExplainResponse{Index: result.Index, ID: result.ID, Matched: result.Matched, Breakdown: []string{}, Explanation: result.Explanation}
+	if result.Explanation != nil {
+		explained.Score = result.Explanation.Value
+		explained.Breakdown = result.Explanation.breakdown(0, explained.Breakdown)
+	}
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "%s/%s matched: %t\n", explained.Index, explained.ID, explained.Matched)
+		for _, line := range explained.Breakdown {
+			fmt.Fprintln(w, line)
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, explained)
+}
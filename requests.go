@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//RequestTrackingConfig keeps the last Keep requests in memory with the calls
+//they made to elastic search, so that /elastic/requests/{id} can tell what a
+//request is doing. Their cluster tasks are found by the request ID, which is
+//sent as X-Opaque-Id. A request reusing the ID of a tracked one is tracked
+//under an ID of its own, answered in X-Request-ID.
+type RequestTrackingConfig struct {
+	Enabled bool `json:"enabled"`
+	Keep    int  `json:"keep"`
+}
+
+//Request states.
+const (
+	requestRunning   = "running"
+	requestCompleted = "completed"
+	requestCancelled = "cancelled"
+)
+
+//RequestStatus is what the gateway knows of a request: its own state, the
+//calls it made to elastic search and their tasks still running on the cluster.
+type RequestStatus struct {
+	ID         string         `json:"id"`
+	Method     string         `json:"method"`
+	Path       string         `json:"path"`
+	Actor      string         `json:"actor,omitempty"`
+	State      string         `json:"state"`
+	Status     int            `json:"status,omitempty"`
+	Started    time.Time      `json:"started"`
+	DurationMS float64        `json:"duration_ms"`
+	Calls      []UpstreamCall `json:"calls"`
+	Tasks      []RequestTask  `json:"tasks"`
+}
+
+//UpstreamCall is one call of a request to elastic search.
+type UpstreamCall struct {
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Started    time.Time `json:"started"`
+	DurationMS float64   `json:"duration_ms"`
+	Done       bool      `json:"done"`
+}
+
+//RequestTask is a cluster task started on behalf of a request.
+type RequestTask struct {
+	ID            string  `json:"id"`
+	Parent        string  `json:"parent,omitempty"`
+	Action        string  `json:"action"`
+	Description   string  `json:"description,omitempty"`
+	RunningTimeMS float64 `json:"running_time_ms"`
+	Cancellable   bool    `json:"cancellable"`
+	Cancelled     bool    `json:"cancelled"`
+}
+
+//tracked are the requests being or recently served, guarded by trackedMu,
+//trackedOrder the order they arrived in.
+var (
+	trackedMu    sync.Mutex
+	tracked      = map[string]*RequestStatus{}
+	trackedOrder []string
+)
+
+//trackRequest tracks t, unless a request with its ID is tracked already.
+func trackRequest(t *RequestStatus) bool {
+	trackedMu.Lock()
+	defer trackedMu.Unlock()
+	if _, ok := tracked[t.ID]; ok {
+		return false
+	}
+	trackedOrder = append(trackedOrder, t.ID)
+	tracked[t.ID] = t
+	for len(trackedOrder) > config.RequestTracking.Keep {
+		delete(tracked, trackedOrder[0])
+		trackedOrder = trackedOrder[1:]
+	}
+	return true
+}
+
+func trackedFrom(ctx context.Context) *RequestStatus {
+	t, _ := ctx.Value(trackedKey).(*RequestStatus)
+	return t
+}
+
+//RequestTrackingMid records the request and its outcome.
+func RequestTrackingMid(app http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := &RequestStatus{
+			ID:      requestID(r.Context()),
+			Method:  r.Method,
+			Path:    r.URL.Path,
+			State:   requestRunning,
+			Started: time.Now(),
+			Calls:   []UpstreamCall{},
+		}
+		ctx := context.WithValue(r.Context(), trackedKey, t)
+		for !trackRequest(t) {
+			//the ID is the caller's own X-Request-ID, already taken
+			t.ID = newRequestID()
+		}
+		if t.ID != requestID(ctx) {
+			w.Header().Set("X-Request-ID", t.ID)
+			ctx = context.WithValue(ctx, requestIDKey, t.ID)
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			trackedMu.Lock()
+			t.State, t.Status = requestCompleted, sw.status
+			if ctx.Err() != nil {
+				t.State = requestCancelled
+			}
+			t.DurationMS = float64(time.Since(t.Started).Microseconds()) / 1000
+			trackedMu.Unlock()
+		}()
+		app.ServeHTTP(sw, r.WithContext(ctx))
+	})
+}
+
+//trackingTransport records the calls to elastic search of the tracked request
+//of the context.
+type trackingTransport struct {
+	base http.RoundTripper
+}
+
+func (t trackingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tr := trackedFrom(req.Context())
+	if tr == nil {
+		return t.base.RoundTrip(req)
+	}
+	start := time.Now()
+	trackedMu.Lock()
+	//the identity is known once the auth middleware ran, after the tracking one
+	if id := identityFrom(req.Context()); id != nil {
+		tr.Actor = id.Name
+	}
+	tr.Calls = append(tr.Calls, UpstreamCall{Method: req.Method, Path: req.URL.Path, Started: start})
+	i := len(tr.Calls) - 1
+	trackedMu.Unlock()
+	res, err := t.base.RoundTrip(req)
+	trackedMu.Lock()
+	call := &tr.Calls[i]
+	call.Done, call.DurationMS = true, float64(time.Since(start).Microseconds())/1000
+	if err != nil {
+		call.Error = err.Error()
+	} else {
+		call.Status = res.StatusCode
+	}
+	trackedMu.Unlock()
+	return res, err
+}
+
+//requestTasks lists the cluster tasks started with the request ID as their
+//X-Opaque-Id, child tasks included. With an owner, only the tasks of the
+//request of that caller are listed.
+func requestTasks(ctx context.Context, id, owner string) ([]RequestTask, error) {
+	es, err := defaultClient()
+	if err != nil {
+		return nil, err
+	}
+	u := &url.URL{Path: "/_tasks", RawQuery: "detailed=true&group_by=none"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := es.Perform(req)
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		Tasks []struct {
+			Node         string            `json:"node"`
+			ID           int64             `json:"id"`
+			Action       string            `json:"action"`
+			Description  string            `json:"description"`
+			RunningNanos int64             `json:"running_time_in_nanos"`
+			Cancellable  bool              `json:"cancellable"`
+			Cancelled    bool              `json:"cancelled"`
+			Parent       string            `json:"parent_task_id"`
+			Headers      map[string]string `json:"headers"`
+		} `json:"tasks"`
+	}
+	if err := decodeAdminResponse(res.StatusCode >= http.StatusMultipleChoices, res.Status, res.Body, &list); err != nil {
+		return nil, err
+	}
+	tasks := []RequestTask{}
+	for _, t := range list.Tasks {
+		opaque := t.Headers["X-Opaque-Id"]
+		if len(owner) != 0 && opaque != id+"/"+owner {
+			continue
+		}
+		if opaque != id && !strings.HasPrefix(opaque, id+"/") {
+			continue
+		}
+		tasks = append(tasks, RequestTask{
+			ID:            t.Node + ":" + strconv.FormatInt(t.ID, 10),
+			Parent:        t.Parent,
+			Action:        t.Action,
+			Description:   t.Description,
+			RunningTimeMS: float64(t.RunningNanos) / 1e6,
+			Cancellable:   t.Cancellable,
+			Cancelled:     t.Cancelled,
+		})
+	}
+	return tasks, nil
+}
+
+//requestStatusHandler shows a request with its calls to elastic search and
+//their live cluster tasks. Callers see their own requests, admins all of them.
+func requestStatusHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	trackedMu.Lock()
+	t, ok := tracked[id]
+	var status RequestStatus
+	if ok {
+		status = *t
+		status.Calls = append([]UpstreamCall{}, t.Calls...)
+	}
+	trackedMu.Unlock()
+	own := ok && len(status.Actor) != 0 && status.Actor == actor(r)
+	owner := ""
+	if own && authorize(r, opAdmin, nil) != nil {
+		owner = status.Actor
+	}
+	if !own && !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	tasks, err := requestTasks(r.Context(), id, owner)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to list cluster tasks", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	switch {
+	case !ok && len(tasks) == 0:
+		http.Error(w, "unknown request "+id, http.StatusNotFound)
+		return
+	case !ok:
+		//served by another instance, or forgotten already
+		status = RequestStatus{ID: id, State: requestRunning, Calls: []UpstreamCall{}}
+	case status.State == requestRunning:
+		status.DurationMS = float64(time.Since(status.Started).Microseconds()) / 1000
+	}
+	status.Tasks = tasks
+	writeJSON(w, http.StatusOK, status)
+}
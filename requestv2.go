@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//RequestBodyV2 is the body of /v2/elastic: the search of /elastic with typed
+//fields instead of comma joined strings. Unknown fields are refused, so
+//typos do not go unnoticed. Responses follow the v2 schema unless the
+//caller pins v1.
+//
+//	{"index": ["orders", "orders-archive"], "query": {"query": {"match_all": {}}},
+//	 "sort": ["created:desc", "id"], "pagination": {"from": 20, "size": 10},
+//	 "source": {"includes": ["id", "customer.*"]}, "highlight": {"fields": ["title"]}}
+type RequestBodyV2 struct {
+	Cluster    *ClusterV2    `json:"cluster"`
+	Index      []string      `json:"index"`
+	Query      interface{}   `json:"query"`
+	Sort       []string      `json:"sort"`
+	Pagination *PaginationV2 `json:"pagination"`
+	Source     *SourceV2     `json:"source"`
+	Highlight  *Highlight    `json:"highlight"`
+	Filters    []Filter      `json:"filters"`
+	Where      string        `json:"where"`
+	Text       string        `json:"text"`
+	Language   string        `json:"language"`
+	Normalize  bool          `json:"normalize"`
+	PIT        string        `json:"pit"`
+	NoCache    bool          `json:"no_cache"`
+	//LatencyBudget ("250ms") lets elastic search cut the search short to answer in time
+	LatencyBudget Duration `json:"latency_budget"`
+}
+
+//ClusterV2 points the search at another cluster than the default one.
+type ClusterV2 struct {
+	Addresses []string `json:"addresses"`
+	Username  string   `json:"username"`
+	Password  string   `json:"password"`
+}
+
+//PaginationV2 selects the page of hits. Session and AutoPIT check that the
+//pages stay consistent, as pagination does on /elastic.
+type PaginationV2 struct {
+	From    int    `json:"from"`
+	Size    int    `json:"size"`
+	Session string `json:"session"`
+	AutoPIT bool   `json:"auto_pit"`
+}
+
+//SourceV2 filters the _source of the hits by field patterns.
+type SourceV2 struct {
+	Includes []string `json:"includes"`
+	Excludes []string `json:"excludes"`
+}
+
+//checkList refuses empty entries and entries holding commas, which the v1
+//body they are joined into would split.
+func checkList(path string, list []string) error {
+	for i, s := range list {
+		if len(strings.TrimSpace(s)) == 0 || strings.Contains(s, ",") {
+			return &ValidationError{Path: path + "/" + strconv.Itoa(i), Message: "must be a name without commas"}
+		}
+	}
+	return nil
+}
+
+//toV1 checks the body and converts it to the body of /elastic.
+func (b RequestBodyV2) toV1() (RequestBody, error) {
+	v1 := RequestBody{
+		ElasticQuery:  b.Query,
+		Highlight:     b.Highlight,
+		Filters:       b.Filters,
+		Where:         b.Where,
+		Text:          b.Text,
+		Language:      b.Language,
+		Normalize:     b.Normalize,
+		PIT:           b.PIT,
+		NoCache:       b.NoCache,
+		LatencyBudget: b.LatencyBudget,
+	}
+	if err := checkList("/index", b.Index); err != nil {
+		return v1, err
+	}
+	v1.Index = StringList(strings.Join(b.Index, ","))
+	for i, s := range b.Sort {
+		field, order, _ := strings.Cut(s, ":")
+		if len(field) == 0 || strings.Contains(s, ",") || (order != "" && order != "asc" && order != "desc") {
+			return v1, &ValidationError{Path: "/sort/" + strconv.Itoa(i), Message: "must be field, field:asc or field:desc"}
+		}
+	}
+	v1.Sort = StringList(strings.Join(b.Sort, ","))
+	if c := b.Cluster; c != nil {
+		if len(c.Addresses) == 0 {
+			return v1, &ValidationError{Path: "/cluster/addresses", Message: "is required"}
+		}
+		if err := checkList("/cluster/addresses", c.Addresses); err != nil {
+			return v1, err
+		}
+		v1.Addresses, v1.Username, v1.Password = StringList(strings.Join(c.Addresses, ",")), c.Username, c.Password
+	}
+	if p := b.Pagination; p != nil {
+		if p.From < 0 {
+			return v1, &ValidationError{Path: "/pagination/from", Message: "must not be negative"}
+		}
+		if p.Size < 0 {
+			return v1, &ValidationError{Path: "/pagination/size", Message: "must not be negative"}
+		}
+		v1.From, v1.Size = p.From, p.Size
+		if len(p.Session) != 0 || p.AutoPIT {
+			v1.Pagination = &PageGuard{Session: p.Session, AutoPIT: p.AutoPIT}
+		}
+	}
+	if s := b.Source; s != nil {
+		if err := checkList("/source/includes", s.Includes); err != nil {
+			return v1, err
+		}
+		if err := checkList("/source/excludes", s.Excludes); err != nil {
+			return v1, err
+		}
+		v1.SourceIncludes, v1.SourceExcludes = strings.Join(s.Includes, ","), strings.Join(s.Excludes, ",")
+	}
+	return v1, nil
+}
+
+//searchV2Handler runs a v2 search through the search of /elastic, so both
+//versions behave alike but for the shape of their bodies.
+func searchV2Handler(w http.ResponseWriter, r *http.Request) {
+	var body RequestBodyV2
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	v1, err := body.toV1()
+	if err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	if len(r.Header.Get("X-Response-Schema")) == 0 {
+		r.Header.Set("X-Response-Schema", schemaV2)
+	}
+	runSearch(w, r, v1)
+}
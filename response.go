@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+//SearchResponse is a search response of elastic search. Sections the gateway
+//does not model (suggest, profile, pit_id...) are kept in Other and written
+//back unchanged, so decoding into it never loses anything.
+type SearchResponse struct {
+	Took         int64                      `json:"took"`
+	TimedOut     bool                       `json:"timed_out"`
+	Shards       *ShardStats                `json:"_shards,omitempty"`
+	Hits         Hits                       `json:"hits"`
+	Aggregations map[string]json.RawMessage `json:"aggregations,omitempty"`
+	//Meta is the gateway's own section, see responseMeta
+	Meta  map[string]interface{}     `json:"meta,omitempty"`
+	Other map[string]json.RawMessage `json:"-"`
+}
+
+//ShardStats tells how many shards answered a search.
+type ShardStats struct {
+	Total      int               `json:"total"`
+	Successful int               `json:"successful"`
+	Skipped    int               `json:"skipped"`
+	Failed     int               `json:"failed"`
+	Failures   []json.RawMessage `json:"failures,omitempty"`
+}
+
+//Hits is the hits section of a search response.
+type Hits struct {
+	Total    *Total   `json:"total,omitempty"`
+	MaxScore *float64 `json:"max_score"`
+	Hits     []Hit    `json:"hits"`
+}
+
+//Total is the number of matching documents, exact when Relation is "eq".
+type Total struct {
+	Value    int64  `json:"value"`
+	Relation string `json:"relation"`
+}
+
+//Hit is one returned document. Other keeps the less common keys (_version,
+//inner_hits, _explanation...).
+type Hit struct {
+	Index     string                     `json:"_index"`
+	ID        string                     `json:"_id"`
+	Score     *float64                   `json:"_score"`
+	Source    map[string]interface{}     `json:"_source,omitempty"`
+	Highlight map[string][]string        `json:"highlight,omitempty"`
+	Sort      []interface{}              `json:"sort,omitempty"`
+	Fields    map[string]interface{}     `json:"fields,omitempty"`
+	Other     map[string]json.RawMessage `json:"-"`
+}
+
+//ErrorResponse is the body elastic search answers with on errors.
+type ErrorResponse struct {
+	Status int        `json:"status"`
+	Error  ErrorCause `json:"error"`
+}
+
+//ErrorCause describes an elastic search error. Some errors are a bare
+//string, which ends up in Reason.
+type ErrorCause struct {
+	Type      string       `json:"type"`
+	Reason    string       `json:"reason"`
+	RootCause []ErrorCause `json:"root_cause,omitempty"`
+}
+
+//UnmarshalJSON accepts both the object and the string form of an error.
+func (e *ErrorCause) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &e.Reason); err == nil {
+		return nil
+	}
+	type plain ErrorCause
+	return json.Unmarshal(b, (*plain)(e))
+}
+
+//UnmarshalJSON decodes the modelled sections and keeps the others.
+func (s *SearchResponse) UnmarshalJSON(b []byte) error {
+	type plain SearchResponse
+	if err := json.Unmarshal(b, (*plain)(s)); err != nil {
+		return err
+	}
+	other, err := otherKeys(b, s)
+	s.Other = other
+	return err
+}
+
+//MarshalJSON writes the modelled sections along with the kept ones.
+func (s SearchResponse) MarshalJSON() ([]byte, error) {
+	type plain SearchResponse
+	return withOtherKeys(plain(s), s.Other)
+}
+
+//UnmarshalJSON decodes the modelled keys of a hit and keeps the others.
+func (h *Hit) UnmarshalJSON(b []byte) error {
+	type plain Hit
+	if err := json.Unmarshal(b, (*plain)(h)); err != nil {
+		return err
+	}
+	other, err := otherKeys(b, h)
+	h.Other = other
+	return err
+}
+
+//MarshalJSON writes the modelled keys of a hit along with the kept ones.
+func (h Hit) MarshalJSON() ([]byte, error) {
+	type plain Hit
+	return withOtherKeys(plain(h), h.Other)
+}
+
+//otherKeys returns the keys of the JSON object b that the struct v points to
+//has no field for.
+func otherKeys(b []byte, v interface{}) (map[string]json.RawMessage, error) {
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+	t := reflect.TypeOf(v).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		delete(all, name)
+	}
+	if len(all) == 0 {
+		return nil, nil
+	}
+	return all, nil
+}
+
+func withOtherKeys(v interface{}, other map[string]json.RawMessage) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil || len(other) == 0 {
+		return b, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+	for k, raw := range other {
+		all[k] = raw
+	}
+	return json.Marshal(all)
+}
+
+//responseMeta returns the gateway's own "meta" section of a search response,
+//creating it on first use. Everything the gateway adds to a response goes there
+//so it never collides with what elastic search returned.
+func responseMeta(response *SearchResponse) map[string]interface{} {
+	if response.Meta == nil {
+		response.Meta = map[string]interface{}{}
+	}
+	return response.Meta
+}
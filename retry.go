@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//RetryConfig gives each class of routes a retry budget for the calls the
+//gateway makes to elastic search while serving one request. Routes maps
+//route templates ("/elastic", "/elastic/doc/{index}/{id}") to a class; the
+//"default" class covers the others. The budget is shared by all the calls
+//of the request, so retries cannot multiply across them. The elastic search
+//client itself does not retry.
+type RetryConfig struct {
+	Classes map[string]RetryBudget `json:"classes"`
+	Routes  map[string]string      `json:"routes"`
+}
+
+//RetryBudget caps the attempts of a request, first ones included, and the
+//latency retries may add to it. Backoff is the wait before the first retry,
+//doubled for each following one.
+type RetryBudget struct {
+	MaxAttempts     int      `json:"max_attempts"`
+	MaxAddedLatency Duration `json:"max_added_latency"`
+	Backoff         Duration `json:"backoff"`
+}
+
+//retryState is what is left of the budget of one request.
+type retryState struct {
+	mu       sync.Mutex
+	budget   RetryBudget
+	retries  int
+	deadline time.Time
+}
+
+//take uses one retry of the budget and returns the wait before it. ok is
+//false when the budget is spent or the wait would go past the added latency.
+func (s *retryState) take() (wait time.Duration, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.retries+1 >= s.budget.MaxAttempts {
+		return 0, false
+	}
+	wait = s.budget.Backoff.Duration << s.retries
+	if time.Now().Add(wait).After(s.deadline) {
+		return 0, false
+	}
+	s.retries++
+	return wait, true
+}
+
+func (c RetryConfig) enabled() bool {
+	return len(c.Classes) != 0
+}
+
+//RetryMid gives the request the retry budget of its route class. Callers
+//announcing a retry of their own with X-Retry-Attempt get no proxy retries,
+//so client and proxy retries do not multiply.
+func RetryMid(app http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		class, ok := config.Retry.Routes[routeTemplate(r)]
+		if !ok {
+			class = "default"
+		}
+		budget, ok := config.Retry.Classes[class]
+		if !ok {
+			app.ServeHTTP(w, r)
+			return
+		}
+		if n, _ := strconv.Atoi(r.Header.Get("X-Retry-Attempt")); n > 0 {
+			budget.MaxAttempts = 1
+		}
+		state := &retryState{budget: budget, deadline: time.Now().Add(budget.MaxAddedLatency.Duration)}
+		app.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), retryKey, state)))
+	})
+}
+
+//retryable tells whether a failed call may be sent again. Rejections (429,
+//503) were not processed and can always be retried; other failures only for
+//calls that are safe to repeat.
+func retryable(req *http.Request, res *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	if err == nil {
+		switch res.StatusCode {
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			return true
+		case http.StatusBadGateway, http.StatusGatewayTimeout:
+		default:
+			return false
+		}
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	for _, suffix := range []string{"/_search", "/_mget", "/_count", "/_msearch"} {
+		if strings.HasSuffix(req.URL.Path, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+//retryTransport retries failed calls to elastic search within the budget
+//of the request.
+type retryTransport struct {
+	base http.RoundTripper
+}
+
+func (t retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	state, _ := req.Context().Value(retryKey).(*retryState)
+	if state == nil || (req.Body != nil && req.GetBody == nil) {
+		return t.base.RoundTrip(req)
+	}
+	for {
+		res, err := t.base.RoundTrip(req)
+		if !retryable(req, res, err) {
+			return res, err
+		}
+		wait, ok := state.take()
+		if !ok {
+			return res, err
+		}
+		if res != nil {
+			res.Body.Close()
+		}
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		logger.WarnContext(req.Context(), "retrying elastic search call", "path", req.URL.Path, "error", err)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+//sampleQuery replaces the scoring of the query with a random score so the top
+//hits are a uniform random sample of the matching documents. A non zero seed
+//makes the sample reproducible.
+func sampleQuery(q interface{}, seed int64) interface{} {
+	body, ok := searchBody(q)
+	if !ok {
+		return q
+	}
+	inner, ok := body["query"]
+	if !ok {
+		inner = map[string]interface{}{"match_all": map[string]interface{}{}}
+	}
+	randomScore := map[string]interface{}{}
+	if seed != 0 {
+		randomScore["seed"] = seed
+		randomScore["field"] = "_seq_no"
+	}
+	body["query"] = map[string]interface{}{
+		"function_score": map[string]interface{}{
+			"query":        inner,
+			"random_score": randomScore,
+			"boost_mode":   "replace",
+		},
+	}
+	delete(body, "sort")
+	return body
+}
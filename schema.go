@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+//Response schemas clients can pin with the X-Response-Schema header or the
+//schema query parameter while they migrate. v1 is the elastic search
+//response passed through with the gateway meta section; v2 is typed, with
+//hits flattened and meta enriched with the request id and shard stats.
+const (
+	schemaV1 = "v1"
+	schemaV2 = "v2"
+)
+
+//ResponseV2 is the v2 search response.
+type ResponseV2 struct {
+	Took         int64                      `json:"took"`
+	TimedOut     bool                       `json:"timed_out"`
+	Total        *Total                     `json:"total,omitempty"`
+	MaxScore     *float64                   `json:"max_score"`
+	Hits         []HitV2                    `json:"hits"`
+	Aggregations map[string]json.RawMessage `json:"aggregations,omitempty"`
+	Meta         map[string]interface{}     `json:"meta"`
+}
+
+//HitV2 is a hit of the v2 response, with _source flattened into dotted keys.
+type HitV2 struct {
+	ID        string                 `json:"id"`
+	Index     string                 `json:"index"`
+	Score     *float64               `json:"score"`
+	Fields    map[string]interface{} `json:"fields"`
+	Highlight map[string][]string    `json:"highlight,omitempty"`
+	Sort      []interface{}          `json:"sort,omitempty"`
+}
+
+//responseSchema returns the schema the caller asked for, v1 by default.
+func responseSchema(r *http.Request) (string, error) {
+	schema := r.Header.Get("X-Response-Schema")
+	if s := r.URL.Query().Get("schema"); len(s) != 0 {
+		schema = s
+	}
+	switch schema {
+	case "", schemaV1:
+		return schemaV1, nil
+	case schemaV2:
+		return schemaV2, nil
+	}
+	return "", &ValidationError{Path: "/schema", Message: "response schema must be v1 or v2"}
+}
+
+//toV2 converts a search response to the v2 schema.
+func toV2(ctx context.Context, response *SearchResponse) ResponseV2 {
+	v2 := ResponseV2{
+		Took:         response.Took,
+		TimedOut:     response.TimedOut,
+		Total:        response.Hits.Total,
+		MaxScore:     response.Hits.MaxScore,
+		Hits:         make([]HitV2, 0, len(response.Hits.Hits)),
+		Aggregations: response.Aggregations,
+		Meta:         map[string]interface{}{"schema": schemaV2, "request_id": requestID(ctx)},
+	}
+	for k, v := range response.Meta {
+		v2.Meta[k] = v
+	}
+	if response.Shards != nil {
+		v2.Meta["shards"] = response.Shards
+	}
+	for _, h := range response.Hits.Hits {
+		hit := HitV2{ID: h.ID, Index: h.Index, Score: h.Score, Fields: map[string]interface{}{}, Highlight: h.Highlight, Sort: h.Sort}
+		flatten("", h.Source, hit.Fields)
+		v2.Hits = append(v2.Hits, hit)
+	}
+	return v2
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//ScoringConfig holds the named scoring profiles and the profile each route
+//uses when the request does not name one.
+type ScoringConfig struct {
+	Profiles map[string]ScoringProfile `json:"profiles"`
+	Routes   map[string]string         `json:"routes"`
+}
+
+//ScoringProfile is relevance tuning kept in the gateway instead of in every
+//client. FieldBoosts apply to the field lists of multi_match, query_string and
+//simple_query_string queries; Functions wrap the query in a function_score.
+type ScoringProfile struct {
+	FieldBoosts map[string]float64 `json:"field_boosts"`
+	Functions   []interface{}      `json:"functions"`
+	ScoreMode   string             `json:"score_mode"`
+	BoostMode   string             `json:"boost_mode"`
+	Rescore     interface{}        `json:"rescore"`
+}
+
+//scoringProfile returns the profile named in the request, or the default
+//profile of the route. ok is false when neither applies.
+func scoringProfile(name, route string) (p ScoringProfile, ok bool, err error) {
+	if len(name) == 0 {
+		name = config.Scoring.Routes[route]
+		if len(name) == 0 {
+			return p, false, nil
+		}
+	}
+	p, ok = config.Scoring.Profiles[name]
+	if !ok {
+		return p, false, fmt.Errorf("unknown scoring profile %q", name)
+	}
+	return p, true, nil
+}
+
+//apply rewrites the search body with the profile.
+func (p ScoringProfile) apply(q interface{}) interface{} {
+	body, ok := searchBody(q)
+	if !ok {
+		return q
+	}
+	if len(p.FieldBoosts) != 0 {
+		if query, ok := body["query"]; ok {
+			p.boostFields(query)
+		}
+	}
+	if len(p.Functions) != 0 {
+		params := map[string]interface{}{"functions": p.Functions}
+		if len(p.ScoreMode) != 0 {
+			params["score_mode"] = p.ScoreMode
+		}
+		if len(p.BoostMode) != 0 {
+			params["boost_mode"] = p.BoostMode
+		}
+		wrapFunctionScore(body, params)
+	}
+	if p.Rescore != nil {
+		body["rescore"] = p.Rescore
+	}
+	return body
+}
+
+//boostFields walks the query and sets the configured boost on every listed
+//field that has none yet.
+func (p ScoringProfile) boostFields(q interface{}) {
+	switch q := q.(type) {
+	case map[string]interface{}:
+		for name, v := range q {
+			switch name {
+			case "multi_match", "query_string", "simple_query_string":
+				params, _ := v.(map[string]interface{})
+				fields, _ := params["fields"].([]interface{})
+				for i, f := range fields {
+					s, ok := f.(string)
+					if !ok || strings.Contains(s, "^") {
+						continue
+					}
+					if boost, ok := p.FieldBoosts[s]; ok {
+						fields[i] = s + "^" + strconv.FormatFloat(boost, 'f', -1, 64)
+					}
+				}
+			default:
+				p.boostFields(v)
+			}
+		}
+	case []interface{}:
+		for _, v := range q {
+			p.boostFields(v)
+		}
+	}
+}
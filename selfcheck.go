@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+//selfCheckTimeout bounds each check that contacts another service.
+const selfCheckTimeout = 5 * time.Second
+
+//checkResult is one line of the self-check report. Remote checks contact the
+//cluster or another service; their failures may be transient.
+type checkResult struct {
+	Name   string
+	Remote bool
+	Err    error
+	Detail string
+}
+
+//selfCheck verifies the configuration: the syntax of rules and index
+//patterns, the TLS material and reachability of the configured services,
+//and that the cluster accepts the configured credentials.
+func selfCheck(ctx context.Context) []checkResult {
+	var results []checkResult
+	results = append(results, checkRules()...)
+	results = append(results, checkIndexPatterns()...)
+	results = append(results, checkAuth()...)
+	results = append(results, checkTenants()...)
+	results = append(results, checkCache(ctx)...)
+	results = append(results, checkStore(ctx)...)
+	results = append(results, checkCluster(ctx)...)
+	results = append(results, checkTLS(ctx)...)
+	return results
+}
+
+func checkRules() []checkResult {
+	var results []checkResult
+	for i, rule := range config.Authz.Rules {
+		name := fmt.Sprintf("authz rule %d", i)
+		var problems []string
+		if len(rule.Principals) == 0 {
+			problems = append(problems, "no principals")
+		}
+		if len(rule.Indices) == 0 {
+			problems = append(problems, "no indices")
+		}
+		if len(rule.Operations) == 0 {
+			problems = append(problems, "no operations")
+		}
+		for _, op := range rule.Operations {
+			if op != opSearch && op != opWrite && op != opAdmin {
+				problems = append(problems, fmt.Sprintf("unknown operation %q", op))
+			}
+		}
+		results = append(results, checkResult{Name: name, Err: problemsError(problems)})
+	}
+	for route, class := range config.Retry.Routes {
+		var err error
+		if _, ok := config.Retry.Classes[class]; !ok {
+			err = fmt.Errorf("unknown retry class %q", class)
+		}
+		results = append(results, checkResult{Name: "retry route " + route, Err: err})
+	}
+	for route, profile := range config.Scoring.Routes {
+		var err error
+		if _, ok := config.Scoring.Profiles[profile]; !ok {
+			err = fmt.Errorf("unknown scoring profile %q", profile)
+		}
+		results = append(results, checkResult{Name: "scoring route " + route, Err: err})
+	}
+	return results
+}
+
+//checkIndexPatterns checks the index lists of the configuration: patterns
+//must compile and the names in them must be valid index names.
+func checkIndexPatterns() []checkResult {
+	lists := map[string][]string{
+		"softdelete indices": config.SoftDelete.Indices,
+		"graphql indices":    config.GraphQL.Indices,
+	}
+	for i, rule := range config.Authz.Rules {
+		lists[fmt.Sprintf("authz rule %d indices", i)] = rule.Indices
+	}
+	for _, e := range config.Experiments {
+		lists["experiment "+e.Name+" indices"] = e.Indices
+	}
+	var results []checkResult
+	for _, name := range sortedStrings(lists) {
+		var problems []string
+		for _, pattern := range lists[name] {
+			if problem := indexPatternProblem(pattern); len(problem) != 0 {
+				problems = append(problems, fmt.Sprintf("%q %s", pattern, problem))
+			}
+		}
+		if len(lists[name]) != 0 {
+			results = append(results, checkResult{Name: name, Err: problemsError(problems)})
+		}
+	}
+	return results
+}
+
+func indexPatternProblem(pattern string) string {
+	if len(pattern) == 0 {
+		return "is empty"
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return "is not a valid pattern"
+	}
+	if strings.ToLower(pattern) != pattern {
+		return "has upper case letters, index names are lower case"
+	}
+	if strings.ContainsAny(pattern, `\/"<>| ,#`) {
+		return "has characters index names cannot contain"
+	}
+	if strings.HasPrefix(pattern, "-") || strings.HasPrefix(pattern, "+") {
+		return "starts with a character index names cannot start with"
+	}
+	return ""
+}
+
+func checkAuth() []checkResult {
+	var results []checkResult
+	for i, k := range config.Auth.APIKeys {
+		var problems []string
+		if len(k.Name) == 0 {
+			problems = append(problems, "no name")
+		}
+		switch {
+		case len(k.Key) == 0 && len(k.KeyHash) == 0:
+			problems = append(problems, "neither key nor key_hash")
+		case len(k.KeyHash) != 0:
+			if b, err := hex.DecodeString(k.KeyHash); err != nil || len(b) != 32 {
+				problems = append(problems, "key_hash is not a hex SHA-256")
+			}
+		}
+		results = append(results, checkResult{Name: fmt.Sprintf("api key %d", i), Err: problemsError(problems)})
+	}
+	if u := config.Auth.JWT.JWKSURL; len(u) != 0 {
+		_, err := url.ParseRequestURI(u)
+		results = append(results, checkResult{Name: "jwks url", Err: err})
+	}
+	return results
+}
+
+//checkTenants checks that the clusters of the tenants are configured and
+//that no prefix is the start of another, which would let a tenant reach the
+//indices of the other.
+func checkTenants() []checkResult {
+	var results []checkResult
+	for name, t := range config.Tenancy.Tenants {
+		var problems []string
+		if _, ok := config.Environments[t.Cluster]; len(t.Cluster) != 0 && !ok {
+			problems = append(problems, fmt.Sprintf("unknown cluster %q", t.Cluster))
+		}
+		for _, region := range t.Regions {
+			if _, ok := config.Environments[region]; !ok {
+				problems = append(problems, fmt.Sprintf("unknown region cluster %q", region))
+			}
+		}
+		if len(t.Cluster) != 0 && len(t.Regions) != 0 {
+			problems = append(problems, "cluster and regions are exclusive")
+		}
+		if problem := indexPatternProblem(t.IndexPrefix); len(t.IndexPrefix) != 0 && len(problem) != 0 {
+			problems = append(problems, fmt.Sprintf("index_prefix %q %s", t.IndexPrefix, problem))
+		}
+		for other, o := range config.Tenancy.Tenants {
+			if other != name && strings.HasPrefix(o.IndexPrefix, t.IndexPrefix) && t.Cluster == o.Cluster {
+				problems = append(problems, fmt.Sprintf("index_prefix %q also covers tenant %s", t.IndexPrefix, other))
+			}
+		}
+		results = append(results, checkResult{Name: "tenant " + name, Err: problemsError(problems)})
+	}
+	return results
+}
+
+//checkCache checks the backend of the response cache, and that Redis
+//answers when it is the backend.
+func checkCache(ctx context.Context) []checkResult {
+	if !config.Cache.Enabled {
+		return nil
+	}
+	switch config.Cache.Backend {
+	case "memory":
+		return []checkResult{{Name: "cache backend"}}
+	case "redis":
+	default:
+		return []checkResult{{Name: "cache backend", Err: fmt.Errorf("unknown backend %q", config.Cache.Backend)}}
+	}
+	reach := checkResult{Name: "redis " + config.Cache.Redis.Addr, Remote: true}
+	ctx, cancel := context.WithTimeout(ctx, selfCheckTimeout)
+	defer cancel()
+	if _, err := newRedisClient(config.Cache.Redis).do(ctx, "PING"); err != nil {
+		reach.Err = err
+	}
+	return []checkResult{reach}
+}
+
+//checkStore checks the backend of the store, and that it answers when it is
+//remote.
+func checkStore(ctx context.Context) []checkResult {
+	switch config.Store.Backend {
+	case "memory", "file":
+		return []checkResult{{Name: "store backend"}}
+	case "redis", "sql":
+	default:
+		return []checkResult{{Name: "store backend", Err: fmt.Errorf("unknown backend %q", config.Store.Backend)}}
+	}
+	reach := checkResult{Name: "store " + config.Store.Backend, Remote: true}
+	ctx, cancel := context.WithTimeout(ctx, selfCheckTimeout)
+	defer cancel()
+	s, err := openStore(config.Store)
+	if err == nil {
+		_, err = s.list(ctx, flagsNamespace)
+	}
+	reach.Err = err
+	return []checkResult{reach}
+}
+
+//checkCluster checks that the default cluster answers and accepts the
+//configured credentials.
+func checkCluster(ctx context.Context) []checkResult {
+	var results []checkResult
+	for _, address := range config.Cluster.Addresses {
+		u, err := url.Parse(address)
+		if err == nil && u.Scheme != "http" && u.Scheme != "https" {
+			err = fmt.Errorf("scheme must be http or https")
+		}
+		results = append(results, checkResult{Name: "cluster address " + address, Err: err})
+	}
+	reach := checkResult{Name: "cluster", Remote: true}
+	ctx, cancel := context.WithTimeout(ctx, selfCheckTimeout)
+	defer cancel()
+	es, err := defaultClient()
+	if err != nil {
+		reach.Err = err
+		return append(results, reach)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+	if err != nil {
+		reach.Err = err
+		return append(results, reach)
+	}
+	res, err := es.Perform(req)
+	if err != nil {
+		reach.Err = err
+		return append(results, reach)
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		reach.Err = fmt.Errorf("credentials rejected: %s", res.Status)
+	case res.StatusCode >= http.StatusMultipleChoices:
+		reach.Err = fmt.Errorf("elastic search answered %s", res.Status)
+	default:
+		var info struct {
+			ClusterName string `json:"cluster_name"`
+			Version     struct {
+				Number string `json:"number"`
+			} `json:"version"`
+		}
+		if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&info); err == nil {
+			reach.Detail = fmt.Sprintf("%s, version %s", info.ClusterName, info.Version.Number)
+		}
+	}
+	return append(results, reach)
+}
+
+//checkTLS connects to the https services of the configuration and checks
+//that their certificates verify, reporting when they expire.
+func checkTLS(ctx context.Context) []checkResult {
+	urls := append([]string{}, config.Cluster.Addresses...)
+	if len(config.Auth.JWT.JWKSURL) != 0 {
+		urls = append(urls, config.Auth.JWT.JWKSURL)
+	}
+	var results []checkResult
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil || u.Scheme != "https" {
+			continue
+		}
+		result := checkResult{Name: "tls " + u.Host, Remote: true}
+		host := u.Host
+		if len(u.Port()) == 0 {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+		dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: selfCheckTimeout}, Config: &tls.Config{ServerName: u.Hostname()}}
+		dctx, cancel := context.WithTimeout(ctx, selfCheckTimeout)
+		conn, err := dialer.DialContext(dctx, "tcp", host)
+		cancel()
+		if err != nil {
+			result.Err = err
+			results = append(results, result)
+			continue
+		}
+		certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+		conn.Close()
+		if len(certs) != 0 {
+			result.Detail = "certificate valid until " + certs[0].NotAfter.Format(time.RFC3339)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func problemsError(problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(problems, "; "))
+}
+
+func sortedStrings(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//printReport writes one line per check and tells whether all passed.
+func printReport(w io.Writer, results []checkResult) bool {
+	ok := true
+	for _, r := range results {
+		status := "ok  "
+		line := r.Name
+		if r.Err != nil {
+			status = "FAIL"
+			line += ": " + r.Err.Error()
+			ok = false
+		} else if len(r.Detail) != 0 {
+			line += ": " + r.Detail
+		}
+		fmt.Fprintf(w, "%s %s\n", status, line)
+	}
+	return ok
+}
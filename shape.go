@@ -0,0 +1,64 @@
+package main
+
+//Response modes of a search. Raw is the elastic search response with the
+//gateway meta section; hits is the array of documents, each _source with its
+//_id and _score; flat is one array whose first element is a header (took,
+//total, meta) followed by the documents with nested objects flattened into
+//dotted keys.
+const (
+	modeRaw  = "raw"
+	modeHits = "hits"
+	modeFlat = "flat"
+)
+
+func checkResponseMode(mode string) error {
+	switch mode {
+	case "", modeRaw, modeHits, modeFlat:
+		return nil
+	}
+	return &ValidationError{Path: "/response_mode", Message: "response_mode must be raw, hits or flat"}
+}
+
+//shapeResponse returns the response in the requested mode.
+func shapeResponse(response *SearchResponse, mode string) interface{} {
+	switch mode {
+	case modeHits:
+		docs := make([]map[string]interface{}, 0, len(response.Hits.Hits))
+		for _, h := range response.Hits.Hits {
+			doc := map[string]interface{}{}
+			for k, v := range h.Source {
+				doc[k] = v
+			}
+			doc["_id"], doc["_score"] = h.ID, h.Score
+			docs = append(docs, doc)
+		}
+		return docs
+	case modeFlat:
+		header := map[string]interface{}{"took": response.Took}
+		if response.Hits.Total != nil {
+			header["total"] = response.Hits.Total.Value
+		}
+		if response.Meta != nil {
+			header["meta"] = response.Meta
+		}
+		rows := []interface{}{header}
+		for _, h := range response.Hits.Hits {
+			row := map[string]interface{}{"_id": h.ID, "_index": h.Index, "_score": h.Score}
+			flatten("", h.Source, row)
+			rows = append(rows, row)
+		}
+		return rows
+	}
+	return response
+}
+
+//flatten copies doc into out with the keys of nested objects joined by dots.
+func flatten(prefix string, doc map[string]interface{}, out map[string]interface{}) {
+	for k, v := range doc {
+		if m, ok := v.(map[string]interface{}); ok {
+			flatten(prefix+k+".", m, out)
+			continue
+		}
+		out[prefix+k] = v
+	}
+}
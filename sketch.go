@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch"
+	"github.com/gorilla/mux"
+)
+
+//SketchConfig lists the high cardinality fields for which the gateway keeps
+//HyperLogLog sketches, so distinct counts can be answered without a query.
+type SketchConfig struct {
+	Fields   []SketchField `json:"fields"`
+	Interval Duration      `json:"interval"`
+	MaxAge   Duration      `json:"max_age"`
+}
+
+//SketchField is one index/field pair to sketch. When TimeField is set, only
+//documents newer than the previous run are scanned on each refresh.
+type SketchField struct {
+	Index     string `json:"index"`
+	Field     string `json:"field"`
+	TimeField string `json:"time_field"`
+}
+
+const hllPrecision = 14
+
+//hll is a HyperLogLog sketch with 2^hllPrecision registers.
+type hll struct {
+	registers [1 << hllPrecision]uint8
+}
+
+func (h *hll) add(value string) {
+	f := fnv.New64a()
+	f.Write([]byte(value))
+	x := mix64(f.Sum64())
+	idx := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+	}
+}
+
+func (h *hll) estimate() uint64 {
+	m := float64(len(h.registers))
+	sum, zeros := 0.0, 0
+	for _, r := range h.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+	return uint64(e + 0.5)
+}
+
+//mix64 spreads fnv output over all bits, which the register index relies on.
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+type sketch struct {
+	hll       hll
+	updatedAt time.Time
+	watermark string
+}
+
+var (
+	sketchesMu sync.RWMutex
+	sketches   = map[string]*sketch{}
+)
+
+func sketchKey(index, field string) string {
+	return index + "/" + field
+}
+
+//maintainSketches refreshes every configured sketch on the configured interval.
+func maintainSketches() {
+	for {
+		es, err := defaultClient()
+		if err != nil {
+			logger.Error("unable to create es client object", "error", err)
+		} else {
+			for _, f := range config.Sketches.Fields {
+				if err := refreshSketch(context.Background(), es, f); err != nil {
+					logger.Error("unable to refresh sketch", "sketch", sketchKey(f.Index, f.Field), "error", err)
+				}
+			}
+		}
+		time.Sleep(config.Sketches.Interval.Duration)
+	}
+}
+
+//refreshSketch pages through the distinct values of a field with a composite
+//aggregation and adds them to its sketch. Sketches only ever grow, so scanning
+//just the documents added since the last watermark keeps them exact enough.
+func refreshSketch(ctx context.Context, es *elasticsearch.Client, f SketchField) error {
+	key := sketchKey(f.Index, f.Field)
+	sketchesMu.RLock()
+	s, ok := sketches[key]
+	sketchesMu.RUnlock()
+	if !ok || len(f.TimeField) == 0 {
+		s = &sketch{}
+	} else {
+		cp := *s
+		s = &cp
+	}
+	started := time.Now().UTC().Format(time.RFC3339)
+
+	var after interface{}
+	for {
+		composite := map[string]interface{}{
+			"size":    1000,
+			"sources": []interface{}{map[string]interface{}{"v": map[string]interface{}{"terms": map[string]interface{}{"field": f.Field}}}},
+		}
+		if after != nil {
+			composite["after"] = after
+		}
+		query := map[string]interface{}{
+			"size": 0,
+			"aggs": map[string]interface{}{"values": map[string]interface{}{"composite": composite}},
+		}
+		if len(f.TimeField) != 0 && len(s.watermark) != 0 {
+			query["query"] = map[string]interface{}{
+				"range": map[string]interface{}{f.TimeField: map[string]interface{}{"gte": s.watermark}},
+			}
+		}
+		var result struct {
+			Aggregations struct {
+				Values struct {
+					AfterKey interface{} `json:"after_key"`
+					Buckets  []struct {
+						Key map[string]interface{} `json:"key"`
+					} `json:"buckets"`
+				} `json:"values"`
+			} `json:"aggregations"`
+		}
+		if err := searchInto(ctx, es, []string{f.Index}, query, &result); err != nil {
+			return err
+		}
+		for _, b := range result.Aggregations.Values.Buckets {
+			v, _ := json.Marshal(b.Key["v"])
+			s.hll.add(string(v))
+		}
+		if len(result.Aggregations.Values.Buckets) == 0 || result.Aggregations.Values.AfterKey == nil {
+			break
+		}
+		after = result.Aggregations.Values.AfterKey
+	}
+
+	s.updatedAt = time.Now()
+	s.watermark = started
+	sketchesMu.Lock()
+	sketches[key] = s
+	sketchesMu.Unlock()
+	return nil
+}
+
+//distinctHandler answers a distinct count from the sketch of the field when it
+//is fresh enough, and falls back to a live cardinality aggregation otherwise.
+//The count of a sensitive index is noised.
+func distinctHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !checkAccess(w, r, opSearch, []string{vars["index"]}) {
+		return
+	}
+	key := sketchKey(tenantIndex(r.Context(), vars["index"]), vars["field"])
+	sketchesMu.RLock()
+	s, ok := sketches[key]
+	sketchesMu.RUnlock()
+	if ok && time.Since(s.updatedAt) <= config.Sketches.MaxAge.Duration {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"value":      distinctValue(vars["index"], vars["field"], float64(s.hll.estimate())),
+			"source":     "sketch",
+			"updated_at": s.updatedAt.UTC().Format(time.RFC3339),
+		})
+		return
+	}
+
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	query := map[string]interface{}{
+		"size": 0,
+		"aggs": map[string]interface{}{
+			"distinct": map[string]interface{}{"cardinality": map[string]interface{}{"field": vars["field"]}},
+		},
+	}
+	var result struct {
+		Aggregations struct {
+			Distinct struct {
+				Value uint64 `json:"value"`
+			} `json:"distinct"`
+		} `json:"aggregations"`
+	}
+	if err := searchInto(r.Context(), es, []string{vars["index"]}, query, &result); err != nil {
+		logger.ErrorContext(r.Context(), "error getting cardinality from elastic search", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"value":  distinctValue(vars["index"], vars["field"], float64(result.Aggregations.Distinct.Value)),
+		"source": "live",
+	})
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/elastic/go-elasticsearch"
+)
+
+//smokeIndexPrefix names the temporary indices of smoke tests, so leftovers of
+//an interrupted run are easy to find.
+const smokeIndexPrefix = "elastic-smoke-"
+
+//SmokeStep is the outcome of one step of a smoke test. Steps after a failed
+//one are skipped, except the removal of the index.
+type SmokeStep struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Skipped bool   `json:"skipped,omitempty"`
+	Millis  int64  `json:"ms"`
+	Detail  string `json:"detail,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+//SmokeReport is the outcome of a smoke test against a cluster.
+type SmokeReport struct {
+	Cluster string      `json:"cluster"`
+	Index   string      `json:"index"`
+	OK      bool        `json:"ok"`
+	Steps   []SmokeStep `json:"steps"`
+}
+
+//smokeDoc is the document the smoke test indexes then finds.
+var smokeDoc = map[string]interface{}{"title": "smoke test canary", "kind": "canary"}
+
+//runSmoke creates a temporary index, indexes a document, finds it by search
+//and aggregation, then deletes the index.
+func runSmoke(ctx context.Context, es *elasticsearch.Client, report *SmokeReport) {
+	failed := false
+	step := func(name string, fn func() (string, error)) {
+		s := SmokeStep{Name: name}
+		if failed {
+			s.Skipped = true
+			report.Steps = append(report.Steps, s)
+			return
+		}
+		start := time.Now()
+		detail, err := fn()
+		s.Millis = time.Since(start).Milliseconds()
+		s.OK, s.Detail = err == nil, detail
+		if err != nil {
+			s.Error = err.Error()
+			failed = true
+		}
+		report.Steps = append(report.Steps, s)
+	}
+	index := report.Index
+	created := false
+	step("create index", func() (string, error) {
+		buf, err := encodeBody(map[string]interface{}{
+			"settings": map[string]interface{}{"number_of_shards": 1, "number_of_replicas": 0},
+			"mappings": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"title": map[string]interface{}{"type": "text"},
+					"kind":  map[string]interface{}{"type": "keyword"},
+				},
+			},
+		})
+		if err != nil {
+			return "", err
+		}
+		res, err := es.Indices.Create(index, es.Indices.Create.WithContext(ctx), es.Indices.Create.WithBody(buf))
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		if res.IsError() {
+			return "", fmt.Errorf("create index: %s", res.String())
+		}
+		created = true
+		return "", nil
+	})
+	step("index document", func() (string, error) {
+		buf, err := encodeBody(smokeDoc)
+		if err != nil {
+			return "", err
+		}
+		res, err := es.Index(index, buf,
+			es.Index.WithContext(ctx),
+			es.Index.WithDocumentID("canary"),
+			es.Index.WithRefresh("true"),
+		)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		if res.IsError() {
+			return "", fmt.Errorf("index document: %s", res.String())
+		}
+		return "", nil
+	})
+	step("search", func() (string, error) {
+		var sr SearchResponse
+		query := map[string]interface{}{"query": map[string]interface{}{"match": map[string]interface{}{"title": "canary"}}}
+		if err := searchInto(ctx, es, []string{index}, query, &sr); err != nil {
+			return "", err
+		}
+		if len(sr.Hits.Hits) != 1 || sr.Hits.Hits[0].ID != "canary" {
+			return "", fmt.Errorf("expected the canary document, got %d hits", len(sr.Hits.Hits))
+		}
+		return fmt.Sprintf("found in %dms", sr.Took), nil
+	})
+	step("aggregate", func() (string, error) {
+		var sr struct {
+			Aggregations struct {
+				Kinds struct {
+					Buckets []struct {
+						Key      string `json:"key"`
+						DocCount int64  `json:"doc_count"`
+					} `json:"buckets"`
+				} `json:"kinds"`
+			} `json:"aggregations"`
+		}
+		query := map[string]interface{}{
+			"size": 0,
+			"aggs": map[string]interface{}{"kinds": map[string]interface{}{"terms": map[string]interface{}{"field": "kind"}}},
+		}
+		if err := searchInto(ctx, es, []string{index}, query, &sr); err != nil {
+			return "", err
+		}
+		b := sr.Aggregations.Kinds.Buckets
+		if len(b) != 1 || b[0].Key != "canary" || b[0].DocCount != 1 {
+			return "", fmt.Errorf("expected one canary bucket, got %v", b)
+		}
+		return "", nil
+	})
+	//the index is removed whatever happened before, even when the caller left
+	failed = failed && !created
+	step("delete index", func() (string, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), selfCheckTimeout)
+		defer cancel()
+		res, err := es.Indices.Delete([]string{index}, es.Indices.Delete.WithContext(ctx))
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		if res.IsError() {
+			return "", fmt.Errorf("delete index: %s", res.String())
+		}
+		return "", nil
+	})
+	report.OK = true
+	for _, s := range report.Steps {
+		report.OK = report.OK && s.OK
+	}
+}
+
+//smokeHandler runs the smoke test against the default cluster or the
+//environment named by the cluster parameter. It answers 502 when a step
+//failed, so deploy pipelines can gate on the status alone.
+func smokeHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	env := r.URL.Query().Get("cluster")
+	es, err := defaultClient()
+	if len(env) != 0 {
+		cluster, ok := config.Environments[env]
+		if !ok {
+			http.Error(w, "unknown environment "+env, http.StatusBadRequest)
+			return
+		}
+		es, err = clusterClient(cluster)
+	}
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	report := SmokeReport{Cluster: env, Index: smokeIndexPrefix + hex.EncodeToString(suffix)}
+	if len(env) == 0 {
+		report.Cluster = "default"
+	}
+	runSmoke(r.Context(), es, &report)
+	status := http.StatusOK
+	if !report.OK {
+		status = http.StatusBadGateway
+		logger.WarnContext(r.Context(), "smoke test failed", "cluster", report.Cluster, "index", report.Index)
+	}
+	writeJSON(w, status, report)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"path"
+	"time"
+)
+
+//SoftDeleteConfig turns DELETE requests into a deleted marker on the document.
+//Marked documents are hidden from searches and purged once Retention has passed.
+type SoftDeleteConfig struct {
+	Enabled       bool     `json:"enabled"`
+	Field         string   `json:"field"`
+	Indices       []string `json:"indices"`
+	Retention     Duration `json:"retention"`
+	PurgeInterval Duration `json:"purge_interval"`
+}
+
+//softDeletes reports whether deletes in index are soft deletes: those of the
+//indices the purge covers, matched on the name of the index in the cluster.
+func softDeletes(ctx context.Context, index string) bool {
+	if !config.SoftDelete.Enabled {
+		return false
+	}
+	name := tenantIndex(ctx, index)
+	for _, pattern := range config.SoftDelete.Indices {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//deletedMarker is the partial document written on a soft delete.
+func deletedMarker(by string) map[string]interface{} {
+	return map[string]interface{}{
+		"doc": map[string]interface{}{
+			config.SoftDelete.Field: map[string]interface{}{
+				"at": time.Now().UTC().Format(time.RFC3339),
+				"by": by,
+			},
+		},
+	}
+}
+
+//excludeSoftDeleted adds a must_not clause hiding documents carrying the deleted marker.
+func excludeSoftDeleted(q interface{}) interface{} {
+	body, ok := searchBody(q)
+	if !ok {
+		return q
+	}
+	addClause(body, "must_not", map[string]interface{}{
+		"exists": map[string]interface{}{"field": config.SoftDelete.Field + ".at"},
+	})
+	return body
+}
+
+//purgeSoftDeleted periodically hard deletes documents that were soft deleted
+//longer ago than the retention window, on the default cluster and on those of
+//the tenants, in the indices of each tenant.
+func purgeSoftDeleted() {
+	ticker := time.NewTicker(config.SoftDelete.PurgeInterval.Duration)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := purgeOnce(context.Background()); err != nil {
+			logger.Error("soft delete purge failed", "error", err)
+		}
+		for name, t := range config.Tenancy.Tenants {
+			t.Name = name
+			if err := purgeOnce(scopedContext(&t, nil)); err != nil {
+				logger.Error("soft delete purge failed", "tenant", name, "error", err)
+			}
+		}
+	}
+}
+
+func purgeOnce(ctx context.Context) error {
+	es, err := defaultClient()
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-config.SoftDelete.Retention.Duration).UTC().Format(time.RFC3339)
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"range": map[string]interface{}{
+				config.SoftDelete.Field + ".at": map[string]interface{}{"lt": cutoff},
+			},
+		},
+	}
+	buf, err := encodeBody(query)
+	if err != nil {
+		return err
+	}
+	res, err := es.DeleteByQuery(
+		config.SoftDelete.Indices,
+		buf,
+		es.DeleteByQuery.WithContext(ctx),
+		es.DeleteByQuery.WithConflicts("proceed"),
+		es.DeleteByQuery.WithAllowNoIndices(true),
+	)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		logger.ErrorContext(ctx, "soft delete purge rejected by elastic search", "response", res.String())
+	}
+	return nil
+}
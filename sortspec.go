@@ -0,0 +1,138 @@
+package main
+
+import "strconv"
+
+//SortSpec is one entry of a structured sort, for what the comma separated
+//sort string cannot express: sorting on fields of nested documents and
+//sorting on a script.
+type SortSpec struct {
+	Field   string      `json:"field"`
+	Order   string      `json:"order"`
+	Mode    string      `json:"mode"`
+	Missing interface{} `json:"missing"`
+	Nested  *NestedSort `json:"nested"`
+	Script  *ScriptSort `json:"script"`
+}
+
+//NestedSort picks the nested documents a sort value is taken from.
+type NestedSort struct {
+	Path        string      `json:"path"`
+	Filter      interface{} `json:"filter"`
+	MaxChildren int         `json:"max_children"`
+	Nested      *NestedSort `json:"nested"`
+}
+
+//ScriptSort sorts on the value of an inline (Source) or stored (ID) script.
+type ScriptSort struct {
+	Type   string                 `json:"type"`
+	Source string                 `json:"source"`
+	ID     string                 `json:"id"`
+	Lang   string                 `json:"lang"`
+	Params map[string]interface{} `json:"params"`
+}
+
+//compileSorts turns structured sorts into the sort section of the query DSL.
+func compileSorts(specs []SortSpec) ([]interface{}, error) {
+	sorts := make([]interface{}, 0, len(specs))
+	for i, s := range specs {
+		path := "/sorts/" + strconv.Itoa(i)
+		opts := map[string]interface{}{}
+		switch s.Order {
+		case "", "asc", "desc":
+			if len(s.Order) != 0 {
+				opts["order"] = s.Order
+			}
+		default:
+			return nil, &ValidationError{Path: path + "/order", Message: "order must be asc or desc"}
+		}
+		if len(s.Mode) != 0 {
+			opts["mode"] = s.Mode
+		}
+		if s.Nested != nil {
+			nested, err := compileNested(s.Nested, path+"/nested")
+			if err != nil {
+				return nil, err
+			}
+			opts["nested"] = nested
+		}
+		switch {
+		case s.Script != nil && len(s.Field) != 0:
+			return nil, &ValidationError{Path: path, Message: "field and script are exclusive"}
+		case s.Script != nil:
+			script, err := compileScript(s.Script, path+"/script")
+			if err != nil {
+				return nil, err
+			}
+			opts["type"] = s.Script.Type
+			if len(s.Script.Type) == 0 {
+				opts["type"] = "number"
+			}
+			opts["script"] = script
+			sorts = append(sorts, map[string]interface{}{"_script": opts})
+		case len(s.Field) != 0:
+			if s.Missing != nil {
+				opts["missing"] = s.Missing
+			}
+			sorts = append(sorts, map[string]interface{}{s.Field: opts})
+		default:
+			return nil, &ValidationError{Path: path, Message: "field or script is required"}
+		}
+	}
+	return sorts, nil
+}
+
+func compileNested(n *NestedSort, path string) (map[string]interface{}, error) {
+	if len(n.Path) == 0 {
+		return nil, &ValidationError{Path: path + "/path", Message: "path is required"}
+	}
+	nested := map[string]interface{}{"path": n.Path}
+	if n.Filter != nil {
+		nested["filter"] = n.Filter
+	}
+	if n.MaxChildren > 0 {
+		nested["max_children"] = n.MaxChildren
+	}
+	if n.Nested != nil {
+		inner, err := compileNested(n.Nested, path+"/nested")
+		if err != nil {
+			return nil, err
+		}
+		nested["nested"] = inner
+	}
+	return nested, nil
+}
+
+func compileScript(s *ScriptSort, path string) (map[string]interface{}, error) {
+	script := map[string]interface{}{}
+	switch {
+	case len(s.Source) != 0 && len(s.ID) != 0:
+		return nil, &ValidationError{Path: path, Message: "source and id are exclusive"}
+	case len(s.Source) != 0:
+		script["source"] = s.Source
+		if len(s.Lang) != 0 {
+			script["lang"] = s.Lang
+		}
+	case len(s.ID) != 0:
+		script["id"] = s.ID
+	default:
+		return nil, &ValidationError{Path: path, Message: "source or id is required"}
+	}
+	if len(s.Params) != 0 {
+		script["params"] = s.Params
+	}
+	return script, nil
+}
+
+//withSorts sets the sort section of the search body from structured sorts.
+func withSorts(q interface{}, specs []SortSpec) (interface{}, error) {
+	sorts, err := compileSorts(specs)
+	if err != nil {
+		return nil, err
+	}
+	body, ok := searchBody(q)
+	if !ok {
+		return nil, &ValidationError{Path: "/", Message: "elasticquery must be a JSON object when sorts are used"}
+	}
+	body["sort"] = sorts
+	return body, nil
+}
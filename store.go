@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+//StoreConfig picks where the state of the gateway that must outlive a restart
+//is kept: flag overrides and webhook deliveries. Backend is one of
+//   - "memory", the default: the state of each instance is lost on restart
+//   - "file": a JSON file at Path, for a single instance
+//   - "redis": a Redis server shared by the instances
+//   - "sql": a database/sql database shared by the instances, Postgres or
+//     SQLite, named by Driver ("postgres", "sqlite3") and DSN, in Table. The
+//     driver is built in with the postgres or sqlite build tag.
+//
+//Instances sharing a store load the changes of the others every Reload. The
+//state is migrated on boot when the gateway was upgraded, after a backup to
+//BackupDir.
+type StoreConfig struct {
+	Backend   string      `json:"backend"`
+	Path      string      `json:"path"`
+	Redis     RedisConfig `json:"redis"`
+	Driver    string      `json:"driver"`
+	DSN       string      `json:"dsn"`
+	Table     string      `json:"table"`
+	Reload    Duration    `json:"reload"`
+	BackupDir string      `json:"backup_dir"`
+}
+
+//stateStore keeps values by namespace and key.
+type stateStore interface {
+	get(ctx context.Context, namespace, key string) (value []byte, found bool, err error)
+	put(ctx context.Context, namespace, key string, value []byte) error
+	delete(ctx context.Context, namespace, key string) error
+	//list returns the values of the namespace by key.
+	list(ctx context.Context, namespace string) (map[string][]byte, error)
+}
+
+//state is the store of the gateway, replaced at startup when another backend
+//is configured.
+var state stateStore = newMemoryStore()
+
+//openStore opens the configured backend.
+func openStore(c StoreConfig) (stateStore, error) {
+	switch c.Backend {
+	case "memory":
+		return newMemoryStore(), nil
+	case "file":
+		return openFileStore(c.Path)
+	case "redis":
+		return &redisStore{client: newRedisClient(c.Redis), prefix: c.Redis.Prefix}, nil
+	case "sql":
+		return openSQLStore(c.Driver, c.DSN, c.Table)
+	}
+	return nil, fmt.Errorf("unknown store backend %q", c.Backend)
+}
+
+//setupStore opens the configured store and loads the state kept in it.
+func setupStore() error {
+	s, err := openStore(config.Store)
+	if err != nil {
+		return err
+	}
+	state = s
+	ctx := context.Background()
+	if err := migrateState(ctx, s); err != nil {
+		return err
+	}
+	if err := loadFlagOverrides(ctx); err != nil {
+		return err
+	}
+	if err := loadDeliveries(ctx); err != nil {
+		return err
+	}
+	if config.Store.Backend == "redis" || config.Store.Backend == "sql" {
+		go reloadState()
+	}
+	return nil
+}
+
+//reloadState loads the changes made by the other instances forever.
+func reloadState() {
+	for {
+		time.Sleep(config.Store.Reload.Duration)
+		if err := loadFlagOverrides(context.Background()); err != nil {
+			logger.Warn("unable to reload flag overrides", "error", err)
+		}
+	}
+}
+
+//saveState writes v as JSON under the key, or deletes the key when v is nil.
+func saveState(ctx context.Context, namespace, key string, v interface{}) error {
+	if v == nil {
+		return state.delete(ctx, namespace, key)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return state.put(ctx, namespace, key, b)
+}
+
+type memoryStore struct {
+	mu     sync.Mutex
+	values map[string]map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{values: map[string]map[string][]byte{}}
+}
+
+func (s *memoryStore) get(ctx context.Context, namespace, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[namespace][key]
+	return v, ok, nil
+}
+
+func (s *memoryStore) put(ctx context.Context, namespace, key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values[namespace] == nil {
+		s.values[namespace] = map[string][]byte{}
+	}
+	s.values[namespace][key] = value
+	return nil
+}
+
+func (s *memoryStore) delete(ctx context.Context, namespace, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values[namespace], key)
+	return nil
+}
+
+func (s *memoryStore) list(ctx context.Context, namespace string) (map[string][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := map[string][]byte{}
+	for k, v := range s.values[namespace] {
+		values[k] = v
+	}
+	return values, nil
+}
+
+//fileStore is a memory store written to a file after every change, through
+//a temporary file renamed over it so a crash never leaves half a file.
+type fileStore struct {
+	memoryStore
+	path string
+}
+
+func openFileStore(path string) (*fileStore, error) {
+	s := &fileStore{memoryStore: *newMemoryStore(), path: path}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.values); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *fileStore) put(ctx context.Context, namespace, key string, value []byte) error {
+	s.memoryStore.put(ctx, namespace, key, value)
+	return s.write()
+}
+
+func (s *fileStore) delete(ctx context.Context, namespace, key string) error {
+	s.memoryStore.delete(ctx, namespace, key)
+	return s.write()
+}
+
+func (s *fileStore) write() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := json.Marshal(s.values)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+//redisStore keeps each namespace in a hash.
+type redisStore struct {
+	client *redisClient
+	prefix string
+}
+
+func (s *redisStore) get(ctx context.Context, namespace, key string) ([]byte, bool, error) {
+	reply, err := s.client.do(ctx, "HGET", s.prefix+namespace, key)
+	if err != nil || reply == nil {
+		return nil, false, err
+	}
+	v, ok := reply.(string)
+	if !ok {
+		return nil, false, fmt.Errorf("redis: unexpected reply to HGET")
+	}
+	return []byte(v), true, nil
+}
+
+func (s *redisStore) put(ctx context.Context, namespace, key string, value []byte) error {
+	_, err := s.client.do(ctx, "HSET", s.prefix+namespace, key, string(value))
+	return err
+}
+
+func (s *redisStore) delete(ctx context.Context, namespace, key string) error {
+	_, err := s.client.do(ctx, "HDEL", s.prefix+namespace, key)
+	return err
+}
+
+func (s *redisStore) list(ctx context.Context, namespace string) (map[string][]byte, error) {
+	reply, err := s.client.do(ctx, "HGETALL", s.prefix+namespace)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := reply.([]interface{})
+	if !ok || len(fields)%2 != 0 {
+		return nil, fmt.Errorf("redis: unexpected reply to HGETALL")
+	}
+	values := map[string][]byte{}
+	for i := 0; i < len(fields); i += 2 {
+		k, _ := fields[i].(string)
+		v, _ := fields[i+1].(string)
+		values[k] = []byte(v)
+	}
+	return values, nil
+}
+
+//sqlTableRe restricts table names, which cannot be query parameters.
+var sqlTableRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+//sqlStore keeps the state in one table. The statements are understood by
+//both Postgres and SQLite.
+type sqlStore struct {
+	db    *sql.DB
+	table string
+}
+
+func openSQLStore(driver, dsn, table string) (*sqlStore, error) {
+	if !sqlTableRe.MatchString(table) {
+		return nil, fmt.Errorf("invalid store table %q", table)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	blob := "BLOB"
+	if driver == "postgres" || driver == "pgx" {
+		blob = "BYTEA"
+	}
+	create := "CREATE TABLE IF NOT EXISTS " + table + " (namespace TEXT NOT NULL, key TEXT NOT NULL, value " + blob + " NOT NULL, PRIMARY KEY (namespace, key))"
+	if _, err := db.Exec(create); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlStore{db: db, table: table}, nil
+}
+
+func (s *sqlStore) get(ctx context.Context, namespace, key string) ([]byte, bool, error) {
+	var v []byte
+	err := s.db.QueryRowContext(ctx, "SELECT value FROM "+s.table+" WHERE namespace = $1 AND key = $2", namespace, key).Scan(&v)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	return v, err == nil, err
+}
+
+func (s *sqlStore) put(ctx context.Context, namespace, key string, value []byte) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO "+s.table+" (namespace, key, value) VALUES ($1, $2, $3) ON CONFLICT (namespace, key) DO UPDATE SET value = excluded.value", namespace, key, value)
+	return err
+}
+
+func (s *sqlStore) delete(ctx context.Context, namespace, key string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM "+s.table+" WHERE namespace = $1 AND key = $2", namespace, key)
+	return err
+}
+
+func (s *sqlStore) list(ctx context.Context, namespace string) (map[string][]byte, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT key, value FROM "+s.table+" WHERE namespace = $1", namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := map[string][]byte{}
+	for rows.Next() {
+		var k string
+		var v []byte
+		if err := rows.Scan(&k, &v); err != nil {
+			return nil, err
+		}
+		values[k] = v
+	}
+	return values, rows.Err()
+}
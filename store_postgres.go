@@ -0,0 +1,6 @@
+//go:build postgres
+
+package main
+
+//the Postgres driver of the sql store
+import _ "github.com/lib/pq"
@@ -0,0 +1,6 @@
+//go:build sqlite
+
+package main
+
+//the SQLite driver of the sql store
+import _ "github.com/mattn/go-sqlite3"
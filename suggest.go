@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+//SuggestRequest is the body of /elastic/suggest. Type is completion (the
+//default, Field being a completion field), term or phrase.
+type SuggestRequest struct {
+	Index  string `json:"index"`
+	Field  string `json:"field"`
+	Prefix string `json:"prefix"`
+	Size   int    `json:"size"`
+	Type   string `json:"type"`
+}
+
+//suggestHandler answers typeahead requests with the suggesters of elastic
+//search and returns the distinct suggestions, best first.
+func suggestHandler(w http.ResponseWriter, r *http.Request) {
+	var body SuggestRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body.Index) == 0 || len(body.Field) == 0 {
+		http.Error(w, "index and field are required", http.StatusBadRequest)
+		return
+	}
+	index := stringToArray(body.Index)
+	if !checkAccess(w, r, opSearch, index) {
+		return
+	}
+	if body.Size <= 0 {
+		body.Size = defaultSize
+	}
+	var suggester map[string]interface{}
+	switch body.Type {
+	case "", "completion":
+		suggester = map[string]interface{}{
+			"prefix":     body.Prefix,
+			"completion": map[string]interface{}{"field": body.Field, "size": body.Size, "skip_duplicates": true},
+		}
+	case "term", "phrase":
+		suggester = map[string]interface{}{
+			"text":    body.Prefix,
+			body.Type: map[string]interface{}{"field": body.Field, "size": body.Size},
+		}
+	default:
+		http.Error(w, "type must be completion, term or phrase", http.StatusBadRequest)
+		return
+	}
+	query := map[string]interface{}{
+		"size":    0,
+		"_source": false,
+		"suggest": map[string]interface{}{"s": suggester},
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var result struct {
+		Suggest struct {
+			S []struct {
+				Options []struct {
+					Text string `json:"text"`
+				} `json:"options"`
+			} `json:"s"`
+		} `json:"suggest"`
+	}
+	if err := searchInto(r.Context(), es, index, query, &result); err != nil {
+		logger.ErrorContext(r.Context(), "error getting suggestions from elastic search", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	seen := map[string]bool{}
+	suggestions := []string{}
+	for _, entry := range result.Suggest.S {
+		for _, o := range entry.Options {
+			key := strings.ToLower(o.Text)
+			if seen[key] || len(suggestions) == body.Size {
+				continue
+			}
+			seen[key] = true
+			suggestions = append(suggestions, o.Text)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"suggestions": suggestions})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/elastic/go-elasticsearch"
+	"github.com/gorilla/mux"
+)
+
+//templateID is the id a search template is stored under. Tenants have
+//templates of their own, stored with their index prefix, and cannot render
+//those of others.
+func templateID(ctx context.Context, id string) string {
+	if t := tenantFrom(ctx); t != nil {
+		return t.IndexPrefix + id
+	}
+	return id
+}
+
+//renderTemplate renders a stored search template with params into the query
+//it stands for. Searches by template then go through the same rewrites,
+//caching and checks as any other search.
+func renderTemplate(ctx context.Context, es *elasticsearch.Client, id string, params map[string]interface{}) (interface{}, error) {
+	buf, err := encodeBody(map[string]interface{}{"id": templateID(ctx, id), "params": params})
+	if err != nil {
+		return nil, err
+	}
+	res, err := es.RenderSearchTemplate(
+		es.RenderSearchTemplate.WithContext(ctx),
+		es.RenderSearchTemplate.WithBody(buf),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, fmt.Errorf("template %s: %s", id, res.String())
+	}
+	var rendered struct {
+		TemplateOutput interface{} `json:"template_output"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&rendered)
+	return rendered.TemplateOutput, err
+}
+
+//putTemplateHandler stores a mustache search template under the id of the
+//path. The body holds the template as source, a string or a JSON object.
+func putTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	var body struct {
+		Source interface{} `json:"source"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.Source == nil {
+		http.Error(w, "source is required", http.StatusBadRequest)
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	buf, err := encodeBody(map[string]interface{}{
+		"script": map[string]interface{}{"lang": "mustache", "source": body.Source},
+	})
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error encoding search template", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res, err := es.PutScript(templateID(r.Context(), mux.Vars(r)["id"]), buf, es.PutScript.WithContext(r.Context()))
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error storing search template", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeResponse(w, res)
+}
+
+//deleteTemplateHandler removes a stored search template.
+func deleteTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res, err := es.DeleteScript(templateID(r.Context(), mux.Vars(r)["id"]), es.DeleteScript.WithContext(r.Context()))
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error deleting search template", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeResponse(w, res)
+}
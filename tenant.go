@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+//TenancyConfig lets one gateway serve several teams. The tenant of a request
+//is named by the Claim of its token when Claim is set, else by the Header.
+//Requests of a tenant go to its cluster and only reach the indices starting
+//with its prefix: index names are prefixed on the way to elastic search
+//("logs" becomes "team-a-logs"), wildcards and "_all" only expand within the
+//prefix, and cluster wide APIs are refused.
+type TenancyConfig struct {
+	Header string `json:"header"`
+	Claim  string `json:"claim"`
+	//Required refuses requests without a tenant
+	Required bool              `json:"required"`
+	Tenants  map[string]Tenant `json:"tenants"`
+	//Regions routes the tenants with Regions, see regions.go
+	Regions RegionConfig `json:"regions"`
+}
+
+//Tenant maps a tenant to a cluster of Environments (empty for the default
+//cluster) and to the prefix of its indices. A tenant with clusters in several
+//regions lists them in Regions instead, to be routed to the fastest.
+type Tenant struct {
+	Name        string   `json:"-"`
+	Cluster     string   `json:"cluster"`
+	Regions     []string `json:"regions"`
+	IndexPrefix string   `json:"index_prefix"`
+	//session names the session of the request, for sticking to a region
+	session string
+}
+
+//hasRegions tells whether the tenant has clusters in several regions.
+func (t *Tenant) hasRegions() bool {
+	return len(t.Regions) != 0
+}
+
+func (c TenancyConfig) enabled() bool {
+	return len(c.Tenants) != 0
+}
+
+//tenantFrom returns the tenant of the request, if any.
+func tenantFrom(ctx context.Context) *Tenant {
+	t, _ := ctx.Value(tenantKey).(*Tenant)
+	return t
+}
+
+//resolveTenant finds the tenant of the request. A header naming another
+//tenant than the token is refused, so callers cannot switch tenants.
+func resolveTenant(r *http.Request) (*Tenant, error) {
+	c := config.Tenancy
+	name := r.Header.Get(c.Header)
+	if len(c.Claim) != 0 {
+		var claimed string
+		if id := identityFrom(r.Context()); id != nil {
+			claimed, _ = id.Claims[c.Claim].(string)
+		}
+		if len(name) != 0 && name != claimed {
+			return nil, fmt.Errorf("tenant %q is not the tenant of the token", name)
+		}
+		name = claimed
+	}
+	if len(name) == 0 {
+		if c.Required {
+			return nil, fmt.Errorf("a tenant is required")
+		}
+		return nil, nil
+	}
+	t, ok := c.Tenants[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown tenant %q", name)
+	}
+	t.Name = name
+	if t.hasRegions() {
+		t.session = r.Header.Get(c.Regions.SessionHeader)
+		if id := identityFrom(r.Context()); len(t.session) == 0 && id != nil {
+			t.session = id.Name
+		}
+	}
+	return &t, nil
+}
+
+//TenancyMid resolves the tenant of the request for the clients, which scope
+//every call to elastic search to it.
+func TenancyMid(app http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions || authExempt(r.URL.Path) {
+			app.ServeHTTP(w, r)
+			return
+		}
+		t, err := resolveTenant(r)
+		if err != nil {
+			logger.WarnContext(r.Context(), "tenant refused", "error", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if t == nil {
+			app.ServeHTTP(w, r)
+			return
+		}
+		app.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey, t)))
+	})
+}
+
+//tenantScope makes a cache key private to the tenant of the context, for
+//caches keyed by index names the tenant sees unprefixed.
+func tenantScope(ctx context.Context, key string) string {
+	if t := tenantFrom(ctx); t != nil {
+		return t.Name + "/" + key
+	}
+	return key
+}
+
+//tenantIndex returns the index name elastic search knows for the name the
+//tenant of the context uses.
+func tenantIndex(ctx context.Context, index string) string {
+	if t := tenantFrom(ctx); t != nil {
+		return t.index(index)
+	}
+	return index
+}
+
+//index prefixes an index name or pattern. Names already carrying the prefix
+//are left alone, and exclusions ("-logs-old") stay exclusions.
+func (t *Tenant) index(name string) string {
+	if strings.HasPrefix(name, "-") {
+		return "-" + t.index(name[1:])
+	}
+	if name == "_all" || name == "*" {
+		return t.IndexPrefix + "*"
+	}
+	if strings.HasPrefix(name, t.IndexPrefix) {
+		return name
+	}
+	return t.IndexPrefix + name
+}
+
+//tenantPaths are the APIs without an index a tenant may call. Those marked
+//true search all indices and are scoped to the indices of the tenant; the
+//others address a search context (scroll, point in time, async search) by an
+//id the tenant got from a scoped search, or a search template by an id
+//carrying the prefix of the tenant (see templateID).
+var tenantPaths = map[string]bool{
+	"":              false,
+	"_search":       true,
+	"_count":        true,
+	"_async_search": true,
+	"_pit":          false,
+	"_bulk":         false,
+	"_render":       false,
+	"_scripts":      false,
+}
+
+//scopePath rewrites the path of a call to elastic search for the tenant. ok
+//is false for calls the tenant may not make.
+func (t *Tenant) scopePath(p string) (string, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)
+	first, rest := parts[0], ""
+	if len(parts) == 2 {
+		rest = parts[1]
+	}
+	if len(first) == 0 || strings.HasPrefix(first, "_") {
+		scoped, ok := tenantPaths[first]
+		if !ok || (first == "_scripts" && !strings.HasPrefix(rest, t.IndexPrefix)) {
+			return "", false
+		}
+		if scoped && len(rest) == 0 {
+			return "/" + t.IndexPrefix + "*/" + first, true
+		}
+		return p, true
+	}
+	names := strings.Split(first, ",")
+	for i, name := range names {
+		//indices of remote clusters are out of reach
+		if strings.Contains(name, ":") {
+			return "", false
+		}
+		names[i] = t.index(name)
+	}
+	p = "/" + strings.Join(names, ",")
+	if len(parts) == 2 {
+		p += "/" + rest
+	}
+	return p, true
+}
+
+//scopeBulk prefixes the _index of the action lines of a bulk body.
+func (t *Tenant) scopeBulk(body []byte) ([]byte, error) {
+	var out bytes.Buffer
+	source := false
+	sc := bufio.NewScanner(bytes.NewReader(body))
+	sc.Buffer(make([]byte, 0, 64*1024), len(body)+1)
+	for sc.Scan() {
+		line := sc.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		//index, create and update actions are followed by a source line
+		if source {
+			source = false
+			out.Write(line)
+			out.WriteByte('\n')
+			continue
+		}
+		var action map[string]map[string]interface{}
+		if err := json.Unmarshal(line, &action); err != nil {
+			return nil, err
+		}
+		for op, meta := range action {
+			source = op != "delete"
+			if index, ok := meta["_index"].(string); ok {
+				meta["_index"] = t.index(index)
+			}
+		}
+		b, err := json.Marshal(action)
+		if err != nil {
+			return nil, err
+		}
+		out.Write(b)
+		out.WriteByte('\n')
+	}
+	return out.Bytes(), sc.Err()
+}
+
+//tenantCounter spreads the calls of tenants over the addresses of their cluster.
+var tenantCounter uint64
+
+//tenantTransport scopes the calls made for a tenant to its cluster and
+//indices. Refused calls get a 403 from the transport, as elastic search
+//would answer them, so handlers report them as they report any refusal.
+type tenantTransport struct {
+	base http.RoundTripper
+}
+
+func (t tenantTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tenant := tenantFrom(req.Context())
+	if tenant == nil {
+		return t.base.RoundTrip(req)
+	}
+	p, ok := tenant.scopePath(req.URL.Path)
+	if !ok {
+		return tenantDenied(req, fmt.Sprintf("%s is not available to tenant %s", req.URL.Path, tenant.Name)), nil
+	}
+	req = req.Clone(req.Context())
+	req.URL.Path, req.URL.RawPath = p, ""
+	if strings.HasSuffix(p, "/_bulk") && req.Body != nil {
+		raw, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		scoped, err := tenant.scopeBulk(raw)
+		if err != nil {
+			return tenantDenied(req, "invalid bulk body: "+err.Error()), nil
+		}
+		req.Body = io.NopCloser(bytes.NewReader(scoped))
+		req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(scoped)), nil }
+		req.ContentLength = int64(len(scoped))
+	}
+	name := tenant.Cluster
+	if tenant.hasRegions() {
+		name = tenant.regionCluster()
+	}
+	if len(name) != 0 {
+		cluster, ok := config.Environments[name]
+		if !ok || len(cluster.Addresses) == 0 {
+			return nil, fmt.Errorf("cluster %q of tenant %s is not configured", name, tenant.Name)
+		}
+		n := atomic.AddUint64(&tenantCounter, 1)
+		u, err := url.Parse(cluster.Addresses[n%uint64(len(cluster.Addresses))])
+		if err != nil {
+			return nil, err
+		}
+		req.URL.Scheme, req.URL.Host, req.Host = u.Scheme, u.Host, ""
+		req.Header.Del("Authorization")
+		if len(cluster.Username) != 0 {
+			req.SetBasicAuth(cluster.Username, cluster.Password)
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+func tenantDenied(req *http.Request, reason string) *http.Response {
+	body, _ := json.Marshal(map[string]interface{}{
+		"error":  map[string]interface{}{"type": "security_exception", "reason": reason},
+		"status": http.StatusForbidden,
+	})
+	return &http.Response{
+		Status:        "403 Forbidden",
+		StatusCode:    http.StatusForbidden,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+//ensured remembers the internal indices created, per tenant since each
+//tenant gets its own.
+var ensured sync.Map
+
+//ensureOnce runs create the first time the internal index is needed in the
+//tenant of the context.
+func ensureOnce(ctx context.Context, index string, create func()) {
+	once, _ := ensured.LoadOrStore(tenantScope(ctx, index), &sync.Once{})
+	once.(*sync.Once).Do(create)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+//TextPipelineConfig lists, in order, the steps applied to the text of
+//full-text searches before the query is built: trim, nfc, strip_emoji,
+//transliterate, lowercase and synonyms. Synonyms maps a word to the words
+//added next to it, so the search matches either.
+type TextPipelineConfig struct {
+	Steps    []string            `json:"steps"`
+	Synonyms map[string][]string `json:"synonyms"`
+}
+
+var textSteps = map[string]func(string) string{
+	"trim":          func(s string) string { return strings.Join(strings.Fields(s), " ") },
+	"nfc":           norm.NFC.String,
+	"strip_emoji":   stripEmoji,
+	"transliterate": transliterate,
+	"lowercase":     strings.ToLower,
+	"synonyms":      expandSynonyms,
+}
+
+//checkTextPipeline rejects unknown steps when the configuration is loaded
+//rather than on the first search that uses them.
+func checkTextPipeline(c TextPipelineConfig) error {
+	for _, step := range c.Steps {
+		if _, ok := textSteps[step]; !ok {
+			return fmt.Errorf("unknown text pipeline step %q", step)
+		}
+	}
+	return nil
+}
+
+//preprocessText runs text through the configured steps.
+func preprocessText(text string) string {
+	for _, step := range config.TextPipeline.Steps {
+		text = textSteps[step](text)
+	}
+	return text
+}
+
+//stripEmoji removes pictographs along with the joiners, variation selectors
+//and skin tone modifiers that glue them together. Latin-1 symbols such as °
+//are kept.
+func stripEmoji(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case unicode.Is(unicode.So, r) && r > 0xff, r == 0x200d,
+			r >= 0xfe00 && r <= 0xfe0f, r >= 0x1f3fb && r <= 0x1f3ff:
+			return -1
+		}
+		return r
+	}, s)
+}
+
+var transliterations = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'Æ': "AE", 'ø': "o", 'Ø': "O", 'œ': "oe", 'Œ': "OE",
+	'đ': "d", 'Đ': "D", 'ł': "l", 'Ł': "L", 'þ': "th", 'Þ': "TH",
+}
+
+//transliterate folds latin letters to ASCII: diacritics are dropped and the
+//few letters without a decomposition are spelled out.
+func transliterate(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(s) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if t, ok := transliterations[r]; ok {
+			b.WriteString(t)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return norm.NFC.String(b.String())
+}
+
+func expandSynonyms(s string) string {
+	var words []string
+	for _, w := range strings.Fields(s) {
+		words = append(words, w)
+		words = append(words, config.TextPipeline.Synonyms[strings.ToLower(w)]...)
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+//TextRangeConfig names, per index, the fields that ranges found in the text
+//of full-text searches filter on: ">= 100" on the numeric field, "2023..2024"
+//and "last week" on the date field. Ranges are left in the text for indices
+//without the matching field.
+type TextRangeConfig struct {
+	NumericFields map[string]string `json:"numeric_fields"`
+	DateFields    map[string]string `json:"date_fields"`
+}
+
+var (
+	comparisonPattern = regexp.MustCompile(`(>=|<=|>|<)\s*(-?\d+(?:\.\d+)?)`)
+	spanPattern       = regexp.MustCompile(`(-?\d+(?:[.-]\d+)*)\.\.(-?\d+(?:[.-]\d+)*)`)
+	datePattern       = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2})?)?$`)
+	numberPattern     = regexp.MustCompile(`^-?\d+(\.\d+)?$`)
+	relativePattern   = regexp.MustCompile(`(?i)\b(today|yesterday|last\s+(\d+\s+)?(day|week|month|year)s?)\b`)
+)
+
+var comparisonOps = map[string]string{">=": "gte", "<=": "lte", ">": "gt", "<": "lt"}
+
+var dateUnits = map[string]string{"day": "d", "week": "w", "month": "M", "year": "y"}
+
+//rangeField returns the field configured for the first of the indices that has one.
+func rangeField(fields map[string]string, index []string) string {
+	for _, i := range index {
+		if f := fields[i]; len(f) != 0 {
+			return f
+		}
+	}
+	return ""
+}
+
+//extractRanges moves the ranges written in text into range filters of the
+//query and returns what is left of the text.
+func extractRanges(index []string, text string, q interface{}) (string, interface{}) {
+	body, ok := searchBody(q)
+	if !ok {
+		return text, q
+	}
+	numeric := rangeField(config.TextRanges.NumericFields, index)
+	date := rangeField(config.TextRanges.DateFields, index)
+	var filters []interface{}
+	rangeFilter := func(field string, bounds map[string]interface{}) interface{} {
+		return map[string]interface{}{"range": map[string]interface{}{field: bounds}}
+	}
+
+	text = spanPattern.ReplaceAllStringFunc(text, func(m string) string {
+		parts := spanPattern.FindStringSubmatch(m)
+		switch {
+		case len(date) != 0 && datePattern.MatchString(parts[1]) && datePattern.MatchString(parts[2]):
+			filters = append(filters, rangeFilter(date, map[string]interface{}{
+				"gte": parts[1] + "||/" + datePrecision(parts[1]),
+				"lte": parts[2] + "||/" + datePrecision(parts[2]),
+			}))
+		case len(numeric) != 0 && numberPattern.MatchString(parts[1]) && numberPattern.MatchString(parts[2]):
+			filters = append(filters, rangeFilter(numeric, map[string]interface{}{"gte": parts[1], "lte": parts[2]}))
+		default:
+			return m
+		}
+		return " "
+	})
+	if len(numeric) != 0 {
+		text = comparisonPattern.ReplaceAllStringFunc(text, func(m string) string {
+			parts := comparisonPattern.FindStringSubmatch(m)
+			filters = append(filters, rangeFilter(numeric, map[string]interface{}{comparisonOps[parts[1]]: parts[2]}))
+			return " "
+		})
+	}
+	if len(date) != 0 {
+		text = relativePattern.ReplaceAllStringFunc(text, func(m string) string {
+			filters = append(filters, rangeFilter(date, relativeRange(m)))
+			return " "
+		})
+	}
+
+	switch len(filters) {
+	case 0:
+		return text, q
+	case 1:
+		addClause(body, "filter", filters[0])
+	default:
+		addClause(body, "filter", map[string]interface{}{"bool": map[string]interface{}{"filter": filters}})
+	}
+	return strings.Join(strings.Fields(text), " "), body
+}
+
+//datePrecision is the date math rounding unit matching how much of a date is written.
+func datePrecision(d string) string {
+	switch strings.Count(d, "-") {
+	case 0:
+		return "y"
+	case 1:
+		return "M"
+	}
+	return "d"
+}
+
+//relativeRange turns "today", "yesterday", "last week" or "last 3 days" into
+//date math bounds.
+func relativeRange(m string) map[string]interface{} {
+	words := strings.Fields(strings.ToLower(m))
+	switch words[0] {
+	case "today":
+		return map[string]interface{}{"gte": "now/d"}
+	case "yesterday":
+		return map[string]interface{}{"gte": "now-1d/d", "lt": "now/d"}
+	}
+	count, unit := "1", words[len(words)-1]
+	if len(words) == 3 {
+		count = words[1]
+	}
+	unit = dateUnits[strings.TrimSuffix(unit, "s")]
+	return map[string]interface{}{"gte": "now-" + count + unit + "/" + unit, "lte": "now"}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/mux"
+)
+
+//Transforms read source indices and write a destination index on their own
+//schedule, so only admins manage them.
+
+//transformsHandler lists the transforms, or returns the one named by id.
+func transformsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	path := "/_transform"
+	if id := mux.Vars(r)["id"]; len(id) != 0 {
+		path += "/" + url.PathEscape(id)
+	}
+	passthrough(w, r, http.MethodGet, path, forwardParams(r, "from", "size", "allow_no_match", "exclude_generated"), nil)
+}
+
+//transformStatsHandler returns the state, progress and checkpoints of a transform.
+func transformStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	passthrough(w, r, http.MethodGet, "/_transform/"+url.PathEscape(mux.Vars(r)["id"])+"/_stats", forwardParams(r, "allow_no_match"), nil)
+}
+
+//putTransformHandler creates a transform, pivot or latest, with the request
+//body. The transform does not run before it is started.
+func putTransformHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	logger.InfoContext(r.Context(), "transform created", "transform", id, "actor", actor(r))
+	passthrough(w, r, http.MethodPut, "/_transform/"+url.PathEscape(id), forwardParams(r, "defer_validation", "timeout"), r.Body)
+}
+
+//deleteTransformHandler removes a stopped transform, or a running one with
+//force=true. Its destination index is kept.
+func deleteTransformHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	logger.InfoContext(r.Context(), "transform deleted", "transform", id, "actor", actor(r))
+	passthrough(w, r, http.MethodDelete, "/_transform/"+url.PathEscape(id), forwardParams(r, "force", "timeout"), nil)
+}
+
+//startTransformHandler starts a transform.
+func startTransformHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	logger.InfoContext(r.Context(), "transform started", "transform", id, "actor", actor(r))
+	passthrough(w, r, http.MethodPost, "/_transform/"+url.PathEscape(id)+"/_start", forwardParams(r, "from", "timeout"), nil)
+}
+
+//stopTransformHandler stops a transform. wait_for_checkpoint=true lets it
+//finish its current checkpoint first.
+func stopTransformHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	logger.InfoContext(r.Context(), "transform stopped", "transform", id, "actor", actor(r))
+	passthrough(w, r, http.MethodPost, "/_transform/"+url.PathEscape(id)+"/_stop", forwardParams(r, "force", "wait_for_completion", "wait_for_checkpoint", "allow_no_match", "timeout"), nil)
+}
+
+//previewTransformHandler shows the first documents a transform would write:
+//the stored transform named by id, or the transform given in the body.
+func previewTransformHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	path := "/_transform/_preview"
+	if id := mux.Vars(r)["id"]; len(id) != 0 {
+		path = "/_transform/" + url.PathEscape(id) + "/_preview"
+		passthrough(w, r, http.MethodGet, path, forwardParams(r, "timeout"), nil)
+		return
+	}
+	passthrough(w, r, http.MethodPost, path, forwardParams(r, "timeout"), r.Body)
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch/esapi"
+)
+
+//TranslateRequest converts a query between the dialects the gateway speaks:
+//"sql" (elastic search SQL, From only), "filters" (the simplified filter
+//API), "where" (the SQL like where condition) and "dsl" (the query DSL, a
+//search body or a bare query). The query goes in the field of its dialect.
+type TranslateRequest struct {
+	From    string      `json:"from"`
+	To      string      `json:"to"`
+	SQL     string      `json:"sql"`
+	Filters []Filter    `json:"filters"`
+	Where   string      `json:"where"`
+	Query   interface{} `json:"query"`
+}
+
+//TranslateResponse holds the query in the field of the target dialect.
+type TranslateResponse struct {
+	From    string      `json:"from"`
+	To      string      `json:"to"`
+	Query   interface{} `json:"query,omitempty"`
+	Filters []Filter    `json:"filters,omitempty"`
+	Where   *string     `json:"where,omitempty"`
+}
+
+func translateError(msg string) error {
+	return &ValidationError{Path: "/query", Message: msg}
+}
+
+//dslFilters turns a query into filters. Only the conjunctions of conditions
+//filters can express translate: term, terms, range, match, prefix and exists
+//in the must, filter and must_not sections of bool queries.
+func dslFilters(q interface{}, negated bool, out *[]Filter) error {
+	kind, params, ok := singleKey(q)
+	if !ok {
+		return translateError("expected a query object with a single key")
+	}
+	if kind == "bool" {
+		for _, section := range sortedKeys(params) {
+			clauses := params[section]
+			switch section {
+			case "must", "filter", "must_not":
+			case "boost", "adjust_pure_negative":
+				continue
+			default:
+				return translateError("bool " + section + " has no filter equivalent")
+			}
+			if section == "must_not" && negated {
+				return translateError("nested must_not has no filter equivalent")
+			}
+			list, ok := clauses.([]interface{})
+			if !ok {
+				list = []interface{}{clauses}
+			}
+			for _, c := range list {
+				if err := dslFilters(c, section == "must_not", out); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if kind == "match_all" && !negated {
+		return nil
+	}
+	if kind == "exists" {
+		field, _ := params["field"].(string)
+		*out = append(*out, Filter{Field: field, Op: "exists", Value: !negated})
+		return nil
+	}
+	field, value, err := fieldValue(kind, params)
+	if err != nil {
+		return err
+	}
+	switch {
+	case kind == "term" && negated:
+		*out = append(*out, Filter{Field: field, Op: "ne", Value: value})
+	case kind == "term":
+		*out = append(*out, Filter{Field: field, Op: "eq", Value: value})
+	case kind == "terms" && negated:
+		*out = append(*out, Filter{Field: field, Op: "not_in", Value: value})
+	case kind == "terms":
+		*out = append(*out, Filter{Field: field, Op: "in", Value: value})
+	case negated:
+		return translateError("negated " + kind + " has no filter equivalent")
+	case kind == "match" || kind == "prefix":
+		*out = append(*out, Filter{Field: field, Op: kind, Value: value})
+	case kind == "range":
+		bounds, err := rangeBounds(value)
+		if err != nil {
+			return err
+		}
+		if from, ok := bounds["gte"]; ok {
+			if to, ok := bounds["lte"]; ok {
+				*out = append(*out, Filter{Field: field, Op: "between", Value: []interface{}{from, to}})
+				delete(bounds, "gte")
+				delete(bounds, "lte")
+			}
+		}
+		for _, op := range sortedKeys(bounds) {
+			*out = append(*out, Filter{Field: field, Op: op, Value: bounds[op]})
+		}
+	default:
+		return translateError(kind + " has no filter equivalent")
+	}
+	return nil
+}
+
+//dslWhere turns a query into a where condition. compound tells whether the
+//condition needs parentheses inside another.
+func dslWhere(q interface{}) (where string, compound bool, err error) {
+	kind, params, ok := singleKey(q)
+	if !ok {
+		return "", false, translateError("expected a query object with a single key")
+	}
+	switch kind {
+	case "match_all":
+		return "", false, nil
+	case "bool":
+		var parts []string
+		add := func(section, format string) error {
+			clauses, ok := params[section].([]interface{})
+			if !ok && params[section] != nil {
+				clauses = []interface{}{params[section]}
+			}
+			for _, c := range clauses {
+				w, compound, err := dslWhere(c)
+				if err != nil {
+					return err
+				}
+				if len(w) == 0 {
+					continue
+				}
+				if compound {
+					w = "(" + w + ")"
+				}
+				parts = append(parts, fmt.Sprintf(format, w))
+			}
+			return nil
+		}
+		if err := add("must", "%s"); err != nil {
+			return "", false, err
+		}
+		if err := add("filter", "%s"); err != nil {
+			return "", false, err
+		}
+		if err := add("must_not", "NOT %s"); err != nil {
+			return "", false, err
+		}
+		if _, ok := params["should"]; ok {
+			if len(parts) != 0 {
+				return "", false, translateError("should next to must, filter or must_not has no where equivalent")
+			}
+			if err := add("should", "%s"); err != nil {
+				return "", false, err
+			}
+			return strings.Join(parts, " OR "), len(parts) > 1, nil
+		}
+		return strings.Join(parts, " AND "), len(parts) > 1, nil
+	case "exists":
+		field, _ := params["field"].(string)
+		return whereField(field) + " IS NOT NULL", false, nil
+	}
+	field, value, err := fieldValue(kind, params)
+	if err != nil {
+		return "", false, err
+	}
+	switch kind {
+	case "term":
+		v, err := whereValue(value)
+		return whereField(field) + " = " + v, false, err
+	case "terms":
+		values, ok := value.([]interface{})
+		if !ok {
+			return "", false, translateError("terms needs an array")
+		}
+		list := make([]string, 0, len(values))
+		for _, value := range values {
+			v, err := whereValue(value)
+			if err != nil {
+				return "", false, err
+			}
+			list = append(list, v)
+		}
+		return whereField(field) + " IN (" + strings.Join(list, ", ") + ")", false, nil
+	case "range":
+		bounds, err := rangeBounds(value)
+		if err != nil {
+			return "", false, err
+		}
+		from, lower := bounds["gte"]
+		to, upper := bounds["lte"]
+		if lower && upper && len(bounds) == 2 {
+			f, err := whereValue(from)
+			if err != nil {
+				return "", false, err
+			}
+			t, err := whereValue(to)
+			return whereField(field) + " BETWEEN " + f + " AND " + t, false, err
+		}
+		ops := map[string]string{"gt": ">", "gte": ">=", "lt": "<", "lte": "<="}
+		var parts []string
+		for _, op := range sortedKeys(bounds) {
+			v, err := whereValue(bounds[op])
+			if err != nil {
+				return "", false, err
+			}
+			parts = append(parts, whereField(field)+" "+ops[op]+" "+v)
+		}
+		return strings.Join(parts, " AND "), len(parts) > 1, nil
+	case "wildcard", "prefix":
+		pattern, ok := value.(string)
+		if !ok || strings.ContainsAny(pattern, "%_") {
+			return "", false, translateError(kind + " pattern has no LIKE equivalent")
+		}
+		if kind == "prefix" {
+			return whereField(field) + " LIKE " + quoteWhere(pattern+"%"), false, nil
+		}
+		return whereField(field) + " LIKE " + quoteWhere(unlikeReplacer.Replace(pattern)), false, nil
+	}
+	return "", false, translateError(kind + " has no where equivalent")
+}
+
+//unlikeReplacer undoes likeReplacer.
+var unlikeReplacer = strings.NewReplacer(`\\`, `\`, `\*`, "*", `\?`, "?", "*", "%", "?", "_")
+
+func whereField(name string) string {
+	for i, r := range name {
+		if i == 0 && (r == '.' || r >= '0' && r <= '9') || !(r == '_' || r == '@' || r == '.' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+		}
+	}
+	return name
+}
+
+func quoteWhere(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func whereValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return quoteWhere(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case bool:
+		return strings.ToUpper(strconv.FormatBool(v)), nil
+	}
+	return "", translateError(fmt.Sprintf("value %v has no where equivalent", v))
+}
+
+//singleKey returns the kind and parameters of a query clause.
+func singleKey(q interface{}) (string, map[string]interface{}, bool) {
+	m, ok := q.(map[string]interface{})
+	if !ok || len(m) != 1 {
+		return "", nil, false
+	}
+	for k, v := range m {
+		params, ok := v.(map[string]interface{})
+		return k, params, ok
+	}
+	return "", nil, false
+}
+
+//fieldValue returns the field and value of a leaf query, in its short
+//({"status": "open"}) or long ({"status": {"value": "open", "boost": 1}}) form.
+func fieldValue(kind string, params map[string]interface{}) (string, interface{}, error) {
+	var field string
+	var value interface{}
+	for k, v := range params {
+		if k == "boost" {
+			continue
+		}
+		if len(field) != 0 {
+			return "", nil, translateError(kind + " on several fields")
+		}
+		field, value = k, v
+	}
+	if len(field) == 0 {
+		return "", nil, translateError(kind + " without a field")
+	}
+	if long, ok := value.(map[string]interface{}); ok && kind != "range" {
+		for _, key := range []string{"value", "query", "wildcard"} {
+			if v, ok := long[key]; ok {
+				return field, v, nil
+			}
+		}
+	}
+	return field, value, nil
+}
+
+//rangeBounds returns the gt, gte, lt and lte bounds of a range, also from the
+//from, to, include_lower and include_upper form elastic search SQL writes.
+func rangeBounds(value interface{}) (map[string]interface{}, error) {
+	params, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, translateError("range needs an object")
+	}
+	bounds := map[string]interface{}{}
+	for k, v := range params {
+		switch k {
+		case "gt", "gte", "lt", "lte":
+			bounds[k] = v
+		case "from", "to":
+			if v == nil {
+				continue
+			}
+			op := map[string]string{"from": "gt", "to": "lt"}[k]
+			include := map[string]string{"from": "include_lower", "to": "include_upper"}[k]
+			if inclusive, ok := params[include].(bool); !ok || inclusive {
+				op += "e"
+			}
+			bounds[op] = v
+		case "boost", "include_lower", "include_upper":
+		default:
+			return nil, translateError("range " + k + " has no equivalent")
+		}
+	}
+	return bounds, nil
+}
+
+//sqlTranslate has elastic search translate a SQL query into a search body.
+func sqlTranslate(r *http.Request, sql string) (map[string]interface{}, *esapi.Response, error) {
+	buf, err := encodeBody(map[string]interface{}{"query": sql})
+	if err != nil {
+		return nil, nil, err
+	}
+	es, err := defaultClient()
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, "/_sql/translate", buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := es.Perform(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if res.StatusCode >= http.StatusMultipleChoices {
+		return nil, &esapi.Response{StatusCode: res.StatusCode, Header: res.Header, Body: res.Body}, nil
+	}
+	defer res.Body.Close()
+	var body map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	return body, nil, err
+}
+
+//translateHandler converts a query between dialects, to learn one from
+//another or migrate from one to another.
+func translateHandler(w http.ResponseWriter, r *http.Request) {
+	var req TranslateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	//the source is first turned into a search body
+	var body map[string]interface{}
+	switch req.From {
+	case "sql":
+		if len(strings.TrimSpace(req.SQL)) == 0 {
+			writeValidationError(w, &ValidationError{Path: "/sql", Message: "sql is required"})
+			return
+		}
+		translated, failed, err := sqlTranslate(r, req.SQL)
+		if err != nil {
+			logger.ErrorContext(r.Context(), "error translating SQL", "error", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if failed != nil {
+			writeResponse(w, failed)
+			return
+		}
+		body = translated
+	case "filters":
+		q, err := compileFilters(req.Filters)
+		if err != nil {
+			writeValidationError(w, err)
+			return
+		}
+		body = map[string]interface{}{"query": q}
+	case "where":
+		q, err := compileWhere(req.Where)
+		if err != nil {
+			writeValidationError(w, err)
+			return
+		}
+		body = map[string]interface{}{"query": q}
+	case "dsl":
+		m, ok := req.Query.(map[string]interface{})
+		if !ok {
+			writeValidationError(w, &ValidationError{Path: "/query", Message: "query must be a JSON object"})
+			return
+		}
+		body = m
+		if _, ok := m["query"]; !ok {
+			body = map[string]interface{}{"query": m}
+		}
+	default:
+		writeValidationError(w, &ValidationError{Path: "/from", Message: "from must be sql, filters, where or dsl"})
+		return
+	}
+	out := TranslateResponse{From: req.From, To: req.To}
+	q, ok := body["query"]
+	if !ok {
+		q = map[string]interface{}{"match_all": map[string]interface{}{}}
+	}
+	switch req.To {
+	case "dsl":
+		out.Query = body
+	case "filters":
+		out.Filters = []Filter{}
+		if err := dslFilters(q, false, &out.Filters); err != nil {
+			writeValidationError(w, err)
+			return
+		}
+	case "where":
+		where, _, err := dslWhere(q)
+		if err != nil {
+			writeValidationError(w, err)
+			return
+		}
+		out.Where = &where
+	default:
+		writeValidationError(w, &ValidationError{Path: "/to", Message: "to must be dsl, filters or where"})
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//upstreamInfo collects what happened on the elastic search side while serving
+//one request: the indices touched, the number of calls and the summed took time.
+type upstreamInfo struct {
+	mu        sync.Mutex
+	indices   []string
+	calls     int
+	took      int64
+	queryHash string
+}
+
+func withUpstreamInfo(ctx context.Context) (context.Context, *upstreamInfo) {
+	info := &upstreamInfo{}
+	return context.WithValue(ctx, upstreamKey, info), info
+}
+
+func upstreamFrom(ctx context.Context) *upstreamInfo {
+	info, _ := ctx.Value(upstreamKey).(*upstreamInfo)
+	return info
+}
+
+func (u *upstreamInfo) setQueryHash(hash string) {
+	u.mu.Lock()
+	u.queryHash = hash
+	u.mu.Unlock()
+}
+
+func (u *upstreamInfo) snapshot() (index string, calls int, took int64, queryHash string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return strings.Join(u.indices, ","), u.calls, u.took, u.queryHash
+}
+
+//upstreamTransport fills the upstreamInfo of the request context, if any.
+type upstreamTransport struct {
+	base http.RoundTripper
+}
+
+func (t upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	info := upstreamFrom(req.Context())
+	if info == nil {
+		return t.base.RoundTrip(req)
+	}
+	info.mu.Lock()
+	info.calls++
+	if index := indexFromPath(req.URL.Path); len(index) != 0 {
+		info.indices = append(info.indices, index)
+	}
+	info.mu.Unlock()
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body = &tookReader{ReadCloser: res.Body, onClose: func(took int64, ok bool) {
+		if ok {
+			info.mu.Lock()
+			info.took += took
+			info.mu.Unlock()
+		}
+	}}
+	return res, nil
+}
+
+var tookPattern = regexp.MustCompile(`"took"\s*:\s*(\d+)`)
+
+//tookReader watches the head of an elastic search response body for its took
+//time and reports it once the body is closed.
+type tookReader struct {
+	io.ReadCloser
+	onClose func(took int64, ok bool)
+	head    bytes.Buffer
+	closed  bool
+}
+
+func (r *tookReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if room := 256 - r.head.Len(); room > 0 && n > 0 {
+		if room > n {
+			room = n
+		}
+		r.head.Write(p[:room])
+	}
+	return n, err
+}
+
+func (r *tookReader) Close() error {
+	if !r.closed {
+		r.closed = true
+		var took int64
+		m := tookPattern.FindSubmatch(r.head.Bytes())
+		ok := m != nil
+		if ok {
+			took, _ = strconv.ParseInt(string(m[1]), 10, 64)
+		}
+		r.onClose(took, ok)
+	}
+	return r.ReadCloser.Close()
+}
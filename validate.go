@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch"
+)
+
+//ValidationConfig turns on checking of the elastic query before it is sent.
+//Remote additionally asks the cluster through _validate/query.
+type ValidationConfig struct {
+	Enabled bool `json:"enabled"`
+	Remote  bool `json:"remote"`
+}
+
+//ValidationError points at the part of the request that is wrong, as a JSON
+//pointer into the elastic query.
+type ValidationError struct {
+	Path    string `json:"path"`
+	Message string `json:"error"`
+}
+
+func (e *ValidationError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+var searchBodyKeys = map[string]bool{
+	"query": true, "aggs": true, "aggregations": true, "sort": true, "from": true, "size": true,
+	"_source": true, "fields": true, "docvalue_fields": true, "stored_fields": true, "script_fields": true,
+	"runtime_mappings": true, "highlight": true, "suggest": true, "post_filter": true, "rescore": true,
+	"collapse": true, "search_after": true, "pit": true, "track_total_hits": true, "track_scores": true,
+	"min_score": true, "timeout": true, "terminate_after": true, "explain": true, "version": true,
+	"seq_no_primary_term": true, "indices_boost": true, "knn": true, "profile": true, "stats": true,
+	"ext": true, "slice": true,
+}
+
+var leafQueries = map[string]bool{
+	"match": true, "match_all": true, "match_none": true, "match_phrase": true, "match_phrase_prefix": true,
+	"match_bool_prefix": true, "multi_match": true, "combined_fields": true, "query_string": true,
+	"simple_query_string": true, "intervals": true, "term": true, "terms": true, "terms_set": true,
+	"range": true, "exists": true, "prefix": true, "wildcard": true, "regexp": true, "fuzzy": true,
+	"ids": true, "geo_distance": true, "geo_bounding_box": true, "geo_polygon": true, "geo_shape": true,
+	"shape": true, "more_like_this": true, "script": true, "script_score": true, "percolate": true,
+	"distance_feature": true, "rank_feature": true, "wrapper": true, "pinned": true, "knn": true,
+	"has_child": true, "has_parent": true, "parent_id": true, "span_term": true, "span_near": true,
+	"span_or": true, "span_not": true, "span_first": true, "span_multi": true, "span_containing": true,
+	"span_within": true, "field_masking_span": true, "text_expansion": true, "sparse_vector": true,
+	"semantic": true, "rule": true,
+}
+
+//compoundQueries maps each compound query to its clauses holding sub queries.
+var compoundQueries = map[string][]string{
+	"bool":           {"must", "should", "filter", "must_not"},
+	"dis_max":        {"queries"},
+	"constant_score": {"filter"},
+	"function_score": {"query"},
+	"boosting":       {"positive", "negative"},
+	"nested":         {"query"},
+}
+
+//validateSearchBody checks the structure of an elastic query without
+//contacting the cluster.
+func validateSearchBody(q interface{}) error {
+	if q == nil {
+		return nil
+	}
+	body, ok := q.(map[string]interface{})
+	if !ok {
+		return &ValidationError{Path: "/", Message: "elasticquery must be a JSON object"}
+	}
+	for k, v := range body {
+		if !searchBodyKeys[k] {
+			return &ValidationError{Path: "/" + escapePointer(k), Message: "unknown search body key"}
+		}
+		if k == "query" || k == "post_filter" {
+			if err := validateQuery("/"+k, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateQuery(path string, q interface{}) error {
+	obj, ok := q.(map[string]interface{})
+	if !ok {
+		return &ValidationError{Path: path, Message: "query must be a JSON object"}
+	}
+	if len(obj) != 1 {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("query must have exactly one type, found %d", len(obj))}
+	}
+	for name, clause := range obj {
+		p := path + "/" + escapePointer(name)
+		if leafQueries[name] {
+			if _, ok := clause.(map[string]interface{}); !ok {
+				return &ValidationError{Path: p, Message: "query body must be a JSON object"}
+			}
+			return nil
+		}
+		subs, ok := compoundQueries[name]
+		if !ok {
+			return &ValidationError{Path: p, Message: "unknown query type"}
+		}
+		params, ok := clause.(map[string]interface{})
+		if !ok {
+			return &ValidationError{Path: p, Message: "query body must be a JSON object"}
+		}
+		for _, sub := range subs {
+			v, ok := params[sub]
+			if !ok {
+				continue
+			}
+			if list, ok := v.([]interface{}); ok {
+				for i, item := range list {
+					if err := validateQuery(p+"/"+sub+"/"+strconv.Itoa(i), item); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if err := validateQuery(p+"/"+sub, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//escapePointer escapes a JSON pointer token (RFC 6901).
+func escapePointer(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
+
+//validateRemote asks the cluster whether the query part of the body is valid.
+func validateRemote(ctx context.Context, es *elasticsearch.Client, index []string, q interface{}) error {
+	body, ok := searchBody(q)
+	if !ok || body["query"] == nil {
+		return nil
+	}
+	buf, err := encodeBody(map[string]interface{}{"query": body["query"]})
+	if err != nil {
+		return err
+	}
+	res, err := es.Indices.ValidateQuery(
+		es.Indices.ValidateQuery.WithContext(ctx),
+		es.Indices.ValidateQuery.WithIndex(index...),
+		es.Indices.ValidateQuery.WithBody(buf),
+		es.Indices.ValidateQuery.WithExplain(true),
+	)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	var result struct {
+		Valid        bool `json:"valid"`
+		Explanations []struct {
+			Index string `json:"index"`
+			Error string `json:"error"`
+		} `json:"explanations"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return err
+	}
+	if result.Valid {
+		return nil
+	}
+	msg := "query rejected by elastic search"
+	for _, e := range result.Explanations {
+		if len(e.Error) != 0 {
+			msg = e.Error
+			break
+		}
+	}
+	return &ValidationError{Path: "/query", Message: msg}
+}
+
+//writeValidationError answers 400 for validation failures and 502 otherwise.
+func writeValidationError(w http.ResponseWriter, err error) {
+	if v, ok := err.(*ValidationError); ok {
+		writeJSON(w, http.StatusBadRequest, v)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+//version is set at build time with -ldflags "-X main.version=1.4.0".
+var version = "dev"
+
+//supportedVersions is the range of elastic search versions the gateway is
+//tested against. Exports need point in time searches, added in 7.10.
+var supportedVersions = map[string]string{"min": "7.10.0", "max": "8.x"}
+
+//BuildInfo tells clients what this gateway is and can do, so they can detect
+//features instead of guessing from the version.
+type BuildInfo struct {
+	Version       string                 `json:"version"`
+	Commit        string                 `json:"commit,omitempty"`
+	CommitTime    string                 `json:"commit_time,omitempty"`
+	Modified      bool                   `json:"modified,omitempty"`
+	GoVersion     string                 `json:"go_version"`
+	Features      map[string]bool        `json:"features"`
+	Limits        map[string]interface{} `json:"limits"`
+	ElasticSearch map[string]string      `json:"elasticsearch"`
+}
+
+//features lists the optional parts of the gateway and whether this
+//configuration turns them on.
+func features() map[string]bool {
+	return map[string]bool{
+		"search":           true,
+		"export":           true,
+		"export_progress":  true,
+		"ingestion":        true,
+		"async_search":     true,
+		"websocket":        true,
+		"odata":            true,
+		"prepared":         true,
+		"eql":              true,
+		"percolate":        true,
+		"more_like_this":   true,
+		"knn":              true,
+		"geo":              true,
+		"where":            true,
+		"translate":        true,
+		"template_lint":    true,
+		"doc_schemas":      true,
+		"ingest_pipelines": true,
+		"transforms":       true,
+		"data_streams":     true,
+		"pit":              true,
+		"fanout":           true,
+		"complexity":       true,
+		"remote_clusters":  len(config.RemoteClusters.Allowed) != 0,
+		"cache_warmup":     len(config.Warmup.Schedules) != 0,
+		"export_manifest":  true,
+		"request_v2":       true,
+		"webhooks":         len(config.Webhooks.Endpoints) != 0,
+		"fieldcaps":        true,
+		"privacy":          len(config.Privacy.Indices) != 0,
+		"datasets":         true,
+		"cluster_settings": len(config.ClusterSettings.Allowed) != 0,
+		"regions":          len(regionClusters()) != 0,
+		"explain":          true,
+		"profiling":        true,
+		"page_guard":       true,
+		"msgpack":          true,
+		"xml":              true,
+		"request_tracking": config.RequestTracking.Enabled,
+		"journal":          config.Journal.Enabled,
+		"auth":             config.Auth.enabled(),
+		"embeddings":       config.Embedding.enabled(),
+		"jwt":              config.Auth.JWT.enabled(),
+		"authz":            len(config.Authz.Rules) != 0,
+		"cache":            config.Cache.Enabled,
+		"shared_cache":     config.Cache.Enabled && config.Cache.Backend == "redis",
+		"soft_delete":      config.SoftDelete.Enabled,
+		"history":          config.History.Enabled,
+		"freshness":        config.Freshness.Enabled,
+		"validation":       config.Validation.Enabled,
+		"openapi_checks":   config.OpenAPI.Validate,
+		"backpressure":     config.Backpressure.Enabled,
+		"retry":            config.Retry.enabled(),
+		"tracing":          config.Tracing.Enabled,
+		"analytics":        len(config.Analytics.Index) != 0,
+		"sketches":         len(config.Sketches.Fields) != 0,
+		"experiments":      len(config.Experiments) != 0,
+		"scoring":          len(config.Scoring.Profiles) != 0,
+		"graphql":          config.GraphQL.enabled(),
+		"grpc":             len(config.GRPC.Addr) != 0,
+		"tenancy":          config.Tenancy.enabled(),
+		"degradation":      config.Degradation.Enabled,
+	}
+}
+
+//limits lists the limits clients run into, zero meaning none.
+func limits() map[string]interface{} {
+	l := map[string]interface{}{
+		"default_size":      defaultSize,
+		"max_result_window": defaultMaxResultWindow,
+		"export_page_size":  exportPageSize,
+	}
+	if config.Backpressure.Enabled {
+		l["max_in_flight_writes"] = config.Backpressure.MaxInFlight
+		l["max_rejections"] = config.Backpressure.MaxRejections
+		l["rejection_window"] = config.Backpressure.Window.String()
+	}
+	if config.Cache.Enabled {
+		l["cache_ttl"] = config.Cache.TTL.String()
+		l["cache_max_entries"] = config.Cache.MaxEntries
+		l["cache_max_bytes"] = config.Cache.MaxBytes
+	}
+	return l
+}
+
+func buildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:       version,
+		GoVersion:     runtime.Version(),
+		Features:      features(),
+		Limits:        limits(),
+		ElasticSearch: supportedVersions,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "dev" && len(bi.Main.Version) != 0 && bi.Main.Version != "(devel)" {
+			info.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				info.Commit = s.Value
+			case "vcs.time":
+				info.CommitTime = s.Value
+			case "vcs.modified":
+				info.Modified = s.Value == "true"
+			}
+		}
+	}
+	return info
+}
+
+//versionHandler answers the build and capability information.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, buildInfo())
+}
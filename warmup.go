@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//WarmupConfig schedules the warming of the response cache with the panels of
+//saved dashboards, so the first users of the day do not pay for cold caches.
+//Panels run as Actor with Roles, in Workers at a time.
+type WarmupConfig struct {
+	Schedules []WarmupSchedule `json:"schedules"`
+	Actor     string           `json:"actor"`
+	Roles     []string         `json:"roles"`
+	Workers   int              `json:"workers"`
+}
+
+//WarmupSchedule warms the caches for Dashboards at At ("07:45") in each of
+//Timezones ("Europe/Paris"), on Days ("mon", "tue"...), every day without.
+type WarmupSchedule struct {
+	Dashboards []string `json:"dashboards"`
+	At         string   `json:"at"`
+	Timezones  []string `json:"timezones"`
+	Days       []string `json:"days"`
+}
+
+//Dashboard is a saved set of panels, each a search as sent to /elastic. The
+//panels of a tenant's dashboard run for that tenant.
+type Dashboard struct {
+	Name    string           `json:"name"`
+	Tenant  string           `json:"tenant,omitempty"`
+	Panels  []DashboardPanel `json:"panels"`
+	Actor   string           `json:"actor,omitempty"`
+	Updated time.Time        `json:"updated"`
+}
+
+//DashboardPanel is one search of a dashboard.
+type DashboardPanel struct {
+	Title  string          `json:"title"`
+	Search json.RawMessage `json:"search"`
+}
+
+//WarmupRun is the outcome of warming the caches with a dashboard.
+type WarmupRun struct {
+	Dashboard string        `json:"dashboard"`
+	Timezone  string        `json:"timezone,omitempty"`
+	Started   time.Time     `json:"started"`
+	Millis    int64         `json:"ms"`
+	Panels    []PanelWarmup `json:"panels"`
+}
+
+//PanelWarmup is the outcome of running one panel.
+type PanelWarmup struct {
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Cache  string `json:"cache,omitempty"`
+	Millis int64  `json:"ms"`
+}
+
+//dashboardsNamespace is the namespace of the saved dashboards in the store.
+const dashboardsNamespace = "dashboards"
+
+var (
+	warmupMu sync.Mutex
+	//warmupRuns holds the last run of each dashboard
+	warmupRuns = map[string]WarmupRun{}
+	//warmedAt holds the day each schedule last ran, by schedule and timezone
+	warmedAt = map[string]string{}
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+//checkWarmup checks the warmup configuration: without workers, no panel
+//would ever be warmed and the warmups would wait forever.
+func checkWarmup(c WarmupConfig) error {
+	if c.Workers < 1 {
+		return &ValidationError{Path: "/warmup/workers", Message: "must be at least 1"}
+	}
+	for i, s := range c.Schedules {
+		p := "/warmup/schedules/" + strconv.Itoa(i)
+		if _, err := time.Parse("15:04", s.At); err != nil {
+			return &ValidationError{Path: p + "/at", Message: "must be a time of day (07:45)"}
+		}
+		for _, tz := range s.Timezones {
+			if _, err := time.LoadLocation(tz); err != nil {
+				return &ValidationError{Path: p + "/timezones", Message: err.Error()}
+			}
+		}
+		for _, d := range s.Days {
+			if _, ok := weekdays[strings.ToLower(d)]; !ok {
+				return &ValidationError{Path: p + "/days", Message: "unknown day " + d}
+			}
+		}
+	}
+	return nil
+}
+
+//dueWarmup is a schedule due in one of its timezones.
+type dueWarmup struct {
+	schedule WarmupSchedule
+	timezone string
+}
+
+//dueWarmups returns the schedules due at now in each of their timezones, the
+//UTC when they have none, each once a day.
+func dueWarmups(now time.Time) []dueWarmup {
+	var due []dueWarmup
+	warmupMu.Lock()
+	defer warmupMu.Unlock()
+	for i, s := range config.Warmup.Schedules {
+		timezones := s.Timezones
+		if len(timezones) == 0 {
+			timezones = []string{"UTC"}
+		}
+		for _, tz := range timezones {
+			loc, err := time.LoadLocation(tz)
+			if err != nil {
+				continue
+			}
+			local := now.In(loc)
+			if local.Format("15:04") != s.At || !warmupDay(s.Days, local.Weekday()) {
+				continue
+			}
+			key, day := strconv.Itoa(i)+"/"+tz, local.Format("2006-01-02")
+			if warmedAt[key] == day {
+				continue
+			}
+			warmedAt[key] = day
+			due = append(due, dueWarmup{schedule: s, timezone: tz})
+		}
+	}
+	return due
+}
+
+func warmupDay(days []string, day time.Weekday) bool {
+	if len(days) == 0 {
+		return true
+	}
+	for _, d := range days {
+		if weekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+//scheduleWarmups runs the due schedules forever, checking every minute.
+func scheduleWarmups() {
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		for _, due := range dueWarmups(time.Now()) {
+			for _, name := range due.schedule.Dashboards {
+				d, ok, err := loadDashboard(context.Background(), name)
+				if err != nil || !ok {
+					logger.Warn("unable to load dashboard to warm", "dashboard", name, "error", err)
+					continue
+				}
+				warmDashboard(context.Background(), d, due.timezone)
+			}
+		}
+	}
+}
+
+func loadDashboard(ctx context.Context, name string) (Dashboard, bool, error) {
+	var d Dashboard
+	b, ok, err := state.get(ctx, dashboardsNamespace, name)
+	if err != nil || !ok {
+		return d, false, err
+	}
+	if err := json.Unmarshal(b, &d); err != nil {
+		return d, false, err
+	}
+	return d, true, nil
+}
+
+//warmDashboard runs the panels of the dashboard through the search handler,
+//so their responses are cached under the keys the users' searches look up.
+func warmDashboard(ctx context.Context, d Dashboard, timezone string) WarmupRun {
+	ctx = context.WithValue(ctx, identityKey, &Identity{Name: config.Warmup.Actor, Roles: config.Warmup.Roles, Method: "warmup"})
+	if len(d.Tenant) != 0 {
+		if t, ok := config.Tenancy.Tenants[d.Tenant]; ok {
+			t.Name = d.Tenant
+			ctx = context.WithValue(ctx, tenantKey, &t)
+		}
+	}
+	run := WarmupRun{Dashboard: d.Name, Timezone: timezone, Started: time.Now().UTC(), Panels: make([]PanelWarmup, len(d.Panels))}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for n := 0; n < config.Warmup.Workers && n < len(d.Panels); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				run.Panels[i] = warmPanel(ctx, d.Panels[i])
+			}
+		}()
+	}
+	for i := range d.Panels {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	run.Millis = time.Since(run.Started).Milliseconds()
+	warmed := 0
+	for _, p := range run.Panels {
+		if p.Status == http.StatusOK {
+			warmed++
+		}
+	}
+	logger.Info("dashboard cache warmed", "dashboard", d.Name, "timezone", timezone, "panels", len(d.Panels), "warmed", warmed, "ms", run.Millis)
+	warmupMu.Lock()
+	warmupRuns[d.Name] = run
+	warmupMu.Unlock()
+	return run
+}
+
+func warmPanel(ctx context.Context, p DashboardPanel) PanelWarmup {
+	start := time.Now()
+	req := httptest.NewRequest(http.MethodPost, "/elastic", bytes.NewReader(p.Search)).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	RecoveryMid(http.HandlerFunc(elasticSearchHandler)).ServeHTTP(rec, req)
+	return PanelWarmup{Title: p.Title, Status: rec.Code, Cache: rec.Header().Get("X-Cache"), Millis: time.Since(start).Milliseconds()}
+}
+
+//dashboardsHandler lists the saved dashboards with their last warmup.
+func dashboardsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	values, err := state.list(r.Context(), dashboardsNamespace)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to list dashboards", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	type dashboardState struct {
+		Dashboard
+		LastWarmup *WarmupRun `json:"last_warmup,omitempty"`
+	}
+	list := []dashboardState{}
+	warmupMu.Lock()
+	defer warmupMu.Unlock()
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var d Dashboard
+		if err := json.Unmarshal(values[name], &d); err != nil {
+			logger.WarnContext(r.Context(), "unable to read dashboard", "dashboard", name, "error", err)
+			continue
+		}
+		s := dashboardState{Dashboard: d}
+		if run, ok := warmupRuns[name]; ok {
+			s.LastWarmup = &run
+		}
+		list = append(list, s)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+//putDashboardHandler saves a dashboard.
+func putDashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	var d Dashboard
+	if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(d.Panels) == 0 {
+		writeValidationError(w, &ValidationError{Path: "/panels", Message: "is required"})
+		return
+	}
+	for i, p := range d.Panels {
+		var search RequestBody
+		if err := json.Unmarshal(p.Search, &search); err != nil {
+			writeValidationError(w, &ValidationError{Path: "/panels/" + strconv.Itoa(i) + "/search", Message: err.Error()})
+			return
+		}
+	}
+	if _, ok := config.Tenancy.Tenants[d.Tenant]; len(d.Tenant) != 0 && !ok {
+		writeValidationError(w, &ValidationError{Path: "/tenant", Message: "unknown tenant " + d.Tenant})
+		return
+	}
+	d.Name, d.Actor, d.Updated = name, actor(r), time.Now().UTC()
+	if err := saveState(r.Context(), dashboardsNamespace, name, d); err != nil {
+		logger.ErrorContext(r.Context(), "unable to save dashboard", "dashboard", name, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger.InfoContext(r.Context(), "dashboard saved", "dashboard", name, "panels", len(d.Panels), "actor", actor(r))
+	writeJSON(w, http.StatusOK, d)
+}
+
+//deleteDashboardHandler removes a saved dashboard.
+func deleteDashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if _, ok, err := loadDashboard(r.Context(), name); err != nil || !ok {
+		http.Error(w, "unknown dashboard "+name, http.StatusNotFound)
+		return
+	}
+	if err := saveState(r.Context(), dashboardsNamespace, name, nil); err != nil {
+		logger.ErrorContext(r.Context(), "unable to remove dashboard", "dashboard", name, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger.InfoContext(r.Context(), "dashboard removed", "dashboard", name, "actor", actor(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//warmDashboardHandler warms the caches with a dashboard now, and answers the
+//outcome of each panel.
+func warmDashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	d, ok, err := loadDashboard(r.Context(), name)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to load dashboard", "dashboard", name, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "unknown dashboard "+name, http.StatusNotFound)
+		return
+	}
+	logger.InfoContext(r.Context(), "dashboard warmup requested", "dashboard", name, "actor", actor(r))
+	writeJSON(w, http.StatusOK, warmDashboard(r.Context(), d, ""))
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//WebhookConfig lists the endpoints notified of the events of the gateway
+//(export.finished, export.failed...). A delivery is attempted up to
+//MaxAttempts times, waiting Backoff before the first retry, doubled for each
+//following one up to MaxBackoff; network errors, 408, 429 and 5xx answers are
+//retried, other answers fail the delivery at once. The last LogSize
+//deliveries of each endpoint are kept for the admin endpoints, where failed
+//ones can be redriven.
+type WebhookConfig struct {
+	Endpoints   []WebhookEndpoint `json:"endpoints"`
+	MaxAttempts int               `json:"max_attempts"`
+	Backoff     Duration          `json:"backoff"`
+	MaxBackoff  Duration          `json:"max_backoff"`
+	Timeout     Duration          `json:"timeout"`
+	LogSize     int               `json:"log_size"`
+}
+
+//WebhookEndpoint receives the events matching one of its Events patterns
+//("export.*"), all of them without. With a Secret, the payload is signed: the
+//X-Webhook-Signature header is "sha256=" and the hex HMAC-SHA256 of the
+//X-Webhook-Timestamp header, a dot and the body, so receivers can check both
+//the sender and the age of the payload.
+type WebhookEndpoint struct {
+	Name   string   `json:"name"`
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+//Delivery is one event sent to one endpoint.
+type Delivery struct {
+	ID         string          `json:"id"`
+	Endpoint   string          `json:"endpoint"`
+	Event      string          `json:"event"`
+	Payload    json.RawMessage `json:"payload"`
+	Status     string          `json:"status"`
+	Attempts   int             `json:"attempts"`
+	LastStatus int             `json:"last_status,omitempty"`
+	LastError  string          `json:"last_error,omitempty"`
+	Created    time.Time       `json:"created"`
+	Updated    time.Time       `json:"updated"`
+}
+
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+var (
+	deliveriesMu sync.Mutex
+	//deliveries are the logs of the endpoints, oldest first, kept in the store
+	//so that pending deliveries resume and failed ones can be redriven after
+	//a restart.
+	deliveries = map[string][]*Delivery{}
+)
+
+//deliveriesNamespace is the namespace of the deliveries in the store.
+const deliveriesNamespace = "webhook_deliveries"
+
+//saveDelivery writes a copy of a delivery, taken under deliveriesMu, to the
+//store. Failures are logged: the delivery goes on regardless.
+func saveDelivery(d Delivery) {
+	if err := saveState(context.Background(), deliveriesNamespace, d.ID, d); err != nil {
+		logger.Warn("unable to save webhook delivery", "delivery", d.ID, "error", err)
+	}
+}
+
+//logDelivery appends a delivery to the log of its endpoint, dropping the
+//oldest ones past LogSize.
+func logDelivery(d *Delivery) {
+	deliveriesMu.Lock()
+	log := append(deliveries[d.Endpoint], d)
+	var dropped []*Delivery
+	if len(log) > config.Webhooks.LogSize {
+		dropped = log[:len(log)-config.Webhooks.LogSize]
+		log = log[len(log)-config.Webhooks.LogSize:]
+	}
+	deliveries[d.Endpoint] = log
+	deliveriesMu.Unlock()
+	for _, old := range dropped {
+		if err := saveState(context.Background(), deliveriesNamespace, old.ID, nil); err != nil {
+			logger.Warn("unable to remove webhook delivery", "delivery", old.ID, "error", err)
+		}
+	}
+}
+
+//loadDeliveries reads the logs of the endpoints from the store, and resumes
+//the pending deliveries of the endpoints still configured.
+func loadDeliveries(ctx context.Context) error {
+	values, err := state.list(ctx, deliveriesNamespace)
+	if err != nil {
+		return err
+	}
+	list := make([]*Delivery, 0, len(values))
+	for id, b := range values {
+		var d Delivery
+		if err := json.Unmarshal(b, &d); err != nil {
+			return fmt.Errorf("webhook delivery %s: %w", id, err)
+		}
+		list = append(list, &d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	for _, d := range list {
+		logDelivery(d)
+	}
+	for _, d := range list {
+		if e, ok := webhookEndpoint(d.Endpoint); ok && d.Status == deliveryPending {
+			go deliver(e, d)
+		}
+	}
+	return nil
+}
+
+var webhookClient = &http.Client{}
+
+func webhookEndpoint(name string) (WebhookEndpoint, bool) {
+	for _, e := range config.Webhooks.Endpoints {
+		if e.Name == name {
+			return e, true
+		}
+	}
+	return WebhookEndpoint{}, false
+}
+
+func (e WebhookEndpoint) wants(event string) bool {
+	if len(e.Events) == 0 {
+		return true
+	}
+	for _, pattern := range e.Events {
+		if ok, _ := path.Match(pattern, event); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//notify sends the event with its payload to the endpoints wanting it, in the
+//background.
+func notify(event string, payload interface{}) {
+	if len(config.Webhooks.Endpoints) == 0 {
+		return
+	}
+	b, err := json.Marshal(map[string]interface{}{"event": event, "time": time.Now().UTC(), "data": payload})
+	if err != nil {
+		logger.Error("error encoding webhook payload", "event", event, "error", err)
+		return
+	}
+	for _, e := range config.Webhooks.Endpoints {
+		if !e.wants(event) {
+			continue
+		}
+		id := make([]byte, 12)
+		rand.Read(id)
+		d := &Delivery{
+			ID:       hex.EncodeToString(id),
+			Endpoint: e.Name,
+			Event:    event,
+			Payload:  b,
+			Status:   deliveryPending,
+			Created:  time.Now(),
+			Updated:  time.Now(),
+		}
+		logDelivery(d)
+		saveDelivery(*d)
+		go deliver(e, d)
+	}
+}
+
+//deliver makes the attempts of a delivery until one succeeds, one fails for
+//good or none are left.
+func deliver(e WebhookEndpoint, d *Delivery) {
+	wait := config.Webhooks.Backoff.Duration
+	for attempt := 1; ; attempt++ {
+		status, err := postWebhook(e, d)
+		retry := err != nil || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+		if err == nil && (status < http.StatusOK || status >= http.StatusMultipleChoices) {
+			err = fmt.Errorf("endpoint answered %d", status)
+		}
+		deliveriesMu.Lock()
+		d.Attempts++
+		d.LastStatus, d.Updated = status, time.Now()
+		d.LastError = ""
+		switch {
+		case err == nil:
+			d.Status = deliveryDelivered
+		case !retry || attempt >= config.Webhooks.MaxAttempts:
+			d.Status, d.LastError = deliveryFailed, err.Error()
+		default:
+			d.LastError = err.Error()
+		}
+		done := d.Status != deliveryPending
+		saved := *d
+		deliveriesMu.Unlock()
+		saveDelivery(saved)
+		if done {
+			if d.Status == deliveryFailed {
+				logger.Warn("webhook delivery failed", "endpoint", e.Name, "event", d.Event, "delivery", d.ID, "attempts", attempt, "error", err)
+			}
+			return
+		}
+		time.Sleep(wait)
+		if wait *= 2; wait > config.Webhooks.MaxBackoff.Duration {
+			wait = config.Webhooks.MaxBackoff.Duration
+		}
+	}
+}
+
+//postWebhook makes one attempt of a delivery and returns the status answered.
+func postWebhook(e WebhookEndpoint, d *Delivery) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.Webhooks.Timeout.Duration)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-ID", d.ID)
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	if len(e.Secret) != 0 {
+		mac := hmac.New(sha256.New, []byte(e.Secret))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(d.Payload)
+		req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	return res.StatusCode, nil
+}
+
+//webhooksHandler lists the webhook endpoints, secrets left out, with the
+//count of their logged deliveries by status.
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	list := []map[string]interface{}{}
+	deliveriesMu.Lock()
+	for _, e := range config.Webhooks.Endpoints {
+		counts := map[string]int{deliveryPending: 0, deliveryDelivered: 0, deliveryFailed: 0}
+		for _, d := range deliveries[e.Name] {
+			counts[d.Status]++
+		}
+		list = append(list, map[string]interface{}{
+			"name":       e.Name,
+			"url":        e.URL,
+			"signed":     len(e.Secret) != 0,
+			"events":     e.Events,
+			"deliveries": counts,
+		})
+	}
+	deliveriesMu.Unlock()
+	writeJSON(w, http.StatusOK, list)
+}
+
+//webhookDeliveriesHandler returns the logged deliveries of an endpoint, newest
+//first, only those with the status parameter when given.
+func webhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	name := mux.Vars(r)["id"]
+	if _, ok := webhookEndpoint(name); !ok {
+		http.Error(w, "unknown webhook endpoint", http.StatusNotFound)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	list := []Delivery{}
+	deliveriesMu.Lock()
+	log := deliveries[name]
+	for i := len(log) - 1; i >= 0; i-- {
+		if len(status) == 0 || log[i].Status == status {
+			list = append(list, *log[i])
+		}
+	}
+	deliveriesMu.Unlock()
+	writeJSON(w, http.StatusOK, list)
+}
+
+//redriveWebhookHandler delivers again the failed deliveries of an endpoint,
+//or only the one named by the delivery parameter, with a fresh set of attempts.
+func redriveWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, opAdmin, nil) {
+		return
+	}
+	name := mux.Vars(r)["id"]
+	e, ok := webhookEndpoint(name)
+	if !ok {
+		http.Error(w, "unknown webhook endpoint", http.StatusNotFound)
+		return
+	}
+	id := r.URL.Query().Get("delivery")
+	var redriven []*Delivery
+	found := false
+	deliveriesMu.Lock()
+	for _, d := range deliveries[name] {
+		if len(id) != 0 && d.ID != id {
+			continue
+		}
+		found = true
+		if d.Status == deliveryFailed {
+			d.Status, d.Attempts, d.Updated = deliveryPending, 0, time.Now()
+			redriven = append(redriven, d)
+		}
+	}
+	deliveriesMu.Unlock()
+	if len(id) != 0 && !found {
+		http.Error(w, "unknown delivery", http.StatusNotFound)
+		return
+	}
+	if len(id) != 0 && len(redriven) == 0 {
+		http.Error(w, "only failed deliveries can be redriven", http.StatusConflict)
+		return
+	}
+	ids := []string{}
+	for _, d := range redriven {
+		ids = append(ids, d.ID)
+		go deliver(e, d)
+	}
+	logger.InfoContext(r.Context(), "webhook deliveries redriven", "endpoint", name, "deliveries", len(ids), "actor", actor(r))
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"redriven": ids})
+}
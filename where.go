@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//whereToken is a token of a where expression: "(", ")", ",", "op" (a
+//comparison), "word" (identifier or keyword), "string" or "number".
+type whereToken struct {
+	kind  string
+	text  string
+	value interface{}
+	pos   int
+}
+
+func whereError(pos int, msg string) error {
+	return &ValidationError{Path: "/where", Message: fmt.Sprintf("at %d: %s", pos, msg)}
+}
+
+func whereTokens(s string) ([]whereToken, error) {
+	var tokens []whereToken
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')' || r == ',':
+			tokens = append(tokens, whereToken{kind: string(r), text: string(r), pos: i})
+			i++
+		case strings.ContainsRune("=<>!", r):
+			for i++; i < len(rs) && strings.ContainsRune("=<>", rs[i]); i++ {
+			}
+			op := string(rs[start:i])
+			switch op {
+			case "=", "!=", "<>", "<", "<=", ">", ">=":
+			default:
+				return nil, whereError(start, "unknown operator "+op)
+			}
+			tokens = append(tokens, whereToken{kind: "op", text: op, pos: start})
+		case r == '\'' || r == '"':
+			//'text' is a string, "name" a quoted identifier; quotes are
+			//escaped by doubling them
+			var b strings.Builder
+			for i++; ; i++ {
+				if i >= len(rs) {
+					return nil, whereError(start, "unterminated quote")
+				}
+				if rs[i] == r {
+					if i+1 < len(rs) && rs[i+1] == r {
+						i++
+					} else {
+						break
+					}
+				}
+				b.WriteRune(rs[i])
+			}
+			i++
+			kind := "string"
+			if r == '"' {
+				kind = "word"
+			}
+			tokens = append(tokens, whereToken{kind: kind, text: b.String(), value: b.String(), pos: start})
+		case r == '-' || r == '.' || unicode.IsDigit(r):
+			for i++; i < len(rs) && (unicode.IsDigit(rs[i]) || strings.ContainsRune(".eE", rs[i]) || (strings.ContainsRune("+-", rs[i]) && strings.ContainsRune("eE", rs[i-1]))); i++ {
+			}
+			text := string(rs[start:i])
+			var value interface{}
+			if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+				value = n
+			} else if f, err := strconv.ParseFloat(text, 64); err == nil {
+				value = f
+			} else {
+				return nil, whereError(start, "invalid number "+text)
+			}
+			tokens = append(tokens, whereToken{kind: "number", text: text, value: value, pos: start})
+		case unicode.IsLetter(r) || r == '_' || r == '@':
+			for i++; i < len(rs) && (unicode.IsLetter(rs[i]) || unicode.IsDigit(rs[i]) || strings.ContainsRune("_@.", rs[i])); i++ {
+			}
+			tokens = append(tokens, whereToken{kind: "word", text: string(rs[start:i]), pos: start})
+		default:
+			return nil, whereError(i, "unexpected "+strconv.QuoteRune(r))
+		}
+	}
+	return tokens, nil
+}
+
+//whereParser compiles a where expression into a query, by recursive descent:
+//
+//	or      = and {OR and}
+//	and     = unary {AND unary}
+//	unary   = NOT unary | primary
+//	primary = "(" or ")" | field op value | field [NOT] IN "(" value {"," value} ")"
+//	        | field [NOT] BETWEEN value AND value | field [NOT] LIKE string | field IS [NOT] NULL
+//
+//Keywords are case insensitive.
+type whereParser struct {
+	tokens []whereToken
+	i      int
+	end    int
+}
+
+var whereRanges = map[string]string{">": "gt", ">=": "gte", "<": "lt", "<=": "lte"}
+
+//likeReplacer turns the % and _ wildcards of LIKE into those of a wildcard
+//query, after escaping the characters wildcard queries treat specially.
+var likeReplacer = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "%", "*", "_", "?")
+
+func (p *whereParser) peek() (whereToken, bool) {
+	if p.i >= len(p.tokens) {
+		return whereToken{pos: p.end}, false
+	}
+	return p.tokens[p.i], true
+}
+
+//keyword consumes the next token when it is the given keyword.
+func (p *whereParser) keyword(word string) bool {
+	if t, ok := p.peek(); ok && t.kind == "word" && strings.EqualFold(t.text, word) {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *whereParser) expect(kind, what string) (whereToken, error) {
+	t, ok := p.peek()
+	if !ok || t.kind != kind {
+		return t, whereError(t.pos, "expected "+what)
+	}
+	p.i++
+	return t, nil
+}
+
+func (p *whereParser) value() (interface{}, error) {
+	t, ok := p.peek()
+	if ok && (t.kind == "string" || t.kind == "number") {
+		p.i++
+		return t.value, nil
+	}
+	if p.keyword("true") {
+		return true, nil
+	}
+	if p.keyword("false") {
+		return false, nil
+	}
+	return nil, whereError(t.pos, "expected a value")
+}
+
+func (p *whereParser) or() (interface{}, error) {
+	return p.list("or", "should", p.and)
+}
+
+func (p *whereParser) and() (interface{}, error) {
+	return p.list("and", "filter", p.unary)
+}
+
+//list parses operands separated by op and joins them in the occur section of
+//a bool query; a single operand is returned as is.
+func (p *whereParser) list(op, occur string, operand func() (interface{}, error)) (interface{}, error) {
+	first, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	clauses := []interface{}{first}
+	for p.keyword(op) {
+		next, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, next)
+	}
+	if len(clauses) == 1 {
+		return first, nil
+	}
+	return map[string]interface{}{"bool": map[string]interface{}{occur: clauses}}, nil
+}
+
+func (p *whereParser) unary() (interface{}, error) {
+	if p.keyword("not") {
+		inner, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return negate(inner), nil
+	}
+	return p.primary()
+}
+
+func (p *whereParser) primary() (interface{}, error) {
+	if t, ok := p.peek(); ok && t.kind == "(" {
+		p.i++
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(")", `")"`); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	}
+	name, err := p.expect("word", "a field name")
+	if err != nil {
+		return nil, err
+	}
+	field := name.text
+	if p.keyword("is") {
+		exists := map[string]interface{}{"exists": map[string]interface{}{"field": field}}
+		not := p.keyword("not")
+		if !p.keyword("null") {
+			t, _ := p.peek()
+			return nil, whereError(t.pos, "expected NULL")
+		}
+		if not {
+			return exists, nil
+		}
+		return negate(exists), nil
+	}
+	not := p.keyword("not")
+	clause, err := p.predicate(field)
+	if err != nil {
+		return nil, err
+	}
+	if not {
+		return negate(clause), nil
+	}
+	return clause, nil
+}
+
+//predicate parses what follows the field name of a condition.
+func (p *whereParser) predicate(field string) (interface{}, error) {
+	switch {
+	case p.keyword("in"):
+		if _, err := p.expect("(", `"("`); err != nil {
+			return nil, err
+		}
+		var values []interface{}
+		for {
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+			if t, ok := p.peek(); !ok || t.kind != "," {
+				break
+			}
+			p.i++
+		}
+		if _, err := p.expect(")", `")"`); err != nil {
+			return nil, err
+		}
+		return leaf("terms", field, values), nil
+	case p.keyword("between"):
+		from, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword("and") {
+			t, _ := p.peek()
+			return nil, whereError(t.pos, "expected AND")
+		}
+		to, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		return leaf("range", field, map[string]interface{}{"gte": from, "lte": to}), nil
+	case p.keyword("like"):
+		s, err := p.expect("string", "a quoted pattern")
+		if err != nil {
+			return nil, err
+		}
+		return leaf("wildcard", field, map[string]interface{}{"value": likeReplacer.Replace(s.text)}), nil
+	}
+	op, err := p.expect("op", "a comparison")
+	if err != nil {
+		return nil, err
+	}
+	v, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	switch op.text {
+	case "=":
+		return leaf("term", field, v), nil
+	case "!=", "<>":
+		return negate(leaf("term", field, v)), nil
+	}
+	return leaf("range", field, map[string]interface{}{whereRanges[op.text]: v}), nil
+}
+
+//compileWhere turns a where expression into a query.
+func compileWhere(where string) (interface{}, error) {
+	tokens, err := whereTokens(where)
+	if err != nil {
+		return nil, err
+	}
+	p := &whereParser{tokens: tokens, end: len([]rune(where))}
+	q, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := p.peek(); ok {
+		return nil, whereError(t.pos, "unexpected "+strconv.Quote(t.text))
+	}
+	return q, nil
+}
+
+//withWhere adds the where expression of the request to its elastic query as
+//a filter, so it does not change scores.
+func withWhere(q interface{}, where string) (interface{}, error) {
+	compiled, err := compileWhere(where)
+	if err != nil {
+		return nil, err
+	}
+	body, ok := searchBody(q)
+	if !ok {
+		return nil, &ValidationError{Path: "/", Message: "elasticquery must be a JSON object when where is used"}
+	}
+	addClause(body, "filter", compiled)
+	return body, nil
+}
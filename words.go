@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch"
+	"github.com/gorilla/mux"
+)
+
+//WordsConfig stores, per index and language, the stopwords removed from the
+//text of full-text searches and the protected words that are never removed.
+//Filters names, per index and language, a stop filter of the index analysis
+//settings that saved stopword lists are pushed to.
+type WordsConfig struct {
+	Index           string                       `json:"index"`
+	DefaultLanguage string                       `json:"default_language"`
+	Refresh         Duration                     `json:"refresh"`
+	Filters         map[string]map[string]string `json:"filters"`
+}
+
+//WordList is the stopwords and protected words of one index and language.
+type WordList struct {
+	Index     string   `json:"index"`
+	Language  string   `json:"language"`
+	Stopwords []string `json:"stopwords"`
+	Protected []string `json:"protected"`
+	Actor     string   `json:"actor"`
+	Timestamp string   `json:"timestamp"`
+}
+
+type wordsEntry struct {
+	at   time.Time
+	list WordList
+}
+
+var (
+	wordsMu    sync.Mutex
+	wordsCache = map[string]wordsEntry{}
+)
+
+func wordListID(index, language string) string {
+	return index + ":" + language
+}
+
+//wordList returns the stored lists of an index and language, cached for the
+//refresh interval. Indices without lists get empty ones.
+func wordList(ctx context.Context, es *elasticsearch.Client, index, language string) (WordList, error) {
+	key := wordListID(index, language)
+	wordsMu.Lock()
+	e, ok := wordsCache[tenantScope(ctx, key)]
+	wordsMu.Unlock()
+	if ok && time.Since(e.at) < config.Words.Refresh.Duration {
+		return e.list, nil
+	}
+	list := WordList{Index: index, Language: language}
+	doc, err := getDoc(ctx, es, config.Words.Index, key)
+	if err != nil {
+		return list, err
+	}
+	if doc.Found {
+		if err := json.Unmarshal(doc.Source, &list); err != nil {
+			return list, err
+		}
+	}
+	wordsMu.Lock()
+	wordsCache[tenantScope(ctx, key)] = wordsEntry{at: time.Now(), list: list}
+	wordsMu.Unlock()
+	return list, nil
+}
+
+//removeStopwords drops the stopwords of the indices from text, keeping
+//protected words. Text made only of stopwords is returned unchanged, since
+//searching for nothing is never what the caller meant.
+func removeStopwords(ctx context.Context, index []string, language, text string) (string, error) {
+	if len(language) == 0 {
+		language = config.Words.DefaultLanguage
+	}
+	es, err := defaultClient()
+	if err != nil {
+		return text, err
+	}
+	stop, protected := map[string]bool{}, map[string]bool{}
+	for _, i := range index {
+		list, err := wordList(ctx, es, i, language)
+		if err != nil {
+			return text, err
+		}
+		for _, w := range list.Stopwords {
+			stop[strings.ToLower(w)] = true
+		}
+		for _, w := range list.Protected {
+			protected[strings.ToLower(w)] = true
+		}
+	}
+	if len(stop) == 0 {
+		return text, nil
+	}
+	var kept []string
+	for _, w := range strings.Fields(text) {
+		lw := strings.ToLower(w)
+		if !stop[lw] || protected[lw] {
+			kept = append(kept, w)
+		}
+	}
+	if len(kept) == 0 {
+		return text, nil
+	}
+	return strings.Join(kept, " "), nil
+}
+
+//pushStopwords writes the stopwords into the stop filter configured for the
+//index and language. Elastic search only changes the analysis settings of
+//closed indices, so the index is closed for the update and opened again,
+//which also reloads its analyzers: searches and writes on it fail for that
+//moment. _reload_search_analyzers would avoid it, but only reloads filters
+//reading their words from files on the nodes, which the gateway cannot write.
+func pushStopwords(ctx context.Context, es *elasticsearch.Client, list WordList) error {
+	filter := config.Words.Filters[list.Index][list.Language]
+	if len(filter) == 0 {
+		return nil
+	}
+	buf, err := encodeBody(map[string]interface{}{
+		"analysis": map[string]interface{}{
+			"filter": map[string]interface{}{
+				filter: map[string]interface{}{"type": "stop", "stopwords": list.Stopwords},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := indexAction(ctx, es, list.Index, "_close"); err != nil {
+		return err
+	}
+	res, err := es.Indices.PutSettings(buf,
+		es.Indices.PutSettings.WithContext(ctx),
+		es.Indices.PutSettings.WithIndex(list.Index),
+	)
+	if err == nil {
+		res.Body.Close()
+		if res.IsError() {
+			err = fmt.Errorf("stop filter update on %s: %s", list.Index, res.Status())
+		}
+	}
+	//the index is opened again whether the update went through or not, even
+	//when the caller went away
+	if openErr := indexAction(context.WithoutCancel(ctx), es, list.Index, "_open"); openErr != nil && err == nil {
+		err = openErr
+	}
+	return err
+}
+
+//indexAction posts an index action without a body, such as _close.
+func indexAction(ctx context.Context, es *elasticsearch.Client, index, action string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/"+index+"/"+action, nil)
+	if err != nil {
+		return err
+	}
+	res, err := es.Perform(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("%s on %s: %s", action, index, res.Status)
+	}
+	return nil
+}
+
+//wordsHandler returns the stopwords and protected words of an index and language.
+func wordsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !checkAccess(w, r, opAdmin, []string{vars["index"]}) {
+		return
+	}
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	list, err := wordList(r.Context(), es, vars["index"], vars["language"])
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to read word lists", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+//putWordsHandler replaces the stopwords and protected words of an index and
+//language, and pushes the stopwords to the analyzer filter when one is configured.
+func putWordsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !checkAccess(w, r, opAdmin, []string{vars["index"]}) {
+		return
+	}
+	var list WordList
+	if err := json.NewDecoder(r.Body).Decode(&list); err != nil {
+		logger.ErrorContext(r.Context(), "unable to decode request body", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	list.Index, list.Language = vars["index"], vars["language"]
+	list.Actor, list.Timestamp = actor(r), time.Now().UTC().Format(time.RFC3339)
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	buf, err := encodeBody(list)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "error encoding word lists", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res, err := es.Index(config.Words.Index, buf,
+		es.Index.WithContext(r.Context()),
+		es.Index.WithDocumentID(wordListID(list.Index, list.Language)),
+		es.Index.WithRefresh("wait_for"),
+	)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to save word lists", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if res.IsError() {
+		writeResponse(w, res)
+		return
+	}
+	res.Body.Close()
+	wordsMu.Lock()
+	wordsCache[tenantScope(r.Context(), wordListID(list.Index, list.Language))] = wordsEntry{at: time.Now(), list: list}
+	wordsMu.Unlock()
+	if err := pushStopwords(r.Context(), es, list); err != nil {
+		logger.ErrorContext(r.Context(), "unable to push stopwords to the analyzer", "error", err)
+		http.Error(w, "word lists saved, but "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsPingInterval = 30 * time.Second
+	wsPongWait     = 60 * time.Second
+	wsWriteWait    = 10 * time.Second
+	wsMaxMessage   = 1 << 20
+)
+
+var wsUpgrader = websocket.Upgrader{CheckOrigin: wsCheckOrigin}
+
+//wsCheckOrigin accepts clients without an Origin header, the gateway's own
+//host and the origins the CORS policy of the route allows.
+func wsCheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 || corsPolicy(routeTemplate(r)).allows(origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+//WSMessage is a message of the websocket protocol. Clients send
+//
+//	{"type": "search", "id": "q1", "index": "logs", "elasticquery": {...}, "size": 5000, "page_size": 100}
+//	{"type": "cancel", "id": "q1"}
+//
+//and receive one "page" message per page of hits, then "done", "cancelled"
+//or "error". Size 0 streams every matching document.
+type WSMessage struct {
+	Type         string      `json:"type"`
+	ID           string      `json:"id,omitempty"`
+	Index        string      `json:"index,omitempty"`
+	ElasticQuery interface{} `json:"elasticquery,omitempty"`
+	Size         int         `json:"size,omitempty"`
+	PageSize     int         `json:"page_size,omitempty"`
+	Page         int         `json:"page,omitempty"`
+	Hits         []Hit       `json:"hits,omitempty"`
+	Count        int         `json:"count,omitempty"`
+	Error        string      `json:"error,omitempty"`
+}
+
+//wsConn serializes writes to the connection, which allows one writer at a time.
+type wsConn struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+}
+
+func (c *wsConn) send(msg WSMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return c.conn.WriteJSON(msg)
+}
+
+//keepalive pings the client until ctx ends and cancels the connection when
+//a ping cannot be sent. Missing pongs are caught by the read deadline.
+func (c *wsConn) keepalive(ctx context.Context, cancel context.CancelFunc) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+//stream pages through the query of msg and sends each page to the client.
+func (c *wsConn) stream(ctx context.Context, r *http.Request, es *elasticsearch.Client, msg WSMessage) {
+	if len(msg.Index) == 0 {
+		c.send(WSMessage{Type: "error", ID: msg.ID, Error: "index is required"})
+		return
+	}
+	index := stringToArray(msg.Index)
+	if err := authorize(r, opSearch, index); err != nil {
+		logger.WarnContext(r.Context(), "access denied", "error", err)
+		c.send(WSMessage{Type: "error", ID: msg.ID, Error: err.Error()})
+		return
+	}
+	if msg.PageSize > exportPageSize {
+		msg.PageSize = exportPageSize
+	}
+	page, count := 0, 0
+	err := pageThrough(ctx, es, index, msg.ElasticQuery, msg.Size, msg.PageSize, func(hits []Hit) error {
+		page++
+		count += len(hits)
+		return c.send(WSMessage{Type: "page", ID: msg.ID, Page: page, Hits: hits})
+	})
+	switch {
+	case ctx.Err() != nil:
+		c.send(WSMessage{Type: "cancelled", ID: msg.ID, Count: count})
+	case err != nil:
+		logger.ErrorContext(r.Context(), "error streaming documents", "error", err)
+		c.send(WSMessage{Type: "error", ID: msg.ID, Error: err.Error()})
+	default:
+		c.send(WSMessage{Type: "done", ID: msg.ID, Count: count})
+	}
+}
+
+//wsHandler streams search results over a websocket. One search runs at a
+//time: a new search cancels the running one, and so does a disconnect, which
+//also releases the point in time underneath.
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	es, err := defaultClient()
+	if err != nil {
+		logger.ErrorContext(r.Context(), "unable to create es client object", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		//the upgrader already answered the client
+		logger.WarnContext(r.Context(), "websocket upgrade failed", "error", err)
+		return
+	}
+	defer conn.Close()
+	c := &wsConn{conn: conn}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go c.keepalive(ctx, cancel)
+
+	conn.SetReadLimit(wsMaxMessage)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	var running sync.WaitGroup
+	stop := func() {}
+	defer func() {
+		stop()
+		running.Wait()
+	}()
+	for ctx.Err() == nil {
+		_, b, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				logger.WarnContext(r.Context(), "websocket closed", "error", err)
+			}
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		var msg WSMessage
+		if err := json.Unmarshal(b, &msg); err != nil {
+			c.send(WSMessage{Type: "error", Error: err.Error()})
+			continue
+		}
+		switch msg.Type {
+		case "search":
+			stop()
+			running.Wait()
+			queryCtx, queryCancel := context.WithCancel(ctx)
+			stop = queryCancel
+			running.Add(1)
+			go func() {
+				defer running.Done()
+				defer queryCancel()
+				c.stream(queryCtx, r, es, msg)
+			}()
+		case "cancel":
+			stop()
+		default:
+			c.send(WSMessage{Type: "error", ID: msg.ID, Error: "unknown message type " + msg.Type})
+		}
+	}
+}